@@ -0,0 +1,140 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type Ban struct {
+	Reason string `json:"reason"`
+
+	// Unix time the ban is lifted, 0 if it never is.
+	Expires int64 `json:"expires"`
+}
+
+func (b Ban) Expired() bool {
+	return b.Expires != 0 && time.Now().Unix() >= b.Expires
+}
+
+// Peers we refuse to talk to, keyed by encoded DFI address or public address.
+// Saved to disk whenever it changes.
+type Blacklist struct {
+	path string
+
+	lock sync.RWMutex
+	bans map[string]Ban
+}
+
+// Loads the blacklist at path, if there is one.
+func LoadBlacklist(path string) (*Blacklist, error) {
+	ret := &Blacklist{path: path, bans: make(map[string]Ban)}
+
+	raw, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+
+	if err != nil {
+		return ret, err
+	}
+
+	err = json.Unmarshal(raw, &ret.bans)
+
+	return ret, err
+}
+
+// A duration of 0 bans forever.
+func (bl *Blacklist) Ban(key, reason string, d time.Duration) error {
+	ban := Ban{Reason: reason}
+
+	if d > 0 {
+		ban.Expires = time.Now().Add(d).Unix()
+	}
+
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	bl.bans[key] = ban
+
+	return bl.save()
+}
+
+func (bl *Blacklist) Unban(key string) error {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	if _, ok := bl.bans[key]; !ok {
+		return nil
+	}
+
+	delete(bl.bans, key)
+
+	return bl.save()
+}
+
+// Expired bans are not removed here, just ignored. They go the next time the
+// list is saved.
+func (bl *Blacklist) IsBanned(key string) bool {
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	ban, ok := bl.bans[key]
+
+	return ok && !ban.Expired()
+}
+
+// Must be called with the lock held.
+func (bl *Blacklist) save() error {
+	for k, v := range bl.bans {
+		if v.Expired() {
+			delete(bl.bans, k)
+		}
+	}
+
+	if bl.path == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(bl.bans)
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(bl.path+".tmp", raw, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(bl.path+".tmp", bl.path)
+}
@@ -0,0 +1,218 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/spf13/viper"
+)
+
+func TestBlacklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacklist")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blacklist.dat")
+
+	bl, err := dfi.LoadBlacklist(path)
+	if err != nil {
+		t.Fatal("Missing blacklist should not be an error: ", err)
+	}
+
+	if err = bl.Ban("flooder", "too many announces", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = bl.Ban("192.0.2.1", "bad entries", time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// already over by the time it is checked
+	if err = bl.Ban("forgiven", "brief", time.Nanosecond); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bl.IsBanned("flooder") || !bl.IsBanned("192.0.2.1") {
+		t.Fatal("Ban not applied")
+	}
+
+	if bl.IsBanned("forgiven") {
+		t.Fatal("Expired ban still in force")
+	}
+
+	if bl.IsBanned("stranger") {
+		t.Fatal("Banned someone never banned")
+	}
+
+	// survives a restart
+	loaded, err := dfi.LoadBlacklist(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !loaded.IsBanned("flooder") || !loaded.IsBanned("192.0.2.1") {
+		t.Fatal("Bans lost on reload")
+	}
+
+	if err = loaded.Unban("flooder"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	loaded, err = dfi.LoadBlacklist(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if loaded.IsBanned("flooder") {
+		t.Fatal("Unban not saved")
+	}
+
+	if !loaded.IsBanned("192.0.2.1") {
+		t.Fatal("Unbanning one peer lifted another's ban")
+	}
+}
+
+func TestBannedConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banned")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if err = lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// peers load the blacklist when they start, so what each has banned is
+	// whatever is in it at the time
+	bl, err := dfi.LoadBlacklist(filepath.Join("data", "blacklist.dat"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dial := func(remote *dfi.LocalPeer) string {
+		return fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port)
+	}
+
+	// the handshake completes before the remote gets to refuse us, so what
+	// matters is that it never takes us on
+	refused := func(remote *dfi.LocalPeer) bool {
+		lp.ConnectPeerDirect(dial(remote))
+		time.Sleep(100 * time.Millisecond)
+
+		return remote.GetPeer(*lp.Address()) == nil
+	}
+
+	if err = bl.Ban(lp.Address().StringOr(""), "test", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	byAddress := listeningPeer(t, "byaddress")
+	defer byAddress.DHT.Close()
+	defer byAddress.Database.Close()
+	defer byAddress.Server.Close()
+
+	if !refused(byAddress) {
+		t.Fatal("Handshake accepted from a banned address")
+	}
+
+	bl.Unban(lp.Address().StringOr(""))
+
+	if err = bl.Ban("127.0.0.1", "test", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	byHost := listeningPeer(t, "byhost")
+	defer byHost.DHT.Close()
+	defer byHost.Database.Close()
+	defer byHost.Server.Close()
+
+	if !refused(byHost) {
+		t.Fatal("Handshake accepted from a banned host")
+	}
+
+	bl.Unban("127.0.0.1")
+
+	// and that it is the ban doing it
+	welcoming := listeningPeer(t, "welcoming")
+	defer welcoming.DHT.Close()
+	defer welcoming.Database.Close()
+	defer welcoming.Server.Close()
+
+	if refused(welcoming) {
+		t.Fatal("Handshake refused without a ban")
+	}
+
+	// and on our side, whoever we have banned we won't connect to
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	if _, err = lp.DHT.Insert(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pm := dfi.NewPeerManager(lp)
+
+	if err = pm.Ban(*remote.Address(), "test"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, _, err = pm.ConnectPeer(*remote.Address()); err != dfi.PeerBanned {
+		t.Fatal("Expected PeerBanned connecting by address, got ", err)
+	}
+
+	// only known once it has answered
+	if _, err = pm.ConnectPeerDirect(dial(remote)); err != dfi.PeerBanned {
+		t.Fatal("Expected PeerBanned connecting directly, got ", err)
+	}
+
+	if err = pm.BanHost("127.0.0.1", "test", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = pm.ConnectPeerDirect(dial(byAddress)); err != dfi.PeerBanned {
+		t.Fatal("Expected PeerBanned connecting to a banned host, got ", err)
+	}
+}
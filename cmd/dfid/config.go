@@ -58,9 +58,23 @@ func SetupConfig() {
 		"http": "127.0.0.1:8080",
 	})
 
-	// someday support postgresql, etc. Hence the map :)
-	viper.SetDefault("database", map[string]string{
-		"path": "./data/posts.db",
+	// empty leaves the API open to anyone who can reach it
+	viper.SetDefault("http", map[string]interface{}{
+		"token":       "",
+		"corsOrigins": []string{},
+		"pprof":       false,
+	})
+
+	// other drivers need a dialect registered, see util.Dialect
+	viper.SetDefault("database", map[string]interface{}{
+		"driver":            "sqlite3",
+		"path":              "./data/posts.db",
+		"peers":             "./data/peers.db",
+		"maxSize":           0,
+		"sizeCheckInterval": "1m",
+		"pieceSize":         1000,
+		"maxTitleLength":    144,
+		"maxTagsLength":     256,
 	})
 
 	viper.SetDefault("tor", map[string]interface{}{
@@ -70,10 +84,46 @@ func SetupConfig() {
 		"cookiePath": "./tor/",
 	})
 
-	viper.SetDefault("socks", map[string]interface{}{"enabled": true, "port": 10050})
+	// the passphrase is better kept out of the config file
+	viper.SetDefault("identity", map[string]interface{}{"passphrase": ""})
+	viper.BindEnv("identity.passphrase", "DFI_PASSPHRASE")
+
+	viper.SetDefault("socks", map[string]interface{}{"enabled": true, "port": 10050, "user": "", "pass": ""})
 
 	viper.SetDefault("net", map[string]interface{}{
-		"maxPeers": 100,
+		"maxPeers":            100,
+		"maxPiecesPerRequest": 100,
+		"bucketSize":          20,
+		"bootstrapValidate":   false,
+		"maxEntrySeeds":       1000,
+		"queryCacheSize":      1024,
+		"queryCacheTTL":       "10s",
+		"rawAddresses":        false,
+		"signedSeeds":         false,
+		"publicAddresses":     []string{},
+		"fedSearchPeers":      10,
+		"fedSearchTimeout":    "10s",
+		"dialTimeout":         "10s",
+		"streamDeadline":      "10s",
+		"pingTimeout":         "10s",
+		"keepAlive":           true,
+		"keepAliveInterval":   "30s",
+		"writeTimeout":        "30s",
+		"maxStreamWindow":     256 * 1024,
+		"reconnectAttempts":   6,
+		"reconnectBackoff":    "30m",
+		"tableFlushInterval":  "5s",
+		"pruneInterval":       "1h",
+		"entryTTL":            "168h",
+		"resolveParallelism":  3,
+		"refreshInterval":     "15m",
+		"minCoverage":         0.5,
+		"uploadLimit":         0,
+		"maxSessions":         4,
+		"sessionStreams":      32,
+		"announceWork":        0,
+		"crawlInterval":       "30m",
+		"crawlRate":           "1s",
 	})
 
 	viper.WatchConfig()
@@ -27,12 +27,11 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
 
-	"strings"
-
 	dfi "github.com/dfindex/dfi"
 	data "github.com/dfindex/dfi/data"
 	dht "github.com/dfindex/dfi/dht"
@@ -50,9 +49,15 @@ var (
 func SetupLocalPeer(addr string) *dfi.LocalPeer {
 	var lp dfi.LocalPeer
 
-	if lp.ReadKey() != nil {
+	// anything but a missing key is fatal, a new one would replace the old
+	if err := lp.ReadKey(); os.IsNotExist(err) {
 		lp.GenerateKey()
-		lp.WriteKey()
+
+		if err = lp.WriteKey(); err != nil {
+			log.Fatal(err.Error())
+		}
+	} else if err != nil {
+		log.Fatal(err.Error())
 	}
 	lp.Setup()
 
@@ -74,7 +79,8 @@ func main() {
 	addr := viper.GetString("bind.dfi")
 	fmt.Println(addr)
 
-	port, _ := strconv.Atoi(strings.Split(addr, ":")[1])
+	_, portString, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portString)
 
 	lp := SetupLocalPeer(fmt.Sprintf("%s", addr))
 	lp.LoadEntry()
@@ -106,6 +112,10 @@ func main() {
 		lp.Peer.Streams().Socks = true
 		lp.Peer.Streams().SocksPort = viper.GetInt("socks.port")
 
+		lp.SetSocksAuth(viper.GetString("socks.user"), viper.GetString("socks.pass"))
+		lp.Peer.Streams().SocksUser = viper.GetString("socks.user")
+		lp.Peer.Streams().SocksPass = viper.GetString("socks.pass")
+
 		// TODO: configurable public address
 	} else {
 		if lp.Entry.PublicAddress == "" {
@@ -116,7 +126,23 @@ func main() {
 		}
 	}
 
+	// the onion still goes first, it's the only one reachable through tor
+	if addrs := viper.GetStringSlice("net.publicAddresses"); len(addrs) > 0 {
+		if viper.GetBool("tor.enabled") {
+			addrs = append([]string{lp.Entry.PublicAddress}, addrs...)
+		}
+
+		for _, i := range addrs {
+			if err := dht.CheckPublicAddress(i); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+
+		lp.Entry.PublicAddresses = addrs
+	}
+
 	lp.Entry.Port = port
+	lp.Entry.SignedSeeds = viper.GetBool("net.signedSeeds")
 	lp.Entry.SetLocalPeer(lp)
 	lp.SignEntry()
 	lp.SaveEntry()
@@ -127,7 +153,8 @@ func main() {
 		panic(err)
 	}
 
-	lp.Database = data.NewDatabase(viper.GetString("database.path"))
+	lp.Database = data.NewDatabaseDriver(viper.GetString("database.driver"),
+		viper.GetString("database.path"))
 
 	err = lp.Database.Connect()
 
@@ -135,6 +162,25 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	lp.Database.SetPieceSize(viper.GetInt("database.pieceSize"))
+	lp.Database.SetMaxSize(viper.GetInt64("database.maxSize"))
+	lp.Database.WatchSize(viper.GetDuration("database.sizeCheckInterval"))
+	data.SetPostLimits(viper.GetInt("database.maxTitleLength"),
+		viper.GetInt("database.maxTagsLength"))
+
+	// pieces made with a different database.pieceSize would fail every mirror
+	matches, err := lp.Collection.Matches(lp.Database)
+
+	if err != nil {
+		log.Error(err.Error())
+	} else if !matches {
+		log.Info("Collection does not match the database, rebuilding")
+
+		if err = lp.RebuildCollection(); err != nil {
+			log.Error(err.Error())
+		}
+	}
+
 	lp.Listen(viper.GetString("bind.dfi"))
 
 	log.Info("My name: ", lp.Entry.Name)
@@ -142,6 +188,7 @@ func main() {
 	log.Info("My address: ", s)
 
 	commandServer := dfi.NewCommandServer(lp)
+	commandServer.Version = Version
 	var httpServer dfi.HttpServer
 	httpServer.CommandServer = commandServer
 	go httpServer.ListenHttp(viper.GetString("bind.http"))
@@ -43,6 +43,11 @@ type CommandFile struct {
 	File string `json:"file"`
 }
 
+// The most common tags, 0 for DefaultTagLimit.
+type CommandTagCounts struct {
+	Limit int `json:"limit"`
+}
+
 type CommandPing CommandPeer
 type CommandAnnounce CommandPeer
 
@@ -70,6 +75,10 @@ type CommandPeerRecent struct {
 	Page int `json:"page"`
 }
 type CommandPeerPopular CommandPeerRecent
+type CommandPeerRecentCursor struct {
+	CommandPeer
+	CommandCursor
+}
 type CommandMirror CommandPeer
 type CommandMirrorProgress CommandPeer
 type CommandPeerIndex struct {
@@ -85,11 +94,15 @@ type CommandAddPost struct {
 	data.Post
 	Index bool
 }
+type CommandRemovePost struct {
+	InfoHash string `json:"infohash"`
+}
 type CommandSelfIndex struct {
 	Since int `json:"since"`
 }
 type CommandResolve CommandPeer
 type CommandBootstrap CommandPeer
+type CommandStopSeeding CommandPeer
 
 type CommandSuggest struct {
 	Query string `json:"query"`
@@ -98,11 +111,28 @@ type CommandSuggest struct {
 type CommandSelfSearch struct {
 	CommandSuggest
 	Page int `json:"page"`
+	// include snippets of where each post matched
+	Highlight bool `json:"highlight"`
 }
 type CommandSelfRecent struct {
 	Page int `json:"page"`
 }
 type CommandSelfPopular CommandSelfRecent
+
+// Posts uploaded at or after Since, a unix timestamp.
+type CommandSelfSince struct {
+	Since int64 `json:"since"`
+	Page  int   `json:"page"`
+}
+
+// Cursor paged commands, an empty cursor fetches the first page.
+type CommandCursor struct {
+	Cursor string `json:"cursor"`
+}
+type CommandSelfSearchCursor struct {
+	CommandSuggest
+	CommandCursor
+}
 type CommandAddMeta struct {
 	CommandMeta
 	Value string `json:"value"`
@@ -116,7 +146,7 @@ type CommandSaveRoutingTable interface{}
 // Used for setting values in the localpeer entry
 type CommandLocalSet struct {
 	Key   string `json:"key"`
-	Value string `json:"key"`
+	Value string `json:"value"`
 }
 
 type CommandLocalGet struct {
@@ -133,18 +163,88 @@ type CommandSetSeedLeech struct {
 	Leechers uint
 }
 
+// A search of ourselves and other peers at once, see CommandServer.FedSearch.
+type CommandFedSearch struct {
+	Query string
+	Page  int
+	// Addresses of connected peers to search, all of them if empty
+	Peers []string
+}
+
+type CommandSeedCount struct {
+	Min       int
+	Max       int
+	Page      int
+	Ascending bool
+}
+
 type CommandNetMap struct {
 	Address string
 }
 
 // Command output types
 
+// What sort of failure a command had, so the caller can tell a bad request
+// apart from something going wrong on our end.
+type ErrorCategory int
+
+const (
+	CategoryInternal ErrorCategory = iota
+	CategoryBadRequest
+	CategoryNotFound
+	CategoryUnauthorized
+	CategoryRateLimited
+	CategoryUnavailable
+)
+
+// An error tagged with a category.
+type CommandError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (ce CommandError) Error() string {
+	return ce.Err.Error()
+}
+
+func BadRequest(err error) error {
+	return CommandError{CategoryBadRequest, err}
+}
+
+func NotFound(err error) error {
+	return CommandError{CategoryNotFound, err}
+}
+
+func Unauthorized(err error) error {
+	return CommandError{CategoryUnauthorized, err}
+}
+
+func RateLimited(err error) error {
+	return CommandError{CategoryRateLimited, err}
+}
+
+// Something we rely on, usually the network, couldn't be reached. Worth trying
+// again later.
+func Unavailable(err error) error {
+	return CommandError{CategoryUnavailable, err}
+}
+
 type CommandResult struct {
 	IsOK   bool        `json:"status"`
 	Result interface{} `json:"value"`
 	Error  error       `json:"err"`
 }
 
+// The category of the error, anything that wasn't given one is assumed to be
+// internal.
+func (cr *CommandResult) Category() ErrorCategory {
+	if ce, ok := cr.Error.(CommandError); ok {
+		return ce.Category
+	}
+
+	return CategoryInternal
+}
+
 func (cr *CommandResult) WriteJSON(w io.Writer) {
 	e := json.NewEncoder(w)
 
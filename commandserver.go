@@ -25,20 +25,29 @@
 package dfi
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"runtime/pprof"
 
 	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
 	"github.com/dfindex/dfi/util"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/streamrail/concurrent-map"
 )
 
@@ -49,12 +58,43 @@ type CommandServer struct {
 
 	// Piece count for ongoing mirrors
 	MirrorProgress cmap.ConcurrentMap
+
+	// The software version, reported by Info
+	Version string
+	started time.Time
+
+	// the file an ongoing cpu profile is written to, nil if not profiling
+	profileMutex sync.Mutex
+	cpuProfile   *os.File
+
+	// counts that need a trip to the database, cached for statsCacheTime
+	statsMutex   sync.Mutex
+	statsCounted time.Time
+	statsEntries int
+	statsPosts   uint
+
+	// bootstraps currently running, a node with no peers yet is still live
+	// while this is above zero
+	bootstrapping int32
+
+	// whether a rejoin is running, and the report from the last to finish
+	rejoinMutex sync.Mutex
+	rejoining   bool
+	lastRejoin  *RejoinReport
 }
 
+const statsCacheTime = time.Second * 10
+
+// How long each liveness check gets before it counts as failed, so a hung
+// database can't hang whoever is probing us as well.
+const LivenessTimeout = time.Second * 2
+
 func NewCommandServer(lp *LocalPeer) *CommandServer {
 	ret := &CommandServer{
 		LocalPeer:      lp,
 		MirrorProgress: cmap.New(),
+		Version:        "N/A",
+		started:        time.Now(),
 	}
 
 	return ret
@@ -68,16 +108,16 @@ func (cs *CommandServer) Ping(p CommandPing) CommandResult {
 	address, err := dht.DecodeAddress(p.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer, _, err := cs.LocalPeer.ConnectPeer(address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, peerError(err)}
 	}
 
-	time, err := peer.Ping(time.Second * 10)
+	time, err := peer.Ping(peer.PingTimeout())
 
 	return CommandResult{err == nil, time.Seconds(), err}
 }
@@ -89,7 +129,7 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 	address, err := dht.DecodeAddress(a.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer := cs.LocalPeer.GetPeer(address)
@@ -98,7 +138,7 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 		peer, _, err = cs.LocalPeer.ConnectPeer(address)
 
 		if err != nil {
-			return CommandResult{false, nil, err}
+			return CommandResult{false, nil, peerError(err)}
 		}
 	}
 
@@ -108,9 +148,12 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 
 	err = peer.Announce(cs.LocalPeer)
 
-	return CommandResult{err == nil, nil, err}
+	return CommandResult{err == nil, nil, peerError(err)}
 }
-func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
+
+// Remote requests give up with ctx.Err() once ctx is done, the http server
+// passes the request context so a client hanging up cancels them.
+func (cs *CommandServer) RSearch(ctx context.Context, rs CommandRSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Remote Search request")
@@ -118,7 +161,7 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 	address, err := dht.DecodeAddress(rs.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer := cs.LocalPeer.GetPeer(address)
@@ -128,21 +171,21 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 		// verification so can be falsified easily. Mirror people, mirror!
 		peer, _, err = cs.LocalPeer.ConnectPeer(address)
 		if err != nil {
-			return CommandResult{false, nil, err}
+			return CommandResult{false, nil, peerError(err)}
 		}
 	}
 
-	posts, err := peer.Search(rs.Query, rs.Page)
+	posts, err := peer.SearchContext(ctx, rs.Query, rs.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
+func (cs *CommandServer) PeerSearch(ctx context.Context, ps CommandPeerSearch) CommandResult {
 	var err error
 
 	log.Info("Command: Peer Search request")
 
 	if !cs.LocalPeer.Databases.Has(ps.CommandPeer.Address) {
-		return cs.RSearch(CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
+		return cs.RSearch(ctx, CommandRSearch{ps.CommandPeer, ps.Query, ps.Page})
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ps.CommandPeer.Address)
@@ -152,6 +195,57 @@ func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
 	return CommandResult{err == nil, posts, err}
 }
 
+// Searches our own database, sending on posts as they are found. Not a
+// CommandResult as the results are streamed.
+func (cs *CommandServer) SelfSearchStream(ctx context.Context, css CommandSelfSearch) <-chan *data.Post {
+	log.Info("Command: Search stream request")
+
+	return cs.LocalPeer.Database.SearchStream(ctx, css.Query, css.Page, 25)
+}
+
+// Searches our own database along with connected peers, results are sent on
+// as each answers. Not a CommandResult as the results are streamed.
+func (cs *CommandServer) FedSearch(cfs CommandFedSearch) (<-chan *data.SearchResult, error) {
+	log.Info("Command: Federated search request")
+
+	searchers := []Searcher{localSearcher{cs.LocalPeer}}
+
+	if len(cfs.Peers) == 0 {
+		for _, p := range cs.LocalPeer.Peers() {
+			searchers = append(searchers, p)
+		}
+	}
+
+	for _, i := range cfs.Peers {
+		address, err := dht.DecodeAddress(i)
+
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		peer := cs.LocalPeer.GetPeer(address)
+
+		if peer == nil {
+			return nil, NotFound(errors.New("Not connected to " + i))
+		}
+
+		searchers = append(searchers, peer)
+	}
+
+	// one extra for ourselves
+	fanout := viper.GetInt("net.fedSearchPeers")
+	if fanout < 1 {
+		fanout = DefaultFedSearchPeers
+	}
+
+	timeout := viper.GetDuration("net.fedSearchTimeout")
+	if timeout <= 0 {
+		timeout = DefaultFedSearchTimeout
+	}
+
+	return FederatedSearch(searchers, cfs.Query, cfs.Page, fanout+1, timeout), nil
+}
+
 func (cs *CommandServer) EntrySearch(ps CommandSearchEntry) CommandResult {
 	var err error
 
@@ -173,7 +267,58 @@ func (cs *CommandServer) EntrySearch(ps CommandSearchEntry) CommandResult {
 	return CommandResult{err == nil, addresses, err}
 }
 
-func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
+func (cs *CommandServer) EntrySeedCount(csc CommandSeedCount) CommandResult {
+	log.Info("Command: Entry seed count request")
+
+	entries, err := cs.LocalPeer.DHT.QueryBySeedCount(csc.Min, csc.Max, csc.Page,
+		csc.Ascending)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	for n, _ := range entries {
+		// force encoding for the client
+		entries[n].Address.String()
+	}
+
+	return CommandResult{true, entries, nil}
+}
+
+func (cs *CommandServer) SeedingList() CommandResult {
+	log.Info("Command: Seeding list request")
+
+	seeding := cs.LocalPeer.SeedingList()
+	ret := make([]string, 0, len(seeding))
+
+	for _, i := range seeding {
+		ret = append(ret, i.StringOr(""))
+	}
+
+	sort.Strings(ret)
+
+	return CommandResult{true, ret, nil}
+}
+
+func (cs *CommandServer) StopSeeding(css CommandStopSeeding) CommandResult {
+	log.Info("Command: Stop seeding request")
+
+	address, err := dht.DecodeAddress(css.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, BadRequest(err)}
+	}
+
+	err = cs.LocalPeer.StopSeeding(address)
+
+	if err == NotSeeding {
+		return CommandResult{false, nil, NotFound(err)}
+	}
+
+	return CommandResult{err == nil, nil, err}
+}
+
+func (cs *CommandServer) PeerRecent(ctx context.Context, pr CommandPeerRecent) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -188,7 +333,7 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 	address, err := dht.DecodeAddress(pr.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer := cs.LocalPeer.GetPeer(address)
@@ -196,15 +341,15 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 	if peer == nil {
 		peer, _, err = cs.LocalPeer.ConnectPeer(address)
 		if err != nil {
-			return CommandResult{false, nil, err}
+			return CommandResult{false, nil, peerError(err)}
 		}
 	}
 
-	posts, err = peer.Recent(pr.Page)
+	posts, err = peer.RecentContext(ctx, pr.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
-func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
+func (cs *CommandServer) PeerPopular(ctx context.Context, pp CommandPeerPopular) CommandResult {
 	var err error
 	var posts []*data.Post
 
@@ -219,7 +364,7 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 	address, err := dht.DecodeAddress(pp.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer := cs.LocalPeer.GetPeer(address)
@@ -227,11 +372,11 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 	if peer == nil {
 		peer, _, err = cs.LocalPeer.ConnectPeer(address)
 		if err != nil {
-			return CommandResult{false, nil, err}
+			return CommandResult{false, nil, peerError(err)}
 		}
 	}
 
-	posts, err = peer.Popular(pp.Page)
+	posts, err = peer.PopularContext(ctx, pp.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -243,13 +388,13 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	address, err := dht.DecodeAddress(cm.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	mirroring, err := cs.LocalPeer.Resolve(address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, peerError(err)}
 	}
 
 	peer := cs.LocalPeer.GetPeer(address)
@@ -306,6 +451,7 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	os.Mkdir(d, 0777)
 
 	db := data.NewDatabase(fmt.Sprintf("%s/posts.db", d))
+	db.SetPieceSize(viper.GetInt("database.pieceSize"))
 	db.Connect()
 
 	cs.LocalPeer.Databases.Set(peer.Address().StringOr(""), db)
@@ -313,8 +459,15 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	progressChan := make(chan int)
 
 	go func() {
+		// the first piece we're sent is where the mirror picked up from
+		resumedAt := -1
+
 		for i := range progressChan {
-			cs.MirrorProgress.Set(cm.Address, i)
+			if resumedAt == -1 {
+				resumedAt = i
+			}
+
+			cs.MirrorProgress.Set(cm.Address, MirrorStatus{i, resumedAt})
 		}
 	}()
 
@@ -326,14 +479,21 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 	return CommandResult{true, nil, nil}
 }
 
+// The piece a mirror is on, and the one it started from. Above zero if an
+// earlier, interrupted mirror was resumed.
+type MirrorStatus struct {
+	Piece     int `json:"piece"`
+	ResumedAt int `json:"resumedAt"`
+}
+
 func (cs *CommandServer) GetMirrorProgress(cmp CommandMirrorProgress) CommandResult {
 	if !cs.MirrorProgress.Has(cmp.Address) {
-		return CommandResult{false, nil, errors.New("Mirror not in progress")}
+		return CommandResult{false, nil, NotFound(errors.New("Mirror not in progress"))}
 	}
 
 	progress, _ := cs.MirrorProgress.Get(cmp.Address)
 
-	return CommandResult{true, progress.(int), nil}
+	return CommandResult{true, progress.(MirrorStatus), nil}
 }
 
 func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
@@ -342,7 +502,7 @@ func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
 	log.Info("Command: Peer Index request")
 
 	if !cs.LocalPeer.Databases.Has(ci.CommandPeer.Address) {
-		return CommandResult{false, nil, errors.New("Peer database not loaded.")}
+		return CommandResult{false, nil, NotFound(errors.New("Peer database not loaded."))}
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ci.CommandPeer.Address)
@@ -369,16 +529,52 @@ func (cs *CommandServer) AddPost(ap CommandAddPost) CommandResult {
 
 	id, err := cs.LocalPeer.AddPost(post, false)
 
+	if _, ok := err.(data.InvalidPostError); ok {
+		return CommandResult{false, nil, BadRequest(err)}
+	}
+
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
 	if ap.Index {
-		cs.LocalPeer.Database.GenerateFts(id - 1)
+		cs.LocalPeer.Database.GenerateFts(id)
 	}
 
 	return CommandResult{true, id, nil}
 }
+func (cs *CommandServer) RemovePost(crp CommandRemovePost) CommandResult {
+	log.Info("Command: Remove Post request")
+
+	err := cs.LocalPeer.RemovePost(crp.InfoHash)
+
+	if err == sql.ErrNoRows {
+		err = NotFound(errors.New("No post with that info hash"))
+	}
+
+	return CommandResult{err == nil, nil, err}
+}
+// Streams every local post as newline delimited JSON.
+func (cs *CommandServer) Export(w io.Writer) CommandResult {
+	log.Info("Command: Export request")
+
+	err := cs.LocalPeer.Database.Export(w)
+
+	return CommandResult{err == nil, nil, err}
+}
+
+// Reads posts from an export, returning how many were new.
+func (cs *CommandServer) Import(r io.Reader) CommandResult {
+	log.Info("Command: Import request")
+
+	count, err := cs.LocalPeer.ImportPosts(r)
+
+	if _, ok := err.(data.ImportError); ok {
+		err = BadRequest(err)
+	}
+
+	return CommandResult{err == nil, count, err}
+}
 func (cs *CommandServer) SelfIndex(ci CommandSelfIndex) CommandResult {
 	log.Info("Command: FTS Index request")
 
@@ -392,13 +588,13 @@ func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
 	address, err := dht.DecodeAddress(cr.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	entry, err := cs.LocalPeer.Resolve(address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, peerError(err)}
 	}
 
 	// forces the address to generate its encoded value, so this is then
@@ -410,22 +606,29 @@ func (cs *CommandServer) Resolve(cr CommandResolve) CommandResult {
 func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
 	log.Info("Command: Bootstrap request")
 
-	addrnport := strings.Split(cb.Address, ":")
+	// copes with bracketed IPv6 literals, which are full of colons
+	host, port, err := net.SplitHostPort(cb.Address)
 
-	host := addrnport[0]
-	var port string
-	if len(addrnport) == 1 {
+	if err != nil {
+		host = cb.Address
 		port = "5050" // TODO: make this configurable
-	} else {
-		port = addrnport[1]
 	}
 
-	peer, err := cs.LocalPeer.ConnectPeerDirect(host + ":" + port)
+	atomic.AddInt32(&cs.bootstrapping, 1)
+	defer atomic.AddInt32(&cs.bootstrapping, -1)
+
+	peer, err := cs.LocalPeer.ConnectPeerDirect(net.JoinHostPort(strings.Trim(host, "[]"), port))
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Bootstrap(cs.LocalPeer.DHT)
+	// slower, but a bootstrap node can't fill the table with peers that
+	// aren't there
+	if viper.GetBool("net.bootstrapValidate") {
+		err = peer.BootstrapValidate(cs.LocalPeer.DHT, cs.LocalPeer.CheckReachable)
+	} else {
+		err = peer.Bootstrap(cs.LocalPeer.DHT)
+	}
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -437,7 +640,7 @@ func (cs *CommandServer) SelfSuggest(css CommandSuggest) CommandResult {
 func (cs *CommandServer) PeerSuggest(css CommandPeerSearch) CommandResult {
 
 	if !cs.LocalPeer.Databases.Has(css.CommandPeer.Address) {
-		return CommandResult{true, nil, errors.New("That peer is not mirrored")}
+		return CommandResult{false, nil, NotFound(errors.New("That peer is not mirrored"))}
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(css.Address)
@@ -449,11 +652,52 @@ func (cs *CommandServer) PeerSuggest(css CommandPeerSearch) CommandResult {
 func (cs *CommandServer) SelfSearch(css CommandSelfSearch) CommandResult {
 	log.Info("Command: Search request")
 
+	if css.Highlight {
+		hits, err := cs.LocalPeer.SearchProvider.SearchWithSnippets(cs.LocalPeer.Address().StringOr(""),
+			cs.LocalPeer.Database, css.Query, css.Page)
+
+		return CommandResult{err == nil, hits, err}
+	}
+
 	posts, err := cs.LocalPeer.SearchProvider.Search(cs.LocalPeer.Address().StringOr(""),
 		cs.LocalPeer.Database, css.Query, css.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
+
+// Searches our own database and every mirror, the same torrent found in more
+// than one is only returned once. See data.DedupPosts. The pages are merged in
+// search order, a mirror that can't be searched is left out.
+func (cs *CommandServer) MirrorSearch(css CommandSelfSearch) CommandResult {
+	log.Info("Command: Mirror search request")
+
+	res, err := cs.LocalPeer.SearchProvider.Search("", cs.LocalPeer.Database, css.Query, css.Page)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	posts := res.Posts
+
+	for k, i := range cs.LocalPeer.Databases.Items() {
+		res, err := cs.LocalPeer.SearchProvider.Search("", i.(*data.Database), css.Query, css.Page)
+
+		if err != nil {
+			log.WithField("mirror", k).Warn("Failed to search mirror: ", err.Error())
+			continue
+		}
+
+		posts = append(posts, res.Posts...)
+	}
+
+	posts = data.DedupPosts(posts)
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return posts[a].SearchScore() > posts[b].SearchScore()
+	})
+
+	return CommandResult{true, posts, nil}
+}
 func (cs *CommandServer) SelfRecent(cr CommandSelfRecent) CommandResult {
 	log.Info("Command: Recent request")
 
@@ -461,6 +705,13 @@ func (cs *CommandServer) SelfRecent(cr CommandSelfRecent) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
+func (cs *CommandServer) SelfSince(since CommandSelfSince) CommandResult {
+	log.Info("Command: Since request")
+
+	posts, err := cs.LocalPeer.Database.QueryByDateRange(since.Since, 0, since.Page, 25)
+
+	return CommandResult{err == nil, posts, err}
+}
 func (cs *CommandServer) SelfPopular(cp CommandSelfPopular) CommandResult {
 	log.Info("Command: Popular request")
 
@@ -468,6 +719,81 @@ func (cs *CommandServer) SelfPopular(cp CommandSelfPopular) CommandResult {
 
 	return CommandResult{err == nil, posts, err}
 }
+func (cs *CommandServer) SelfSearchCursor(css CommandSelfSearchCursor) CommandResult {
+	log.Info("Command: Search request")
+
+	page, err := cs.LocalPeer.Database.SearchCursor(css.Query, css.Cursor, 25)
+
+	return CommandResult{err == nil, page, cursorError(err)}
+}
+func (cs *CommandServer) SelfRecentCursor(cc CommandCursor) CommandResult {
+	log.Info("Command: Recent request")
+
+	page, err := cs.LocalPeer.Database.QueryRecentCursor(cc.Cursor, 25)
+
+	return CommandResult{err == nil, page, cursorError(err)}
+}
+func (cs *CommandServer) SelfPopularCursor(cc CommandCursor) CommandResult {
+	log.Info("Command: Popular request")
+
+	page, err := cs.LocalPeer.Database.QueryPopularCursor(cc.Cursor, 25)
+
+	return CommandResult{err == nil, page, cursorError(err)}
+}
+
+// Cursor paged recent posts for ourselves or a peer we have mirrored. Peers
+// are only asked for pages by number, so anyone else is NotFound.
+func (cs *CommandServer) PeerRecentCursor(prc CommandPeerRecentCursor) CommandResult {
+	log.Info("Command: Peer Recent request")
+
+	db := cs.LocalPeer.Database
+
+	if prc.Address != cs.LocalPeer.Address().StringOr("") {
+		mirror, ok := cs.LocalPeer.Databases.Get(prc.Address)
+
+		if !ok {
+			return CommandResult{false, nil, NotFound(errors.New("That peer is not mirrored"))}
+		}
+
+		db = mirror.(*data.Database)
+	}
+
+	page, err := db.QueryRecentCursor(prc.Cursor, 25)
+
+	return CommandResult{err == nil, page, cursorError(err)}
+}
+
+// A bad cursor is the client's fault, anything else is ours.
+func cursorError(err error) error {
+	if err == data.ErrInvalidCursor {
+		return BadRequest(err)
+	}
+
+	return err
+}
+
+// Failing to find or reach a peer isn't an internal error.
+func peerError(err error) error {
+	// resolving only ever fails with a ResolveError, it's the kind that says
+	// what went wrong
+	if re, ok := err.(*ResolveError); ok {
+		switch {
+		case re.NotFound():
+			return NotFound(err)
+		case re.Err == proto.ErrRateLimited:
+			return RateLimited(err)
+		}
+
+		return Unavailable(err)
+	}
+
+	if err == proto.ErrRateLimited {
+		return RateLimited(err)
+	}
+
+	return err
+}
+
 func (cs *CommandServer) AddMeta(cam CommandAddMeta) CommandResult {
 	log.Info("Command: Add Meta request")
 
@@ -484,34 +810,53 @@ func (cs *CommandServer) SaveCollection(csc CommandSaveCollection) CommandResult
 	return CommandResult{true, nil, nil}
 }
 func (cs *CommandServer) RebuildCollection(crc CommandRebuildCollection) CommandResult {
-	var err error
-
 	log.Info("Command: Rebuild Collection request")
 
-	cs.LocalPeer.Collection, err = data.CreateCollection(cs.LocalPeer.Database, 0, data.PieceSize)
+	err := cs.LocalPeer.RebuildCollection()
+
 	return CommandResult{err == nil, nil, err}
 }
+
+// An entry along with the streams the peer currently has open with us, useful
+// for spotting streams that are never closed.
+type PeerInfo struct {
+	*dht.Entry
+	Streams   int      `json:"streams"`
+	StreamIds []uint32 `json:"streamIds"`
+	// milliseconds, as of the last ping, 0 if not yet measured
+	Latency float64 `json:"latency"`
+	// unix time we last heard from the peer
+	LastSeen int64 `json:"lastSeen"`
+	// between MinReputation and MaxReputation, higher is more trusted
+	Reputation int `json:"reputation"`
+	// bytes and streams over every session since connecting
+	Connection PeerConnStats `json:"connection"`
+}
+
 func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 	log.Info("Command: Peers request")
 
-	ps := make([]*dht.Entry, cs.LocalPeer.PeerCount()+1)
-	var err error
-
-	ps[0] = cs.LocalPeer.Entry
+	ps := make([]PeerInfo, 0, cs.LocalPeer.PeerCount()+1)
+	ps = append(ps, PeerInfo{cs.LocalPeer.Entry, 0, []uint32{}, 0, 0, 0, PeerConnStats{}})
 
-	if err != nil {
-		return CommandResult{false, nil, err}
-	}
-
-	i := 1
 	for _, p := range cs.LocalPeer.Peers() {
-		ps[i], err = p.Entry()
+		entry, err := p.Entry()
 
 		if err != nil {
 			return CommandResult{false, nil, err}
 		}
 
-		i = i + 1
+		ids := p.Streams().StreamIDs()
+		info := PeerInfo{entry, len(ids), ids, 0, 0, 0, p.Stats()}
+		info.Reputation = cs.LocalPeer.Reputation(*p.Address())
+
+		info.Latency = float64(p.LastLatency()) / float64(time.Millisecond)
+
+		if seen, ok := cs.LocalPeer.LastSeen(*p.Address()); ok {
+			info.LastSeen = seen.Unix()
+		}
+
+		ps = append(ps, info)
 	}
 
 	return CommandResult{true, ps, nil}
@@ -523,19 +868,19 @@ func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResul
 	address, err := dht.DecodeAddress(crap.Peer)
 
 	if err != nil {
-		return CommandResult{true, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	peer, _, err := cs.LocalPeer.ConnectPeer(address)
 
 	if err != nil {
-		return CommandResult{true, nil, err}
+		return CommandResult{false, nil, peerError(err)}
 	}
 
 	entry, err := cs.LocalPeer.QueryEntry(address)
 
 	if err != nil {
-		return CommandResult{true, nil, err}
+		return CommandResult{false, nil, err}
 	}
 
 	err = peer.RequestAddPeer(*entry)
@@ -553,9 +898,30 @@ func (cs *CommandServer) LocalSet(cls CommandLocalSet) CommandResult {
 		cs.LocalPeer.Entry.Desc = cls.Value
 	case "public":
 		cs.LocalPeer.Entry.PublicAddress = cls.Value
+	case "addresses":
+		// comma separated, empty goes back to just the public address
+		addrs := make([]string, 0)
+
+		for _, i := range strings.Split(cls.Value, ",") {
+			if i = strings.TrimSpace(i); i == "" {
+				continue
+			}
+
+			if err := dht.CheckPublicAddress(i); err != nil {
+				return CommandResult{false, nil, BadRequest(err)}
+			}
+
+			addrs = append(addrs, i)
+		}
+
+		if len(addrs) > dht.MaxEntryPublicAddresses {
+			return CommandResult{false, nil, BadRequest(errors.New("Too many public addresses"))}
+		}
+
+		cs.LocalPeer.Entry.PublicAddresses = addrs
 
 	default:
-		return CommandResult{false, nil, errors.New("Unknown key")}
+		return CommandResult{false, nil, BadRequest(errors.New("Unknown key"))}
 	}
 
 	cs.LocalPeer.SignEntry()
@@ -575,6 +941,8 @@ func (cs *CommandServer) LocalGet(clg CommandLocalGet) CommandResult {
 		value = cs.LocalPeer.Entry.Desc
 	case "public":
 		value = cs.LocalPeer.Entry.PublicAddress
+	case "addresses":
+		value = strings.Join(cs.LocalPeer.Entry.Addresses(), ",")
 	case "dfi":
 		value, _ = cs.LocalPeer.Entry.Address.String()
 	case "postcount":
@@ -583,7 +951,7 @@ func (cs *CommandServer) LocalGet(clg CommandLocalGet) CommandResult {
 		value, _ = cs.LocalPeer.Entry.EncodeString()
 
 	default:
-		return CommandResult{false, nil, errors.New("Unknown key")}
+		return CommandResult{false, nil, BadRequest(errors.New("Unknown key"))}
 	}
 
 	return CommandResult{true, value, nil}
@@ -595,6 +963,223 @@ func (cs *CommandServer) Explore() CommandResult {
 	return CommandResult{err == nil, nil, err}
 }
 
+// Whether a rejoin is running, and how the last one went. Last is nil until one
+// has finished.
+type RejoinStatus struct {
+	Running bool          `json:"running"`
+	Last    *RejoinReport `json:"last"`
+}
+
+// Starts a rejoin in the background, unless one is already running. It dials
+// a lot of peers, far too slow to wait on.
+func (cs *CommandServer) Rejoin() CommandResult {
+	log.Info("Command: Rejoin request")
+
+	cs.rejoinMutex.Lock()
+	defer cs.rejoinMutex.Unlock()
+
+	if !cs.rejoining {
+		cs.rejoining = true
+
+		go func() {
+			report := cs.LocalPeer.Rejoin()
+
+			cs.rejoinMutex.Lock()
+			cs.rejoining = false
+			cs.lastRejoin = &report
+			cs.rejoinMutex.Unlock()
+		}()
+	}
+
+	return CommandResult{true, RejoinStatus{true, cs.lastRejoin}, nil}
+}
+
+// Identifies the node, safe to hand out to anyone who asks.
+func (cs *CommandServer) Info() CommandResult {
+	ret := make(map[string]interface{})
+
+	ret["address"] = ""
+	if cs.LocalPeer != nil {
+		ret["address"] = cs.LocalPeer.Address().StringOr("")
+	}
+
+	ret["protocolVersion"] = proto.ProtoVersion
+	ret["version"] = cs.Version
+	ret["uptime"] = int64(time.Since(cs.started).Seconds())
+
+	return CommandResult{true, ret, nil}
+}
+
+func (cs *CommandServer) Health() CommandResult {
+	size, maxSize := cs.LocalPeer.Database.Size()
+
+	ret := make(map[string]interface{})
+
+	ret["database"] = map[string]interface{}{
+		"size":    size,
+		"maxSize": maxSize,
+		"full":    cs.LocalPeer.Database.Full(),
+	}
+
+	return CommandResult{true, ret, nil}
+}
+
+// Cheap enough for a supervisor to poll. OK only if both databases answer, the
+// listener is bound and there is at least one peer, or a bootstrap underway.
+func (cs *CommandServer) Liveness() CommandResult {
+	if cs.LocalPeer == nil {
+		return CommandResult{false, nil, Unavailable(errors.New("Not set up yet"))}
+	}
+
+	var failed []string
+
+	// one that hangs is interrupted once it has had long enough
+	check := func(name string, ping func(context.Context) error) {
+		ctx, cancel := context.WithTimeout(context.Background(), LivenessTimeout)
+		defer cancel()
+
+		err := ping(ctx)
+
+		if ctx.Err() == context.DeadlineExceeded {
+			failed = append(failed, name+": timed out")
+		} else if err != nil {
+			failed = append(failed, name+": "+err.Error())
+		}
+	}
+
+	check("posts database", func(ctx context.Context) error {
+		if cs.LocalPeer.Database == nil {
+			return data.ErrNotConnected
+		}
+
+		return cs.LocalPeer.Database.PingContext(ctx)
+	})
+
+	check("peers database", func(ctx context.Context) error {
+		if cs.LocalPeer.DHT == nil {
+			return data.ErrNotConnected
+		}
+
+		return cs.LocalPeer.DHT.PingContext(ctx)
+	})
+
+	if cs.LocalPeer.Server == nil || cs.LocalPeer.Server.Addr() == nil {
+		failed = append(failed, "listener: not bound")
+	}
+
+	if cs.LocalPeer.PeerCount() == 0 && atomic.LoadInt32(&cs.bootstrapping) == 0 {
+		failed = append(failed, "peers: none connected")
+	}
+
+	if len(failed) > 0 {
+		return CommandResult{false, nil, Unavailable(errors.New(strings.Join(failed, ", ")))}
+	}
+
+	return CommandResult{true, nil, nil}
+}
+
+// Tags returned by TagCounts when no limit is given, and the most it will give.
+const (
+	DefaultTagLimit = 50
+	MaxTagLimit     = 1000
+)
+
+func (cs *CommandServer) TagCounts(ctc CommandTagCounts) CommandResult {
+	log.Info("Command: Tag counts request")
+
+	limit := ctc.Limit
+	if limit == 0 {
+		limit = DefaultTagLimit
+	}
+
+	if limit < 0 || limit > MaxTagLimit {
+		return CommandResult{false, nil, BadRequest(errors.New(fmt.Sprintf("Limit must be between 1 and %d", MaxTagLimit)))}
+	}
+
+	tags, err := cs.LocalPeer.Database.TagCounts(limit)
+
+	return CommandResult{err == nil, tags, err}
+}
+
+func (cs *CommandServer) SeederHistogram() CommandResult {
+	log.Info("Command: Seeder histogram request")
+
+	buckets, err := cs.LocalPeer.Database.SeederHistogram()
+
+	return CommandResult{err == nil, buckets, err}
+}
+
+// How big the node is and how healthy it looks: stored entries and posts,
+// connected peers, routing table coverage, the query cache and rejected posts.
+// Entries and posts are only counted every statsCacheTime.
+func (cs *CommandServer) Stats() CommandResult {
+	entries, posts, err := cs.countStats()
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	ret := make(map[string]interface{})
+
+	ret["entries"] = entries
+	ret["posts"] = posts
+	ret["peers"] = cs.LocalPeer.PeerCount()
+	ret["seeding"] = cs.LocalPeer.SeedCount()
+	ret["uptime"] = int64(time.Since(cs.started).Seconds())
+	ret["table"] = map[string]interface{}{
+		"size":     cs.LocalPeer.DHT.TableLen(),
+		"coverage": cs.LocalPeer.DHT.CoverageScore(),
+		"buckets":  cs.LocalPeer.DHT.Coverage(),
+	}
+	ret["cache"] = cs.LocalPeer.DHT.CacheStats()
+	ret["rejected"] = cs.LocalPeer.Database.RejectedPosts()
+
+	return CommandResult{true, ret, nil}
+}
+
+// Stats is meant to be scraped, so don't count every row on every request.
+func (cs *CommandServer) countStats() (int, uint, error) {
+	cs.statsMutex.Lock()
+	defer cs.statsMutex.Unlock()
+
+	if time.Since(cs.statsCounted) < statsCacheTime {
+		return cs.statsEntries, cs.statsPosts, nil
+	}
+
+	entries, err := cs.LocalPeer.DHT.Len()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cs.statsEntries = entries
+	cs.statsPosts = cs.LocalPeer.Database.PostCount()
+	cs.statsCounted = time.Now()
+
+	return cs.statsEntries, cs.statsPosts, nil
+}
+
+func (cs *CommandServer) DbBenchmark() CommandResult {
+	log.Info("Command: Database benchmark")
+
+	res, err := cs.LocalPeer.Database.Benchmark()
+
+	return CommandResult{err == nil, res, err}
+}
+
+// Reclaims space in the post and entry databases.
+func (cs *CommandServer) Vacuum() CommandResult {
+	log.Info("Command: Vacuum")
+
+	if err := cs.LocalPeer.Database.Vacuum(); err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	err := cs.LocalPeer.DHT.Vacuum()
+
+	return CommandResult{err == nil, nil, err}
+}
+
 func (cs *CommandServer) AddressEncode(ce CommandAddressEncode) CommandResult {
 	log.Info("Encode request")
 	address := &dht.Address{Raw: ce.Raw}
@@ -604,7 +1189,16 @@ func (cs *CommandServer) AddressEncode(ce CommandAddressEncode) CommandResult {
 	return CommandResult{err == nil, decoded, err}
 }
 
+// Checked before creating the file, so a second start can't truncate the
+// profile already being written.
 func (cs *CommandServer) StartCpuProfile(cf CommandFile) CommandResult {
+	cs.profileMutex.Lock()
+	defer cs.profileMutex.Unlock()
+
+	if cs.cpuProfile != nil {
+		return CommandResult{false, nil, BadRequest(errors.New("Already profiling"))}
+	}
+
 	f, err := os.Create(cf.File)
 
 	if err != nil {
@@ -613,13 +1207,31 @@ func (cs *CommandServer) StartCpuProfile(cf CommandFile) CommandResult {
 
 	err = pprof.StartCPUProfile(f)
 
-	return CommandResult{err == nil, nil, err}
+	if err != nil {
+		f.Close()
+		return CommandResult{false, nil, err}
+	}
+
+	cs.cpuProfile = f
+
+	return CommandResult{true, nil, nil}
 }
 
+// Does nothing if there is no profile running.
 func (cs *CommandServer) StopCpuProfile() CommandResult {
+	cs.profileMutex.Lock()
+	defer cs.profileMutex.Unlock()
+
+	if cs.cpuProfile == nil {
+		return CommandResult{true, nil, nil}
+	}
+
 	pprof.StopCPUProfile()
 
-	return CommandResult{true, nil, nil}
+	err := cs.cpuProfile.Close()
+	cs.cpuProfile = nil
+
+	return CommandResult{err == nil, nil, err}
 }
 
 func (cs *CommandServer) MemProfile(cf CommandFile) CommandResult {
@@ -629,6 +1241,8 @@ func (cs *CommandServer) MemProfile(cf CommandFile) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
+	defer f.Close()
+
 	err = pprof.WriteHeapProfile(f)
 
 	return CommandResult{err == nil, nil, err}
@@ -650,11 +1264,15 @@ func (cs *CommandServer) NetMap(cnm CommandNetMap) CommandResult {
 	address, err := dht.DecodeAddress(cnm.Address)
 
 	if err != nil {
-		return CommandResult{false, nil, err}
+		return CommandResult{false, nil, BadRequest(err)}
 	}
 
 	entry, err := cs.LocalPeer.QueryEntry(address)
 
+	if err != nil {
+		return CommandResult{false, nil, NotFound(err)}
+	}
+
 	currentNodes := make(map[string]bool)
 	// a map of link sources, with a key of the source and target appended
 	currentLinks := make(map[string]bool)
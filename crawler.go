@@ -0,0 +1,190 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Random addresses looked for each crawl.
+	CrawlTargets = 4
+
+	// How many hops past our own table a crawl goes towards each target.
+	CrawlDepth = 4
+
+	// The least time between crawl queries, unless configured otherwise.
+	DefaultCrawlRate = time.Second
+)
+
+// Looks for peers we don't know about every net.crawlInterval, straight away
+// to begin with so a fresh node fills its table. Queries are spaced out by
+// net.crawlRate. Blocks.
+func (pm *PeerManager) Crawl() {
+	interval := viper.GetDuration("net.crawlInterval")
+
+	if interval <= 0 {
+		log.Info("Crawling disabled")
+		return
+	}
+
+	rate := viper.GetDuration("net.crawlRate")
+	if rate <= 0 {
+		rate = DefaultCrawlRate
+	}
+
+	limiter := util.NewLimiter(rate, 1, true)
+	defer limiter.Stop()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		discovered := pm.CrawlOnce(limiter.Wait)
+
+		log.WithFields(log.Fields{
+			"discovered": discovered,
+			"table":      pm.localPeer.DHT.TableLen(),
+		}).Info("Crawl finished")
+
+		<-ticker.C
+	}
+}
+
+// Walks towards a few random addresses, asking the closest peers we know of
+// for ones closer still. Only peers that told us about someone new are
+// followed further, a branch full of entries we already have stops there. No
+// peer is asked twice, and wait is called before every query. Each new entry
+// stored is published as an EventDiscovered, returns how many there were.
+func (pm *PeerManager) CrawlOnce(wait func()) int {
+	asked := make(map[string]bool)
+	discovered := 0
+
+	for t := 0; t < CrawlTargets; t++ {
+		target, err := dht.RandomAddress()
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		frontier, err := pm.localPeer.DHT.FindClosest(*target)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		for depth := 0; depth < CrawlDepth && len(frontier) > 0; depth++ {
+			next := make(dht.Entries, 0)
+
+			for _, i := range frontier {
+				if asked[string(i.Address.Raw)] || i.Address.Equals(pm.localPeer.Address()) {
+					continue
+				}
+
+				asked[string(i.Address.Raw)] = true
+
+				found := pm.crawlPeer(i, *target, wait)
+				discovered += len(found)
+				next = append(next, found...)
+			}
+
+			frontier = next
+		}
+	}
+
+	return discovered
+}
+
+// Asks entry for the peers it knows closest to target, storing and returning
+// the ones we had never heard of. Banned peers are skipped, and a connection
+// made just for the query is dropped again afterwards.
+func (pm *PeerManager) crawlPeer(entry *dht.Entry, target dht.Address, wait func()) dht.Entries {
+	if pm.IsBanned(entry.Address) {
+		return nil
+	}
+
+	wait()
+
+	peer := pm.GetPeer(entry.Address)
+
+	if peer == nil {
+		before := pm.Peers()
+
+		var err error
+		peer, err = pm.connectEntry(entry)
+
+		if err != nil {
+			return nil
+		}
+
+		if before[string(peer.Address().Raw)] != peer {
+			defer pm.dropProbe(peer)
+		}
+
+		if !peer.Address().Equals(&entry.Address) {
+			log.WithField("peer", entry.Address.StringOr("")).Info("A different peer answered at the entry's address")
+			return nil
+		}
+	}
+
+	found, err := peer.FindClosest(target)
+
+	if err != nil {
+		log.WithField("peer", entry.Address.StringOr("")).Info("Crawl query failed: ", err.Error())
+		return nil
+	}
+
+	ret := make(dht.Entries, 0)
+
+	for _, f := range found {
+		e, ok := f.(*dht.Entry)
+
+		if !ok || e.Address.Equals(pm.localPeer.Address()) {
+			continue
+		}
+
+		if current, err := pm.localPeer.DHT.Query(e.Address); err != nil || current != nil {
+			continue
+		}
+
+		// Insert verifies it first
+		if affected, err := pm.localPeer.DHT.Insert(*e); err != nil || affected == 0 {
+			continue
+		}
+
+		pm.events.publish(e.Address, EventDiscovered)
+		ret = append(ret, e)
+	}
+
+	return ret
+}
@@ -0,0 +1,193 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pieces worth of posts imported per transaction, the same as InsertPieces
+// commits.
+const ImportBatchPieces = 100
+
+// Writes every post as a line of JSON, oldest first. Runs in a transaction so
+// the export is consistent even while posts are being added.
+func (db *Database) Export(w io.Writer) (err error) {
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	// only ever read from
+	defer tx.Rollback()
+
+	rows, err := tx.Query(sql_query_paged_post, 0, -1)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+
+	for rows.Next() {
+		var post Post
+
+		err = rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return err
+		}
+
+		if err = e.Encode(post); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Reads posts written by Export, committing every ImportBatchPieces. Ids are
+// given out afresh, and posts with an info hash already stored are skipped.
+// Returns how many were added, which on an error is what was committed before
+// it.
+func (db *Database) Import(r io.Reader) (int, error) {
+	if db.Full() {
+		return 0, ErrDatabaseFull
+	}
+
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	startPosts := db.lastId()
+	imported, read := 0, 0
+
+	// batches already committed stay if a later one fails, so they need to be
+	// searchable either way
+	defer func() {
+		if imported == 0 {
+			return
+		}
+
+		if err := db.GenerateFts(startPosts); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	d := json.NewDecoder(r)
+	done := false
+
+	for !done {
+		count, err := db.importBatch(d, &read, &done)
+
+		if err != nil {
+			return imported, err
+		}
+
+		imported += count
+
+		if !done && db.Full() {
+			return imported, ErrDatabaseFull
+		}
+	}
+
+	log.WithField("posts", imported).Info("Imported posts")
+
+	return imported, nil
+}
+
+// One transaction's worth of Import, read counts the posts decoded and done is
+// set once the reader runs out.
+func (db *Database) importBatch(d *json.Decoder, read *int, done *bool) (count int, err error) {
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			count = 0
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	for n := 0; n < ImportBatchPieces*db.PieceSize(); n++ {
+		var post Post
+
+		err = d.Decode(&post)
+
+		if err == io.EOF {
+			*done = true
+			return count, nil
+		}
+
+		*read++
+
+		if err == nil {
+			err = db.validate(&post)
+		}
+
+		if err != nil {
+			err = ImportError{*read, err}
+			return
+		}
+
+		var res sql.Result
+		res, err = insertPostTx(tx, post)
+
+		if err != nil {
+			return
+		}
+
+		// nothing affected if it was a duplicate
+		if added, _ := res.RowsAffected(); added > 0 {
+			count++
+		}
+	}
+
+	return
+}
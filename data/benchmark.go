@@ -0,0 +1,109 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"strings"
+	"time"
+)
+
+// How long a single query took, and how many rows it gave back.
+type QueryBenchmark struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Rows     int           `json:"rows"`
+}
+
+type BenchmarkResult struct {
+	Posts   uint             `json:"posts"`
+	Term    string           `json:"term"`
+	Queries []QueryBenchmark `json:"queries"`
+}
+
+// Times the queries that the API runs most often against the actual data, so
+// it is possible to tell when indexes or a vacuum are needed. Everything is run
+// in a transaction that is rolled back, nothing is ever written.
+func (db *Database) Benchmark() (BenchmarkResult, error) {
+	ret := BenchmarkResult{Posts: db.PostCount()}
+
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return ret, err
+	}
+	defer tx.Rollback()
+
+	// search for something that will actually match, the first word of the
+	// newest post's title is as good as anything
+	title := ""
+	tx.QueryRow("SELECT title FROM post ORDER BY upload_date DESC LIMIT 1").Scan(&title)
+
+	ret.Term = "a"
+	if words := strings.Fields(SanitiseForAuto(title)); len(words) > 0 {
+		ret.Term = words[0]
+	}
+
+	queries := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"recent", sql_query_recent_post, []interface{}{0, 25}},
+		{"popular", sql_query_popular_post, []interface{}{0, 25}},
+		{"search", sql_search_post, []interface{}{ret.Term, 0, 25}},
+		{"suggest", sql_suggest_posts, []interface{}{ret.Term + "%", 10}},
+		{"count", sql_count_post, nil},
+	}
+
+	for _, i := range queries {
+		start := time.Now()
+
+		rows, err := tx.Query(i.query, i.args...)
+
+		if err != nil {
+			return ret, err
+		}
+
+		count := 0
+		for rows.Next() {
+			count += 1
+		}
+
+		err = rows.Err()
+		rows.Close()
+
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Queries = append(ret.Queries, QueryBenchmark{i.name, time.Since(start), count})
+	}
+
+	return ret, nil
+}
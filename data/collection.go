@@ -25,10 +25,10 @@
 package data
 
 import (
+	"bytes"
 	"errors"
 	"hash"
 	"io/ioutil"
-	"math"
 
 	"golang.org/x/crypto/sha3"
 )
@@ -53,25 +53,66 @@ func NewCollection() *Collection {
 	return col
 }
 
-// Takes a database, starting id, and piece size. From this we create a
-// collection, except it does not contain any posts - consider making this optional.
-func CreateCollection(db *Database, start, pieceSize int) (*Collection, error) {
+// Creates a collection of every post in db, pieces are db.PieceSize() posts.
+// It does not contain any posts, just their hashes - see RebuildFrom.
+func CreateCollection(db *Database) (*Collection, error) {
 	col := NewCollection()
 
-	postCount := db.PostCount()
-	pieceCount := int(math.Ceil(float64(postCount) / float64(pieceSize)))
+	if err := col.RebuildFrom(db); err != nil {
+		return nil, err
+	}
+
+	return col, nil
+}
+
+// Replaces the hash list and root hash with ones built from every post in the
+// database, a piece of db.PieceSize() posts at a time. Pieces go by position
+// rather than id, the same way they're served, so a peer mirroring the
+// database ends up with the same hash list from the posts it's sent. The
+// collection is left alone if the database can't be read.
+func (c *Collection) RebuildFrom(db *Database) error {
+	pieceSize := db.PieceSize()
+	pieceCount := (int(db.PostCount()) + pieceSize - 1) / pieceSize
+	hashList := make([]byte, 0, pieceCount*32)
 
 	for i := 0; i < pieceCount; i++ {
 		piece, err := db.QueryPiece(uint(i), false)
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		col.Add(piece)
+		hashList = append(hashList, piece.Hash()...)
 	}
 
-	return col, nil
+	c.HashList = hashList
+	c.Rehash()
+
+	return nil
+}
+
+// Whether the hash list still matches what RebuildFrom would make from db. Only
+// the piece count and the first piece are compared, they both change with the
+// piece size unless every post fits in one piece either way.
+func (c *Collection) Matches(db *Database) (bool, error) {
+	pieceSize := db.PieceSize()
+	pieceCount := (int(db.PostCount()) + pieceSize - 1) / pieceSize
+
+	if len(c.HashList) != pieceCount*32 {
+		return false, nil
+	}
+
+	if pieceCount == 0 {
+		return true, nil
+	}
+
+	piece, err := db.QueryPiece(0, false)
+
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(c.HashList[:32], piece.Hash()), nil
 }
 
 // Loads a collection from file.
@@ -105,7 +146,8 @@ func (c *Collection) Save(path string) error {
 // Add a piece to the collection, storing it in c.Pieces and appending it's hash
 // to the hash list.
 func (c *Collection) Add(piece *Piece) {
-	if uint(len(c.HashList)) < piece.Id+1 {
+	// the hash list is 32 bytes per piece
+	if uint(len(c.HashList)) < (piece.Id+1)*32 {
 		c.HashList = append(c.HashList, piece.Hash()...)
 	} else {
 		copy(c.HashList[piece.Id*32:piece.Id*32+32], piece.Hash())
@@ -125,6 +167,18 @@ func (c *Collection) Hash() []byte {
 	return ret
 }
 
+// Checks the hash list hashes to root, normally the collection hash a peer
+// signed in its entry.
+func (c *Collection) Verify(root []byte) error {
+	c.Rehash()
+
+	if !bytes.Equal(c.Hash(), root) {
+		return ErrCollectionMismatch
+	}
+
+	return nil
+}
+
 // Regenerates the root hash from the hash list we have.
 func (c *Collection) Rehash() {
 	c.RootHash = sha3.New256()
@@ -0,0 +1,78 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+)
+
+// Offset paging drifts when posts are added between requests, so instead the
+// position of the last post seen is remembered. Key is whatever the results
+// are ordered by (upload date, score) and Id breaks ties.
+type Cursor struct {
+	Key int64
+	Id  int
+}
+
+// The page of posts along with the cursor for the page after it. Next is
+// empty when there are no more posts.
+type CursorPage struct {
+	Posts []*Post `json:"posts"`
+	Next  string  `json:"next"`
+}
+
+// The cursor for the very first page, everything comes after it.
+func StartCursor() Cursor {
+	return Cursor{math.MaxInt64, math.MaxInt32}
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Key, c.Id)))
+}
+
+// Parses a cursor token, an empty token is the start cursor.
+func ParseCursor(token string) (Cursor, error) {
+	if token == "" {
+		return StartCursor(), nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var c Cursor
+	_, err = fmt.Sscanf(string(raw), "%d.%d", &c.Key, &c.Id)
+
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
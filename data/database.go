@@ -25,21 +25,67 @@
 package data
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
-	"fmt"
-
+	"encoding/json"
+	"html"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfindex/dfi/util"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 )
 
+// How often WatchSize stats the database file if no interval is given.
+const DefaultSizeCheckInterval = time.Minute
+
 type Database struct {
-	path string
-	conn *sql.DB
+	// for sqlite the path is the file, for others it is whatever the driver
+	// takes to connect
+	driver string
+	path   string
+	conn   *sql.DB
+
+	pieceSize int
+
+	size     int64
+	maxSize  int64
+	full     bool
+	sizeLock sync.RWMutex
+	sizeStop chan bool
+
+	// posts that failed Validate and were never stored
+	rejected uint64
+
+	// held for reading by anything running a transaction, Vacuum needs it to
+	// itself. So a vacuum waits for the transactions already running to
+	// finish, and everything wanting to write waits on the vacuum
+	txLock sync.RWMutex
+
+	// prepared once on connecting, these are run far too often to parse each
+	// time
+	stmtInsertPost     *sql.Stmt
+	stmtAttachMeta     *sql.Stmt
+	stmtUpdateSeeders  *sql.Stmt
+	stmtUpdateLeechers *sql.Stmt
 }
 
+// A sqlite database stored at path.
 func NewDatabase(path string) *Database {
+	return NewDatabaseDriver(util.DefaultDriver, path)
+}
+
+// A database using any driver there is a dialect for, see RegisterDialect.
+func NewDatabaseDriver(driver, dsn string) *Database {
 	var db Database
-	db.path = path
+	db.driver = driver
+	db.path = dsn
+	db.pieceSize = PieceSize
 
 	return &db
 }
@@ -49,27 +95,51 @@ func NewDatabase(path string) *Database {
 func (db *Database) Connect() error {
 	var err error
 
-	db.conn, err = sql.Open("sqlite3", db.path)
+	if db.conn != nil {
+		return ErrAlreadyConnected
+	}
+
+	dialect, err := dialects.Get(db.driver)
 	if err != nil {
 		return err
 	}
 
-	// Enable Write-Ahead Logging
-	db.conn.Exec("PRAGMA journal_mode=WAL")
+	db.conn, err = sql.Open(db.driver, db.path)
+	if err != nil {
+		return err
+	}
 
-	//db.conn.SetMaxOpenConns(1)
+	err = dialect.Setup(db.conn)
+	if err != nil {
+		return err
+	}
 
-	_, err = db.conn.Exec(sql_create_post_table)
+	err = dialect.CreateSchema(db.conn)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.conn.Exec(sql_create_fts_post)
+	err = util.Migrate(db.conn, migrations)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.conn.Exec(sql_create_upload_date_index)
+	db.stmtInsertPost, err = db.conn.Prepare(sql_insert_post)
+	if err != nil {
+		return err
+	}
+
+	db.stmtAttachMeta, err = db.conn.Prepare(sql_attach_meta)
+	if err != nil {
+		return err
+	}
+
+	db.stmtUpdateSeeders, err = db.conn.Prepare(sql_update_seeders)
+	if err != nil {
+		return err
+	}
+
+	db.stmtUpdateLeechers, err = db.conn.Prepare(sql_update_leechers)
 	if err != nil {
 		return err
 	}
@@ -78,10 +148,23 @@ func (db *Database) Connect() error {
 }
 
 // Inserts a piece into the database. All the posts are iterated over and inserted
-// within a single SQL transaction.
+// within a single SQL transaction. Pieces are stored as they are, they come
+// from mirrors and are checked against the collection hash, so leaving a post
+// out would shift every piece after it.
 func (db *Database) InsertPiece(piece *Piece) (err error) {
+	if db.Full() {
+		return ErrDatabaseFull
+	}
+
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
 	tx, err := db.conn.Begin()
 
+	if err != nil {
+		return err
+	}
+
 	defer func() {
 		if err != nil {
 			tx.Rollback()
@@ -92,8 +175,7 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 	}()
 
 	for _, i := range piece.Posts {
-		_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-			i.Seeders, i.Leechers, i.UploadDate, i.Tags)
+		_, err = insertPostTx(tx, i)
 
 		if err != nil {
 			return
@@ -103,12 +185,49 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 	return
 }
 
+// Validates a post written here rather than mirrored, counting it if it's
+// rejected.
+func (db *Database) validate(post *Post) error {
+	err := post.Validate()
+
+	if err != nil {
+		atomic.AddUint64(&db.rejected, 1)
+		log.WithField("info_hash", post.InfoHash).Debug(err.Error())
+	}
+
+	return err
+}
+
+// How many posts added or imported have failed validation and been rejected
+// since the database was opened.
+func (db *Database) RejectedPosts() uint64 {
+	return atomic.LoadUint64(&db.rejected)
+}
+
+// Inserts within a transaction, posts with an info hash already stored are
+// ignored.
+func insertPostTx(tx *sql.Tx, post Post) (sql.Result, error) {
+	return tx.Exec(sql_insert_post, post.InfoHash, post.Title, post.Size,
+		post.FileCount, post.Seeders, post.Leechers, post.UploadDate, post.Tags,
+		post.Meta)
+}
+
+// Sent to InsertPieces in place of nil, throws away the pieces that haven't been
+// committed yet instead of committing them.
+var AbortPieces = &Piece{}
+
 // Insert pieces from a channel, good for streaming them from a network or something.
 // The fts bool is whether or not a fts index will be generated on every transaction
-// commit. Transactions contain 100 pieces, or 100,000 posts.
+// commit. Transactions contain 100 pieces, or 100,000 posts. Like InsertPiece,
+// posts aren't validated.
 func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	// everything up to here has been indexed already, or was added without
+	// wanting to be
+	indexed := db.lastId()
 	tx, err := db.conn.Begin()
-	startPosts := db.PostCount()
 
 	if err != nil {
 		log.Error(err.Error())
@@ -116,54 +235,68 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 	}
 
 	n := 0
+	full := false
+	aborted := false
 
 	defer func() {
-		err = tx.Commit()
-
-		if err != nil {
+		if aborted || err != nil {
 			tx.Rollback()
-			log.Error(err.Error())
+		} else {
+			indexed, err = db.commitPieces(tx, indexed, fts)
 		}
 
-		err = db.GenerateFts(int64(startPosts))
 		if err != nil {
 			log.Error(err.Error())
 		}
 
+		if full {
+			err = ErrDatabaseFull
+		}
+
 		close(pieces)
 	}()
 
-	//lastId := 0
 	for piece := range pieces {
 		if piece == nil {
 			return nil
 		}
 
+		if piece == AbortPieces {
+			aborted = true
+			return nil
+		}
+
+		// keep draining so the sender doesn't block, just don't store anything
+		if full || db.Full() {
+			if !full {
+				log.WithField("path", db.path).Warn("Database full, refusing pieces")
+			}
+
+			full = true
+			continue
+		}
+
 		// Insert the transaction every 100,000 posts.
 		if n == 99 {
-			err = tx.Commit()
+			indexed, err = db.commitPieces(tx, indexed, fts)
 
 			if err != nil {
-				log.Error(err.Error())
 				return err
 			}
 
-			//db.GenerateFts(lastId)
-			//lastId = piece.Posts[len(piece.Posts)-1].Id
-
-			tx, err = db.conn.Begin()
+			var next *sql.Tx
+			next, err = db.conn.Begin()
 
 			if err != nil {
-				log.Error(err.Error())
 				return
 			}
 
+			tx = next
 			n = 0
 		}
 
 		for _, i := range piece.Posts {
-			_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-				i.Seeders, i.Leechers, i.UploadDate, i.Tags, i.Meta)
+			_, err = insertPostTx(tx, i)
 
 			if err != nil {
 				log.Error(err.Error())
@@ -177,15 +310,45 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 	return
 }
 
+// Commits one of InsertPieces' transactions. With fts the posts after indexed
+// are added to the index in the same transaction, so the index only ever has
+// whole transactions in it and no post is indexed twice. Returns the newest id
+// committed, where the next transaction's indexing starts.
+func (db *Database) commitPieces(tx *sql.Tx, indexed int64, fts bool) (int64, error) {
+	last := indexed
+	err := tx.QueryRow(sql_max_post_id).Scan(&last)
+
+	if err == nil && fts && last > indexed {
+		_, err = tx.Exec(sql_generate_fts, indexed+1)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return indexed, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return indexed, err
+	}
+
+	return last, nil
+}
+
 // Insert a single post into the database.
 func (db *Database) InsertPost(post Post) (int64, error) {
-	// TODO: Is preparing all statements before hand worth doing for perf?
-	stmt, err := db.conn.Prepare(sql_insert_post)
+	if db.Full() {
+		return -1, ErrDatabaseFull
+	}
+
+	err := db.validate(&post)
+
 	if err != nil {
 		return -1, err
 	}
 
-	res, err := stmt.Exec(post.InfoHash, post.Title, post.Size, post.FileCount, post.Seeders,
+	res, err := db.stmtInsertPost.Exec(post.InfoHash, post.Title, post.Size, post.FileCount, post.Seeders,
 		post.Leechers, post.UploadDate, post.Tags, post.Meta)
 
 	if err != nil {
@@ -197,6 +360,62 @@ func (db *Database) InsertPost(post Post) (int64, error) {
 	return id, nil
 }
 
+// Removes a post and its search index entry. Returns sql.ErrNoRows if there is
+// no post with the given info hash.
+func (db *Database) DeleteByInfoHash(hash string) error {
+	return db.deleteWith(func(tx *sql.Tx) (id int64, err error) {
+		err = tx.QueryRow(sql_query_id_by_info_hash, hash).Scan(&id)
+		return
+	})
+}
+
+// Removes a post and its search index entry. Returns sql.ErrNoRows if there is
+// no post with the given id.
+func (db *Database) DeletePost(id uint) error {
+	return db.deleteWith(func(tx *sql.Tx) (ret int64, err error) {
+		err = tx.QueryRow(sql_query_post_exists, id).Scan(&ret)
+		return
+	})
+}
+
+// Finds the id of the post to delete with find, then removes it, all in one
+// transaction.
+func (db *Database) deleteWith(find func(*sql.Tx) (int64, error)) (err error) {
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	id, err := find(tx)
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(sql_delete_fts_post, id)
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(sql_delete_post, id)
+
+	return
+}
+
 // Generate a full text search index since the given id. This should ideally be
 // done only for new additions, otherwise on a large dataset it can take a bit of
 // time.
@@ -215,15 +434,89 @@ func (db *Database) GenerateFts(since int64) error {
 // Performs a query upon the database where the only arguments are the page range.
 // This is useful for thing such as popular and recent posts.
 func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
+	return db.paginatedQuery(query, page)
+}
+
+// args come before the offset and limit.
+func (db *Database) paginatedQuery(query string, page int, args ...interface{}) ([]*Post, error) {
 	page_size := 25
 	posts := make([]*Post, 0, page_size)
 
-	rows, err := db.conn.Query(query, page_size*page,
-		page_size)
+	rows, err := db.conn.Query(query, append(args, page_size*page,
+		page_size)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var post Post
+
+		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return nil, err
+		}
+
+		posts = append(posts, &post)
+	}
+
+	return posts, nil
+}
+
+// Returns a page of posts with the given tag, newest first. See TagSeparator.
+func (db *Database) QueryByTag(tag string, page, pageSize int) ([]*Post, error) {
+	posts := make([]*Post, 0, pageSize)
+
+	// LIKE wildcards in the tag itself match only themselves
+	escaped := likeEscaper.Replace(tag)
+	pattern := "%" + TagSeparator + escaped + TagSeparator + "%"
+
+	rows, err := db.conn.Query(sql_query_post_tag, pattern, page*pageSize, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var post Post
+
+		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return nil, err
+		}
+
+		posts = append(posts, &post)
+	}
+
+	return posts, nil
+}
+
+// Returns a page of posts uploaded between from and to inclusive, newest first.
+// Either being 0 leaves that end unbounded.
+func (db *Database) QueryByDateRange(from, to int64, page, pageSize int) ([]*Post, error) {
+	posts := make([]*Post, 0, pageSize)
+
+	if from == 0 {
+		from = math.MinInt64
+	}
+
+	if to == 0 {
+		to = math.MaxInt64
+	}
+
+	rows, err := db.conn.Query(sql_query_post_date_range, from, to, page*pageSize, pageSize)
 
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var post Post
@@ -254,10 +547,219 @@ func (db *Database) QueryPopular(page int) ([]*Post, error) {
 	return db.PaginatedQuery(sql_query_popular_post, page)
 }
 
+// Returns a page of posts whose meta is JSON with key set to value, newest
+// first. Posts with any other meta are skipped. The meta is decoded here rather
+// than in SQL, so sqlite doesn't need to be built with JSON support.
+func (db *Database) QueryByMeta(key, value string, page int) ([]*Post, error) {
+	if err := checkMetaKey(key); err != nil {
+		return nil, err
+	}
+
+	page_size := 25
+	posts := make([]*Post, 0, page_size)
+
+	// only posts mentioning the key need decoding. It's written by
+	// json.Marshal, so quoted and escaped the same way
+	quoted, _ := json.Marshal(key)
+	escaped := likeEscaper.Replace(string(quoted))
+
+	rows, err := db.conn.Query(sql_query_post_meta, "%"+escaped+"%")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	skip := page_size * page
+
+	for rows.Next() && len(posts) < page_size {
+		var post Post
+
+		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !metaMatches(post.Meta, key, value) {
+			continue
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		posts = append(posts, &post)
+	}
+
+	return posts, rows.Err()
+}
+
+// Whether meta is a JSON object with key set to value. Numbers and bools are
+// compared as text, true being "1" and false "0", nulls never match.
+func metaMatches(meta, key, value string) bool {
+	var fields map[string]json.RawMessage
+
+	if json.Unmarshal([]byte(meta), &fields) != nil {
+		return false
+	}
+
+	raw, ok := fields[key]
+
+	if !ok {
+		return false
+	}
+
+	var field interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if decoder.Decode(&field) != nil {
+		return false
+	}
+
+	switch f := field.(type) {
+	case string:
+		return f == value
+	case json.Number:
+		return f.String() == value
+	case bool:
+		return (f && value == "1") || (!f && value == "0")
+	case nil:
+		return false
+	}
+
+	// objects and arrays compare as their JSON
+	return string(raw) == value
+}
+
+// Runs a cursor paginated query. key is used to pull the cursor key out of
+// each post, so that the cursor for the next page can be built.
+func (db *Database) cursorQuery(query string, cursor Cursor, pageSize int, key func(*Post) int64) (*CursorPage, error) {
+	ret := &CursorPage{Posts: make([]*Post, 0, pageSize)}
+
+	rows, err := db.conn.Query(query, cursor.Key, cursor.Key, cursor.Id, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var post Post
+
+		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
+			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
+			&post.Tags, &post.Meta)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Posts = append(ret.Posts, &post)
+	}
+
+	if len(ret.Posts) == pageSize {
+		last := ret.Posts[len(ret.Posts)-1]
+		ret.Next = Cursor{key(last), last.Id}.String()
+	}
+
+	return ret, nil
+}
+
+// Recent posts after the given cursor token, an empty token starts from the
+// newest post.
+func (db *Database) QueryRecentCursor(token string, pageSize int) (*CursorPage, error) {
+	cursor, err := ParseCursor(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return db.cursorQuery(sql_query_recent_post_cursor, cursor, pageSize,
+		func(p *Post) int64 { return int64(p.UploadDate) })
+}
+
+// Posts by seeders and leechers after the given cursor token, an empty token
+// starts from the most popular. Every post is paged through, not just recent
+// ones, so new posts coming in can't move where a cursor picks up.
+func (db *Database) QueryPopularCursor(token string, pageSize int) (*CursorPage, error) {
+	cursor, err := ParseCursor(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return db.cursorQuery(sql_query_popular_post_cursor, cursor, pageSize,
+		func(p *Post) int64 { return int64(p.Seeders + p.Leechers) })
+}
+
+func (db *Database) SearchCursor(query, token string, pageSize int) (*CursorPage, error) {
+	cursor, err := ParseCursor(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &CursorPage{Posts: make([]*Post, 0, pageSize)}
+
+	query = postFtsQuery(query)
+	if query == "" {
+		return ret, nil
+	}
+
+	rows, err := db.conn.Query(sql_search_post_cursor, query, cursor.Key,
+		cursor.Key, cursor.Id, pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var score int64
+
+	for rows.Next() {
+		var result uint
+
+		err = rows.Scan(&result, &score)
+
+		if err != nil {
+			return nil, err
+		}
+
+		post, err := db.QueryPostId(result)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Posts = append(ret.Posts, &post)
+	}
+
+	if len(ret.Posts) == pageSize {
+		ret.Next = Cursor{score, ret.Posts[len(ret.Posts)-1].Id}.String()
+	}
+
+	return ret, nil
+}
+
 // Perform a query on the FTS table. The results returned are used to pull actual
 // results out of the post table, and these are returned.
 func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
 	posts := make([]*Post, 0, pageSize)
+
+	// sqlite errors on an empty match
+	query = postFtsQuery(query)
+	if query == "" {
+		return posts, nil
+	}
+
 	rows, err := db.conn.Query(sql_search_post, query, page*pageSize,
 		pageSize)
 
@@ -287,6 +789,113 @@ func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
 	return posts, nil
 }
 
+// Search, but posts are sent on as they are read rather than all at once. The
+// channel is closed once there are no more, or ctx is done. Errors are logged
+// and end the stream early.
+func (db *Database) SearchStream(ctx context.Context, query string, page, pageSize int) <-chan *Post {
+	ret := make(chan *Post)
+
+	go func() {
+		defer close(ret)
+
+		query = postFtsQuery(query)
+		if query == "" {
+			return
+		}
+
+		rows, err := db.conn.QueryContext(ctx, sql_search_post, query, page*pageSize,
+			pageSize)
+
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var result uint
+
+			if err = rows.Scan(&result); err != nil {
+				log.Error(err.Error())
+				return
+			}
+
+			post, err := db.QueryPostId(result)
+
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+
+			select {
+			case ret <- &post:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ret
+}
+
+// A search result, along with why it matched.
+type SearchHit struct {
+	Post
+	// The title, HTML escaped, with matching terms wrapped in <b> tags. Long
+	// titles are cut down to the part that matched.
+	Snippet string `json:"snippet"`
+}
+
+// For LIKE patterns escaped with a backslash.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Swaps the markers sql_search_post_snippet puts around matches for tags, once
+// the title itself has been escaped.
+var snippetTags = strings.NewReplacer("\x02", "<b>", "\x03", "</b>")
+
+// Search, but with snippets showing where each post matched. Results are in
+// the same order.
+func (db *Database) SearchWithSnippets(query string, page, pageSize int) ([]SearchHit, error) {
+	hits := make([]SearchHit, 0, pageSize)
+
+	query = postFtsQuery(query)
+	if query == "" {
+		return hits, nil
+	}
+
+	rows, err := db.conn.Query(sql_search_post_snippet, query, page*pageSize,
+		pageSize)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result uint
+		var snippet string
+
+		err = rows.Scan(&result, &snippet)
+
+		if err != nil {
+			return nil, err
+		}
+
+		post, err := db.QueryPostId(result)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// titles are anything a peer likes, and this ends up in a page
+		snippet = snippetTags.Replace(html.EscapeString(snippet))
+
+		hits = append(hits, SearchHit{post, snippet})
+	}
+
+	return hits, nil
+}
+
 // Return a single post given it's id.
 func (db *Database) QueryPostId(id uint) (Post, error) {
 	var post Post
@@ -295,6 +904,7 @@ func (db *Database) QueryPostId(id uint) (Post, error) {
 	if err != nil {
 		return post, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 
@@ -313,10 +923,11 @@ func (db *Database) QueryPostId(id uint) (Post, error) {
 // Return a single piece given it's id. Optionally store the posts as well,
 // otherwise we just get a hash.
 func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
-	page_size := PieceSize // TODO: Configure this elsewhere
+	page_size := db.pieceSize
 	var piece Piece
 	piece.Setup()
 	piece.Id = id
+	piece.Size = page_size
 
 	rows, err := db.conn.Query(sql_query_paged_post, id*uint(page_size),
 		page_size)
@@ -348,13 +959,13 @@ func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
 // starting at an id.
 func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 	ret := make(chan *Post)
-	page_size := PieceSize // TODO: Configure this elsewhere
+	page_size := db.pieceSize
 
 	go func() {
 		defer close(ret)
 
 		rows, err := db.conn.Query(sql_query_paged_post, start*page_size,
-			start+page_size*length)
+			page_size*length)
 
 		if err != nil {
 			return
@@ -390,16 +1001,100 @@ func (db *Database) PostCount() uint {
 	return res
 }
 
-// Add a metadata key/value.
-func (db *Database) AddMeta(pid int, value string) error {
+// The id of the newest post, 0 if there are none. Once posts are deleted this
+// is more than PostCount.
+func (db *Database) lastId() int64 {
+	var res int64
+
+	db.conn.QueryRow(sql_max_post_id).Scan(&res)
+
+	return res
+}
+
+// Sets a single field in a post's JSON meta, keeping the rest. Empty meta
+// starts a new object, anything else that isn't a JSON object is left alone.
+func (db *Database) AddMetaField(id int, key, value string) (err error) {
+	if err = checkMetaKey(key); err != nil {
+		return err
+	}
+
+	db.txLock.RLock()
+	defer db.txLock.RUnlock()
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
 
-	stmt, err := db.conn.Prepare(sql_attach_meta)
+	var meta string
+
+	if err = tx.QueryRow(sql_query_post_meta_value, id).Scan(&meta); err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+
+	if meta != "" && json.Unmarshal([]byte(meta), &fields) != nil {
+		return ErrMetaNotJSON
+	}
+
+	// "null" is valid JSON too
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+
+	fields[key] = value
+	merged, err := json.Marshal(fields)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(value, pid)
+	_, err = tx.Stmt(db.stmtAttachMeta).Exec(string(merged), id)
+
+	return err
+}
+
+func checkMetaKey(key string) error {
+	if strings.Contains(key, `"`) {
+		return ErrBadMetaKey
+	}
+
+	return nil
+}
+
+// Rebuilds the database file, giving the space left behind by deleted posts
+// back to the filesystem, and truncates the write ahead log. On a large
+// database it can take a while, best done when it is quiet.
+func (db *Database) Vacuum() error {
+	db.txLock.Lock()
+	defer db.txLock.Unlock()
+
+	log.WithField("path", db.path).Info("Vacuuming database")
+
+	if _, err := db.conn.Exec(sql_vacuum); err != nil {
+		return err
+	}
+
+	_, err := db.conn.Exec(sql_checkpoint_truncate)
+
+	return err
+}
+
+// Add a metadata key/value.
+func (db *Database) AddMeta(pid int, value string) error {
+
+	_, err := db.stmtAttachMeta.Exec(value, pid)
 
 	if err != nil {
 		return err
@@ -434,33 +1129,66 @@ func (db *Database) Suggest(query string) ([]string, error) {
 	return ret, nil
 }
 
-func (db *Database) SetSeeders(id, seeders uint) error {
-	stmt, err := db.conn.Prepare(sql_update_seeders)
+// Checks the connection still answers a trivial query.
+func (db *Database) Ping() error {
+	return db.PingContext(context.Background())
+}
 
-	if err != nil {
-		fmt.Println("could not prepare")
-		return err
+// Ping, but interrupted once ctx is done.
+func (db *Database) PingContext(ctx context.Context) error {
+	if db.conn == nil {
+		return ErrNotConnected
 	}
 
-	_, err = stmt.Exec(seeders, id)
+	// exec rather than query, the driver closing rows as it interrupts a
+	// query can race with reading them
+	_, err := db.conn.ExecContext(ctx, "SELECT 1")
 
 	return err
 }
 
-func (db *Database) SetLeechers(id, leechers uint) error {
-	stmt, err := db.conn.Prepare(sql_update_leechers)
-
-	if err != nil {
-		fmt.Println("could not preparel")
-		return err
+// Sets how many posts make up a piece, anything under 1 is PieceSize. Only
+// peers using the same size can mirror each other.
+func (db *Database) SetPieceSize(size int) {
+	if size < 1 {
+		size = PieceSize
 	}
 
-	_, err = stmt.Exec(leechers, id)
+	db.pieceSize = size
+}
+
+func (db *Database) PieceSize() int {
+	return db.pieceSize
+}
+
+func (db *Database) SetSeeders(id, seeders uint) error {
+	_, err := db.stmtUpdateSeeders.Exec(seeders, id)
+
+	return err
+}
+
+func (db *Database) SetLeechers(id, leechers uint) error {
+	_, err := db.stmtUpdateLeechers.Exec(leechers, id)
 
 	return err
 }
 
 // Close the database connection.
 func (db *Database) Close() {
-	db.conn.Close()
+	if db.sizeStop != nil {
+		close(db.sizeStop)
+		db.sizeStop = nil
+	}
+
+	for _, i := range []*sql.Stmt{db.stmtInsertPost, db.stmtAttachMeta,
+		db.stmtUpdateSeeders, db.stmtUpdateLeechers} {
+		if i != nil {
+			i.Close()
+		}
+	}
+
+	if db.conn != nil {
+		db.conn.Close()
+		db.conn = nil
+	}
 }
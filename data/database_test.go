@@ -0,0 +1,1083 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <http://unlicense.org/>
+package data_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/data"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMain(m *testing.M) {
+	os.Mkdir(".testing", 0777)
+	ret := m.Run()
+	os.RemoveAll(".testing")
+	os.Exit(ret)
+}
+
+func fatalErr(err error, t testing.TB) {
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// Posts need a real looking info hash to be stored.
+func infoHash(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func testDatabase(t testing.TB, name string) *data.Database {
+	db := data.NewDatabase(".testing/" + name + ".db")
+	fatalErr(db.Connect(), t)
+
+	return db
+}
+
+func insertPosts(t testing.TB, db *data.Database, prefix string, count, date int) {
+	for i := 0; i < count; i++ {
+		_, err := db.InsertPost(data.Post{
+			InfoHash: infoHash(fmt.Sprintf("%s%d", prefix, i)),
+			Title:    fmt.Sprintf("ubuntu %s %d", prefix, i),
+			// a few share a date, so the id has to break ties
+			UploadDate: date + i/3,
+			Seeders:    i % 4,
+		})
+		fatalErr(err, t)
+	}
+}
+
+// Pages through with cursors, adding new posts after every page.
+func pageAll(t *testing.T, db *data.Database, fetch func(string) (*data.CursorPage, error)) map[int]bool {
+	seen := make(map[int]bool)
+	cursor := ""
+
+	for n := 0; ; n++ {
+		page, err := fetch(cursor)
+		fatalErr(err, t)
+
+		for _, p := range page.Posts {
+			if seen[p.Id] {
+				t.Fatalf("Post %d returned twice", p.Id)
+			}
+
+			seen[p.Id] = true
+		}
+
+		if page.Next == "" {
+			break
+		}
+
+		cursor = page.Next
+		insertPosts(t, db, fmt.Sprintf("new%d-", n), 5, 1000000)
+		db.GenerateFts(0)
+	}
+
+	return seen
+}
+
+func TestRecentCursor(t *testing.T) {
+	db := testDatabase(t, "recentcursor")
+	defer db.Close()
+
+	insertPosts(t, db, "old", 60, 1000)
+
+	seen := pageAll(t, db, func(c string) (*data.CursorPage, error) {
+		return db.QueryRecentCursor(c, 25)
+	})
+
+	// every one of the original posts must have been seen
+	for i := 1; i <= 60; i++ {
+		if !seen[i] {
+			t.Fatalf("Post %d skipped", i)
+		}
+	}
+}
+
+func TestPopularCursor(t *testing.T) {
+	db := testDatabase(t, "popularcursor")
+	defer db.Close()
+
+	insertPosts(t, db, "old", 60, 1000)
+
+	last := int64(math.MaxInt64)
+
+	seen := pageAll(t, db, func(c string) (*data.CursorPage, error) {
+		page, err := db.QueryPopularCursor(c, 25)
+
+		if err == nil {
+			for _, p := range page.Posts {
+				if score := int64(p.Seeders + p.Leechers); score > last {
+					t.Fatalf("Post %d with %d peers came after %d", p.Id, score, last)
+				} else {
+					last = score
+				}
+			}
+		}
+
+		return page, err
+	})
+
+	for i := 1; i <= 60; i++ {
+		if !seen[i] {
+			t.Fatalf("Post %d skipped", i)
+		}
+	}
+}
+
+func TestSearchCursor(t *testing.T) {
+	db := testDatabase(t, "searchcursor")
+	defer db.Close()
+
+	insertPosts(t, db, "old", 60, 1000)
+	fatalErr(db.GenerateFts(0), t)
+
+	seen := pageAll(t, db, func(c string) (*data.CursorPage, error) {
+		return db.SearchCursor("ubuntu", c, 25)
+	})
+
+	for i := 1; i <= 60; i++ {
+		if !seen[i] {
+			t.Fatalf("Post %d skipped", i)
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c := data.Cursor{Key: 1234, Id: 56}
+
+	parsed, err := data.ParseCursor(c.String())
+	fatalErr(err, t)
+
+	if parsed != c {
+		t.Fatal("Cursor did not round trip")
+	}
+
+	if _, err := data.ParseCursor("not a cursor"); err == nil {
+		t.Fatal("Invalid cursor parsed")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	db := testDatabase(t, "maxsize")
+	defer db.Close()
+
+	insertPosts(t, db, "a", 10, 1000)
+
+	size, err := db.CheckSize()
+	fatalErr(err, t)
+
+	// plenty of room, inserts still work
+	db.SetMaxSize(size * 100)
+	insertPosts(t, db, "b", 10, 1000)
+
+	_, err = db.CheckSize()
+	fatalErr(err, t)
+
+	if db.Full() {
+		t.Fatal("Database full while under the maximum size")
+	}
+
+	db.SetMaxSize(1)
+	_, err = db.CheckSize()
+	fatalErr(err, t)
+
+	if _, err := db.InsertPost(data.Post{InfoHash: infoHash("c"), Title: "c"}); err != data.ErrDatabaseFull {
+		t.Fatal("Insert allowed past the maximum size")
+	}
+
+	if err := db.InsertPiece(&data.Piece{}); err != data.ErrDatabaseFull {
+		t.Fatal("Piece insert allowed past the maximum size")
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	db := testDatabase(t, "benchmark")
+	defer db.Close()
+
+	insertPosts(t, db, "a", 100, 1000)
+	fatalErr(db.GenerateFts(0), t)
+
+	res, err := db.Benchmark()
+	fatalErr(err, t)
+
+	if len(res.Queries) != 5 {
+		t.Fatalf("Expected 5 queries, got %d", len(res.Queries))
+	}
+
+	for _, i := range res.Queries {
+		if i.Duration <= 0 {
+			t.Fatalf("Query %s has no timing", i.Name)
+		}
+
+		if i.Rows == 0 {
+			t.Fatalf("Query %s returned no rows", i.Name)
+		}
+	}
+
+	if db.PostCount() != 100 {
+		t.Fatal("Benchmark changed the database")
+	}
+}
+
+func TestInsertPieceMeta(t *testing.T) {
+	db := testDatabase(t, "piecemeta")
+	defer db.Close()
+
+	piece := data.Piece{}
+	piece.Setup()
+
+	for i := 0; i < 3; i++ {
+		fatalErr(piece.Add(data.Post{
+			InfoHash: infoHash(fmt.Sprintf("meta%d", i)),
+			Title:    fmt.Sprintf("meta %d", i),
+			Meta:     fmt.Sprintf(`{"n":%d}`, i),
+		}, true), t)
+	}
+
+	fatalErr(db.InsertPiece(&piece), t)
+
+	for i := 0; i < 3; i++ {
+		post, err := db.QueryPostId(uint(i + 1))
+		fatalErr(err, t)
+
+		if want := fmt.Sprintf(`{"n":%d}`, i); post.Meta != want {
+			t.Fatalf("Post %d has meta %q, expected %q", i+1, post.Meta, want)
+		}
+	}
+}
+
+func TestConnectTwice(t *testing.T) {
+	db := testDatabase(t, "connecttwice")
+
+	if err := db.Connect(); err != data.ErrAlreadyConnected {
+		t.Fatal("Connected twice")
+	}
+
+	insertPosts(t, db, "a", 3, 1000)
+	db.Close()
+
+	// statements are prepared again on reconnecting
+	fatalErr(db.Connect(), t)
+	defer db.Close()
+
+	insertPosts(t, db, "b", 3, 1000)
+	fatalErr(db.SetSeeders(1, 10), t)
+
+	if db.PostCount() != 6 {
+		t.Fatalf("Expected 6 posts, got %d", db.PostCount())
+	}
+}
+
+func TestDeletePost(t *testing.T) {
+	db := testDatabase(t, "deletepost")
+	defer db.Close()
+
+	insertPosts(t, db, "ubuntu", 3, 1000)
+	fatalErr(db.GenerateFts(0), t)
+
+	fatalErr(db.DeletePost(2), t)
+
+	if err := db.DeletePost(2); err != sql.ErrNoRows {
+		t.Fatal("Deleted the same post twice")
+	}
+
+	fatalErr(db.DeleteByInfoHash(infoHash("ubuntu0")), t)
+
+	results, err := db.Search("ubuntu", 0, 25)
+	fatalErr(err, t)
+
+	if len(results) != 1 || results[0].InfoHash != infoHash("ubuntu2") {
+		t.Fatal("Deleted posts still searchable: ", results)
+	}
+
+	if db.PostCount() != 1 {
+		t.Fatalf("Expected a post count of 1, got %d", db.PostCount())
+	}
+}
+
+// Deleting posts leaves gaps in the ids, pieces should still be full and never
+// overlap.
+func TestPiecesAfterDelete(t *testing.T) {
+	db := testDatabase(t, "piecegaps")
+	defer db.Close()
+
+	for _, count := range []int{data.PieceSize, data.PieceSize, data.PieceSize / 2} {
+		piece := data.Piece{}
+		piece.Setup()
+
+		for i := 0; i < count; i++ {
+			fatalErr(piece.Add(data.Post{
+				InfoHash: infoHash(fmt.Sprintf("%d-%d", db.PostCount(), i)),
+				Title:    "gap",
+			}, true), t)
+		}
+
+		fatalErr(db.InsertPiece(&piece), t)
+	}
+
+	for i := 10; i < 10+data.PieceSize/2; i++ {
+		fatalErr(db.DeletePost(uint(i)), t)
+	}
+
+	if db.PostCount() != data.PieceSize*2 {
+		t.Fatalf("Expected %d posts, got %d", data.PieceSize*2, db.PostCount())
+	}
+
+	col, err := data.CreateCollection(db)
+	fatalErr(err, t)
+
+	if len(col.HashList) != 2*32 {
+		t.Fatalf("Expected 2 pieces, got %d", len(col.HashList)/32)
+	}
+
+	seen := make(map[int]bool)
+
+	for i := 0; i < 2; i++ {
+		piece, err := db.QueryPiece(uint(i), true)
+		fatalErr(err, t)
+
+		if len(piece.Posts) != data.PieceSize {
+			t.Fatalf("Piece %d has %d posts", i, len(piece.Posts))
+		}
+
+		for _, p := range piece.Posts {
+			if seen[p.Id] {
+				t.Fatalf("Post %d is in more than one piece", p.Id)
+			}
+
+			seen[p.Id] = true
+		}
+	}
+}
+
+func TestQueryByTag(t *testing.T) {
+	db := testDatabase(t, "tags")
+	defer db.Close()
+
+	for n, tags := range []string{"linux-iso", "linux-iso,ubuntu", "ubuntu", "50%_off", ""} {
+		_, err := db.InsertPost(data.Post{
+			InfoHash:   infoHash(fmt.Sprintf("tag%d", n)),
+			Title:      fmt.Sprintf("tagged %d", n),
+			UploadDate: 1000 + n,
+			Tags:       tags,
+		})
+		fatalErr(err, t)
+	}
+	fatalErr(db.GenerateFts(0), t)
+
+	for tag, expected := range map[string][]string{
+		"linux-iso": {"tag1", "tag0"},
+		"ubuntu":    {"tag2", "tag1"},
+		"50%_off":   {"tag3"},
+		// only whole tags match, wildcards included
+		"linux": nil,
+		"%":     nil,
+	} {
+		posts, err := db.QueryByTag(tag, 0, 25)
+		fatalErr(err, t)
+
+		if len(posts) != len(expected) {
+			t.Fatalf("Expected %d posts tagged %q, got %d", len(expected), tag, len(posts))
+		}
+
+		for n, i := range posts {
+			if i.InfoHash != infoHash(expected[n]) {
+				t.Fatalf("Expected %s tagged %q, got %s", expected[n], tag, i.InfoHash)
+			}
+		}
+	}
+
+	// tags are searchable too
+	results, err := db.Search("ubuntu", 0, 25)
+	fatalErr(err, t)
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results searching a tag, got %d", len(results))
+	}
+}
+
+func TestFtsTagsMigration(t *testing.T) {
+	path := ".testing/ftsmigration.db"
+
+	// a database from before tags were indexed
+	conn, err := sql.Open("sqlite3", path)
+	fatalErr(err, t)
+
+	for _, i := range []string{
+		`CREATE TABLE post(id INTEGER PRIMARY KEY NOT NULL, info_hash STRING UNIQUE,
+			title STRING NOT NULL, size INTEGER NOT NULL, file_count INTEGER NOT NULL,
+			seeders INTEGER NOT NULL, leechers INTEGER NOT NULL,
+			upload_date INTEGER NOT NULL, tags STRING, meta STRING)`,
+		`CREATE VIRTUAL TABLE fts_post using fts4(content="post", title, seeders, leechers)`,
+		`INSERT INTO post VALUES(1, "old", "old post", 0, 0, 0, 0, 0, "vintage", "")`,
+		`INSERT INTO fts_post(docid, title, seeders, leechers) VALUES(1, "old post", 0, 0)`,
+	} {
+		_, err = conn.Exec(i)
+		fatalErr(err, t)
+	}
+	conn.Close()
+
+	db := data.NewDatabase(path)
+	fatalErr(db.Connect(), t)
+	defer db.Close()
+
+	for _, query := range []string{"old", "vintage"} {
+		results, err := db.Search(query, 0, 25)
+		fatalErr(err, t)
+
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result for %q after migrating, got %d", query, len(results))
+		}
+	}
+}
+
+func TestQueryByDateRange(t *testing.T) {
+	db := testDatabase(t, "daterange")
+	defer db.Close()
+
+	// dates 1000 to 1009, three posts per date
+	insertPosts(t, db, "date", 30, 1000)
+
+	for _, i := range []struct {
+		from, to int64
+		count    int
+	}{
+		{1002, 1004, 9},
+		{1005, 0, 15},
+		{0, 1000, 3},
+		{0, 0, 30},
+		{2000, 0, 0},
+	} {
+		posts, err := db.QueryByDateRange(i.from, i.to, 0, 50)
+		fatalErr(err, t)
+
+		if len(posts) != i.count {
+			t.Fatalf("Expected %d posts from %d to %d, got %d", i.count, i.from, i.to, len(posts))
+		}
+
+		for n, p := range posts {
+			if (i.from != 0 && int64(p.UploadDate) < i.from) || (i.to != 0 && int64(p.UploadDate) > i.to) {
+				t.Fatalf("Post dated %d is out of range", p.UploadDate)
+			}
+
+			if n > 0 && p.UploadDate > posts[n-1].UploadDate {
+				t.Fatal("Posts not newest first")
+			}
+		}
+	}
+
+	first, err := db.QueryByDateRange(0, 0, 0, 10)
+	fatalErr(err, t)
+	second, err := db.QueryByDateRange(0, 0, 1, 10)
+	fatalErr(err, t)
+
+	if len(second) != 10 || second[0].Id == first[0].Id {
+		t.Fatal("Second page is not the next ten posts")
+	}
+}
+
+func TestSearchWithSnippets(t *testing.T) {
+	db := testDatabase(t, "snippets")
+	defer db.Close()
+
+	for n, title := range []string{"debian netinst", "ubuntu desktop", "ubuntu <i>server</i>"} {
+		_, err := db.InsertPost(data.Post{
+			InfoHash: infoHash(fmt.Sprintf("snippet%d", n)),
+			Title:    title,
+			Seeders:  n,
+		})
+		fatalErr(err, t)
+	}
+	fatalErr(db.GenerateFts(0), t)
+
+	hits, err := db.SearchWithSnippets("ubuntu", 0, 25)
+	fatalErr(err, t)
+
+	plain, err := db.Search("ubuntu", 0, 25)
+	fatalErr(err, t)
+
+	if len(hits) != 2 || len(plain) != 2 {
+		t.Fatalf("Expected 2 hits, got %d", len(hits))
+	}
+
+	for n, i := range hits {
+		if i.InfoHash != plain[n].InfoHash {
+			t.Fatal("Snippets changed the order of results")
+		}
+
+		escaped := html.EscapeString(i.Title)
+
+		if i.Snippet != strings.Replace(escaped, "ubuntu", "<b>ubuntu</b>", 1) {
+			t.Fatal("Match not highlighted: ", i.Snippet)
+		}
+	}
+}
+
+func TestInsertPiecesAbort(t *testing.T) {
+	db := testDatabase(t, "insertpiecesabort")
+	defer db.Close()
+
+	pieces := make(chan *data.Piece, 2)
+
+	piece := &data.Piece{}
+	piece.Setup()
+	piece.Add(data.Post{InfoHash: infoHash("ubuntu"), Title: "ubuntu"}, true)
+
+	pieces <- piece
+	pieces <- data.AbortPieces
+
+	fatalErr(db.InsertPieces(pieces, true), t)
+
+	if count := db.PostCount(); count != 0 {
+		t.Fatalf("Aborted pieces were committed, %d posts", count)
+	}
+}
+
+// Each transaction is indexed as it's committed, not all at the end.
+func TestInsertPiecesFts(t *testing.T) {
+	db := testDatabase(t, "insertpiecesfts")
+	defer db.Close()
+
+	pieces := make(chan *data.Piece)
+	done := make(chan error)
+
+	go func() {
+		done <- db.InsertPieces(pieces, true)
+	}()
+
+	send := func(n int) {
+		piece := &data.Piece{}
+		piece.Setup()
+		piece.Add(data.Post{InfoHash: infoHash(fmt.Sprintf("fts%d", n)), Title: "mirrored"}, true)
+		pieces <- piece
+	}
+
+	// the 100th piece commits the first 99, once the 101st is taken that's done
+	for n := 0; n < 101; n++ {
+		send(n)
+	}
+
+	posts, err := db.Search("mirrored", 0, 200)
+	fatalErr(err, t)
+
+	if len(posts) != 99 {
+		t.Fatalf("Expected the first transaction's 99 posts indexed, got %d", len(posts))
+	}
+
+	for n := 101; n < 250; n++ {
+		send(n)
+	}
+
+	pieces <- nil
+	fatalErr(<-done, t)
+
+	posts, err = db.Search("mirrored", 0, 500)
+	fatalErr(err, t)
+
+	if len(posts) != 250 {
+		t.Fatalf("Expected 250 posts indexed, got %d", len(posts))
+	}
+
+	seen := make(map[int]bool)
+	for _, i := range posts {
+		if seen[i.Id] {
+			t.Fatalf("Post %d indexed twice", i.Id)
+		}
+
+		seen[i.Id] = true
+	}
+}
+
+func TestAddMetaField(t *testing.T) {
+	db := testDatabase(t, "metafield")
+	defer db.Close()
+
+	for n, meta := range []string{"", `{"codec":"x264"}`, "not json"} {
+		_, err := db.InsertPost(data.Post{InfoHash: infoHash(fmt.Sprintf("meta%d", n)), Title: "meta", Meta: meta})
+		fatalErr(err, t)
+	}
+
+	fatalErr(db.AddMetaField(1, "resolution", "1080p"), t)
+	fatalErr(db.AddMetaField(2, "resolution", "720p"), t)
+
+	if err := db.AddMetaField(3, "resolution", "1080p"); err != data.ErrMetaNotJSON {
+		t.Fatal("Expected ErrMetaNotJSON, got", err)
+	}
+
+	for id, expected := range map[uint]string{
+		1: `{"resolution":"1080p"}`,
+		2: `{"codec":"x264","resolution":"720p"}`,
+		3: "not json",
+	} {
+		post, err := db.QueryPostId(id)
+		fatalErr(err, t)
+
+		if post.Meta != expected {
+			t.Fatalf("Post %d has meta %q, expected %q", id, post.Meta, expected)
+		}
+	}
+
+	posts, err := db.QueryByMeta("resolution", "1080p", 0)
+	fatalErr(err, t)
+
+	if len(posts) != 1 || posts[0].InfoHash != infoHash("meta0") {
+		t.Fatalf("Expected only meta0 with 1080p, got %d posts", len(posts))
+	}
+
+	// mentioning the key or value anywhere else isn't enough
+	for n, meta := range []string{`{"other":"resolution 1080p"}`, `{"resolution":{"x":"1080p"}}`,
+		`["resolution","1080p"]`, `{"resolution":1080,"codec":"x264"}`, `{"resolution":null}`} {
+		_, err := db.InsertPost(data.Post{InfoHash: infoHash(fmt.Sprintf("other%d", n)), Title: "meta", Meta: meta})
+		fatalErr(err, t)
+	}
+
+	posts, err = db.QueryByMeta("resolution", "1080p", 0)
+	fatalErr(err, t)
+
+	if len(posts) != 1 {
+		t.Fatalf("Expected only meta0 with 1080p, got %d posts", len(posts))
+	}
+
+	// numbers compare as their text
+	posts, err = db.QueryByMeta("resolution", "1080", 0)
+	fatalErr(err, t)
+
+	if len(posts) != 1 || posts[0].InfoHash != infoHash("other3") {
+		t.Fatalf("Expected other3 with 1080, got %d posts", len(posts))
+	}
+
+	if _, err = db.QueryByMeta(`res"olution`, "1080p", 0); err != data.ErrBadMetaKey {
+		t.Fatal("Expected ErrBadMetaKey, got", err)
+	}
+}
+
+func TestQueryByMetaPages(t *testing.T) {
+	db := testDatabase(t, "metapages")
+	defer db.Close()
+
+	// every other post matches, so pages have to skip the rest
+	for i := 0; i < 60; i++ {
+		meta := `{"n":"odd"}`
+		if i%2 == 0 {
+			meta = `{"n":"even"}`
+		}
+
+		_, err := db.InsertPost(data.Post{InfoHash: infoHash(fmt.Sprintf("page%d", i)), Title: "meta",
+			UploadDate: i, Meta: meta})
+		fatalErr(err, t)
+	}
+
+	seen := make(map[string]bool)
+
+	for page, expected := range []int{25, 5, 0} {
+		posts, err := db.QueryByMeta("n", "even", page)
+		fatalErr(err, t)
+
+		if len(posts) != expected {
+			t.Fatalf("Page %d has %d posts, expected %d", page, len(posts), expected)
+		}
+
+		for _, i := range posts {
+			if i.Meta != `{"n":"even"}` || seen[i.InfoHash] {
+				t.Fatalf("Post %s on page %d shouldn't be there", i.InfoHash, page)
+			}
+
+			seen[i.InfoHash] = true
+		}
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	db := testDatabase(t, "vacuum")
+	defer db.Close()
+
+	insertPosts(t, db, "vacuum", 50, 1000)
+
+	for i := 1; i <= 40; i++ {
+		fatalErr(db.DeletePost(uint(i)), t)
+	}
+
+	// a transaction still open has to finish before the vacuum runs
+	pieces := make(chan *data.Piece)
+	done := make(chan error)
+
+	go func() {
+		done <- db.InsertPieces(pieces, false)
+	}()
+
+	var piece data.Piece
+	piece.Setup()
+	piece.Add(data.Post{InfoHash: infoHash("vacuumpiece"), Title: "piece"}, true)
+
+	// once this is taken the transaction is open
+	pieces <- &piece
+
+	vacuumed := make(chan error)
+
+	go func() {
+		vacuumed <- db.Vacuum()
+	}()
+
+	select {
+	case <-vacuumed:
+		t.Fatal("Vacuum ran during a transaction")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	pieces <- nil
+	fatalErr(<-done, t)
+	fatalErr(<-vacuumed, t)
+
+	if count := db.PostCount(); count != 11 {
+		t.Fatalf("Expected 11 posts after vacuuming, got %d", count)
+	}
+}
+
+func TestPieceSize(t *testing.T) {
+	db := testDatabase(t, "piecesize")
+	defer db.Close()
+
+	insertPosts(t, db, "piece", 25, 0)
+
+	db.SetPieceSize(10)
+
+	col, err := data.CreateCollection(db)
+	fatalErr(err, t)
+
+	if len(col.HashList) != 3*32 {
+		t.Fatalf("Expected 3 pieces, got %d", len(col.HashList)/32)
+	}
+
+	piece, err := db.QueryPiece(2, true)
+	fatalErr(err, t)
+
+	if len(piece.Posts) != 5 {
+		t.Fatalf("Expected 5 posts in the last piece, got %d", len(piece.Posts))
+	}
+
+	db.SetPieceSize(0)
+
+	if db.PieceSize() != data.PieceSize {
+		t.Fatal("Unset piece size should be the default")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := testDatabase(t, "export")
+	defer src.Close()
+
+	insertPosts(t, src, "backup", 30, 1000)
+
+	var exported bytes.Buffer
+	fatalErr(src.Export(&exported), t)
+
+	if lines := strings.Count(exported.String(), "\n"); lines != 30 {
+		t.Fatalf("Expected 30 lines, got %d", lines)
+	}
+
+	dst := testDatabase(t, "import")
+	defer dst.Close()
+
+	// already there, so skipped
+	insertPosts(t, dst, "backup", 5, 1000)
+
+	count, err := dst.Import(bytes.NewReader(exported.Bytes()))
+	fatalErr(err, t)
+
+	if count != 25 || dst.PostCount() != 30 {
+		t.Fatalf("Expected 25 new of 30 posts, got %d of %d", count, dst.PostCount())
+	}
+
+	posts, err := dst.Search("backup", 0, 10)
+	fatalErr(err, t)
+
+	if len(posts) == 0 {
+		t.Fatal("Imported posts were not indexed")
+	}
+
+	// the first batch is fine, the second line is not
+	bad := `{"InfoHash": "` + infoHash("good") + `", "Title": "good"}` + "\n" + `{"InfoHash": 5}`
+	count, err = dst.Import(strings.NewReader(bad))
+
+	if ie, ok := err.(data.ImportError); !ok || ie.Post != 2 {
+		t.Fatal("Expected an import error for post 2, got ", err)
+	}
+
+	if count != 0 || dst.PostCount() != 30 {
+		t.Fatal("Failed batch was committed")
+	}
+
+	// a whole batch goes in before the bad post, it has to be searchable
+	dst.SetPieceSize(1)
+
+	var batches bytes.Buffer
+	for i := 0; i < data.ImportBatchPieces+1; i++ {
+		fmt.Fprintf(&batches, `{"InfoHash": "%s", "Title": "batched %d"}`+"\n", infoHash(fmt.Sprint("batch", i)), i)
+	}
+	batches.WriteString(`{"InfoHash": 5}`)
+
+	count, err = dst.Import(&batches)
+
+	if _, ok := err.(data.ImportError); !ok || count != data.ImportBatchPieces {
+		t.Fatalf("Expected the first batch of %d committed, got %d (%v)", data.ImportBatchPieces, count, err)
+	}
+
+	posts, err = dst.Search("batched", 0, 10)
+	fatalErr(err, t)
+
+	if len(posts) == 0 {
+		t.Fatal("Committed batch was not indexed")
+	}
+}
+
+func TestTagCounts(t *testing.T) {
+	db := testDatabase(t, "tagcounts")
+	defer db.Close()
+
+	for n, tags := range []string{"linux,iso", "linux", " linux , video", "", "video,iso,linux"} {
+		_, err := db.InsertPost(data.Post{InfoHash: infoHash(fmt.Sprintf("tags%d", n)), Title: "tagged", Tags: tags})
+		fatalErr(err, t)
+	}
+
+	counts, err := db.TagCounts(2)
+	fatalErr(err, t)
+
+	expected := []data.TagCount{{"linux", 4}, {"iso", 2}}
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %d tags, got %d", len(expected), len(counts))
+	}
+
+	for n, i := range expected {
+		if counts[n] != i {
+			t.Fatalf("Expected %v, got %v", i, counts[n])
+		}
+	}
+}
+
+func TestSeederHistogram(t *testing.T) {
+	db := testDatabase(t, "histogram")
+	defer db.Close()
+
+	for n, seeders := range []int{0, 0, 1, 10, 11, 100, 101, 5000} {
+		_, err := db.InsertPost(data.Post{InfoHash: infoHash(fmt.Sprintf("seeds%d", n)), Title: "seeded", Seeders: seeders})
+		fatalErr(err, t)
+	}
+
+	buckets, err := db.SeederHistogram()
+	fatalErr(err, t)
+
+	for n, count := range []int{2, 2, 2, 2} {
+		if buckets[n].Count != count {
+			t.Fatalf("Bucket %d-%d: expected %d, got %d", buckets[n].Min, buckets[n].Max, count, buckets[n].Count)
+		}
+	}
+}
+
+func TestCollectionVerify(t *testing.T) {
+	db := testDatabase(t, "collectionverify")
+	defer db.Close()
+
+	insertPosts(t, db, "verify", data.PieceSize*2+5, 0)
+
+	col, err := data.CreateCollection(db)
+	fatalErr(err, t)
+
+	root := col.Hash()
+
+	// what a mirror rebuilds from the hashes of the pieces it received
+	received := data.Collection{HashList: make([]byte, len(col.HashList))}
+	copy(received.HashList, col.HashList)
+
+	if err := received.Verify(root); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	received.HashList[40] ^= 1
+
+	if err := received.Verify(root); err != data.ErrCollectionMismatch {
+		t.Fatal("Expected ErrCollectionMismatch, got ", err)
+	}
+}
+
+func TestCollectionMatches(t *testing.T) {
+	db := testDatabase(t, "collectionmatches")
+	defer db.Close()
+
+	db.SetPieceSize(10)
+
+	col := data.NewCollection()
+	matches, err := col.Matches(db)
+	fatalErr(err, t)
+
+	if !matches {
+		t.Fatal("Empty collection does not match an empty database")
+	}
+
+	insertPosts(t, db, "matches", 30, 0)
+	fatalErr(col.RebuildFrom(db), t)
+
+	for size, expected := range map[int]bool{10: true, 15: false, 20: false} {
+		db.SetPieceSize(size)
+
+		if matches, err = col.Matches(db); err != nil || matches != expected {
+			t.Fatalf("Piece size %d: expected match %t, got %t (%v)", size, expected, matches, err)
+		}
+	}
+}
+
+func TestRebuildFrom(t *testing.T) {
+	db := testDatabase(t, "rebuildfrom")
+	defer db.Close()
+
+	db.SetPieceSize(10)
+
+	empty := data.NewCollection()
+	fatalErr(empty.RebuildFrom(db), t)
+
+	if len(empty.HashList) != 0 || !bytes.Equal(empty.Hash(), data.NewCollection().Hash()) {
+		t.Fatal("Empty database gave a non-empty collection")
+	}
+
+	insertPosts(t, db, "rebuild", 25, 0)
+
+	// built piece by piece, the way a collection grows as posts are added
+	expected := data.NewCollection()
+	for i := uint(0); i < 3; i++ {
+		piece, err := db.QueryPiece(i, false)
+		fatalErr(err, t)
+
+		expected.Add(piece)
+	}
+
+	// whatever was there before is replaced, not added to
+	col := data.NewCollection()
+	col.HashList = bytes.Repeat([]byte{1}, 32*5)
+	col.Rehash()
+
+	fatalErr(col.RebuildFrom(db), t)
+
+	if !bytes.Equal(col.HashList, expected.HashList) || !bytes.Equal(col.Hash(), expected.Hash()) {
+		t.Fatal("Rebuilt collection differs from one built piece by piece")
+	}
+
+	// pieces go by position, so a deleted post shifts the ones after it
+	fatalErr(db.DeletePost(5), t)
+	fatalErr(col.RebuildFrom(db), t)
+
+	if len(col.HashList) != 32*3 || bytes.Equal(col.HashList[:32], expected.HashList[:32]) {
+		t.Fatal("Rebuilt collection ignored the deleted post")
+	}
+}
+
+func TestPostValidate(t *testing.T) {
+	valid := data.Post{InfoHash: infoHash("valid"), Title: "ubuntu", Size: 1, UploadDate: 1000}
+
+	if err := valid.Validate(); err != nil {
+		t.Fatal("Valid post rejected: ", err)
+	}
+
+	for name, change := range map[string]func(*data.Post){
+		"short hash":     func(p *data.Post) { p.InfoHash = "ubuntu" },
+		"not hex":        func(p *data.Post) { p.InfoHash = strings.Repeat("g", 40) },
+		"not base32":     func(p *data.Post) { p.InfoHash = strings.Repeat("1", 32) },
+		"empty title":    func(p *data.Post) { p.Title = " " },
+		"long title":     func(p *data.Post) { p.Title = strings.Repeat("a", data.TitleMax+1) },
+		"long tags":      func(p *data.Post) { p.Tags = strings.Repeat("a", data.TagsMax+1) },
+		"negative size":  func(p *data.Post) { p.Size = -1 },
+		"negative files": func(p *data.Post) { p.FileCount = -1 },
+		"negative seeds": func(p *data.Post) { p.Seeders = -1 },
+		"negative leech": func(p *data.Post) { p.Leechers = -1 },
+		"negative date":  func(p *data.Post) { p.UploadDate = -1 },
+		"future date":    func(p *data.Post) { p.UploadDate = int(time.Now().Unix()) + 3600 },
+	} {
+		post := valid
+		change(&post)
+
+		if _, ok := post.Validate().(data.InvalidPostError); !ok {
+			t.Fatalf("%s: post not rejected", name)
+		}
+	}
+
+	// magnet links have base32 hashes, v2 torrents longer ones
+	for _, ih := range []string{strings.Repeat("A2", 16), strings.Repeat("f", 64)} {
+		post := valid
+		post.InfoHash = ih
+
+		if err := post.Validate(); err != nil {
+			t.Fatalf("Hash %s rejected: %s", ih, err)
+		}
+	}
+
+	data.SetPostLimits(10, 0)
+	defer data.SetPostLimits(0, 0)
+
+	if post := (data.Post{InfoHash: infoHash("limit"), Title: "a longer title"}); post.Validate() == nil {
+		t.Fatal("Title limit not applied")
+	}
+}
+
+func TestRejectedPosts(t *testing.T) {
+	db := testDatabase(t, "rejected")
+	defer db.Close()
+
+	if _, err := db.InsertPost(data.Post{InfoHash: "bad", Title: "bad"}); err == nil {
+		t.Fatal("Invalid post inserted")
+	}
+
+	// mirrored pieces are checked by hash, one from a peer with looser limits
+	// or an old style info hash has to go in whole
+	piece := data.Piece{Id: 0}
+	piece.Setup()
+	piece.Add(data.Post{Id: 1, InfoHash: infoHash("good"), Title: "good"}, true)
+	piece.Add(data.Post{Id: 2, InfoHash: "legacy", Title: strings.Repeat("a", data.TitleMax+1)}, true)
+	fatalErr(db.InsertPiece(&piece), t)
+
+	if db.PostCount() != 2 {
+		t.Fatalf("Expected the whole piece stored, got %d posts", db.PostCount())
+	}
+
+	col, err := data.CreateCollection(db)
+	fatalErr(err, t)
+
+	if !bytes.Equal(col.HashList, piece.Hash()) {
+		t.Fatal("Stored piece no longer matches its hash")
+	}
+
+	if db.RejectedPosts() != 1 {
+		t.Fatalf("Expected 1 rejected post, got %d", db.RejectedPosts())
+	}
+}
@@ -0,0 +1,119 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import (
+	"database/sql"
+
+	"github.com/dfindex/dfi/util"
+	log "github.com/sirupsen/logrus"
+)
+
+var dialects = util.NewDialects(SqliteDialect{})
+
+// Makes a dialect available to databases using the given driver. The search
+// index is an FTS4 table called fts_post, see util.Dialect.
+func RegisterDialect(driver string, d util.Dialect) {
+	dialects.Register(driver, d)
+}
+
+type SqliteDialect struct{}
+
+func (SqliteDialect) Setup(conn *sql.DB) error {
+	// Enable Write-Ahead Logging
+	conn.Exec("PRAGMA journal_mode=WAL")
+
+	return nil
+}
+
+func (SqliteDialect) CreateSchema(conn *sql.DB) error {
+	_, err := conn.Exec(sql_create_post_table)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(sql_create_fts_post)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(sql_create_upload_date_index)
+
+	return err
+}
+
+// Drops a search index made before tags were indexed, and builds it again.
+func rebuildFtsWithTags(tx *sql.Tx) error {
+	rebuild, err := ftsMissingTags(tx)
+
+	if err != nil || !rebuild {
+		return err
+	}
+
+	log.Info("Rebuilding search index to include tags")
+
+	if _, err = tx.Exec(sql_drop_fts_post); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(sql_create_fts_post); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(sql_generate_fts, 0)
+
+	return err
+}
+
+// Whether there is a search index that was made before tags were indexed.
+func ftsMissingTags(tx *sql.Tx) (bool, error) {
+	rows, err := tx.Query(sql_fts_post_columns)
+
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	columns := 0
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var def interface{}
+
+		if err = rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err != nil {
+			return false, err
+		}
+
+		if name == "tags" {
+			return false, nil
+		}
+
+		columns++
+	}
+
+	// no columns at all means there is no index yet
+	return columns > 0, rows.Err()
+}
@@ -0,0 +1,71 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Wraps sqlite, noting that it was used.
+type countingDialect struct {
+	data.SqliteDialect
+	setups *int
+}
+
+func (cd countingDialect) Setup(conn *sql.DB) error {
+	*cd.setups++
+	return cd.SqliteDialect.Setup(conn)
+}
+
+func TestRegisterDialect(t *testing.T) {
+	db := data.NewDatabaseDriver("nosuchdriver", ".testing/nosuchdriver.db")
+
+	if err := db.Connect(); err == nil {
+		t.Fatal("Connected without a dialect")
+	}
+
+	sql.Register("sqlite3-counting", &sqlite3.SQLiteDriver{})
+
+	setups := 0
+	data.RegisterDialect("sqlite3-counting", countingDialect{setups: &setups})
+
+	db = data.NewDatabaseDriver("sqlite3-counting", ".testing/counting.db")
+	fatalErr(db.Connect(), t)
+	defer db.Close()
+
+	if setups != 1 {
+		t.Fatalf("Dialect set up %d times", setups)
+	}
+
+	insertPosts(t, db, "dialect", 3, 1000)
+
+	if db.PostCount() != 3 {
+		t.Fatal("Posts not stored through the registered dialect")
+	}
+}
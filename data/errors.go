@@ -27,11 +27,49 @@ package data
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Returned by inserts once the database has grown past its maximum size.
+var ErrDatabaseFull = errors.New("Database has reached its maximum size")
+
+// The pieces of a collection don't add up to the hash it was signed with.
+var ErrCollectionMismatch = errors.New("Collection does not match its signed hash")
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+var ErrAlreadyConnected = errors.New("Database is already connected")
+var ErrNotConnected = errors.New("Database is not connected")
+
+// Post meta that is set but isn't a JSON object, AddMetaField won't touch it.
+var ErrMetaNotJSON = errors.New("Post meta is not a JSON object")
+
+var ErrBadMetaKey = errors.New("Meta keys cannot contain quotes")
+
+// A post that can't go in the index, see Post.Validate.
+type InvalidPostError struct {
+	Reason string
+}
+
+func (ipe InvalidPostError) Error() string {
+	return "Invalid post: " + ipe.Reason
+}
+
+// A post in an import that couldn't be read or isn't valid, Post counting from
+// one.
+type ImportError struct {
+	Post int
+	Err  error
+}
+
+func (ie ImportError) Error() string {
+	return fmt.Sprintf("Post %d: %s", ie.Post, ie.Err.Error())
+}
+
 type ErrorReader struct {
 	reader *bufio.Reader
 	Err    error
@@ -65,11 +103,3 @@ func (er *ErrorReader) ReadByte() (byte, error) {
 
 	return ret, nil
 }
-
-type AddressResolutionError struct {
-	Address string
-}
-
-func (a AddressResolutionError) Error() string {
-	return "Failed to resolve address, address may not exist or is not reachable"
-}
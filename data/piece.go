@@ -32,12 +32,16 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// How many posts go in a piece unless the database is told otherwise. Peers
+// need to agree on this, collection hashes are built from pieces.
 const PieceSize = 1000
 
 type Piece struct {
 	Id    uint
 	Posts []Post
-	hash  hash.Hash
+	// the most posts it can hold, PieceSize if unset
+	Size int
+	hash hash.Hash
 }
 
 func (p *Piece) Setup() {
@@ -45,7 +49,12 @@ func (p *Piece) Setup() {
 }
 
 func (p *Piece) Add(post Post, store bool) error {
-	if len(p.Posts) > PieceSize {
+	size := p.Size
+	if size < 1 {
+		size = PieceSize
+	}
+
+	if len(p.Posts) > size {
 		return errors.New("Piece full")
 	}
 
@@ -27,18 +27,44 @@ package data
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"io"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
+	// The longest title and tags a post may have, unless set otherwise with
+	// SetPostLimits.
 	TitleMax    = 144
 	TagsMax     = 256
 	MaxPostSize = TitleMax + TagsMax + 1024
 )
 
+var titleMax int32 = TitleMax
+var tagsMax int32 = TagsMax
+
+// Sets the longest title and tags Validate allows, anything under 1 is the
+// default.
+func SetPostLimits(title, tags int) {
+	if title < 1 {
+		title = TitleMax
+	}
+
+	if tags < 1 {
+		tags = TagsMax
+	}
+
+	atomic.StoreInt32(&titleMax, int32(title))
+	atomic.StoreInt32(&tagsMax, int32(tags))
+}
+
+// Posts with more than one tag keep them in a single string separated by this,
+// with no spaces around it, eg. "linux-iso,ubuntu". The separator is also the
+// same one sql_query_post_tag wraps tags in.
+const TagSeparator = ","
+
 type Post struct {
 	Id         int
 	InfoHash   string
@@ -52,6 +78,19 @@ type Post struct {
 	Meta       string
 }
 
+// The post's tags, split apart. Empty tags are left out.
+func (p *Post) TagList() []string {
+	ret := make([]string, 0)
+
+	for _, i := range strings.Split(p.Tags, TagSeparator) {
+		if i = strings.TrimSpace(i); i != "" {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
 func (p Post) Json() ([]byte, error) {
 	json, err := json.Marshal(p)
 
@@ -129,14 +168,110 @@ func (p *Post) Write(sep, term string, seedLeech bool, w io.Writer) {
 		bw.Flush()*/
 }
 
-func (p *Post) Valid() error {
-	if len(p.Title) > 140 {
-		return errors.New("Title too long")
+// Whether the post is fit to go in the index. Errors are InvalidPostError.
+func (p *Post) Validate() error {
+	if !validInfoHash(p.InfoHash) {
+		return InvalidPostError{"info hash is not a hex or base32 hash"}
+	}
+
+	if strings.TrimSpace(p.Title) == "" {
+		return InvalidPostError{"title is empty"}
+	}
+
+	if len(p.Title) > int(atomic.LoadInt32(&titleMax)) {
+		return InvalidPostError{"title is too long"}
+	}
+
+	if len(p.Tags) > int(atomic.LoadInt32(&tagsMax)) {
+		return InvalidPostError{"tags are too long"}
+	}
+
+	if p.Size < 0 || p.FileCount < 0 || p.Seeders < 0 || p.Leechers < 0 || p.UploadDate < 0 {
+		return InvalidPostError{"negative size, count or date"}
 	}
 
 	if p.UploadDate > int(time.Now().Unix()) {
-		return errors.New("Upload data cannot be in the future")
+		return InvalidPostError{"upload date is in the future"}
 	}
 
 	return nil
 }
+
+// 40 or 64 hex characters (v1 or v2 torrents), or 32 base32 ones, as found in
+// magnet links.
+func validInfoHash(ih string) bool {
+	switch len(ih) {
+	case 40, 64:
+		for _, c := range ih {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+
+		return true
+	case 32:
+		for _, c := range ih {
+			if !strings.ContainsRune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz234567", c) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// How the post ranks in search results, the same order sql_search_post gives
+// but scaled by 10 to stay an integer.
+func (p *Post) SearchScore() int {
+	return p.Seeders*11 + p.Leechers*10
+}
+
+// Collapses posts sharing an info hash, the same torrent mirrored from more
+// than one peer. The one with the most seeders and leechers is kept, in the
+// place the hash first appeared, with the tags of all of them. Posts that are
+// merged are copied, the originals are left alone.
+func DedupPosts(posts []*Post) []*Post {
+	ret := make([]*Post, 0, len(posts))
+	index := make(map[string]int)
+
+	for _, p := range posts {
+		if p == nil {
+			continue
+		}
+
+		n, ok := index[p.InfoHash]
+
+		if !ok {
+			index[p.InfoHash] = len(ret)
+			ret = append(ret, p)
+			continue
+		}
+
+		kept := *ret[n]
+
+		if p.Seeders+p.Leechers > kept.Seeders+kept.Leechers {
+			kept, p = *p, ret[n]
+		}
+
+		tags := kept.TagList()
+		have := make(map[string]bool)
+
+		for _, i := range tags {
+			have[i] = true
+		}
+
+		for _, i := range p.TagList() {
+			if !have[i] {
+				have[i] = true
+				tags = append(tags, i)
+			}
+		}
+
+		kept.Tags = strings.Join(tags, TagSeparator)
+		ret[n] = &kept
+	}
+
+	return ret
+}
@@ -46,6 +46,13 @@ type SearchResult struct {
 	Source string  `json:"source"`
 }
 
+// A SearchResult with snippets, posts are under the same key so either can be
+// read the same way.
+type SnippetResult struct {
+	Hits   []SearchHit `json:"posts"`
+	Source string      `json:"source"`
+}
+
 func NewSearchProvider() *SearchProvider {
 	sp := &SearchProvider{true}
 
@@ -102,3 +109,116 @@ func (sp *SearchProvider) Search(source string, db *Database, query string, page
 
 	return SearchResult{results, source}, err
 }
+
+func (sp *SearchProvider) SearchWithSnippets(source string, db *Database, query string, page int) (SnippetResult, error) {
+	results, err := db.SearchWithSnippets(query, page, 25)
+
+	return SnippetResult{results, source}, err
+}
+
+// Turns a search string from a user into an FTS MATCH expression that sqlite
+// will always accept. "Quoted phrases" are matched exactly, AND, OR and NOT
+// (in capitals) work between terms, and any other word matches as a prefix.
+// Stray quotes, brackets and other punctuation are dropped. Returns an empty
+// string if nothing searchable is left.
+func FtsQuery(in string) string {
+	return ftsQuery(in, func(term string) string { return term })
+}
+
+// FtsQuery for fts_post, with every term restricted to the title and tags.
+// Otherwise a number would match seeder and leecher counts too. sqlite won't
+// take a column filter on a phrase, but a phrase is always more than one word
+// and so can't match a count anyway.
+func postFtsQuery(in string) string {
+	return ftsQuery(in, func(term string) string {
+		if strings.HasPrefix(term, `"`) {
+			return term
+		}
+
+		return "(title:" + term + " OR tags:" + term + ")"
+	})
+}
+
+func ftsQuery(in string, column func(string) string) string {
+	terms := make([]string, 0)
+	// an operator waiting for a term to follow it
+	op := ""
+
+	add := func(term string) {
+		if term == "" {
+			return
+		}
+
+		if op != "" && len(terms) > 0 {
+			terms = append(terms, op)
+		}
+
+		op = ""
+		terms = append(terms, column(term))
+	}
+
+	for in != "" {
+		in = strings.TrimLeftFunc(in, unicode.IsSpace)
+
+		if in == "" {
+			break
+		}
+
+		// a phrase, if the quote is closed
+		if in[0] == '"' {
+			if end := strings.IndexByte(in[1:], '"'); end >= 0 {
+				switch words := ftsWords(in[1 : end+1]); len(words) {
+				case 0:
+				case 1:
+					// exact, without the prefix match
+					add(words[0])
+				default:
+					add(`"` + strings.Join(words, " ") + `"`)
+				}
+
+				in = in[end+2:]
+				continue
+			}
+
+			in = in[1:]
+			continue
+		}
+
+		end := strings.IndexFunc(in, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '"'
+		})
+
+		if end < 0 {
+			end = len(in)
+		}
+
+		word := in[:end]
+		in = in[end:]
+
+		switch word {
+		case "AND", "OR", "NOT":
+			op = word
+			continue
+		}
+
+		words := ftsWords(word)
+
+		switch len(words) {
+		case 0:
+		case 1:
+			add(words[0] + "*")
+		default:
+			// split up by punctuation, eg. linux-iso, so keep it together
+			add(`"` + strings.Join(words, " ") + `"`)
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// The letters and numbers in s, split on everything else.
+func ftsWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
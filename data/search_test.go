@@ -0,0 +1,129 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data_test
+
+import (
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+)
+
+func TestFtsQuery(t *testing.T) {
+	for in, expected := range map[string]string{
+		"":                       "",
+		"   ":                    "",
+		`"`:                      "",
+		`""`:                     "",
+		"()*:^":                  "",
+		"ubuntu":                 "ubuntu*",
+		"ubuntu server":          "ubuntu* server*",
+		`"ubuntu server"`:        `"ubuntu server"`,
+		`"ubuntu server`:         "ubuntu* server*",
+		`ubuntu "18.04 lts" iso`: `ubuntu* "18 04 lts" iso*`,
+		`it's`:                   `"it s"`,
+		"linux-iso":              `"linux iso"`,
+		"ubuntu OR debian":       "ubuntu* OR debian*",
+		"ubuntu AND NOT server":  "ubuntu* NOT server*",
+		"OR ubuntu AND":          "ubuntu*",
+		"ubuntu or debian":       "ubuntu* or* debian*",
+		"NOT":                    "",
+		"(ubuntu OR debian)":     "ubuntu* OR debian*",
+		`"ubuntu" server`:        "ubuntu server*",
+	} {
+		if out := data.FtsQuery(in); out != expected {
+			t.Errorf("FtsQuery(%q) = %q, expected %q", in, out, expected)
+		}
+	}
+}
+
+func TestSearchSyntax(t *testing.T) {
+	db := testDatabase(t, "searchsyntax")
+	defer db.Close()
+
+	insertPosts(t, db, "syntax", 5, 1000)
+	_, err := db.InsertPost(data.Post{InfoHash: infoHash("other"), Title: "other", Seeders: 77})
+	fatalErr(err, t)
+	fatalErr(db.GenerateFts(0), t)
+
+	for query, count := range map[string]int{
+		"":                   0,
+		`"`:                  0,
+		`ubuntu "syntax`:     5,
+		"ubun":               5,
+		`"ubuntu syntax"`:    5,
+		"ubuntu AND NOT 3":   4,
+		"3 OR 4":             2,
+		"NOT AND OR":         0,
+		`"unbalanced (quote`: 0,
+		"missing AND ubuntu": 0,
+		"missing OR ubuntu":  5,
+		"other":              1,
+		"77":                 0,
+		`"77"`:               0,
+	} {
+		results, err := db.Search(query, 0, 25)
+
+		if err != nil {
+			t.Fatalf("Searching %q failed: %s", query, err.Error())
+		}
+
+		if len(results) != count {
+			t.Fatalf("Expected %d results for %q, got %d", count, query, len(results))
+		}
+	}
+}
+
+func TestDedupPosts(t *testing.T) {
+	mirrorA := []*data.Post{
+		{InfoHash: "aaa", Title: "a from A", Seeders: 1, Tags: "linux"},
+		{InfoHash: "bbb", Title: "b from A", Seeders: 10, Tags: "iso"},
+	}
+	mirrorB := []*data.Post{
+		{InfoHash: "aaa", Title: "a from B", Seeders: 5, Leechers: 2, Tags: "ubuntu,linux"},
+		{InfoHash: "ccc", Title: "c from B"},
+		{InfoHash: "bbb", Title: "b from B", Seeders: 3, Tags: "debian"},
+	}
+
+	posts := data.DedupPosts(append(mirrorA, mirrorB...))
+
+	if len(posts) != 3 {
+		t.Fatalf("Expected 3 posts, got %d", len(posts))
+	}
+
+	for n, expected := range []struct{ title, tags string }{
+		{"a from B", "ubuntu,linux"},
+		{"b from A", "iso,debian"},
+		{"c from B", ""},
+	} {
+		if posts[n].Title != expected.title || posts[n].Tags != expected.tags {
+			t.Fatalf("Post %d is %q tagged %q, expected %q tagged %q", n,
+				posts[n].Title, posts[n].Tags, expected.title, expected.tags)
+		}
+	}
+
+	if mirrorA[1].Tags != "iso" {
+		t.Fatal("Merging tags changed the original post")
+	}
+}
@@ -0,0 +1,117 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"os"
+	"time"
+
+	"github.com/dfindex/dfi/util"
+)
+
+// Limits how large the database file is allowed to grow, in bytes. Zero means
+// there is no limit. The size is not checked here, only by CheckSize.
+func (db *Database) SetMaxSize(max int64) {
+	db.sizeLock.Lock()
+	defer db.sizeLock.Unlock()
+
+	db.maxSize = max
+	db.full = max > 0 && db.size >= max
+}
+
+// Stats the database file, along with its write-ahead log, and records whether
+// it has passed the maximum size. Returns the current size.
+func (db *Database) CheckSize() (int64, error) {
+	// anything else is a server, which can look after its own size
+	if db.driver != util.DefaultDriver {
+		return 0, nil
+	}
+
+	info, err := os.Stat(db.path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+
+	if wal, err := os.Stat(db.path + "-wal"); err == nil {
+		size += wal.Size()
+	}
+
+	db.sizeLock.Lock()
+	defer db.sizeLock.Unlock()
+
+	db.size = size
+	db.full = db.maxSize > 0 && size >= db.maxSize
+
+	return size, nil
+}
+
+// Whether inserts are currently being refused.
+func (db *Database) Full() bool {
+	db.sizeLock.RLock()
+	defer db.sizeLock.RUnlock()
+
+	return db.full
+}
+
+// The size at the last check, and the maximum.
+func (db *Database) Size() (int64, int64) {
+	db.sizeLock.RLock()
+	defer db.sizeLock.RUnlock()
+
+	return db.size, db.maxSize
+}
+
+// Checks the size of the database every interval until it is closed. Stat-ing
+// the file on every insert would be wasteful, a little overshoot is fine.
+func (db *Database) WatchSize(interval time.Duration) {
+	if db.sizeStop != nil {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DefaultSizeCheckInterval
+	}
+
+	db.CheckSize()
+	db.sizeStop = make(chan bool)
+
+	go func(stop chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case _ = <-ticker.C:
+				db.CheckSize()
+			case _ = <-stop:
+				return
+			}
+		}
+	}(db.sizeStop)
+}
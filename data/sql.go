@@ -24,6 +24,8 @@
 // For more information, please refer to <http://unlicense.org/>
 package data
 
+import "github.com/dfindex/dfi/util"
+
 const sql_create_post_table string = `CREATE TABLE IF NOT EXISTS 
 										post(
 											id INTEGER PRIMARY KEY NOT NULL,
@@ -43,9 +45,18 @@ const sql_create_fts_post string = `CREATE VIRTUAL TABLE IF NOT EXISTS
 										content="post",
 										title,
 										seeders,
-										leechers
+										leechers,
+										tags
 									)`
 
+const sql_create_popularity_index string = `CREATE INDEX IF NOT EXISTS
+											post_popularity_index
+											ON post(seeders + leechers DESC, id DESC)`
+
+const sql_fts_post_columns string = `PRAGMA table_info(fts_post)`
+
+const sql_drop_fts_post string = `DROP TABLE IF EXISTS fts_post`
+
 const sql_create_upload_date_index string = `CREATE INDEX IF NOT EXISTS
 											port_upload_date_index
 											ON post(upload_date)`
@@ -62,6 +73,17 @@ const sql_insert_post string = `INSERT OR IGNORE INTO post(
 									meta
 								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
+const sql_query_id_by_info_hash string = `SELECT id FROM post
+											WHERE info_hash = ?`
+
+const sql_query_post_exists string = `SELECT id FROM post WHERE id = ?`
+
+// The fts row must be removed before the post, fts4 needs the original content
+// to remove it from the index.
+const sql_delete_fts_post string = `DELETE FROM fts_post WHERE docid = ?`
+
+const sql_delete_post string = `DELETE FROM post WHERE id = ?`
+
 const sql_attach_meta string = `UPDATE POST
 								SET meta=?
 								WHERE id=?`
@@ -70,8 +92,9 @@ const sql_generate_fts string = `INSERT OR IGNORE INTO fts_post(
 								docid,
 								title,
 								seeders,
-								leechers)
-							SELECT id, title, seeders, leechers FROM post 
+								leechers,
+								tags)
+							SELECT id, title, seeders, leechers, tags FROM post 
 							WHERE id >= ?`
 
 const sql_query_recent_post string = `SELECT 	 * FROM post
@@ -86,18 +109,73 @@ const sql_query_popular_post string = ` SELECT * FROM(
 												 ORDER BY seeders + leechers DESC
 												 LIMIT ?,?`
 
+// Cursor based paging, these take the last seen key and id twice, then the page
+// size. Ordering by id as well keeps the order stable when keys are equal.
+const sql_query_recent_post_cursor string = `SELECT * FROM post
+												WHERE upload_date < ?
+												OR (upload_date = ? AND id < ?)
+												ORDER BY upload_date DESC, id DESC
+												LIMIT 0,?`
+
+const sql_query_popular_post_cursor string = `SELECT * FROM post
+												WHERE seeders + leechers < ?
+												OR (seeders + leechers = ? AND id < ?)
+												ORDER BY seeders + leechers DESC, id DESC
+												LIMIT 0,?`
+
+// Same ordering as sql_search_post, but scaled by 10 so the score is an
+// integer and can be compared exactly.
+const sql_search_post_cursor string = `SELECT docid, (seeders * 11) + (leechers * 10)
+										FROM fts_post
+										WHERE fts_post MATCH ?
+										AND ((seeders * 11) + (leechers * 10) < ?
+											OR ((seeders * 11) + (leechers * 10) = ? AND docid < ?))
+										ORDER BY (seeders * 11) + (leechers * 10) DESC, docid DESC
+										LIMIT 0,?`
+
+// Tags are wrapped in TagSeparator so that the first and last match too, the
+// pattern is escaped with a backslash.
+var sql_query_post_tag string = `SELECT * FROM post
+									WHERE '` + TagSeparator + `' || tags || '` + TagSeparator + `' LIKE ? ESCAPE '\'
+									ORDER BY upload_date DESC, id DESC
+									LIMIT ?,?`
+
+// Narrows down to posts whose meta mentions a key, the meta itself is checked
+// after it's read.
+const sql_query_post_meta string = `SELECT * FROM post
+									WHERE meta LIKE ? ESCAPE '\'
+									ORDER BY upload_date DESC, id DESC`
+
+const sql_query_post_meta_value string = `SELECT meta FROM post WHERE id=?`
+
+const sql_query_post_date_range string = `SELECT * FROM post
+											WHERE upload_date >= ? AND upload_date <= ?
+											ORDER BY upload_date DESC, id DESC
+											LIMIT ?,?`
+
 const sql_query_post_id string = `SELECT 	 * FROM post
 												 WHERE id = ?`
 
+// Pieces are made of posts in insertion order, by position rather than id so
+// that deleted posts don't leave pieces short.
 const sql_query_paged_post string = `SELECT 	 * FROM post
-												 WHERE id > ?
-												 LIMIT 0,?`
+												 ORDER BY id
+												 LIMIT ?,?`
 
 // Seeders are weighted, things with more seeders are better than things with
 // more leechers, though both are important.
 // (for one, seeders DO still upload, and are indicative of popularity)
 const sql_search_post string = `SELECT docid FROM fts_post
-									WHERE title MATCH ?
+									WHERE fts_post MATCH ?
+									ORDER BY ((seeders * 1.1) + leechers) DESC
+									LIMIT ?,?`
+
+// The same as sql_search_post, along with the title with matching terms
+// wrapped in control characters, see snippetTags. Column 0 of fts_post is the
+// title.
+const sql_search_post_snippet string = `SELECT docid, snippet(fts_post, char(2), char(3), '...', 0, 16)
+									FROM fts_post
+									WHERE fts_post MATCH ?
 									ORDER BY ((seeders * 1.1) + leechers) DESC
 									LIMIT ?,?`
 
@@ -110,7 +188,19 @@ const sql_suggest_posts string = `SELECT title FROM (
 									ORDER BY (seeders * 1.1) + leechers DESC
 									LIMIT 0,?`
 
-const sql_count_post = `SELECT MAX(id) FROM post`
+const sql_count_post = `SELECT COUNT(*) FROM post`
+
+const sql_max_post_id = `SELECT IFNULL(MAX(id), 0) FROM post`
+
+const sql_query_tags = `SELECT tags FROM post WHERE tags != ''`
+
+// One row, the count for each of SeederBuckets in order.
+const sql_seeder_histogram = `SELECT
+								IFNULL(SUM(seeders <= 0), 0),
+								IFNULL(SUM(seeders BETWEEN 1 AND 10), 0),
+								IFNULL(SUM(seeders BETWEEN 11 AND 100), 0),
+								IFNULL(SUM(seeders > 100), 0)
+							FROM post`
 
 const sql_update_seed_leecth = `UPDATE post
 								SET seeders=?
@@ -123,3 +213,18 @@ const sql_update_leechers = `UPDATE post
 const sql_update_seeders = `UPDATE post
 								SET seeders=?
 								WHERE id=?`
+
+// VACUUM can't be run in a transaction.
+const sql_vacuum string = `VACUUM`
+
+const sql_checkpoint_truncate string = `PRAGMA wal_checkpoint(TRUNCATE)`
+
+// Schema changes made after a database has been created, run in order by
+// util.Migrate. Only ever add to the end of this.
+var migrations = []util.Migration{
+	// search indexes made before tags were indexed have to be built again
+	rebuildFtsWithTags,
+
+	// popular cursors page through every post in this order
+	util.Statement(sql_create_popularity_index),
+}
@@ -0,0 +1,113 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"sort"
+)
+
+// How many posts have a tag.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// How many posts have between Min and Max seeders, inclusive. A Max of -1 has
+// no upper limit.
+type Bucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+// The ranges SeederHistogram counts, in order.
+var SeederBuckets = []Bucket{{0, 0, 0}, {1, 10, 0}, {11, 100, 0}, {101, -1, 0}}
+
+// The most common tags, most posts first, at most limit of them. A limit under
+// 1 returns them all. Tags aren't normalised in the database, so this reads
+// every tagged post.
+func (db *Database) TagCounts(limit int) ([]TagCount, error) {
+	rows, err := db.conn.Query(sql_query_tags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		var post Post
+
+		if err := rows.Scan(&post.Tags); err != nil {
+			return nil, err
+		}
+
+		for _, i := range post.TagList() {
+			counts[i]++
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		ret = append(ret, TagCount{tag, count})
+	}
+
+	// ties by name, so the order doesn't change between calls
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+
+		return ret[i].Tag < ret[j].Tag
+	})
+
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+
+	return ret, nil
+}
+
+// How many posts fall into each of SeederBuckets.
+func (db *Database) SeederHistogram() ([]Bucket, error) {
+	ret := make([]Bucket, len(SeederBuckets))
+	copy(ret, SeederBuckets)
+
+	err := db.conn.QueryRow(sql_seeder_histogram).Scan(&ret[0].Count,
+		&ret[1].Count, &ret[2].Count, &ret[3].Count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
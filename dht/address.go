@@ -32,6 +32,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 
@@ -129,6 +130,34 @@ func RandomAddress() (*Address, error) {
 	return &addr, err
 }
 
+// A random address in bucket n of a's routing table, that is one whose
+// distance from a has exactly n leading zero bits.
+func RandomAddressInBucket(a *Address, n int) (*Address, error) {
+	if n < 0 || n >= len(a.Raw)*8 {
+		return nil, errors.New(fmt.Sprintf("No bucket %d", n))
+	}
+
+	ret, err := RandomAddress()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// share the first n bits, then differ on the next
+	for i := 0; i <= n; i++ {
+		mask := byte(0x80) >> uint8(i%8)
+		bit := a.Raw[i/8] & mask
+
+		if i == n {
+			bit ^= mask
+		}
+
+		ret.Raw[i/8] = ret.Raw[i/8]&^mask | bit
+	}
+
+	return ret, nil
+}
+
 // Generate a DFI address from a public key.
 // This process involves one SHA3-256 iteration, followed by BLAKE2. This is
 // similar to bitcoin, and the BLAKE2 makes the resulting address a bit shorter
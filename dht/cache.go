@@ -0,0 +1,197 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dht
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// How many entries Query keeps, and for how long, unless set otherwise
+	// with SetQueryCache.
+	DefaultQueryCacheSize = 1024
+	DefaultQueryCacheTTL  = time.Second * 10
+)
+
+// How well the Query cache is doing.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+// A least recently used cache of entries by address, each only good for ttl.
+type entryCache struct {
+	lock sync.Mutex
+
+	size int
+	ttl  time.Duration
+
+	// most recently used at the front
+	order *list.List
+	items map[string]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+type cachedEntry struct {
+	key     string
+	entry   Entry
+	id      int
+	expires time.Time
+}
+
+func newEntryCache(size int, ttl time.Duration) *entryCache {
+	return &entryCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (ec *entryCache) enabled() bool {
+	return ec.size > 0 && ec.ttl > 0
+}
+
+// A copy of the cached entry, so callers can't change what others get.
+func (ec *entryCache) get(addr Address) (*Entry, int, bool) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	if !ec.enabled() {
+		return nil, 0, false
+	}
+
+	el, ok := ec.items[string(addr.Raw)]
+
+	if !ok || time.Now().After(el.Value.(*cachedEntry).expires) {
+		if ok {
+			ec.removeElement(el)
+		}
+
+		ec.misses++
+		return nil, 0, false
+	}
+
+	ec.hits++
+	ec.order.MoveToFront(el)
+
+	cached := el.Value.(*cachedEntry)
+	entry := copyEntry(cached.entry)
+
+	return &entry, cached.id, true
+}
+
+func (ec *entryCache) put(entry *Entry, id int) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	if !ec.enabled() {
+		return
+	}
+
+	key := string(entry.Address.Raw)
+	cached := &cachedEntry{key, copyEntry(*entry), id, time.Now().Add(ec.ttl)}
+
+	if el, ok := ec.items[key]; ok {
+		el.Value = cached
+		ec.order.MoveToFront(el)
+		return
+	}
+
+	ec.items[key] = ec.order.PushFront(cached)
+
+	for ec.order.Len() > ec.size {
+		ec.removeElement(ec.order.Back())
+	}
+}
+
+func (ec *entryCache) remove(addrs ...Address) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	for _, i := range addrs {
+		if el, ok := ec.items[string(i.Raw)]; ok {
+			ec.removeElement(el)
+		}
+	}
+}
+
+func (ec *entryCache) clear() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	ec.order.Init()
+	ec.items = make(map[string]*list.Element)
+}
+
+// Expects the lock to be held.
+func (ec *entryCache) removeElement(el *list.Element) {
+	ec.order.Remove(el)
+	delete(ec.items, el.Value.(*cachedEntry).key)
+}
+
+// Changes the size and ttl, emptying the cache.
+func (ec *entryCache) configure(size int, ttl time.Duration) {
+	ec.lock.Lock()
+	ec.size = size
+	ec.ttl = ttl
+	ec.lock.Unlock()
+
+	ec.clear()
+}
+
+func (ec *entryCache) stats() CacheStats {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	return CacheStats{ec.hits, ec.misses, ec.order.Len()}
+}
+
+// Copies the slices an entry holds, though not the bytes in them, which
+// nothing changes in place.
+func copyEntry(e Entry) Entry {
+	e.Address.Raw = append([]byte(nil), e.Address.Raw...)
+
+	// empty and nil look different as JSON, so keep whichever it was
+	if e.PublicAddresses != nil {
+		e.PublicAddresses = append(make([]string, 0, len(e.PublicAddresses)), e.PublicAddresses...)
+	}
+
+	if e.Seeds != nil {
+		e.Seeds = append(make([][]byte, 0, len(e.Seeds)), e.Seeds...)
+	}
+
+	if e.Seeding != nil {
+		e.Seeding = append(make([][]byte, 0, len(e.Seeding)), e.Seeding...)
+	}
+
+	return e
+}
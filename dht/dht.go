@@ -25,7 +25,11 @@
 package dht
 
 import (
+	"context"
 	"database/sql"
+	"time"
+
+	"github.com/dfindex/dfi/util"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -34,10 +38,15 @@ type DHT struct {
 }
 
 // sets up the dht
-func NewDHT(addr Address, path string) *DHT {
+func NewDHT(addr Address, path, tablePath string) *DHT {
+	return NewDHTDriver(util.DefaultDriver, addr, path, tablePath)
+}
+
+// sets up the dht, storing entries with the given database driver
+func NewDHTDriver(driver string, addr Address, path, tablePath string) *DHT {
 	ret := &DHT{}
 
-	db, err := NewNetDB(addr, path)
+	db, err := NewNetDBDriver(driver, addr, path, tablePath)
 
 	if err != nil {
 		panic(err)
@@ -47,7 +56,7 @@ func NewDHT(addr Address, path string) *DHT {
 
 	log.Debug("Loading latest into DHT")
 	// insert a load of new entries, keep it fresh!
-	entries, err := db.QueryLatest()
+	entries, _, err := db.QueryLatest(0, LatestPageSize)
 
 	if err == sql.ErrNoRows {
 		return ret
@@ -73,22 +82,126 @@ func (dht *DHT) Insert(entry Entry) (int64, error) {
 	return dht.db.Insert(entry)
 }
 
+func (dht *DHT) SetRawAddresses(raw bool) error {
+	return dht.db.SetRawAddresses(raw)
+}
+
+func (dht *DHT) InsertMany(entries []Entry) (int64, error) {
+	return dht.db.InsertMany(entries)
+}
+
+func (dht *DHT) Iterate(fn func(*Entry) error) error {
+	return dht.db.Iterate(fn)
+}
+
 func (dht *DHT) Query(addr Address) (*Entry, error) {
 	entry, _, err := dht.db.Query(addr)
 
 	return entry, err
 }
 
+func (dht *DHT) DeleteEntry(addr Address) (int64, error) {
+	return dht.db.DeleteEntry(addr)
+}
+
+func (dht *DHT) RemoveSeed(entry Address, seed Address) error {
+	return dht.db.RemoveSeed(entry, seed)
+}
+
+func (dht *DHT) UpdateSeen(addr Address, seen int64) error {
+	return dht.db.UpdateSeen(addr, seen)
+}
+
+func (dht *DHT) UpdateReputation(addr Address, score int) error {
+	return dht.db.UpdateReputation(addr, score)
+}
+
+func (dht *DHT) Reputation(addr Address) (int, error) {
+	return dht.db.Reputation(addr)
+}
+
+func (dht *DHT) PruneOlderThan(d time.Duration) (int, error) {
+	return dht.db.PruneOlderThan(d)
+}
+
+func (dht *DHT) Vacuum() error {
+	return dht.db.Vacuum()
+}
+
+func (dht *DHT) QueryLatest(beforeId, limit int) ([]Entry, int, error) {
+	return dht.db.QueryLatest(beforeId, limit)
+}
+
+func (dht *DHT) QueryBySeedCount(min, max, page int, ascending bool) ([]Entry, error) {
+	return dht.db.QueryBySeedCount(min, max, page, ascending)
+}
+
+func (dht *DHT) Ping() error {
+	return dht.db.Ping()
+}
+
+func (dht *DHT) PingContext(ctx context.Context) error {
+	return dht.db.PingContext(ctx)
+}
+
+func (dht *DHT) SetBucketSize(size int) {
+	dht.db.SetBucketSize(size)
+}
+
+func (dht *DHT) SetQueryCache(size int, ttl time.Duration) {
+	dht.db.SetQueryCache(size, ttl)
+}
+
+func (dht *DHT) CacheStats() CacheStats {
+	return dht.db.CacheStats()
+}
+
+func (dht *DHT) SetLivenessCheck(check func(Address) bool) {
+	dht.db.SetLivenessCheck(check)
+}
+
+func (dht *DHT) Len() (int, error) {
+	return dht.db.Len()
+}
+
+func (dht *DHT) TableLen() int {
+	return dht.db.TableLen()
+}
+
+func (dht *DHT) Coverage() []float64 {
+	return dht.db.Coverage()
+}
+
+func (dht *DHT) CoverageScore() float64 {
+	return dht.db.CoverageScore()
+}
+
 func (dht *DHT) FindClosest(addr Address) (Entries, error) {
 	return dht.db.FindClosest(addr)
 }
 
-func (dht *DHT) SaveTable(path string) {
-	dht.db.SaveTable(path)
+func (dht *DHT) SaveTable(path string) error {
+	return dht.db.SaveTable(path)
+}
+
+func (dht *DHT) LoadTable() {
+	dht.db.LoadTable()
+}
+
+func (dht *DHT) Flush() error {
+	return dht.db.Flush()
+}
+
+func (dht *DHT) StartFlusher(interval time.Duration) {
+	dht.db.StartFlusher(interval)
+}
+
+func (dht *DHT) StopFlusher() error {
+	return dht.db.StopFlusher()
 }
 
-func (dht *DHT) LoadTable(path string) {
-	dht.db.LoadTable(path)
+func (dht *DHT) Close() error {
+	return dht.db.Close()
 }
 
 func (dht *DHT) SearchEntries(name, desc string, page int) ([]Address, error) {
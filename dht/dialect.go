@@ -0,0 +1,72 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"database/sql"
+
+	"github.com/dfindex/dfi/util"
+)
+
+var dialects = util.NewDialects(SqliteDialect{})
+
+// Makes a dialect available to NetDBs using the given driver, see
+// util.Dialect.
+func RegisterDialect(driver string, d util.Dialect) {
+	dialects.Register(driver, d)
+}
+
+type SqliteDialect struct{}
+
+func (SqliteDialect) Setup(conn *sql.DB) error {
+	return nil
+}
+
+func (SqliteDialect) CreateSchema(conn *sql.DB) error {
+	// don't bother preparing these, they are only used at startup
+
+	// create the entries table first, it is most important
+	_, err := conn.Exec(sqlCreateEntriesTable)
+	if err != nil {
+		return err
+	}
+
+	// store seed lists
+	_, err = conn.Exec(sqlCreateSeedsTable)
+	if err != nil {
+		return err
+	}
+
+	// full text search
+	_, err = conn.Exec(sqlCreateFtsTable)
+	if err != nil {
+		return err
+	}
+
+	// speed up entry lookups
+	_, err = conn.Exec(sqlIndexAddresses)
+
+	return err
+}
@@ -25,24 +25,72 @@
 package dht
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/bits"
 	"math/rand"
+	"net"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
 )
 
 const (
 	MaxEntryNameLength          = 32
 	MaxEntryDescLength          = 160
 	MaxEntryPublicAddressLength = 253
-	MaxEntrySeeds               = 100000
+	MaxEntryPublicAddresses     = 8
+
+	// How many seeds, or feeds being seeded, an entry may list unless set
+	// otherwise with SetMaxEntrySeeds. Each is a row in the seed table.
+	DefaultMaxEntrySeeds = 1000
 )
 
+var ErrTooManySeeds = errors.New("Entry has too many seeds")
+var ErrTooLittleWork = errors.New("Entry has too little proof of work")
+var ErrNilEntry = errors.New("Entry is nil")
+
+var maxEntrySeeds int32 = DefaultMaxEntrySeeds
+var minEntryWork int32
+
+// Sets how many seeds an entry may list, anything under 1 is
+// DefaultMaxEntrySeeds. Entries over it are rejected outright, trimming them
+// would break the signature.
+func SetMaxEntrySeeds(max int) {
+	if max < 1 {
+		max = DefaultMaxEntrySeeds
+	}
+
+	atomic.StoreInt32(&maxEntrySeeds, int32(max))
+}
+
+func MaxEntrySeeds() int {
+	return int(atomic.LoadInt32(&maxEntrySeeds))
+}
+
+// Sets the bits of proof of work, see Entry.WorkBits, an entry needs before it
+// is stored. 0 turns it off.
+func SetMinEntryWork(bits int) {
+	if bits < 0 {
+		bits = 0
+	}
+
+	atomic.StoreInt32(&minEntryWork, int32(bits))
+}
+
+func MinEntryWork() int {
+	return int(atomic.LoadInt32(&minEntryWork))
+}
+
 // This is an entry into the DHT. It is used to connect to a peer given just
 // it's DFI address.
 type Entry struct {
@@ -62,14 +110,60 @@ type Entry struct {
 	CollectionHash []byte `json:"collectionHash"`
 	Port           int    `json:"port"`
 
+	// Every address the peer can be reached at, tried in order. Entries from
+	// before this existed only have PublicAddress, see Addresses.
+	PublicAddresses []string `json:"publicAddresses"`
+
 	Seeds   [][]byte `json:"seeds"`
 	Seeding [][]byte `json:"seeding"`
 	Seen    int      `json:"seed"`
 
+	// When set the seeds are signed along with everything else, so nobody
+	// relaying the entry can add their own. Only the owner can then add seeds.
+	SignedSeeds bool `json:"signedSeeds"`
+
+	// Bumped by the owner every time the entry is signed. An entry never
+	// replaces a stored one with a higher version.
+	Version uint64 `json:"version"`
+
+	// Proof of work for this version of the entry, see WorkBits. It isn't
+	// signed, anyone can check it and changing it only makes it worse.
+	Work uint64 `json:"work"`
+
 	// Used in the FindClosest function, for sorting.
 	distance Address
 }
 
+// The number of leading zero bits in the hash of the address, version and
+// Work. The version is in there so the work has to be done again every time
+// the entry is signed, rather than once per address forever.
+func (e Entry) WorkBits() int {
+	buf := make([]byte, len(e.Address.Raw)+16)
+	copy(buf, e.Address.Raw)
+	binary.BigEndian.PutUint64(buf[len(e.Address.Raw):], e.Version)
+	binary.BigEndian.PutUint64(buf[len(e.Address.Raw)+8:], e.Work)
+
+	hash := sha3.Sum256(buf)
+	zeros := 0
+
+	for _, i := range hash {
+		if i != 0 {
+			return zeros + bits.LeadingZeros8(i)
+		}
+
+		zeros += 8
+	}
+
+	return zeros
+}
+
+// Finds a Work giving at least difficulty bits. Each extra bit doubles how long
+// this takes on average.
+func (e *Entry) DoWork(difficulty int) {
+	for e.Work = 0; e.WorkBits() < difficulty; e.Work++ {
+	}
+}
+
 // true if JSON, false if msgpack
 func DecodeEntry(data []byte, isJson bool) (*Entry, error) {
 	var err error
@@ -112,8 +206,16 @@ func (e Entry) String() (string, error) {
 	str += e.Name
 	str += e.Desc
 	str += string(e.PublicAddress)
+
+	// length prefixed so the same bytes can't be split up into different
+	// addresses. Nothing is added when there are none, so older entries still
+	// verify.
+	for _, i := range e.PublicAddresses {
+		str += strconv.Itoa(len(i)) + ":" + i
+	}
+
 	str += string(e.PublicKey)
-	str += string(e.Port)
+	str += string(rune(e.Port))
 	str += postCount
 	str += updated
 	str += string(e.CollectionHash)
@@ -123,11 +225,37 @@ func (e Entry) String() (string, error) {
 	}
 
 	// note that we do not, in fact, sign who the seeds are. This allows others
-	// to build the swarm while this peer is not online.
+	// to build the swarm while this peer is not online. Unless asked to.
+	if e.SignedSeeds {
+		str += "s"
+
+		for _, i := range e.Seeds {
+			str += string(i)
+		}
+	}
+
+	// left out at zero so entries from before versions still verify
+	if e.Version > 0 {
+		str += "v" + strconv.FormatUint(e.Version, 10)
+	}
 
 	return str, nil
 }
 
+// The addresses the peer can be reached at, falling back to PublicAddress for
+// entries that don't list any.
+func (e *Entry) Addresses() []string {
+	if len(e.PublicAddresses) > 0 {
+		return e.PublicAddresses
+	}
+
+	if e.PublicAddress == "" {
+		return nil
+	}
+
+	return []string{e.PublicAddress}
+}
+
 func (e Entry) Encode() ([]byte, error) {
 	return msgpack.Marshal(e)
 }
@@ -171,7 +299,7 @@ func (e Entries) Less(i, j int) bool {
 // most operations on it.
 func (entry *Entry) Verify() error {
 	if entry == nil {
-		return errors.New("Entry is nil")
+		return ErrNilEntry
 	}
 
 	if len(entry.Address.Raw) != 20 {
@@ -186,8 +314,17 @@ func (entry *Entry) Verify() error {
 		return errors.New("Entry description is too long")
 	}
 
-	if len(entry.Seeds) > MaxEntrySeeds {
-		return errors.New("Entry has too many seeds")
+	if len(entry.Seeds) > MaxEntrySeeds() || len(entry.Seeding) > MaxEntrySeeds() {
+		return ErrTooManySeeds
+	}
+
+	// these are stored back to back, so must all be whole addresses
+	if entry.SignedSeeds {
+		for _, i := range entry.Seeds {
+			if len(i) != AddressBinarySize {
+				return errors.New("Signed seed address size invalid")
+			}
+		}
 	}
 
 	if len(entry.PublicKey) < ed25519.PublicKeySize {
@@ -198,6 +335,15 @@ func (entry *Entry) Verify() error {
 		return errors.New("Signature too small")
 	}
 
+	// otherwise anyone could sign an entry for someone else's address with
+	// their own key
+	var owner Address
+	owner.Generate(entry.PublicKey)
+
+	if !owner.Equals(&entry.Address) {
+		return errors.New("Address does not match public key")
+	}
+
 	data, _ := entry.Bytes()
 	verified := ed25519.Verify(entry.PublicKey, data, entry.Signature[:])
 
@@ -205,22 +351,117 @@ func (entry *Entry) Verify() error {
 		return errors.New("Failed to verify signature")
 	}
 
-	if len(entry.PublicAddress) == 0 {
+	if len(entry.Addresses()) == 0 {
 		return errors.New("Public address must be set")
 	}
 
+	if len(entry.PublicAddresses) > MaxEntryPublicAddresses {
+		return errors.New("Entry has too many public addresses")
+	}
+
 	// 253 is the maximum length of a domain name
 	if len(entry.PublicAddress) >= MaxEntryPublicAddressLength {
 		return errors.New("Public address is too large (253 char max)")
 	}
 
+	if entry.Port < 1 {
+		return errors.New("Port too small (" + strconv.Itoa(entry.Port) + ")")
+	}
+
 	if entry.Port > 65535 {
-		return errors.New("Port too large (" + string(entry.Port) + ")")
+		return errors.New("Port too large (" + strconv.Itoa(entry.Port) + ")")
+	}
+
+	for _, i := range entry.Addresses() {
+		if err := CheckPublicAddress(i); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Checks a public address is a host that can be dialled once the entry's port
+// is added: a name or IP, IPv6 optionally bracketed, and no port of its own.
+func CheckPublicAddress(addr string) error {
+	if len(addr) == 0 {
+		return errors.New("Public address must not be empty")
+	}
+
+	if len(addr) >= MaxEntryPublicAddressLength {
+		return errors.New("Public address is too large (253 char max)")
+	}
+
+	host := addr
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	}
+
+	if host == "" || strings.ContainsAny(host, "[]/@ \t\r\n") {
+		return errors.New("Public address is not a host (" + addr + ")")
+	}
+
+	// only IPv6 has colons, anything else is a port tacked on
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return errors.New("Public address must not include a port (" + addr + ")")
+	}
+
+	split, _, err := net.SplitHostPort(net.JoinHostPort(host, "1"))
+
+	if err != nil || split != host {
+		return errors.New("Public address is not a host (" + addr + ")")
+	}
+
+	return nil
+}
+
+// Verifies a batch of entries across a number of goroutines, signature checks
+// are CPU bound so this is a lot quicker than one at a time for big responses.
+// The returned errors line up with the given entries, nil if valid, and
+// ErrNilEntry for any nil entry. If workers is less than one then one is used
+// per CPU.
+func VerifyEntries(entries []*Entry, workers int) []error {
+	errs := make([]error, len(entries))
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for n := range indices {
+				errs[n] = entries[n].Verify()
+			}
+		}()
+	}
+
+	for n, i := range entries {
+		// a peer can send null in a list, no need to hand those out
+		if i == nil {
+			errs[n] = ErrNilEntry
+			continue
+		}
+
+		indices <- n
+	}
+
+	close(indices)
+	wg.Wait()
+
+	return errs
+}
+
 func ShuffleEntries(slice Entries) {
 	for i := range slice {
 		j := rand.Intn(i + 1)
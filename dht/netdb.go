@@ -25,22 +25,61 @@
 package dht
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/util"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
+	// Addresses kept in each bucket of the routing table, unless set otherwise
+	// with SetBucketSize.
 	BucketSize = 20
+
+	// Entries in each page of QueryLatest, unless asked for otherwise.
+	LatestPageSize = 20
+
+	// Number of results in each page of a peer search.
+	SearchPageSize = 25
+
+	// How often the in-memory routing table is written to disk, if it has
+	// changed.
+	DefaultTableFlushInterval = time.Second * 5
 )
 
 type NetDB struct {
-	table [][]Address
-	addr  Address
-	conn  *sql.DB
+	// Buckets are never changed in place, a changed one is a new slice. Hold
+	// tableLock to read or swap them, not while using one.
+	table     [][]Address
+	tableLock sync.RWMutex
+	addr      Address
+	conn      *sql.DB
+	tablePath string
+
+	bucketSize int
+
+	// Set whenever the table changes, cleared once it has been saved.
+	tableDirty bool
+	dirtyLock  sync.Mutex
+	flushStop  chan bool
+	flushDone  chan bool
+
+	closed    bool
+	closeLock sync.Mutex
+
+	// as with data.Database, read locked by transactions and write locked by
+	// Vacuum
+	txLock sync.RWMutex
 
 	stmtInsertEntry      *sql.Stmt
 	stmtInsertFtsEntry   *sql.Stmt
@@ -53,13 +92,44 @@ type NetDB struct {
 	stmtQuerySeeding     *sql.Stmt
 	stmtQueryLatest      *sql.Stmt
 	stmtSearchPeer       *sql.Stmt
+
+	stmtUpdateLastQueried *sql.Stmt
+	stmtQueryLastQueried  *sql.Stmt
+
+	// Asked whether the oldest peer in a full bucket is still about before it
+	// is replaced. Nil means always replace.
+	livenessCheck func(Address) bool
+
+	// The newest address waiting to get into each full bucket while its oldest
+	// peer is checked, by bucket index. Guarded by tableLock.
+	pending map[int]Address
+	checks  sync.WaitGroup
+
+	// Store addresses as raw bytes rather than encoded, see SetRawAddresses.
+	rawAddresses bool
+
+	// recent Query results, see SetQueryCache
+	cache *entryCache
 }
 
-func NewNetDB(addr Address, path string) (*NetDB, error) {
+// Path is the sqlite database, tablePath is where the routing table is saved
+// to and loaded from.
+func NewNetDB(addr Address, path, tablePath string) (*NetDB, error) {
+	return NewNetDBDriver(util.DefaultDriver, addr, path, tablePath)
+}
+
+// A NetDB using any driver there is a dialect for, see RegisterDialect. For
+// sqlite the path is the file, for others it is whatever the driver takes to
+// connect.
+func NewNetDBDriver(driver string, addr Address, path, tablePath string) (*NetDB, error) {
 	var err error
 
 	ret := &NetDB{}
 	ret.addr = addr
+	ret.tablePath = tablePath
+	ret.bucketSize = BucketSize
+	ret.cache = newEntryCache(DefaultQueryCacheSize, DefaultQueryCacheTTL)
+	ret.pending = make(map[int]Address)
 
 	// One bucket of addresses per bit in an address
 	// At the time of writing, uses roughly 64KB of memory
@@ -67,37 +137,30 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 
 	// allocate each bucket
 	for n, _ := range ret.table {
-		ret.table[n] = make([]Address, 0, BucketSize)
+		ret.table[n] = make([]Address, 0, ret.bucketSize)
 	}
 
-	ret.conn, err = sql.Open("sqlite3", path)
-
+	dialect, err := dialects.Get(driver)
 	if err != nil {
 		return nil, err
 	}
 
-	// don't bother preparing these, they are only used at startup
-
-	// create the entries table first, it is most important
-	_, err = ret.conn.Exec(sqlCreateEntriesTable)
+	ret.conn, err = sql.Open(driver, path)
 	if err != nil {
 		return nil, err
 	}
 
-	// store seed lists
-	_, err = ret.conn.Exec(sqlCreateSeedsTable)
+	err = dialect.Setup(ret.conn)
 	if err != nil {
 		return nil, err
 	}
 
-	// full text search
-	_, err = ret.conn.Exec(sqlCreateFtsTable)
+	err = dialect.CreateSchema(ret.conn)
 	if err != nil {
 		return nil, err
 	}
 
-	// speed up entry lookups
-	_, err = ret.conn.Exec(sqlIndexAddresses)
+	err = util.Migrate(ret.conn, migrations)
 	if err != nil {
 		return nil, err
 	}
@@ -158,11 +221,175 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 		return nil, err
 	}
 
+	ret.stmtUpdateLastQueried, err = ret.conn.Prepare(sqlUpdateLastQueried)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.stmtQueryLastQueried, err = ret.conn.Prepare(sqlQueryLastQueried)
+	if err != nil {
+		return nil, err
+	}
+
 	return ret, nil
 }
 
+// Addresses are stored encoded by default, as it makes debugging far easier.
+// Raw storage skips encoding and decoding on every lookup. Existing rows are
+// converted to the new mode, so this can be switched either way.
+func (ndb *NetDB) SetRawAddresses(raw bool) error {
+	// rows still in the other format
+	from := "blob"
+	if raw {
+		from = "text"
+	}
+
+	ndb.txLock.RLock()
+	defer ndb.txLock.RUnlock()
+
+	tx, err := ndb.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(sqlQueryAddressesByType, from)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	converted := make(map[int]interface{})
+
+	for rows.Next() {
+		id := 0
+		s := ""
+
+		if err = rows.Scan(&id, &s); err != nil {
+			break
+		}
+
+		var addr Address
+		addr, err = ndb.loadAddress(s)
+
+		if err != nil {
+			break
+		}
+
+		if raw {
+			converted[id] = addr.Raw
+		} else {
+			converted[id], err = addr.String()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+	rows.Close()
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for id, stored := range converted {
+		if _, err = tx.Exec(sqlUpdateAddress, stored, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(converted) > 0 {
+		log.WithField("entries", len(converted)).Info("Converted stored addresses")
+	}
+
+	ndb.rawAddresses = raw
+
+	return nil
+}
+
+// The address as it is kept in the database, depending on the storage mode.
+func (ndb *NetDB) storedAddress(addr Address) (interface{}, error) {
+	if !ndb.rawAddresses {
+		return addr.String()
+	}
+
+	if len(addr.Raw) != AddressBinarySize {
+		return nil, errors.New("Address size invalid")
+	}
+
+	return addr.Raw, nil
+}
+
+// The opposite of storedAddress. Rows are told apart by length rather than by
+// the mode, as converting reads rows stored the other way.
+func (ndb *NetDB) loadAddress(stored string) (Address, error) {
+	if len(stored) == AddressBinarySize {
+		return Address{Raw: []byte(stored)}, nil
+	}
+
+	return DecodeAddress(stored)
+}
+
+// Signed seeds are stored one raw address after the other.
+func joinSeeds(entry Entry) []byte {
+	if !entry.SignedSeeds {
+		return nil
+	}
+
+	ret := make([]byte, 0, len(entry.Seeds)*AddressBinarySize)
+
+	for _, i := range entry.Seeds {
+		ret = append(ret, i...)
+	}
+
+	return ret
+}
+
+func splitSeeds(joined []byte) [][]byte {
+	ret := make([][]byte, 0, len(joined)/AddressBinarySize)
+
+	for i := 0; i+AddressBinarySize <= len(joined); i += AddressBinarySize {
+		seed := make([]byte, AddressBinarySize)
+		copy(seed, joined[i:i+AddressBinarySize])
+		ret = append(ret, seed)
+	}
+
+	return ret
+}
+
+// Public addresses are stored JSON encoded, or empty if there are none.
+func encodeAddressList(addrs []string) (string, error) {
+	if len(addrs) == 0 {
+		return "", nil
+	}
+
+	enc, err := json.Marshal(addrs)
+	return string(enc), err
+}
+
+func decodeAddressList(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var addrs []string
+	err := json.Unmarshal([]byte(s), &addrs)
+
+	return addrs, err
+}
+
 // Get the total size of the in-memory routing table
 func (ndb *NetDB) TableLen() int {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
 	size := 0
 
 	for _, i := range ndb.table {
@@ -172,6 +399,47 @@ func (ndb *NetDB) TableLen() int {
 	return size
 }
 
+// How full each bucket of the routing table is, from 0 to 1. Bucket n holds
+// peers whose distance from us has n leading zero bits.
+func (ndb *NetDB) Coverage() []float64 {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
+	ret := make([]float64, len(ndb.table))
+
+	for n, i := range ndb.table {
+		ret[n] = float64(len(i)) / float64(ndb.bucketSize)
+	}
+
+	return ret
+}
+
+// A single figure from 0 to 1 for how well the routing table covers the
+// keyspace. Buckets closer to us than the nearest peer we know of can't be
+// expected to have anything in them, so this is the average fill of every
+// bucket up to and including that one. Gaps in the far buckets drag it down.
+func (ndb *NetDB) CoverageScore() float64 {
+	coverage := ndb.Coverage()
+
+	deepest := -1
+	for n, i := range coverage {
+		if i > 0 {
+			deepest = n
+		}
+	}
+
+	if deepest == -1 {
+		return 0
+	}
+
+	total := 0.0
+	for _, i := range coverage[:deepest+1] {
+		total += i
+	}
+
+	return total / float64(deepest+1)
+}
+
 // Get the total number of entries we have stored
 func (ndb *NetDB) Len() (int, error) {
 	var length int
@@ -192,51 +460,193 @@ func (ndb *NetDB) insertIntoTable(addr Address) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := addr.Xor(&ndb.addr).LeadingZeroes()
+
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
+
 	bucket := ndb.table[index]
 
 	// there is capacity, insert at the front
 	// search to see if it is already inserted
+	found := indexOf(bucket, addr)
+
+	// if it already exists, it first needs to be removed from it's old position.
+	// This builds a new slice, as whoever called Query may be iterating over
+	// the old one.
+	if found != -1 {
+		bucket = append(append([]Address{}, bucket[:found]...), bucket[found+1:]...)
+	} else if len(bucket) >= ndb.bucketSize {
+		// Long lived peers are the most likely to stick around, so only make
+		// room if the oldest one has gone. The check can take a while, so the
+		// new one waits for it in the background, anything arriving for the
+		// bucket meanwhile taking its place.
+		if ndb.livenessCheck != nil {
+			_, checking := ndb.pending[index]
+			ndb.pending[index] = addr
+
+			if !checking {
+				ndb.checks.Add(1)
+				go ndb.checkOldest(index, bucket[len(bucket)-1])
+			}
+
+			return
+		}
 
-	found := -1
+		// remove the back of the bucket, this update will go at the front
+		bucket = bucket[:ndb.bucketSize-1]
+	}
+
+	ndb.table[index] = append([]Address{addr}, bucket...)
+
+	ndb.markDirty()
+}
+
+// Runs the liveness check on the oldest peer of a full bucket. If it's still
+// about it is refreshed and the pending address dropped, otherwise the pending
+// address replaces it.
+func (ndb *NetDB) checkOldest(index int, oldest Address) {
+	defer ndb.checks.Done()
 
+	alive := ndb.livenessCheck(oldest)
+
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
+
+	addr := ndb.pending[index]
+	delete(ndb.pending, index)
+
+	// the bucket may well have changed while we were waiting
+	bucket := ndb.table[index]
+
+	if indexOf(bucket, addr) != -1 {
+		return
+	}
+
+	if found := indexOf(bucket, oldest); found != -1 {
+		bucket = append(append([]Address{}, bucket[:found]...), bucket[found+1:]...)
+
+		if alive {
+			addr = oldest
+		}
+	} else if len(bucket) >= ndb.bucketSize {
+		return
+	}
+
+	ndb.table[index] = append([]Address{addr}, bucket...)
+
+	ndb.markDirty()
+}
+
+func indexOf(bucket []Address, addr Address) int {
 	for n, i := range bucket {
 		if i.Equals(&addr) {
-			found = n
-			break
+			return n
 		}
 	}
 
-	// if it already exists, it first needs to be removed from it's old position
-	if found != -1 {
-		bucket = append(bucket[:found], bucket[found+1:]...)
-	} else if len(bucket) == BucketSize {
+	return -1
+}
 
-		// remove the back of the bucket, this update will go at the front
-		bucket = bucket[:len(bucket)-1]
+// The bucket as it is now, safe to range over while the table changes.
+func (ndb *NetDB) getBucket(index int) []Address {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
+	return ndb.table[index]
+}
+
+// Checks the connection still answers a trivial query.
+func (ndb *NetDB) Ping() error {
+	return ndb.PingContext(context.Background())
+}
+
+// Ping, but interrupted once ctx is done. See data.Database.PingContext.
+func (ndb *NetDB) PingContext(ctx context.Context) error {
+	_, err := ndb.conn.ExecContext(ctx, "SELECT 1")
+
+	return err
+}
+
+// Sets how many addresses each bucket holds, anything under 1 is BucketSize.
+// Buckets already over the new size lose their oldest addresses.
+func (ndb *NetDB) SetBucketSize(size int) {
+	if size < 1 {
+		size = BucketSize
 	}
 
-	bucket = append([]Address{addr}, bucket...)
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
 
-	ndb.table[index] = bucket
+	ndb.bucketSize = size
 
-	ndb.SaveTable("./data/table.dat")
+	for n, i := range ndb.table {
+		if len(i) > size {
+			ndb.table[n] = append([]Address{}, i[:size]...)
+			ndb.markDirty()
+		}
+	}
+}
+
+func (ndb *NetDB) BucketSize() int {
+	ndb.tableLock.RLock()
+	defer ndb.tableLock.RUnlock()
+
+	return ndb.bucketSize
+}
+
+// Sets the function used to check whether the oldest peer in a full bucket is
+// still alive, before it is evicted for a new one. It's run in the background,
+// inserts don't wait on it.
+func (ndb *NetDB) SetLivenessCheck(check func(Address) bool) {
+	ndb.livenessCheck = check
+}
+
+// Removes an address from its bucket in the routing table, if it is there.
+func (ndb *NetDB) removeFromTable(addr Address) {
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
+
+	index := addr.Xor(&ndb.addr).LeadingZeroes()
+	bucket := ndb.table[index]
+
+	for n, i := range bucket {
+		if i.Equals(&addr) {
+			ndb.table[index] = append(append([]Address{}, bucket[:n]...), bucket[n+1:]...)
+			ndb.markDirty()
+			return
+		}
+	}
+}
+
+// Lets the same code run statements either directly or within a transaction.
+type stmtFunc func(*sql.Stmt) *sql.Stmt
+
+func direct(s *sql.Stmt) *sql.Stmt {
+	return s
 }
 
 // Returns updated, inserted. One should be zero.
-func (ndb *NetDB) insertIntoDB(entry Entry) (int64, error) {
+func (ndb *NetDB) insertIntoDB(entry Entry, st stmtFunc) (int64, error) {
 
-	addressString, err := entry.Address.String()
+	storedAddress, err := ndb.storedAddress(entry.Address)
+
+	if err != nil {
+		return 0, err
+	}
+
+	publicAddresses, err := encodeAddressList(entry.PublicAddresses)
 
 	if err != nil {
 		return 0, err
 	}
 
 	// Insert the entry into the main entry table
-	res, err := ndb.stmtInsertEntry.Exec(addressString, entry.Name, entry.Desc,
+	res, err := st(ndb.stmtInsertEntry).Exec(storedAddress, entry.Name, entry.Desc,
 		entry.PublicAddress, entry.Port, entry.PublicKey,
 		entry.Signature, entry.CollectionHash,
 		entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen)
+		entry.Updated, entry.Seen, publicAddresses, entry.Version,
+		entry.SignedSeeds, joinSeeds(entry), entry.Work)
 
 	if err != nil {
 		return 0, err
@@ -258,24 +668,29 @@ func (ndb *NetDB) insertIntoDB(entry Entry) (int64, error) {
 		return 0, err
 	}
 
-	res, err = ndb.stmtInsertFtsEntry.Exec(id, entry.Name, entry.Desc)
+	res, err = st(ndb.stmtInsertFtsEntry).Exec(id, entry.Name, entry.Desc)
 
 	return affected, err
 }
 
-func (ndb *NetDB) insertEntrySeeds(entry Entry) error {
+func (ndb *NetDB) insertEntrySeeds(entry Entry, st stmtFunc) error {
 	// if that is all ok, then we can register all the seeds in the seed table
 	// fun thing about this table, it can be used to populate both Seeds and
 	// Seeding :D
 	// Also need to make sure to not insert duplicates. SQL constraints should
 	// do that for me. Woop woop!
 
+	// Verify checks this too, but a row each is too much to risk
+	if len(entry.Seeds) > MaxEntrySeeds() || len(entry.Seeding) > MaxEntrySeeds() {
+		return ErrTooManySeeds
+	}
+
 	// first, register all the seeds for peers we are a seed for
 	for _, i := range entry.Seeding {
 		peer := Address{Raw: i}
 
 		// we are a seed for this peer
-		err := ndb.InsertSeed(peer, entry.Address)
+		err := ndb.insertSeed(peer, entry.Address, st)
 
 		if err != nil {
 			return err
@@ -286,81 +701,414 @@ func (ndb *NetDB) insertEntrySeeds(entry Entry) error {
 	for _, i := range entry.Seeds {
 		peer := Address{Raw: i}
 
-		// the peer is a seed for us
-		err := ndb.InsertSeed(entry.Address, peer)
+		// the peer is a seed for us
+		err := ndb.insertSeed(entry.Address, peer, st)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ndb *NetDB) InsertSeed(entry Address, seed Address) error {
+	return ndb.insertSeed(entry, seed, direct)
+}
+
+func (ndb *NetDB) insertSeed(entry Address, seed Address, st stmtFunc) error {
+	// First we need to map the addresses, which are essentially a network-wide
+	// id, to an integer id which is local to our database.
+	entryStored, err := ndb.storedAddress(entry)
+
+	if err != nil {
+		return err
+	}
+
+	seedStored, err := ndb.storedAddress(seed)
+
+	if err != nil {
+		return err
+	}
+
+	entryIdRes := st(ndb.stmtQueryIdByAddress).QueryRow(entryStored)
+	seedIdRes := st(ndb.stmtQueryIdByAddress).QueryRow(seedStored)
+
+	entryId := -1
+	seedId := -1
+
+	err = entryIdRes.Scan(&entryId)
+	if err != nil {
+		return err
+	}
+
+	err = seedIdRes.Scan(&seedId)
+	if err != nil {
+		return err
+	}
+
+	// got the ids, so now insert them into the database!
+	_, err = st(ndb.stmtInsertSeed).Exec(seedId, entryId)
+	ndb.cache.remove(entry, seed)
+
+	return err
+}
+
+// Undoes InsertSeed, nothing happens if seed wasn't a seed for entry.
+func (ndb *NetDB) RemoveSeed(entry Address, seed Address) (err error) {
+	ids := make([]int, 0, 2)
+
+	ndb.txLock.RLock()
+	defer ndb.txLock.RUnlock()
+
+	tx, err := ndb.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+		ndb.cache.remove(entry, seed)
+	}()
+
+	for _, i := range []Address{seed, entry} {
+		stored, err := ndb.storedAddress(i)
+
+		if err != nil {
+			return err
+		}
+
+		id := -1
+		err = tx.QueryRow(sqlQueryIdByAddress, stored).Scan(&id)
+
+		if err == sql.ErrNoRows {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, id)
+	}
+
+	seedId, entryId := ids[0], ids[1]
+	res, err := tx.Exec(sqlDeleteSeed, seedId, entryId)
+
+	if err != nil {
+		return err
+	}
+
+	if removed, err := res.RowsAffected(); err != nil || removed == 0 {
+		return err
+	}
+
+	if _, err = tx.Exec(sqlDecrementSeedingCount, seedId); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(sqlDecrementSeedCount, entryId)
+
+	return err
+}
+
+// Inserts an entry into both the routing table and the database
+// Returns number of affected entries and error
+func (ndb *NetDB) Insert(entry Entry) (int64, error) {
+	err := entry.Verify()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = ndb.checkWork(&entry); err != nil {
+		return 0, err
+	}
+
+	log.WithField("peer", entry.Address.StringOr("")).Debug("Inserting into NetDB")
+
+	ndb.insertIntoTable(entry.Address)
+
+	// attempts to update, if this fails then the insert succeeds. Otherwise it
+	// is updated and the insert fails
+	affected, err := ndb.insertOrUpdate(entry, direct)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	ndb.cache.remove(entry.Address)
+
+	return affected, err
+}
+
+// Entries need enough proof of work to be stored, however they reached us.
+// Ours is the exception, it never needs to convince us.
+func (ndb *NetDB) checkWork(entry *Entry) error {
+	if entry.WorkBits() < MinEntryWork() && !entry.Address.Equals(&ndb.addr) {
+		return ErrTooLittleWork
+	}
+
+	return nil
+}
+
+func (ndb *NetDB) insertOrUpdate(entry Entry, st stmtFunc) (int64, error) {
+	affected, err := ndb.update(entry, st)
+	if err != nil {
+		return 0, err
+	}
+
+	if affected > 0 {
+		return affected, nil
+	}
+
+	affected, err = ndb.insertIntoDB(entry, st)
+	if err != nil {
+		return 0, err
+	}
+
+	// already stored with a newer version, leave it be
+	if affected == 0 {
+		return 0, nil
+	}
+
+	return affected, ndb.insertEntrySeeds(entry, st)
+}
+
+// Inserts a batch of entries in a single transaction, as is done after a
+// bootstrap. If any entry is invalid nothing is inserted, those with too little
+// proof of work are just left out. Returns the total number of affected rows.
+func (ndb *NetDB) InsertMany(entries []Entry) (affected int64, err error) {
+	ptrs := make([]*Entry, len(entries))
+	for n := range entries {
+		ptrs[n] = &entries[n]
+	}
+
+	for _, err = range VerifyEntries(ptrs, 0) {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	worked := make([]Entry, 0, len(entries))
+	for _, i := range entries {
+		if ndb.checkWork(&i) == nil {
+			worked = append(worked, i)
+		}
+	}
+
+	ndb.txLock.RLock()
+	defer ndb.txLock.RUnlock()
+
+	tx, err := ndb.conn.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, i := range worked {
+		n, err := ndb.insertOrUpdate(i, tx.Stmt)
+
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		affected += n
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// only once everything is safely stored
+	for _, i := range worked {
+		ndb.cache.remove(i.Address)
+		ndb.insertIntoTable(i.Address)
+	}
+
+	return affected, nil
+}
+
+// Removes an entry, its search index and any seed relationships it is part of
+// from the database, and takes it out of the routing table. Returns the total
+// number of rows removed.
+func (ndb *NetDB) DeleteEntry(addr Address) (removed int64, err error) {
+	storedAddress, err := ndb.storedAddress(addr)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ndb.txLock.RLock()
+	defer ndb.txLock.RUnlock()
+
+	tx, err := ndb.conn.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			removed = 0
+			return
+		}
+
+		err = tx.Commit()
+
+		// the seeds and seeding of others may have changed too
+		ndb.cache.clear()
+	}()
+
+	var id int
+	err = tx.QueryRow(sqlQueryIdByAddress, storedAddress).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		// not in the db, but it may still be in the table
+		err = nil
+		ndb.removeFromTable(addr)
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, i := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{sqlDeleteFtsEntry, []interface{}{id}},
+		{sqlDeleteSeeds, []interface{}{id, id}},
+		{sqlDeleteEntry, []interface{}{id}},
+	} {
+		res, err := tx.Exec(i.query, i.args...)
+
+		if err != nil {
+			return 0, err
+		}
+
+		affected, err := res.RowsAffected()
 
 		if err != nil {
-			return err
+			return 0, err
 		}
+
+		removed += affected
 	}
 
-	return nil
+	ndb.removeFromTable(addr)
+
+	return
 }
 
-func (ndb *NetDB) InsertSeed(entry Address, seed Address) error {
-	// First we need to map the addresses, which are essentially a network-wide
-	// id, to an integer id which is local to our database.
-	entryAddressString, err := entry.String()
-	seedAddressString, err := seed.String()
+// Records that a peer was seen at the given unix time.
+func (ndb *NetDB) UpdateSeen(addr Address, seen int64) error {
+	storedAddress, err := ndb.storedAddress(addr)
 
 	if err != nil {
 		return err
 	}
 
-	entryIdRes := ndb.stmtQueryIdByAddress.QueryRow(entryAddressString)
-	seedIdRes := ndb.stmtQueryIdByAddress.QueryRow(seedAddressString)
+	_, err = ndb.conn.Exec(sqlUpdateSeen, seen, storedAddress)
+	ndb.cache.remove(addr)
 
-	entryId := -1
-	seedId := -1
+	return err
+}
 
-	err = entryIdRes.Scan(&entryId)
-	if err != nil {
-		return err
-	}
+// Stores how much we trust a peer, nothing happens if it has no entry.
+func (ndb *NetDB) UpdateReputation(addr Address, score int) error {
+	storedAddress, err := ndb.storedAddress(addr)
 
-	err = seedIdRes.Scan(&seedId)
 	if err != nil {
 		return err
 	}
 
-	// got the ids, so now insert them into the database!
-	_, err = ndb.stmtInsertSeed.Exec(seedId, entryId)
+	_, err = ndb.conn.Exec(sqlUpdateReputation, score, storedAddress)
 
 	return err
 }
 
-// Inserts an entry into both the routing table and the database
-// Returns number of affected entries and error
-func (ndb *NetDB) Insert(entry Entry) (int64, error) {
-	err := entry.Verify()
+// How much we trust a peer, 0 if it has no entry.
+func (ndb *NetDB) Reputation(addr Address) (int, error) {
+	storedAddress, err := ndb.storedAddress(addr)
 
 	if err != nil {
 		return 0, err
 	}
 
-	log.WithField("peer", entry.Address.StringOr("")).Debug("Inserting into NetDB")
+	score := 0
+	err = ndb.conn.QueryRow(sqlQueryReputation, storedAddress).Scan(&score)
 
-	ndb.insertIntoTable(entry.Address)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return score, err
+}
+
+// Removes every entry that has not been seen or updated within d, returning
+// how many were removed. Our own entry is always kept.
+func (ndb *NetDB) PruneOlderThan(d time.Duration) (int, error) {
+	cutoff := time.Now().Add(-d).Unix()
+
+	self, err := ndb.storedAddress(ndb.addr)
 
-	// attempts to update, if this fails then the insert succeeds. Otherwise it
-	// is updated and the insert fails
-	affected, err := ndb.Update(entry)
 	if err != nil {
-		log.Error(err.Error())
 		return 0, err
 	}
 
-	if affected > 0 {
-		return affected, nil
-	}
+	rows, err := ndb.conn.Query(sqlQueryStale, cutoff, self)
 
-	affected, err = ndb.insertIntoDB(entry)
 	if err != nil {
-		log.Error(err.Error())
 		return 0, err
 	}
 
-	return affected, ndb.insertEntrySeeds(entry)
+	stale := make([]Address, 0)
+
+	for rows.Next() {
+		s := ""
+
+		if err = rows.Scan(&s); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		addr, err := ndb.loadAddress(s)
+
+		if err != nil {
+			continue
+		}
+
+		stale = append(stale, addr)
+	}
+	rows.Close()
+
+	count := 0
+	for _, i := range stale {
+		if i.Equals(&ndb.addr) {
+			continue
+		}
+
+		removed, err := ndb.DeleteEntry(i)
+
+		if err != nil {
+			return count, err
+		}
+
+		if removed > 0 {
+			count += 1
+		}
+	}
+
+	return count, nil
 }
 
 func (ndb *NetDB) Update(entry Entry) (int64, error) {
@@ -370,16 +1118,31 @@ func (ndb *NetDB) Update(entry Entry) (int64, error) {
 		return 0, err
 	}
 
-	addressString, err := entry.Address.String()
+	affected, err := ndb.update(entry, direct)
+	ndb.cache.remove(entry.Address)
+
+	return affected, err
+}
+
+// Expects the entry to have been verified already.
+func (ndb *NetDB) update(entry Entry, st stmtFunc) (int64, error) {
+	storedAddress, err := ndb.storedAddress(entry.Address)
+
+	if err != nil {
+		return 0, err
+	}
+
+	publicAddresses, err := encodeAddressList(entry.PublicAddresses)
 
 	if err != nil {
 		return 0, err
 	}
 
-	res, err := ndb.stmtUpdateEntry.Exec(entry.Name, entry.Desc, entry.PublicAddress,
+	res, err := st(ndb.stmtUpdateEntry).Exec(entry.Name, entry.Desc, entry.PublicAddress,
 		entry.Port, entry.PublicKey, entry.Signature,
 		entry.CollectionHash, entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen, addressString)
+		entry.Updated, entry.Seen, publicAddresses, entry.Version,
+		entry.SignedSeeds, joinSeeds(entry), entry.Work, storedAddress, entry.Version)
 
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -394,25 +1157,48 @@ func (ndb *NetDB) Update(entry Entry) (int64, error) {
 	return affected, err
 }
 
-// Returns the KeyValue if this node has the address, nil if not, and err otherwise
+// Returns the KeyValue if this node has the address, nil if not, and err otherwise.
+// Results are cached for a short while, and lastQueried is only bumped on a
+// miss, which is close enough for a rough popularity.
 func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
-	addressString, err := addr.String()
+	return ndb.query(addr, true)
+}
+
+// Query for our own use, like answering FindClosest. Those aren't anyone looking
+// the entry up, so it isn't counted as popular, or cached for when they do.
+func (ndb *NetDB) lookup(addr Address) (*Entry, int, error) {
+	return ndb.query(addr, false)
+}
+
+func (ndb *NetDB) query(addr Address, queried bool) (*Entry, int, error) {
+	if entry, id, ok := ndb.cache.get(addr); ok {
+		// still keeps it easy to access
+		if queried {
+			ndb.insertIntoTable(entry.Address)
+		}
+		return entry, id, nil
+	}
+
+	storedAddress, err := ndb.storedAddress(addr)
 
 	if err != nil {
 		return nil, -1, err
 	}
 
 	ret := Entry{}
-	row := ndb.stmtQueryAddress.QueryRow(addressString)
+	row := ndb.stmtQueryAddress.QueryRow(storedAddress)
 
 	id := 0
 	seedCount := 0
 	seedingCount := 0
 	address := ""
+	publicAddresses := ""
+	var seedList []byte
 
 	err = row.Scan(&id, &address, &ret.Name, &ret.Desc, &ret.PublicAddress,
 		&ret.Port, &ret.PublicKey, &ret.Signature, &ret.CollectionHash,
-		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen)
+		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen,
+		&publicAddresses, &ret.Version, &ret.SignedSeeds, &seedList, &ret.Work)
 
 	if err == sql.ErrNoRows {
 		return nil, -1, nil
@@ -422,7 +1208,13 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 		return nil, -1, err
 	}
 
-	decoded, err := DecodeAddress(address)
+	ret.PublicAddresses, err = decodeAddressList(publicAddresses)
+
+	if err != nil {
+		return nil, -1, err
+	}
+
+	decoded, err := ndb.loadAddress(address)
 
 	if err != nil {
 		return nil, -1, err
@@ -431,20 +1223,43 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 	ret.Address.Raw = make([]byte, len(decoded.Raw))
 	copy(ret.Address.Raw, decoded.Raw)
 
-	err = ndb.addSeedToEntry(&ret, seedCount, seedingCount, id)
+	if queried {
+		_, err = ndb.stmtUpdateLastQueried.Exec(time.Now().Unix(), id)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	err = ndb.addSeedToEntry(&ret, seedCount, seedingCount, id, seedList)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	if !queried {
+		return &ret, id, nil
+	}
+
+	ndb.cache.put(&ret, id)
+
 	// resinsert into the table, this keeps popular things easy to access
-	// TODO: Store some sort of "lastQueried" in the database, then we have
-	// even more data on how popular something is.
 	// TODO: Make sure I'm not storing too much in the database :P
 	ndb.insertIntoTable(ret.Address)
 	return &ret, id, nil
 }
 
-func (ndb *NetDB) addSeedToEntry(e *Entry, seedCount, seedingCount, id int) error {
+// Sets how many Query results are kept and for how long, emptying the cache.
+// A size or ttl under 1 turns it off.
+func (ndb *NetDB) SetQueryCache(size int, ttl time.Duration) {
+	ndb.cache.configure(size, ttl)
+}
+
+func (ndb *NetDB) CacheStats() CacheStats {
+	return ndb.cache.stats()
+}
+
+// Signed seeds are kept with the entry exactly as they were signed, as the seed
+// table can hold seeds that others have told us about.
+func (ndb *NetDB) addSeedToEntry(e *Entry, seedCount, seedingCount, id int, seedList []byte) error {
 	e.Seeding = make([][]byte, 0, seedingCount)
 	e.Seeds = make([][]byte, 0, seedCount)
 
@@ -460,8 +1275,12 @@ func (ndb *NetDB) addSeedToEntry(e *Entry, seedCount, seedingCount, id int) erro
 		return err
 	}
 
-	for _, i := range seeds {
-		e.Seeds = append(e.Seeds, i.Raw)
+	if e.SignedSeeds {
+		e.Seeds = splitSeeds(seedList)
+	} else {
+		for _, i := range seeds {
+			e.Seeds = append(e.Seeds, i.Raw)
+		}
 	}
 
 	for _, i := range seeding {
@@ -494,7 +1313,7 @@ func (ndb *NetDB) querySeeds(id int) ([]Address, error) {
 		}
 
 		// decode the address
-		addr, err := DecodeAddress(address)
+		addr, err := ndb.loadAddress(address)
 		if err != nil {
 			return nil, err
 		}
@@ -525,7 +1344,7 @@ func (ndb *NetDB) querySeeding(id int) ([]Address, error) {
 		}
 
 		// decode the address
-		addr, err := DecodeAddress(address)
+		addr, err := ndb.loadAddress(address)
 		if err != nil {
 			return nil, err
 		}
@@ -539,7 +1358,7 @@ func (ndb *NetDB) querySeeding(id int) ([]Address, error) {
 // Fetch the seeds for an entry, given its address
 func (ndb *NetDB) QuerySeeds(addr Address) ([]Address, error) {
 	// get the entry and ID
-	_, id, err := ndb.Query(addr)
+	_, id, err := ndb.lookup(addr)
 
 	if err != nil {
 		return nil, err
@@ -553,7 +1372,7 @@ func (ndb *NetDB) QuerySeeds(addr Address) ([]Address, error) {
 
 func (ndb *NetDB) QuerySeeding(addr Address) ([]Address, error) {
 	// get the entry and ID
-	_, id, err := ndb.Query(addr)
+	_, id, err := ndb.lookup(addr)
 
 	if err != nil {
 		return nil, err
@@ -567,9 +1386,10 @@ func (ndb *NetDB) queryAddresses(as []Address) Entries {
 	ret := make(Entries, 0, len(as))
 
 	for _, i := range as {
-		kv, _, err := ndb.Query(i)
+		kv, _, err := ndb.lookup(i)
 
-		if err != nil {
+		// the table can hold addresses that are no longer stored
+		if err != nil || kv == nil {
 			continue
 		}
 
@@ -583,102 +1403,253 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
 	index := addr.Xor(&ndb.addr).LeadingZeroes()
-	bucket := ndb.table[index]
+	bucket := ndb.getBucket(index)
+	size := ndb.BucketSize()
 
-	if len(bucket) == BucketSize {
-		return ndb.queryAddresses(bucket), nil
+	if len(bucket) >= size {
+		return sortByDistance(addr, ndb.queryAddresses(bucket)), nil
 	}
 
-	ret := make(Entries, 0, BucketSize)
+	ret := make(Entries, 0, size)
+
+	// Adds as much of a bucket as there is room for, if there isn't room for
+	// all of it then the most recently queried entries win.
+	collect := func(bucket []Address) {
+		remaining := size - len(ret)
+
+		if remaining <= 0 {
+			return
+		}
+
+		if len(bucket) > remaining {
+			bucket = ndb.mostRecentlyQueried(bucket)[:remaining]
+		}
+
+		for _, i := range bucket {
+			kv, _, err := ndb.lookup(i)
+
+			if err != nil || kv == nil {
+				continue
+			}
+
+			ret = append(ret, kv)
+		}
+	}
 
 	// Start with bucket, copy all across, then move left outwards checking all
 	// other buckets.
 	for i := 0; (index-i >= 0 || index+i <= len(addr.Raw)*8) &&
-		len(ret) < BucketSize; i++ {
+		len(ret) < size; i++ {
 
 		if index-i >= 0 {
-			bucket = ndb.table[index-i]
+			collect(ndb.getBucket(index - i))
+		}
 
-			for _, i := range bucket {
-				if len(ret) >= BucketSize {
-					break
-				}
+		if i != 0 && index+i < len(addr.Raw)*8 {
+			collect(ndb.getBucket(index + i))
+		}
+	}
 
-				kv, _, err := ndb.Query(i)
+	return sortByDistance(addr, ret), nil
+}
 
-				if err != nil {
-					continue
-				}
+// Sorts entries so the closest to addr is first.
+func sortByDistance(addr Address, entries Entries) Entries {
+	for _, i := range entries {
+		i.distance = *addr.Xor(&i.Address)
+	}
 
-				ret = append(ret, kv)
-			}
+	sort.Sort(entries)
+
+	return entries
+}
+
+// Returns a copy of the addresses, ordered by when they were last queried, most
+// recent first.
+func (ndb *NetDB) mostRecentlyQueried(addrs []Address) []Address {
+	ret := make([]Address, len(addrs))
+	copy(ret, addrs)
+
+	queried := make(map[string]int64)
+
+	for _, i := range ret {
+		var last int64
+		if stored, err := ndb.storedAddress(i); err == nil {
+			ndb.stmtQueryLastQueried.QueryRow(stored).Scan(&last)
 		}
+		queried[string(i.Raw)] = last
+	}
+
+	sort.SliceStable(ret, func(a, b int) bool {
+		return queried[string(ret[a].Raw)] > queried[string(ret[b].Raw)]
+	})
+
+	return ret
+}
 
-		if index+i < len(addr.Raw)*8 {
-			bucket = ndb.table[index+i]
+// The newest entries stored before beforeId, or the very newest with a
+// beforeId of 0. Also returns the beforeId for the next page, 0 once there are
+// no more. A limit of 0 uses LatestPageSize.
+func (ndb *NetDB) QueryLatest(beforeId, limit int) ([]Entry, int, error) {
+	if beforeId <= 0 {
+		beforeId = math.MaxInt64
+	}
 
-			for _, i := range bucket {
-				if len(ret) >= BucketSize {
-					break
-				}
+	if limit <= 0 {
+		limit = LatestPageSize
+	}
 
-				kv, _, err := ndb.Query(i)
+	rows, err := ndb.stmtQueryLatest.Query(beforeId, limit)
 
-				if err != nil {
-					continue
-				}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
 
-				ret = append(ret, kv)
-			}
+	ret := make([]Entry, 0, limit)
+	next := 0
+
+	for rows.Next() {
+		e, id, err := ndb.scanEntryId(rows)
+
+		if err != nil {
+			return nil, 0, err
 		}
 
+		ret = append(ret, e)
+		next = id
+	}
+
+	if len(ret) < limit {
+		next = 0
 	}
 
-	return ret, nil
+	return ret, next, rows.Err()
 }
 
-func (ndb *NetDB) QueryLatest() ([]Entry, error) {
-	ret := make([]Entry, 0, 20)
-	entries, err := ndb.stmtQueryLatest.Query()
+// Entries with between min and max seeds, inclusive. Ascending order puts the
+// most poorly seeded first.
+func (ndb *NetDB) QueryBySeedCount(min, max, page int, ascending bool) ([]Entry, error) {
+	query := sqlQueryBySeedCountDesc
+
+	if ascending {
+		query = sqlQueryBySeedCountAsc
+	}
+
+	entries, err := ndb.conn.Query(query, min, max, page*SearchPageSize, SearchPageSize)
 
 	if err != nil {
 		return nil, err
 	}
 
-	for entries.Next() {
-		e := Entry{}
+	return ndb.scanEntries(entries)
+}
 
-		id := 0
-		seedCount := 0
-		seedingCount := 0
-		address := ""
+// Reads full entries, along with their seeds, from rows of SELECT * FROM entry.
+func (ndb *NetDB) scanEntries(entries *sql.Rows) ([]Entry, error) {
+	ret := make([]Entry, 0, 20)
+	defer entries.Close()
 
-		err = entries.Scan(&id, &address, &e.Name, &e.Desc, &e.PublicAddress,
-			&e.Port, &e.PublicKey, &e.Signature, &e.CollectionHash,
-			&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen)
+	for entries.Next() {
+		e, err := ndb.scanEntry(entries)
 
 		if err != nil {
 			return nil, err
 		}
 
-		err = ndb.addSeedToEntry(&e, seedCount, seedingCount, id)
+		ret = append(ret, e)
+	}
+
+	return ret, nil
+}
+
+// Reads the entry the rows are currently on.
+func (ndb *NetDB) scanEntry(entries *sql.Rows) (Entry, error) {
+	e, _, err := ndb.scanEntryId(entries)
+
+	return e, err
+}
+
+// scanEntry, along with the entry's row id.
+func (ndb *NetDB) scanEntryId(entries *sql.Rows) (Entry, int, error) {
+	e := Entry{}
+
+	id := 0
+	seedCount := 0
+	seedingCount := 0
+	address := ""
+	publicAddresses := ""
+	var seedList []byte
+
+	err := entries.Scan(&id, &address, &e.Name, &e.Desc, &e.PublicAddress,
+		&e.Port, &e.PublicKey, &e.Signature, &e.CollectionHash,
+		&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen,
+		&publicAddresses, &e.Version, &e.SignedSeeds, &seedList, &e.Work)
+
+	if err != nil {
+		return e, id, err
+	}
+
+	e.PublicAddresses, err = decodeAddressList(publicAddresses)
+
+	if err != nil {
+		return e, id, err
+	}
+
+	e.Address, err = ndb.loadAddress(address)
+
+	if err != nil {
+		return e, id, err
+	}
+
+	err = ndb.addSeedToEntry(&e, seedCount, seedingCount, id, seedList)
+
+	return e, id, err
+}
+
+// Calls fn for every stored entry, one at a time so memory use doesn't grow
+// with the size of the database. Stops at and returns the first error from fn.
+func (ndb *NetDB) Iterate(fn func(*Entry) error) error {
+	entries, err := ndb.conn.Query(sqlQueryAllEntries)
+
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+
+	for entries.Next() {
+		e, err := ndb.scanEntry(entries)
+
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		ret = append(ret, e)
+		if err = fn(&e); err != nil {
+			return err
+		}
 	}
 
-	return ret, nil
+	return entries.Err()
 }
 
+// Searches entry names and descriptions, returning the addresses of those that
+// match with the most recently updated first.
 func (ndb *NetDB) SearchPeer(name, desc string, page int) ([]Address, error) {
-	ret := make([]Address, 0, 20)
-	addresses, err := ndb.stmtSearchPeer.Query(name, desc, page, 25)
+	ret := make([]Address, 0, SearchPageSize)
+
+	// an empty match is an error, but searching just one of them is fine
+	name, desc = data.FtsQuery(name), data.FtsQuery(desc)
+	if name == "" && desc == "" {
+		return ret, nil
+	}
+
+	addresses, err := ndb.stmtSearchPeer.Query(name, desc, page*SearchPageSize,
+		SearchPageSize)
 
 	if err != nil {
 		return nil, err
 	}
+	defer addresses.Close()
 
 	for addresses.Next() {
 		s := ""
@@ -689,7 +1660,7 @@ func (ndb *NetDB) SearchPeer(name, desc string, page int) ([]Address, error) {
 			return nil, err
 		}
 
-		a, err := DecodeAddress(s)
+		a, err := ndb.loadAddress(s)
 
 		if err != nil {
 			return nil, err
@@ -701,19 +1672,180 @@ func (ndb *NetDB) SearchPeer(name, desc string, page int) ([]Address, error) {
 	return ret, nil
 }
 
-func (ndb *NetDB) SaveTable(path string) {
+func (ndb *NetDB) markDirty() {
+	ndb.dirtyLock.Lock()
+	ndb.tableDirty = true
+	ndb.dirtyLock.Unlock()
+}
+
+// Saves the table only if it has changed since the last save.
+func (ndb *NetDB) saveIfDirty() {
+	ndb.dirtyLock.Lock()
+	dirty := ndb.tableDirty
+	ndb.tableDirty = false
+	ndb.dirtyLock.Unlock()
+
+	if !dirty {
+		return
+	}
+
+	// try again next time
+	if err := ndb.SaveTable(ndb.tablePath); err != nil {
+		log.Error("Failed to save the table: ", err.Error())
+		ndb.markDirty()
+	}
+}
+
+// Writes the routing table to disk right away, whether it has changed or not.
+func (ndb *NetDB) Flush() error {
+	ndb.dirtyLock.Lock()
+	ndb.tableDirty = false
+	ndb.dirtyLock.Unlock()
+
+	err := ndb.SaveTable(ndb.tablePath)
+
+	if err != nil {
+		ndb.markDirty()
+	}
+
+	return err
+}
+
+// Starts a goroutine that writes the routing table at most once every
+// interval, and only when it has changed. Saving on every insert is far too
+// expensive during a bootstrap.
+func (ndb *NetDB) StartFlusher(interval time.Duration) {
+	if ndb.flushStop != nil {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DefaultTableFlushInterval
+	}
+
+	ndb.flushStop = make(chan bool)
+	ndb.flushDone = make(chan bool)
+
+	go ndb.flushTable(interval)
+}
+
+func (ndb *NetDB) flushTable(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(ndb.flushDone)
+
+	for {
+		select {
+		case _ = <-ticker.C:
+			ndb.saveIfDirty()
+		case _ = <-ndb.flushStop:
+			return
+		}
+	}
+}
+
+// Stops the flusher and writes the table one last time. Blocks until the flush
+// goroutine has exited, so it is safe to call on shutdown.
+func (ndb *NetDB) StopFlusher() error {
+	if ndb.flushStop == nil {
+		return nil
+	}
+
+	close(ndb.flushStop)
+	<-ndb.flushDone
+
+	ndb.flushStop = nil
+	ndb.flushDone = nil
+
+	return ndb.Flush()
+}
+
+// Rebuilds the database file, giving the space left behind by pruned entries
+// back to the filesystem.
+func (ndb *NetDB) Vacuum() error {
+	ndb.txLock.Lock()
+	defer ndb.txLock.Unlock()
+
+	if _, err := ndb.conn.Exec(sqlVacuum); err != nil {
+		return err
+	}
+
+	_, err := ndb.conn.Exec(sqlCheckpointTruncate)
+
+	return err
+}
+
+func (ndb *NetDB) SaveTable(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	ndb.tableLock.RLock()
 	data, err := json.Marshal(ndb.table)
+	ndb.tableLock.RUnlock()
 
 	if err != nil {
-		log.Error(err.Error())
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Flushes the table one last time, then releases all prepared statements and
+// the database handle. Safe to call more than once, and from more than one
+// goroutine. A table that couldn't be saved is reported, but everything is
+// still closed.
+func (ndb *NetDB) Close() error {
+	ndb.closeLock.Lock()
+	defer ndb.closeLock.Unlock()
+
+	if ndb.closed {
+		return nil
 	}
 
-	ioutil.WriteFile(path, data, 0644)
+	ndb.closed = true
 
+	// so the table saved has their outcome
+	ndb.checks.Wait()
+
+	var ret error
+
+	if ndb.flushStop != nil {
+		ret = ndb.StopFlusher()
+	} else {
+		ret = ndb.Flush()
+	}
+
+	stmts := []*sql.Stmt{
+		ndb.stmtInsertEntry, ndb.stmtInsertFtsEntry, ndb.stmtEntryLen,
+		ndb.stmtQueryAddress, ndb.stmtInsertSeed, ndb.stmtQueryIdByAddress,
+		ndb.stmtUpdateEntry, ndb.stmtQuerySeeds, ndb.stmtQuerySeeding,
+		ndb.stmtQueryLatest, ndb.stmtSearchPeer, ndb.stmtUpdateLastQueried,
+		ndb.stmtQueryLastQueried,
+	}
+
+	for _, i := range stmts {
+		if i == nil {
+			continue
+		}
+
+		if err := i.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	if err := ndb.conn.Close(); err != nil && ret == nil {
+		ret = err
+	}
+
+	return ret
 }
 
-func (ndb *NetDB) LoadTable(path string) {
-	raw, _ := ioutil.ReadFile(path)
+func (ndb *NetDB) LoadTable() {
+	raw, _ := ioutil.ReadFile(ndb.tablePath)
+
+	ndb.tableLock.Lock()
+	defer ndb.tableLock.Unlock()
 
 	json.Unmarshal(raw, &ndb.table)
 }
@@ -25,11 +25,17 @@
 package dht_test
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"testing"
 	"time"
 
+	_ "github.com/mattn/go-sqlite3"
+
 	"github.com/dfindex/dfi/dht"
 	"github.com/dfindex/dfi/util"
 	"golang.org/x/crypto/ed25519"
@@ -89,10 +95,14 @@ func randomAddress(t testing.TB) *dht.Address {
 }
 
 func dbWithRandomAddress(t testing.TB) *dht.NetDB {
+	return dbWithTable(t, "")
+}
+
+func dbWithTable(t testing.TB, tablePath string) *dht.NetDB {
 	// pretty much just tests that the SQL gets prepared properly
 	addr := randomAddress(t)
 
-	db, err := dht.NewNetDB(*addr, ".testing/"+addr.StringOr(""))
+	db, err := dht.NewNetDB(*addr, ".testing/"+addr.StringOr(""), tablePath)
 
 	if err != nil {
 		t.Fatal(err.Error())
@@ -105,7 +115,33 @@ func randomEntry(t testing.TB) dht.Entry {
 	name := randString(util.RandInt(5, 25))
 	desc := randString(util.RandInt(5, 144))
 
+	return signedEntry(t, name, desc, 0)
+}
+
+// Changes made to an entry before signedEntry signs it.
+type entryOption func(*dht.Entry, *ed25519.PrivateKey)
+
+// Signs with priv rather than a fresh key, so entries can share an address.
+func withKey(priv ed25519.PrivateKey) entryOption {
+	return func(e *dht.Entry, key *ed25519.PrivateKey) {
+		*key = priv
+		e.PublicKey = priv.Public().(ed25519.PublicKey)
+		e.Address = dht.Address{}
+		e.Address.Generate(e.PublicKey)
+	}
+}
+
+// Edits any other fields, apply it after withKey.
+func withFields(edit func(*dht.Entry)) entryOption {
+	return func(e *dht.Entry, _ *ed25519.PrivateKey) {
+		edit(e)
+	}
+}
+
+func signedEntry(t testing.TB, name, desc string, updated uint64, opts ...entryOption) dht.Entry {
 	pub, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
 	addr := dht.Address{}
 	addr.Generate(pub)
 
@@ -116,6 +152,11 @@ func randomEntry(t testing.TB) dht.Entry {
 		PublicKey:     pub,
 		PublicAddress: "localhost",
 		Port:          5050,
+		Updated:       updated,
+	}
+
+	for _, i := range opts {
+		i(&entry, &priv)
 	}
 
 	dat, err := entry.Bytes()
@@ -140,12 +181,13 @@ func TestMain(m *testing.M) {
 }
 
 func TestNewNetDB(t *testing.T) {
-	dbWithRandomAddress(t)
+	fatalErr(dbWithRandomAddress(t).Close(), t)
 }
 
 // Tests Insert, and by extension len and tablelen
 func TestNetDBInsertAndLen(t *testing.T) {
 	db := dbWithRandomAddress(t)
+	defer db.Close()
 
 	entry := randomEntry(t)
 
@@ -169,15 +211,45 @@ func TestNetDBInsertAndLen(t *testing.T) {
 	}
 }
 
+func TestLenAfterDelete(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	length, err := db.Len()
+	fatalErr(err, t)
+
+	if length != 0 {
+		t.Fatalf("Expected empty database, got %d", length)
+	}
+
+	entries := []dht.Entry{randomEntry(t), randomEntry(t), randomEntry(t)}
+
+	for _, i := range entries {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	_, err = db.DeleteEntry(entries[1].Address)
+	fatalErr(err, t)
+
+	length, err = db.Len()
+	fatalErr(err, t)
+
+	if length != 2 {
+		t.Fatalf("Expected 2 entries, got %d", length)
+	}
+}
+
 func TestInsert(t *testing.T) {
 	db := dbWithRandomAddress(t)
+	defer db.Close()
 
 	entry := randomEntry(t)
 
 	_, err := db.Insert(entry)
 
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
 	}
 
 	if l, _ := db.Len(); l != 1 {
@@ -187,6 +259,7 @@ func TestInsert(t *testing.T) {
 
 func TestInsertSeed(t *testing.T) {
 	db := dbWithRandomAddress(t)
+	defer db.Close()
 	entry := randomEntry(t)
 	seed := randomEntry(t)
 
@@ -224,35 +297,1626 @@ func TestInsertSeed(t *testing.T) {
 	}
 }
 
-func BenchmarkInsert(b *testing.B) {
-	makeTesting()
-	db := dbWithRandomAddress(b)
+func TestRemoveSeed(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+	entry := randomEntry(t)
+	seed := randomEntry(t)
+	other := randomEntry(t)
 
-	for n := 0; n < b.N; n++ {
-		b.StopTimer()
-		entry := randomEntry(b)
-		b.StartTimer()
+	for _, i := range []dht.Entry{entry, seed, other} {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
 
-		db.Insert(entry)
+	fatalErr(db.InsertSeed(entry.Address, seed.Address), t)
+	fatalErr(db.InsertSeed(entry.Address, other.Address), t)
+
+	fatalErr(db.RemoveSeed(entry.Address, seed.Address), t)
+
+	// again, and for an entry that was never stored, changes nothing
+	fatalErr(db.RemoveSeed(entry.Address, seed.Address), t)
+	fatalErr(db.RemoveSeed(randomEntry(t).Address, seed.Address), t)
+
+	seeds, err := db.QuerySeeds(entry.Address)
+	fatalErr(err, t)
+
+	if len(seeds) != 1 || !seeds[0].Equals(&other.Address) {
+		t.Fatal("Wrong seeds left: ", seeds)
 	}
 
-	removeTesting()
+	seeding, err := db.QuerySeeding(seed.Address)
+	fatalErr(err, t)
+
+	if len(seeding) != 0 {
+		t.Fatal("Still seeding: ", seeding)
+	}
 }
 
-func BenchmarkQuery(b *testing.B) {
-	makeTesting()
-	db := dbWithRandomAddress(b)
+func TestSearchPeer(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
 
-	for n := 0; n < b.N; n++ {
-		// don't time the actual inserting!
-		// this is not what we are measuring in this case
-		b.StopTimer()
-		entry := randomEntry(b)
-		db.Insert(entry)
-		b.StartTimer()
+	count := dht.SearchPageSize + 5
 
-		db.Query(entry.Address)
+	for i := 0; i < count; i++ {
+		entry := signedEntry(t, "dfi node "+randString(8), "a node", uint64(i+1))
+
+		_, err := db.Insert(entry)
+		fatalErr(err, t)
 	}
 
-	removeTesting()
+	// one that shouldn't match
+	_, err := db.Insert(signedEntry(t, "something else", "another", 1))
+	fatalErr(err, t)
+
+	first, err := db.SearchPeer("dfi", "dfi", 0)
+	fatalErr(err, t)
+
+	second, err := db.SearchPeer("dfi", "dfi", 1)
+	fatalErr(err, t)
+
+	if len(first) != dht.SearchPageSize || len(second) != 5 {
+		t.Fatalf("Expected %d results across pages, got %d and %d", count,
+			len(first), len(second))
+	}
+
+	seen := make(map[string]bool)
+	var last uint64
+
+	for n, i := range append(first, second...) {
+		s := i.StringOr("")
+
+		if seen[s] {
+			t.Fatal("Entry returned twice")
+		}
+		seen[s] = true
+
+		entry, _, err := db.Query(i)
+		fatalErr(err, t)
+
+		if n > 0 && entry.Updated > last {
+			t.Fatal("Results not ordered by recency")
+		}
+		last = entry.Updated
+	}
+}
+
+// Whatever the user types, searching never fails.
+func TestSearchPeerSyntax(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	_, err := db.Insert(signedEntry(t, "dfi node", "a node", 1))
+	fatalErr(err, t)
+
+	for _, i := range []struct {
+		name, desc string
+		count      int
+	}{
+		{"", "", 0},
+		{`"`, `"`, 0},
+		{"", "node", 1},
+		{`"dfi`, "", 1},
+		{"AND", "NOT node", 1},
+		{"df", "df", 1},
+	} {
+		results, err := db.SearchPeer(i.name, i.desc, 0)
+
+		if err != nil {
+			t.Fatalf("Searching %q, %q failed: %s", i.name, i.desc, err.Error())
+		}
+
+		if len(results) != i.count {
+			t.Fatalf("Expected %d results for %q, %q, got %d", i.count, i.name, i.desc, len(results))
+		}
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	entry := signedEntry(t, "doomed", "going away", 1)
+	seed := randomEntry(t)
+
+	_, err := db.Insert(entry)
+	fatalErr(err, t)
+
+	_, err = db.Insert(seed)
+	fatalErr(err, t)
+
+	fatalErr(db.InsertSeed(entry.Address, seed.Address), t)
+
+	removed, err := db.DeleteEntry(entry.Address)
+	fatalErr(err, t)
+
+	// the entry, its fts row and the seed
+	if removed != 3 {
+		t.Fatalf("Expected 3 rows removed, got %d", removed)
+	}
+
+	if db.TableLen() != 1 {
+		t.Fatal("Entry still in routing table")
+	}
+
+	e, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if e != nil {
+		t.Fatal("Entry still in database")
+	}
+
+	seeding, err := db.QuerySeeding(seed.Address)
+	fatalErr(err, t)
+
+	if len(seeding) != 0 {
+		t.Fatal("Seed rows not removed")
+	}
+
+	found, err := db.SearchPeer("doomed", "doomed", 0)
+	fatalErr(err, t)
+
+	if len(found) != 0 {
+		t.Fatal("Entry still searchable")
+	}
+
+	// already gone, nothing more to do
+	removed, err = db.DeleteEntry(entry.Address)
+	fatalErr(err, t)
+
+	if removed != 0 {
+		t.Fatal("Removed rows for a missing entry")
+	}
+}
+
+func TestQueryLatestPages(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	for i := 0; i < 25; i++ {
+		_, err := db.Insert(randomEntry(t))
+		fatalErr(err, t)
+	}
+
+	seen := make(map[string]bool)
+	before := 0
+
+	for page := 0; ; page++ {
+		entries, next, err := db.QueryLatest(before, 10)
+		fatalErr(err, t)
+
+		for _, i := range entries {
+			if seen[string(i.Address.Raw)] {
+				t.Fatal("Entry returned twice: ", i.Address.StringOr(""))
+			}
+
+			seen[string(i.Address.Raw)] = true
+		}
+
+		// newer entries arriving don't shift the pages
+		_, err = db.Insert(randomEntry(t))
+		fatalErr(err, t)
+
+		if next == 0 {
+			break
+		}
+
+		before = next
+	}
+
+	if len(seen) != 25 {
+		t.Fatalf("Expected 25 entries paging through, got %d", len(seen))
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	entries := []dht.Entry{randomEntry(t), randomEntry(t), randomEntry(t)}
+
+	affected, err := db.InsertMany(entries)
+	fatalErr(err, t)
+
+	if affected != 3 {
+		t.Fatalf("Expected 3 rows affected, got %d", affected)
+	}
+
+	if db.TableLen() != 3 {
+		t.Fatalf("Expected 3 entries in table, got %d", db.TableLen())
+	}
+
+	for _, i := range entries {
+		e, _, err := db.Query(i.Address)
+		fatalErr(err, t)
+
+		if e == nil || e.Name != i.Name {
+			t.Fatal("Entry not inserted")
+		}
+	}
+}
+
+func TestInsertManyInvalid(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	bad := randomEntry(t)
+	bad.Name = "tampered"
+
+	entries := []dht.Entry{randomEntry(t), bad, randomEntry(t)}
+
+	_, err := db.InsertMany(entries)
+
+	if err == nil {
+		t.Fatal("Expected an error for an invalid entry")
+	}
+
+	if db.TableLen() != 0 {
+		t.Fatal("Routing table touched by a failed batch")
+	}
+
+	for _, i := range entries {
+		e, _, err := db.Query(i.Address)
+		fatalErr(err, t)
+
+		if e != nil {
+			t.Fatal("Entry inserted from a failed batch")
+		}
+	}
+}
+
+func TestVerifyEntries(t *testing.T) {
+	entries := make([]*dht.Entry, 50)
+
+	for i := range entries {
+		e := randomEntry(t)
+		entries[i] = &e
+	}
+
+	entries[17].Name = "tampered"
+	entries[31] = nil
+
+	errs := dht.VerifyEntries(entries, 4)
+
+	if len(errs) != len(entries) {
+		t.Fatalf("Expected %d results, got %d", len(entries), len(errs))
+	}
+
+	for i, err := range errs {
+		if i == 17 && err == nil {
+			t.Fatal("Tampered entry passed verification")
+		} else if i == 31 && err != dht.ErrNilEntry {
+			t.Fatal("Expected ErrNilEntry for a nil entry, got ", err)
+		} else if i != 17 && i != 31 && err != nil {
+			t.Fatalf("Valid entry %d failed verification: %s", i, err)
+		}
+	}
+}
+
+func TestVerifyAddressMismatch(t *testing.T) {
+	victim := randomEntry(t)
+
+	// Mallory's own key, properly signed, but claiming the victim's address
+	forged := signedEntry(t, "mallory", "", 0, withFields(func(e *dht.Entry) {
+		e.Address = victim.Address
+	}))
+
+	if forged.Verify() == nil {
+		t.Fatal("Entry for someone else's address passed verification")
+	}
+
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	if _, err := db.Insert(forged); err == nil {
+		t.Fatal("Inserted an entry for someone else's address")
+	}
+}
+
+func TestIterate(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	entries := []dht.Entry{randomEntry(t), randomEntry(t), randomEntry(t)}
+
+	for _, i := range entries {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	fatalErr(db.InsertSeed(entries[0].Address, entries[1].Address), t)
+
+	seen := make(map[string]*dht.Entry)
+	err := db.Iterate(func(e *dht.Entry) error {
+		seen[e.Address.StringOr("")] = e
+		return nil
+	})
+	fatalErr(err, t)
+
+	if len(seen) != len(entries) {
+		t.Fatalf("Expected %d entries, iterated %d", len(entries), len(seen))
+	}
+
+	for _, i := range entries {
+		e, ok := seen[i.Address.StringOr("")]
+
+		if !ok || e.Name != i.Name {
+			t.Fatal("Entry missing from iteration")
+		}
+	}
+
+	if len(seen[entries[0].Address.StringOr("")].Seeds) != 1 {
+		t.Fatal("Seeds not populated")
+	}
+
+	// an error from the callback stops things early
+	stop := errors.New("stop")
+	calls := 0
+	err = db.Iterate(func(e *dht.Entry) error {
+		calls++
+		return stop
+	})
+
+	if err != stop || calls != 1 {
+		t.Fatalf("Expected iteration to stop after one call, got %d calls and %v", calls, err)
+	}
+}
+
+func TestPublicAddresses(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	addresses := func(public string, more ...string) *dht.Entry {
+		e := signedEntry(t, "everywhere", "", 0, withFields(func(e *dht.Entry) {
+			e.PublicAddress = public
+			e.PublicAddresses = more
+		}))
+
+		return &e
+	}
+
+	entry := addresses("192.0.2.1", "[2001:db8::1]", "abcdefghijklmnop.onion")
+	fatalErr(entry.Verify(), t)
+
+	_, err := db.Insert(*entry)
+	fatalErr(err, t)
+
+	stored, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if len(stored.PublicAddresses) != 2 || stored.PublicAddresses[1] != "abcdefghijklmnop.onion" {
+		t.Fatal("Public addresses not stored: ", stored.PublicAddresses)
+	}
+
+	if err = stored.Verify(); err != nil {
+		t.Fatal("Stored entry no longer verifies: ", err.Error())
+	}
+
+	// the same characters split differently must not keep the signature valid
+	forged := *entry
+	forged.PublicAddresses = []string{"[2001:db8::1]abcdefgh", "ijklmnop.onion"}
+
+	if forged.Verify() == nil {
+		t.Fatal("Re-split addresses passed verification")
+	}
+
+	many := make([]string, dht.MaxEntryPublicAddresses+1)
+	for i := range many {
+		many[i] = "192.0.2.1"
+	}
+
+	if addresses("192.0.2.1", many...).Verify() == nil {
+		t.Fatal("Too many public addresses passed verification")
+	}
+
+	if addresses("192.0.2.1", "").Verify() == nil {
+		t.Fatal("Empty public address passed verification")
+	}
+
+	// each has to make a host:port once the entry's port is added
+	for _, i := range []string{"192.0.2.1:5050", "2001:db8::1]", "[2001:db8::1]:5050",
+		"bad host", "example.com/path", "user@example.com", "[]"} {
+		if addresses("192.0.2.1", "192.0.2.1", i).Verify() == nil {
+			t.Fatalf("Public address %q passed verification", i)
+		}
+	}
+
+	if addresses("192.0.2.1:5050").Verify() == nil {
+		t.Fatal("Public address with a port passed verification")
+	}
+}
+
+func TestUpdateVersion(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	versioned := func(name string, version uint64) dht.Entry {
+		return signedEntry(t, name, "", 0, withKey(priv), withFields(func(e *dht.Entry) {
+			e.Version = version
+		}))
+	}
+
+	_, err = db.Insert(versioned("new", 2))
+	fatalErr(err, t)
+
+	// arrives late, having been relayed
+	old := versioned("old", 1)
+	affected, err := db.Update(old)
+	fatalErr(err, t)
+
+	if affected != 0 {
+		t.Fatal("Older version applied")
+	}
+
+	affected, err = db.Insert(old)
+	fatalErr(err, t)
+
+	if affected != 0 {
+		t.Fatal("Older version inserted")
+	}
+
+	e, _, err := db.Query(old.Address)
+	fatalErr(err, t)
+
+	if e.Name != "new" || e.Version != 2 {
+		t.Fatalf("Older version replaced newer, have %q version %d", e.Name, e.Version)
+	}
+
+	affected, err = db.Update(versioned("newer", 3))
+	fatalErr(err, t)
+
+	if affected != 1 {
+		t.Fatal("Newer version not applied")
+	}
+
+	// the version is signed, so can't be bumped by anyone else
+	forged := versioned("forged", 3)
+	forged.Version = 4
+
+	if forged.Verify() == nil {
+		t.Fatal("Entry with a changed version passed verification")
+	}
+}
+
+func TestVerifyPort(t *testing.T) {
+	tests := []struct {
+		port  int
+		valid bool
+	}{
+		{0, false},
+		{-1, false},
+		{1, true},
+		{65535, true},
+		{65536, false},
+	}
+
+	for _, test := range tests {
+		e := signedEntry(t, "port", "", 0, withFields(func(e *dht.Entry) {
+			e.Port = test.port
+		}))
+
+		err := e.Verify()
+
+		if test.valid && err != nil {
+			t.Errorf("Port %d rejected: %s", test.port, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("Port %d accepted", test.port)
+		}
+	}
+}
+
+func TestRawAddresses(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	entry := randomEntry(t)
+	seed := randomEntry(t)
+
+	_, err := db.Insert(entry)
+	fatalErr(err, t)
+
+	_, err = db.Insert(seed)
+	fatalErr(err, t)
+
+	fatalErr(db.InsertSeed(entry.Address, seed.Address), t)
+
+	check := func(mode string) {
+		e, _, err := db.Query(entry.Address)
+		fatalErr(err, t)
+
+		if e == nil || !e.Address.Equals(&entry.Address) {
+			t.Fatal("Entry lost after switching to ", mode)
+		}
+
+		if len(e.Seeds) != 1 || !(&dht.Address{Raw: e.Seeds[0]}).Equals(&seed.Address) {
+			t.Fatal("Seeds lost after switching to ", mode)
+		}
+
+		if err = e.Verify(); err != nil {
+			t.Fatal("Entry no longer verifies in ", mode, ": ", err.Error())
+		}
+	}
+
+	fatalErr(db.SetRawAddresses(true), t)
+	check("raw")
+
+	// new entries are stored raw too
+	another := randomEntry(t)
+	_, err = db.Insert(another)
+	fatalErr(err, t)
+
+	fatalErr(db.SetRawAddresses(false), t)
+	check("encoded")
+
+	e, _, err := db.Query(another.Address)
+	fatalErr(err, t)
+
+	if e == nil {
+		t.Fatal("Entry inserted in raw mode lost when switching back")
+	}
+}
+
+func TestSignedSeeds(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	seed := randomEntry(t)
+	other := randomEntry(t)
+
+	entry := signedEntry(t, "signed", "", 0, withFields(func(e *dht.Entry) {
+		e.Seeds = [][]byte{seed.Address.Raw}
+		e.SignedSeeds = true
+	}))
+
+	fatalErr(entry.Verify(), t)
+
+	injected := entry
+	injected.Seeds = append([][]byte{}, entry.Seeds...)
+	injected.Seeds = append(injected.Seeds, other.Address.Raw)
+
+	if injected.Verify() == nil {
+		t.Fatal("Injected seed passed verification")
+	}
+
+	unflagged := injected
+	unflagged.SignedSeeds = false
+
+	if unflagged.Verify() == nil {
+		t.Fatal("Turning off signed seeds passed verification")
+	}
+
+	// the default still lets anyone grow the swarm
+	plain := randomEntry(t)
+	plain.Seeds = append(plain.Seeds, other.Address.Raw)
+	fatalErr(plain.Verify(), t)
+
+	for _, i := range []dht.Entry{seed, other, entry} {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	// someone else claims to be seeding it
+	fatalErr(db.InsertSeed(entry.Address, other.Address), t)
+
+	stored, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if !stored.SignedSeeds || len(stored.Seeds) != 1 {
+		t.Fatal("Stored entry does not have just the signed seeds: ", len(stored.Seeds))
+	}
+
+	if err = stored.Verify(); err != nil {
+		t.Fatal("Stored entry no longer verifies: ", err.Error())
+	}
+}
+
+func TestPruneOlderThan(t *testing.T) {
+	now := uint64(time.Now().Unix())
+	self := signedEntry(t, "self", "us", 1)
+
+	db, err := dht.NewNetDB(self.Address, ".testing/"+randString(16), "")
+	fatalErr(err, t)
+	defer db.Close()
+
+	stale := signedEntry(t, "stale", "long gone", 1)
+	fresh := signedEntry(t, "fresh", "just updated", now)
+	seen := signedEntry(t, "seen", "old entry, but still about", 1)
+
+	for _, i := range []dht.Entry{self, stale, fresh, seen} {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	fatalErr(db.UpdateSeen(seen.Address, int64(now)), t)
+
+	removed, err := db.PruneOlderThan(time.Hour)
+	fatalErr(err, t)
+
+	if removed != 1 {
+		t.Fatalf("Expected 1 entry pruned, got %d", removed)
+	}
+
+	for _, i := range []dht.Entry{self, fresh, seen} {
+		e, _, err := db.Query(i.Address)
+		fatalErr(err, t)
+
+		if e == nil {
+			t.Fatalf("Entry %s should not have been pruned", i.Name)
+		}
+	}
+
+	e, _, err := db.Query(stale.Address)
+	fatalErr(err, t)
+
+	if e != nil {
+		t.Fatal("Stale entry not pruned")
+	}
+
+	if db.TableLen() != 3 {
+		t.Fatal("Stale entry still in routing table")
+	}
+}
+
+func TestQueryBySeedCount(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	seeds := make([]dht.Entry, 0, 5)
+	for i := 0; i < 5; i++ {
+		seed := randomEntry(t)
+		_, err := db.Insert(seed)
+		fatalErr(err, t)
+
+		seeds = append(seeds, seed)
+	}
+
+	// entries with 1 to 4 seeds
+	for i := 1; i <= 4; i++ {
+		entry := randomEntry(t)
+
+		for _, s := range seeds[:i] {
+			entry.Seeds = append(entry.Seeds, s.Address.Raw)
+		}
+
+		_, err := db.Insert(entry)
+		fatalErr(err, t)
+	}
+
+	weak, err := db.QueryBySeedCount(1, 3, 0, true)
+	fatalErr(err, t)
+
+	if len(weak) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(weak))
+	}
+
+	for n, i := range weak {
+		if len(i.Seeds) != n+1 {
+			t.Fatal("Entries not in ascending seed order")
+		}
+	}
+
+	strong, err := db.QueryBySeedCount(2, 10, 0, false)
+	fatalErr(err, t)
+
+	if len(strong) != 3 || len(strong[0].Seeds) != 4 || len(strong[2].Seeds) != 2 {
+		t.Fatal("Entries not in descending seed order")
+	}
+
+	if strong[0].Address.Raw == nil {
+		t.Fatal("Entry address not loaded")
+	}
+}
+
+// The entry table as it was before lastQueried was added.
+const oldEntryTable = `CREATE TABLE entry(
+	id INTEGER PRIMARY KEY NOT NULL,
+	address STRING(40) UNIQUE,
+	name STRING(64) NOT NULL,
+	desc STRING(256),
+	publicAddress STRING(256) NOT NULL,
+	port INT,
+	publicKey BLOB(32) NOT NULL,
+	signature BLOB(64),
+	collectionHash BLOB(32),
+	postCount INT,
+	seedCount INT,
+	seedingCount INT,
+	updated INT,
+	seen INT
+)`
+
+func TestLastQueriedMigration(t *testing.T) {
+	path := ".testing/" + randString(16)
+	entry := randomEntry(t)
+
+	old, err := sql.Open("sqlite3", path)
+	fatalErr(err, t)
+
+	_, err = old.Exec(oldEntryTable)
+	fatalErr(err, t)
+
+	_, err = old.Exec(`INSERT INTO entry (address, name, desc, publicAddress,
+		port, publicKey, signature, collectionHash, postCount, seedCount,
+		seedingCount, updated, seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, x'', 0, 0, 0, 0, 0)`, entry.Address.StringOr(""),
+		entry.Name, entry.Desc, entry.PublicAddress, entry.Port, entry.PublicKey,
+		entry.Signature)
+	fatalErr(err, t)
+	old.Close()
+
+	db, err := dht.NewNetDB(*randomAddress(t), path, "")
+	fatalErr(err, t)
+	defer db.Close()
+
+	e, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if e == nil || e.Name != entry.Name {
+		t.Fatal("Existing entry lost in migration")
+	}
+
+	check, err := sql.Open("sqlite3", path)
+	fatalErr(err, t)
+	defer check.Close()
+
+	var lastQueried int64
+	err = check.QueryRow("SELECT lastQueried FROM entry WHERE address=?",
+		entry.Address.StringOr("")).Scan(&lastQueried)
+	fatalErr(err, t)
+
+	if lastQueried == 0 {
+		t.Fatal("lastQueried not set by Query")
+	}
+
+	// opening it again shouldn't try to add the column twice
+	again, err := dht.NewNetDB(*randomAddress(t), path, "")
+	fatalErr(err, t)
+	again.Close()
+}
+
+func TestFindClosestNotQueried(t *testing.T) {
+	self := randomAddress(t)
+	path := ".testing/" + randString(16)
+
+	db, err := dht.NewNetDB(*self, path, "")
+	fatalErr(err, t)
+	defer db.Close()
+
+	entry := randomEntry(t)
+	_, err = db.Insert(entry)
+	fatalErr(err, t)
+
+	// answering other peers isn't anyone looking the entry up
+	_, err = db.FindClosest(entry.Address)
+	fatalErr(err, t)
+
+	_, err = db.QuerySeeds(entry.Address)
+	fatalErr(err, t)
+
+	check, err := sql.Open("sqlite3", path)
+	fatalErr(err, t)
+	defer check.Close()
+
+	lastQueried := func() int64 {
+		var last int64
+		err := check.QueryRow("SELECT lastQueried FROM entry WHERE address=?",
+			entry.Address.StringOr("")).Scan(&last)
+		fatalErr(err, t)
+
+		return last
+	}
+
+	if lastQueried() != 0 {
+		t.Fatal("lastQueried bumped by FindClosest")
+	}
+
+	_, _, err = db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if lastQueried() == 0 {
+		t.Fatal("lastQueried not set by Query")
+	}
+}
+
+func TestFindClosestOrdered(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	for i := 0; i < dht.BucketSize*2; i++ {
+		_, err := db.Insert(randomEntry(t))
+		fatalErr(err, t)
+	}
+
+	for i := 0; i < 5; i++ {
+		target := randomAddress(t)
+
+		closest, err := db.FindClosest(*target)
+		fatalErr(err, t)
+
+		if len(closest) == 0 {
+			t.Fatal("No entries found")
+		}
+
+		for n := 1; n < len(closest); n++ {
+			prev := target.Xor(&closest[n-1].Address)
+			cur := target.Xor(&closest[n].Address)
+
+			if cur.Less(prev) {
+				t.Fatal("Entries not sorted by distance")
+			}
+		}
+	}
+}
+
+// Querying moves entries to the front of their bucket, which must not upset
+// FindClosest as it walks that bucket.
+func TestFindClosestUnique(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := db.Insert(randomEntry(t))
+		fatalErr(err, t)
+	}
+
+	for i := 0; i < 5; i++ {
+		closest, err := db.FindClosest(*randomAddress(t))
+		fatalErr(err, t)
+
+		if len(closest) != 5 {
+			t.Fatalf("Expected 5 entries, got %d", len(closest))
+		}
+
+		seen := make(map[string]bool)
+
+		for _, e := range closest {
+			if seen[string(e.Address.Raw)] {
+				t.Fatal("Entry returned twice: ", e.Address.StringOr(""))
+			}
+
+			seen[string(e.Address.Raw)] = true
+		}
+	}
+}
+
+// Fills the first bucket of a fresh db, then inserts one more entry into it.
+// Returns the entries in insertion order, the addresses the liveness check was
+// asked about, and the saved table.
+func fillBucket(t *testing.T, alive bool) ([]dht.Entry, []dht.Address, [][]dht.Address) {
+	self := randomAddress(t)
+	path := ".testing/" + randString(16) + ".dat"
+
+	db, err := dht.NewNetDB(*self, ".testing/"+randString(16), path)
+	fatalErr(err, t)
+	defer db.Close()
+
+	checked := make([]dht.Address, 0)
+	db.SetLivenessCheck(func(a dht.Address) bool {
+		checked = append(checked, a)
+		return alive
+	})
+
+	// only keep entries that land in bucket 0
+	entries := make([]dht.Entry, 0, dht.BucketSize+1)
+	for len(entries) <= dht.BucketSize {
+		e := randomEntry(t)
+
+		if e.Address.Xor(self).LeadingZeroes() != 0 {
+			continue
+		}
+
+		_, err := db.Insert(e)
+		fatalErr(err, t)
+
+		entries = append(entries, e)
+	}
+
+	// waits for the liveness check, and saves the table
+	fatalErr(db.Close(), t)
+
+	raw, err := ioutil.ReadFile(path)
+	fatalErr(err, t)
+
+	var table [][]dht.Address
+	fatalErr(json.Unmarshal(raw, &table), t)
+
+	return entries, checked, table
+}
+
+// Addresses in the table but not the db, as left by a crash between pruning
+// and the table being flushed.
+func TestFindClosestStaleTable(t *testing.T) {
+	self := randomAddress(t)
+	path := ".testing/" + randString(16) + ".dat"
+
+	table := make([][]dht.Address, len(self.Raw)*8)
+	for len(table[0]) < dht.BucketSize {
+		addr := randomAddress(t)
+
+		if addr.Xor(self).LeadingZeroes() == 0 {
+			table[0] = append(table[0], *addr)
+		}
+	}
+
+	raw, err := json.Marshal(table)
+	fatalErr(err, t)
+	fatalErr(ioutil.WriteFile(path, raw, 0644), t)
+
+	db, err := dht.NewNetDB(*self, ".testing/"+randString(16), path)
+	fatalErr(err, t)
+	defer db.Close()
+
+	db.LoadTable()
+
+	entries, err := db.FindClosest(table[0][0])
+	fatalErr(err, t)
+
+	if len(entries) != 0 {
+		t.Fatalf("Expected no entries, got %d", len(entries))
+	}
+}
+
+func bucketHas(bucket []dht.Address, addr dht.Address) bool {
+	for _, i := range bucket {
+		if i.Equals(&addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFullBucketKeepsLivePeer(t *testing.T) {
+	entries, checked, table := fillBucket(t, true)
+
+	if len(checked) != 1 || !checked[0].Equals(&entries[0].Address) {
+		t.Fatal("Oldest peer was not checked before eviction")
+	}
+
+	if !bucketHas(table[0], entries[0].Address) {
+		t.Fatal("Live peer was evicted")
+	}
+
+	if bucketHas(table[0], entries[dht.BucketSize].Address) {
+		t.Fatal("New peer inserted over a live one")
+	}
+
+	// the live one is now the freshest
+	if !table[0][0].Equals(&entries[0].Address) {
+		t.Fatal("Live peer not moved to the front")
+	}
+}
+
+func TestFullBucketEvictsDeadPeer(t *testing.T) {
+	entries, checked, table := fillBucket(t, false)
+
+	if len(checked) != 1 || !checked[0].Equals(&entries[0].Address) {
+		t.Fatal("Oldest peer was not checked before eviction")
+	}
+
+	if bucketHas(table[0], entries[0].Address) {
+		t.Fatal("Dead peer was not evicted")
+	}
+
+	if !bucketHas(table[0], entries[dht.BucketSize].Address) {
+		t.Fatal("New peer not inserted")
+	}
+}
+
+func TestFullBucketSlowCheck(t *testing.T) {
+	self := randomAddress(t)
+	path := ".testing/" + randString(16) + ".dat"
+
+	db, err := dht.NewNetDB(*self, ".testing/"+randString(16), path)
+	fatalErr(err, t)
+	defer db.Close()
+
+	checks := make(chan dht.Address, 10)
+	release := make(chan bool)
+	db.SetLivenessCheck(func(a dht.Address) bool {
+		checks <- a
+		<-release
+		return false
+	})
+
+	// two more than bucket 0 holds, neither waiting on the check
+	entries := make([]dht.Entry, 0, dht.BucketSize+2)
+	for len(entries) < dht.BucketSize+2 {
+		e := randomEntry(t)
+
+		if e.Address.Xor(self).LeadingZeroes() != 0 {
+			continue
+		}
+
+		_, err := db.Insert(e)
+		fatalErr(err, t)
+
+		entries = append(entries, e)
+	}
+
+	if checked := <-checks; !checked.Equals(&entries[0].Address) {
+		t.Fatal("Oldest peer was not checked")
+	}
+
+	close(release)
+	fatalErr(db.Close(), t)
+
+	if len(checks) != 0 {
+		t.Fatal("Bucket checked more than once at a time")
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	fatalErr(err, t)
+
+	var table [][]dht.Address
+	fatalErr(json.Unmarshal(raw, &table), t)
+
+	if bucketHas(table[0], entries[0].Address) {
+		t.Fatal("Dead peer was not evicted")
+	}
+
+	// the later arrival took the earlier one's place in line
+	if bucketHas(table[0], entries[dht.BucketSize].Address) ||
+		!bucketHas(table[0], entries[dht.BucketSize+1].Address) {
+		t.Fatal("Wrong peer replaced the dead one")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	self := randomAddress(t)
+
+	db, err := dht.NewNetDB(*self, ".testing/"+randString(16), "")
+	fatalErr(err, t)
+	defer db.Close()
+
+	if db.CoverageScore() != 0 {
+		t.Fatal("Empty table has coverage")
+	}
+
+	// a full bucket 0, nothing in 1 or 2, and one peer in bucket 3
+	inBucket := make(map[int]int)
+	for inBucket[0] < dht.BucketSize || inBucket[3] < 1 {
+		e := randomEntry(t)
+		bucket := e.Address.Xor(self).LeadingZeroes()
+
+		if (bucket != 0 && bucket != 3) || inBucket[bucket] == dht.BucketSize {
+			continue
+		}
+
+		if bucket == 3 && inBucket[3] == 1 {
+			continue
+		}
+
+		_, err := db.Insert(e)
+		fatalErr(err, t)
+
+		inBucket[bucket]++
+	}
+
+	coverage := db.Coverage()
+
+	if len(coverage) != dht.AddressBinarySize*8 {
+		t.Fatalf("Expected %d buckets, got %d", dht.AddressBinarySize*8, len(coverage))
+	}
+
+	expected := []float64{1, 0, 0, 1 / float64(dht.BucketSize)}
+	for n, i := range expected {
+		if coverage[n] != i {
+			t.Fatalf("Bucket %d: expected %f, got %f", n, i, coverage[n])
+		}
+	}
+
+	for n, i := range coverage[len(expected):] {
+		if i != 0 {
+			t.Fatalf("Bucket %d should be empty", n+len(expected))
+		}
+	}
+
+	score := db.CoverageScore()
+	want := (1 + 1/float64(dht.BucketSize)) / 4
+
+	if score != want {
+		t.Fatalf("Expected a coverage score of %f, got %f", want, score)
+	}
+}
+
+func TestRandomAddressInBucket(t *testing.T) {
+	self := randomAddress(t)
+
+	for _, n := range []int{0, 1, 7, 8, 13, dht.AddressBinarySize*8 - 1} {
+		addr, err := dht.RandomAddressInBucket(self, n)
+		fatalErr(err, t)
+
+		if bucket := addr.Xor(self).LeadingZeroes(); bucket != n {
+			t.Fatalf("Wanted an address in bucket %d, got %d", n, bucket)
+		}
+	}
+
+	if _, err := dht.RandomAddressInBucket(self, dht.AddressBinarySize*8); err == nil {
+		t.Fatal("Address made for a bucket that doesn't exist")
+	}
+}
+
+func TestTableFlushCoalesces(t *testing.T) {
+	path := ".testing/" + randString(16) + ".dat"
+	db := dbWithTable(t, path)
+	defer db.Close()
+
+	// long enough that the ticker will never fire during the test
+	db.StartFlusher(time.Hour)
+
+	for i := 0; i < 5; i++ {
+		_, err := db.Insert(randomEntry(t))
+		fatalErr(err, t)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("Table saved on insert, should wait for the flush interval")
+	}
+
+	// stopping should save immediately
+	db.StopFlusher()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("Table not saved on stop: ", err.Error())
+	}
+
+	loaded := dbWithTable(t, path)
+	defer loaded.Close()
+	loaded.LoadTable()
+
+	if loaded.TableLen() != 5 {
+		t.Fatalf("Saved table has %d entries, expected 5", loaded.TableLen())
+	}
+}
+
+func TestTableFlushInterval(t *testing.T) {
+	path := ".testing/" + randString(16) + ".dat"
+	db := dbWithTable(t, path)
+
+	db.StartFlusher(time.Millisecond * 50)
+	defer db.Close()
+
+	_, err := db.Insert(randomEntry(t))
+	fatalErr(err, t)
+
+	time.Sleep(time.Millisecond * 200)
+
+	info, err := os.Stat(path)
+	fatalErr(err, t)
+
+	// nothing has changed, so nothing more should be written
+	time.Sleep(time.Millisecond * 200)
+
+	after, err := os.Stat(path)
+	fatalErr(err, t)
+
+	if !info.ModTime().Equal(after.ModTime()) {
+		t.Fatal("Table saved when it had not changed")
+	}
+}
+
+// The flusher saves the table while inserts change it, run with -race.
+func TestTableFlushWhileInserting(t *testing.T) {
+	path := ".testing/" + randString(16) + ".dat"
+	db := dbWithTable(t, path)
+	defer db.Close()
+
+	// randString isn't safe to share between goroutines
+	entries := make([]dht.Entry, 40)
+	for n := range entries {
+		entries[n] = randomEntry(t)
+	}
+
+	db.StartFlusher(time.Millisecond)
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(entries []dht.Entry) {
+			for _, e := range entries {
+				if _, err := db.Insert(e); err != nil {
+					t.Error(err.Error())
+				}
+				db.TableLen()
+				db.CoverageScore()
+			}
+
+			done <- true
+		}(entries[i*10 : i*10+10])
+	}
+
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	db.StopFlusher()
+
+	loaded := dbWithTable(t, path)
+	defer loaded.Close()
+	loaded.LoadTable()
+
+	if loaded.TableLen() == 0 || loaded.TableLen() != db.TableLen() {
+		t.Fatalf("Saved table has %d addresses, expected %d", loaded.TableLen(), db.TableLen())
+	}
+}
+
+func TestTableFlush(t *testing.T) {
+	path := ".testing/" + randString(16) + ".dat"
+	db := dbWithTable(t, path)
+	defer db.Close()
+
+	_, err := db.Insert(randomEntry(t))
+	fatalErr(err, t)
+
+	fatalErr(db.Flush(), t)
+
+	loaded := dbWithTable(t, path)
+	defer loaded.Close()
+	loaded.LoadTable()
+
+	if loaded.TableLen() != 1 {
+		t.Fatalf("Flushed table has %d entries, expected 1", loaded.TableLen())
+	}
+}
+
+func TestNetDBClose(t *testing.T) {
+	path := ".testing/" + randString(16) + ".dat"
+	db := dbWithTable(t, path)
+	db.StartFlusher(time.Hour)
+
+	_, err := db.Insert(randomEntry(t))
+	fatalErr(err, t)
+
+	fatalErr(db.Close(), t)
+
+	// closing twice is fine
+	fatalErr(db.Close(), t)
+
+	if _, err := db.Len(); err == nil {
+		t.Fatal("Statements still usable after close")
+	}
+
+	loaded := dbWithTable(t, path)
+	defer loaded.Close()
+	loaded.LoadTable()
+
+	if loaded.TableLen() != 1 {
+		t.Fatal("Table not flushed on close")
+	}
+}
+
+func TestNetDBCloseUnsaved(t *testing.T) {
+	// nowhere to write the table to
+	path := ".testing/" + randString(16) + "/table.dat"
+	db := dbWithTable(t, path)
+
+	_, err := db.Insert(randomEntry(t))
+	fatalErr(err, t)
+
+	if db.Close() == nil {
+		t.Fatal("Table that couldn't be saved not reported")
+	}
+
+	if _, err := db.Len(); err == nil {
+		t.Fatal("Statements still usable after close")
+	}
+}
+
+func TestNetDBUseAfterClose(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	entry := randomEntry(t)
+
+	_, err := db.Insert(entry)
+	fatalErr(err, t)
+
+	fatalErr(db.Close(), t)
+
+	if _, err := db.Insert(randomEntry(t)); err == nil {
+		t.Fatal("Insert succeeded after close")
+	}
+
+	if _, _, err := db.Query(entry.Address); err == nil {
+		t.Fatal("Query succeeded after close")
+	}
+
+	if _, _, err := db.QueryLatest(0, 0); err == nil {
+		t.Fatal("QueryLatest succeeded after close")
+	}
+
+	if _, err := db.SearchPeer("a", "a", 0); err == nil {
+		t.Fatal("SearchPeer succeeded after close")
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	makeTesting()
+	db := dbWithRandomAddress(b)
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		entry := randomEntry(b)
+		b.StartTimer()
+
+		db.Insert(entry)
+	}
+
+	removeTesting()
+}
+
+func BenchmarkQuery(b *testing.B) {
+	makeTesting()
+	db := dbWithRandomAddress(b)
+
+	for n := 0; n < b.N; n++ {
+		// don't time the actual inserting!
+		// this is not what we are measuring in this case
+		b.StopTimer()
+		entry := randomEntry(b)
+		db.Insert(entry)
+		b.StartTimer()
+
+		db.Query(entry.Address)
+	}
+
+	removeTesting()
+}
+
+func BenchmarkVerifyEntries(b *testing.B) {
+	entries := make([]*dht.Entry, 100)
+
+	for i := range entries {
+		e := randomEntry(b)
+		entries[i] = &e
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dht.VerifyEntries(entries, 0)
+	}
+}
+
+func benchmarkLookup(b *testing.B, raw bool) {
+	makeTesting()
+	defer removeTesting()
+
+	db := dbWithRandomAddress(b)
+	defer db.Close()
+
+	fatalErr(db.SetRawAddresses(raw), b)
+
+	addresses := make([]dht.Address, 100)
+	for i := range addresses {
+		entry := randomEntry(b)
+		_, err := db.Insert(entry)
+		fatalErr(err, b)
+
+		addresses[i] = entry.Address
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		db.Query(addresses[n%len(addresses)])
+	}
+}
+
+func BenchmarkLookupEncoded(b *testing.B) {
+	benchmarkLookup(b, false)
+}
+
+func BenchmarkLookupRaw(b *testing.B) {
+	benchmarkLookup(b, true)
+}
+
+func TestSetBucketSize(t *testing.T) {
+	self := randomAddress(t)
+
+	db, err := dht.NewNetDB(*self, ".testing/"+randString(16), "")
+	fatalErr(err, t)
+	defer db.Close()
+
+	if db.BucketSize() != dht.BucketSize {
+		t.Fatalf("Expected the default bucket size, got %d", db.BucketSize())
+	}
+
+	// half of all addresses land in bucket 0
+	for inBucket := 0; inBucket < 8; {
+		e := randomEntry(t)
+
+		if e.Address.Xor(self).LeadingZeroes() != 0 {
+			continue
+		}
+
+		_, err := db.Insert(e)
+		fatalErr(err, t)
+
+		inBucket++
+	}
+
+	db.SetBucketSize(4)
+
+	if coverage := db.Coverage(); coverage[0] != 1 {
+		t.Fatalf("Bucket 0 should be trimmed to full, coverage is %f", coverage[0])
+	}
+
+	closest, err := db.FindClosest(*self)
+	fatalErr(err, t)
+
+	if len(closest) != 4 {
+		t.Fatalf("Expected 4 closest, got %d", len(closest))
+	}
+
+	db.SetBucketSize(0)
+
+	if db.BucketSize() != dht.BucketSize {
+		t.Fatal("Unset bucket size should be the default")
+	}
+}
+
+func TestMaxEntrySeeds(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	dht.SetMaxEntrySeeds(10)
+	defer dht.SetMaxEntrySeeds(0)
+
+	entry := signedEntry(t, "seedy", "", uint64(time.Now().Unix()), withFields(func(e *dht.Entry) {
+		for i := 0; i < 11; i++ {
+			e.Seeds = append(e.Seeds, randomAddress(t).Raw)
+		}
+	}))
+
+	if err := entry.Verify(); err != dht.ErrTooManySeeds {
+		t.Fatal("Expected ErrTooManySeeds, got ", err)
+	}
+
+	if _, err := db.Insert(entry); err == nil {
+		t.Fatal("Entry with too many seeds was inserted")
+	}
+
+	if stored, _, _ := db.Query(entry.Address); stored != nil {
+		t.Fatal("Entry with too many seeds was stored")
+	}
+
+	// still signed, so fine once the limit allows it
+	dht.SetMaxEntrySeeds(11)
+
+	if err := entry.Verify(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	versioned := func(name string, version uint64) dht.Entry {
+		return signedEntry(t, name, "", 0, withKey(priv), withFields(func(e *dht.Entry) {
+			e.Version = version
+		}))
+	}
+
+	entry := versioned("first", 1)
+	_, err = db.Insert(entry)
+	fatalErr(err, t)
+
+	first, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	// changing what was returned mustn't change what's cached
+	first.Name = "changed"
+	first.Seeds = append(first.Seeds, randomAddress(t).Raw)
+
+	cached, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if cached.Name != "first" || len(cached.Seeds) != 0 {
+		t.Fatal("Cached entry was changed through a query result")
+	}
+
+	if stats := db.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatal("Unexpected cache stats: ", stats)
+	}
+
+	_, err = db.Update(versioned("second", 2))
+	fatalErr(err, t)
+
+	updated, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if updated.Name != "second" {
+		t.Fatal("Stale entry returned after an update: ", updated.Name)
+	}
+
+	_, err = db.DeleteEntry(entry.Address)
+	fatalErr(err, t)
+
+	if deleted, _, _ := db.Query(entry.Address); deleted != nil {
+		t.Fatal("Deleted entry still returned")
+	}
+
+	db.SetQueryCache(0, 0)
+	db.Query(entry.Address)
+
+	if stats := db.CacheStats(); stats.Size != 0 {
+		t.Fatal("Disabled cache still holds entries: ", stats)
+	}
+}
+
+func TestEntryWork(t *testing.T) {
+	entry := randomEntry(t)
+	entry.DoWork(16)
+
+	if entry.WorkBits() < 16 {
+		t.Fatal("Work found does not pass its own difficulty")
+	}
+
+	// barring a 1 in 2^16 fluke, the next version needs work of its own
+	entry.Version++
+
+	if entry.WorkBits() >= 16 {
+		t.Fatal("Work carried over to another version")
+	}
+}
+
+func TestInsertWork(t *testing.T) {
+	dht.SetMinEntryWork(8)
+	defer dht.SetMinEntryWork(0)
+
+	db := dbWithRandomAddress(t)
+	defer db.Close()
+
+	// less than wanted, which a Work of 0 might just have
+	lazy := func() dht.Entry {
+		entry := randomEntry(t)
+
+		for entry.WorkBits() >= 8 {
+			entry.Work++
+		}
+
+		return entry
+	}
+
+	entry := lazy()
+
+	if _, err := db.Insert(entry); err != dht.ErrTooLittleWork {
+		t.Fatal("Expected ErrTooLittleWork, got ", err)
+	}
+
+	entry.DoWork(8)
+
+	if _, err := db.Insert(entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a batch isn't refused over one, it is just left out
+	worked := randomEntry(t)
+	worked.DoWork(8)
+	skipped := lazy()
+
+	affected, err := db.InsertMany([]dht.Entry{skipped, worked})
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if affected != 1 {
+		t.Fatalf("Expected 1 entry inserted, got %d", affected)
+	}
+
+	if e, _, _ := db.Query(skipped.Address); e != nil {
+		t.Fatal("Entry with too little work inserted")
+	}
+
+	if e, _, _ := db.Query(worked.Address); e == nil || e.Work != worked.Work {
+		t.Fatal("Work not stored with the entry")
+	}
 }
@@ -24,11 +24,19 @@
 // For more information, please refer to <http://unlicense.org/>
 package dht
 
+import "github.com/dfindex/dfi/util"
+
 /*
 	This file stores all the SQL queries needed for the NetDB.
 	It will also be used to prepare all SQL statements :)
 */
 
+// The columns read into an Entry, in order. Listed explicitly rather than using
+// SELECT * so adding a column doesn't break every scan.
+const entrySelect = `SELECT id, address, name, desc, publicAddress, port,
+	publicKey, signature, collectionHash, postCount, seedCount, seedingCount,
+	updated, seen, publicAddresses, version, seedsSigned, seedList, work FROM entry `
+
 const (
 	/*
 		id             - primary key
@@ -44,9 +52,17 @@ const (
 		seedCount      - the number of seeds this node has
 		updated        - when this entry was last updated by the node, or another adding seeds
 		seen           - when this node was last seen online
+		lastQueried    - when we last looked this entry up, a rough measure of popularity
+		publicAddresses - every address the node can be reached at, JSON encoded
+		version        - set by the node, an older version never replaces a newer one
+		seedsSigned    - whether the seeds are part of the signature
+		seedList       - if so, the raw seed addresses exactly as signed
+		reputation     - how much we trust the node, ours alone and never sent on
+		work           - proof of work for this version of the entry
 
 		DFI addresses are stored encoded mostly because it makes debugging *far*
-		easier, at the code of some extra encoding and decoding.
+		easier, at the code of some extra encoding and decoding. They can be
+		stored as raw bytes instead, see NetDB.SetRawAddresses.
 	*/
 	sqlCreateEntriesTable = `
 			CREATE TABLE IF NOT EXISTS
@@ -64,10 +80,20 @@ const (
 					seedCount INT,
 					seedingCount INT,
 					updated INT,
-					seen INT
+					seen INT,
+					lastQueried INTEGER DEFAULT 0,
+					publicAddresses STRING DEFAULT '',
+					version INTEGER DEFAULT 0,
+					seedsSigned INTEGER DEFAULT 0,
+					seedList BLOB,
+					reputation INTEGER DEFAULT 0
 				)
 	`
 
+	sqlAddWork = `
+			ALTER TABLE entry ADD COLUMN work INTEGER DEFAULT 0
+	`
+
 	// Create the seeds table, using to link together seeds and the actual node
 	// constraint should make sure we don't end up with duplicate seeds
 	// TODO: Make sure the constraint is only one way. IE, allow both x,y and y,x
@@ -104,8 +130,33 @@ const (
 				seedCount=?,
 				seedingCount=?,
 				updated=?,
-				seen=?
-			WHERE address=?
+				seen=MAX(seen, ?),
+				publicAddresses=?,
+				version=?,
+				seedsSigned=?,
+				seedList=?,
+				work=?
+			WHERE address=? AND version<=?
+	`
+
+	// Only ever moves forward, we may well have seen a peer more recently than
+	// whoever sent us its entry.
+	sqlUpdateSeen = `
+			UPDATE entry SET seen=MAX(seen, ?) WHERE address=?
+	`
+
+	sqlUpdateReputation = `
+			UPDATE entry SET reputation=? WHERE address=?
+	`
+
+	sqlQueryReputation = `
+			SELECT reputation FROM entry WHERE address=?
+	`
+
+	// Entries that haven't been seen, or updated, since the given time. Never
+	// returns the given address, that's us.
+	sqlQueryStale = `
+		SELECT address FROM entry WHERE MAX(seen, updated) < ? AND address != ?
 	`
 
 	sqlInsertEntry = `
@@ -122,9 +173,14 @@ const (
 				seedCount,
 				seedingCount,
 				updated,
-				seen
+				seen,
+				publicAddresses,
+				version,
+				seedsSigned,
+				seedList,
+				work
 			)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	sqlInsertSeed = `
@@ -143,15 +199,43 @@ const (
 	`
 
 	// We need an index on addresses, as nodes wll be fetched by index really
-	// quite often. Most of the time actually! It's probably a good idea to cache
-	// in RAM for n seconds.
+	// quite often. Most of the time actually! Query caches them in RAM for a
+	// few seconds too.
 	sqlIndexAddresses = `
 			CREATE INDEX IF NOT EXISTS
 				addressIndex ON entry(address)
 	`
 
+	sqlIndexSeedsFor = `
+			CREATE INDEX IF NOT EXISTS
+				seedForIndex ON seed(for)
+	`
+
+	// can't be run in a transaction
+	sqlVacuum = `VACUUM`
+
+	sqlCheckpointTruncate = `PRAGMA wal_checkpoint(TRUNCATE)`
+
 	sqlQueryAddress = `
-		SELECT * FROM entry WHERE address=?
+		` + entrySelect + ` WHERE address=?
+	`
+
+	sqlUpdateLastQueried = `
+		UPDATE entry SET lastQueried=? WHERE id=?
+	`
+
+	sqlQueryLastQueried = `
+		SELECT lastQueried FROM entry WHERE address=?
+	`
+
+	// For switching between raw and encoded address storage, typeof is either
+	// 'text' or 'blob'.
+	sqlQueryAddressesByType = `
+		SELECT id, address FROM entry WHERE typeof(address)=?
+	`
+
+	sqlUpdateAddress = `
+		UPDATE entry SET address=? WHERE id=?
 	`
 
 	sqlQueryIdByAddress = `
@@ -175,19 +259,89 @@ const (
 			WHERE seed.seed = ?
 	`
 
+	// For removing an entry. The fts row has to go first, as it is an external
+	// content table it reads the old values from entry to update the index.
+	sqlDeleteFtsEntry = `
+		DELETE FROM ftsEntry WHERE docid=?
+	`
+
+	sqlDeleteSeeds = `
+		DELETE FROM seed WHERE seed=? OR for=?
+	`
+
+	sqlDeleteSeed = `
+		DELETE FROM seed WHERE seed=? AND for=?
+	`
+
+	// only after a seed was really deleted, so they can't go wrong
+	sqlDecrementSeedCount = `
+		UPDATE entry SET seedCount=seedCount-1 WHERE id=? AND seedCount>0
+	`
+
+	sqlDecrementSeedingCount = `
+		UPDATE entry SET seedingCount=seedingCount-1 WHERE id=? AND seedingCount>0
+	`
+
+	sqlDeleteEntry = `
+		DELETE FROM entry WHERE id=?
+	`
+
+	// Entries with a seed count in the given range, weakest first or strongest
+	// first.
+	sqlQueryBySeedCountAsc = `
+		` + entrySelect + ` WHERE seedCount BETWEEN ? AND ?
+		ORDER BY seedCount ASC, id DESC
+		LIMIT ?,?
+	`
+
+	sqlQueryBySeedCountDesc = `
+		` + entrySelect + ` WHERE seedCount BETWEEN ? AND ?
+		ORDER BY seedCount DESC, id DESC
+		LIMIT ?,?
+	`
+
+	// MAX(id) drifts from the real count once entries are deleted, COUNT is
+	// also never NULL on an empty table.
 	sqlEntryLen = `
-		SELECT MAX(id) FROM entry
+		SELECT COUNT(*) FROM entry
 	`
 
+	// Every entry, oldest first.
+	sqlQueryAllEntries = `
+		` + entrySelect + ` ORDER BY id ASC
+	`
+
+	// ids only ever go up, so paging by them never skips or repeats entries
 	sqlQueryLatest = `
-		SELECT * FROM entry ORDER BY id DESC LIMIT 20
+		` + entrySelect + ` WHERE id < ? ORDER BY id DESC LIMIT ?
 	`
 
+	// Newest first, the id breaks ties so pages don't overlap.
 	sqlSearchEntries = `
-		SELECT entry.address FROM entry 
-			WHERE entry.id=(
+		SELECT entry.address FROM entry
+			WHERE entry.id IN (
 				SELECT docid FROM ftsEntry WHERE name MATCH ? OR desc MATCH ?
 			)
+		ORDER BY entry.updated DESC, entry.id DESC
 		LIMIT ?,?
 	`
 )
+
+// Schema changes made after a database has been created, run in order by
+// util.Migrate. Only ever add to the end of this.
+var migrations = []util.Migration{
+	// the seed lists of an entry are looked up by seed.for, the unique
+	// constraint only helps looking up by seed
+	util.Statement(sqlIndexSeedsFor),
+
+	util.Statement(sqlAddWork),
+
+	// added to the entry table before migrations were tracked, newer databases
+	// already have them from the CREATE TABLE
+	util.AddColumn("entry", "lastQueried", "INTEGER DEFAULT 0"),
+	util.AddColumn("entry", "publicAddresses", "STRING DEFAULT ''"),
+	util.AddColumn("entry", "version", "INTEGER DEFAULT 0"),
+	util.AddColumn("entry", "seedsSigned", "INTEGER DEFAULT 0"),
+	util.AddColumn("entry", "seedList", "BLOB"),
+	util.AddColumn("entry", "reputation", "INTEGER DEFAULT 0"),
+}
@@ -0,0 +1,193 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dfindex/dfi/data"
+)
+
+const (
+	// How many peers a federated search asks, unless configured otherwise.
+	DefaultFedSearchPeers = 10
+
+	// How long a federated search waits on peers, unless configured otherwise.
+	DefaultFedSearchTimeout = time.Second * 10
+)
+
+// Anything that can take part in a federated search. Peers already are.
+type Searcher interface {
+	Search(query string, page int) (*data.SearchResult, error)
+}
+
+// Searches our own database.
+type localSearcher struct {
+	lp *LocalPeer
+}
+
+func (ls localSearcher) Search(query string, page int) (*data.SearchResult, error) {
+	res, err := ls.lp.SearchProvider.Search(ls.lp.Address().StringOr(""),
+		ls.lp.Database, query, page)
+
+	return &res, err
+}
+
+// Searches at most fanout of the searchers at once, passing results on as they
+// arrive with any posts that have already been sent removed. The channel is
+// closed once everyone has answered, or timeout has passed.
+func FederatedSearch(searchers []Searcher, query string, page, fanout int, timeout time.Duration) <-chan *data.SearchResult {
+	if fanout > 0 && len(searchers) > fanout {
+		searchers = searchers[:fanout]
+	}
+
+	// buffered so that searches finishing after the timeout don't block
+	results := make(chan *data.SearchResult, len(searchers))
+
+	for _, i := range searchers {
+		go func(s Searcher) {
+			res, err := s.Search(query, page)
+
+			if err != nil {
+				log.Error("Federated search failed: ", err.Error())
+				res = nil
+			}
+
+			results <- res
+		}(i)
+	}
+
+	ret := make(chan *data.SearchResult)
+
+	go func() {
+		defer close(ret)
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		seen := make(map[string]bool)
+
+		for remaining := len(searchers); remaining > 0; remaining-- {
+			var res *data.SearchResult
+
+			select {
+			case res = <-results:
+			case <-timer.C:
+				log.WithField("unanswered", remaining).Info("Federated search timed out")
+				return
+			}
+
+			if res == nil {
+				continue
+			}
+
+			posts := make([]*data.Post, 0, len(res.Posts))
+
+			for _, p := range res.Posts {
+				if p == nil || seen[p.InfoHash] {
+					continue
+				}
+
+				seen[p.InfoHash] = true
+				posts = append(posts, p)
+			}
+
+			if len(posts) == 0 {
+				continue
+			}
+
+			select {
+			case ret <- &data.SearchResult{Posts: posts, Source: res.Source}:
+			case <-timer.C:
+				return
+			}
+		}
+	}()
+
+	return ret
+}
+
+// Streams search results as Server-Sent Events, a "result" event for each
+// and then "done" once there are no more.
+func WriteSearchEvents(w http.ResponseWriter, results <-chan *data.SearchResult) {
+	send := startEvents(w)
+
+	for res := range results {
+		send("result", res)
+	}
+
+	send("done", struct{}{})
+}
+
+// Streams posts as Server-Sent Events, a "data:" line for each and then a
+// "done" event once there are no more.
+func WritePostEvents(w http.ResponseWriter, posts <-chan *data.Post) {
+	send := startEvents(w)
+
+	for post := range posts {
+		send("", post)
+	}
+
+	send("done", struct{}{})
+}
+
+// Writes the headers for an event stream, returning a function that sends an
+// event and flushes it straight away. An empty name sends a plain message.
+func startEvents(w http.ResponseWriter) func(string, interface{}) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	flush()
+
+	return func(event string, v interface{}) {
+		enc, err := json.Marshal(v)
+
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		if event != "" {
+			fmt.Fprintf(w, "event: %s\n", event)
+		}
+
+		fmt.Fprintf(w, "data: %s\n\n", enc)
+		flush()
+	}
+}
@@ -0,0 +1,250 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/dfindex/dfi/data"
+)
+
+type mockSearcher struct {
+	source string
+	delay  time.Duration
+	hashes []string
+	fail   bool
+	calls  *int32
+}
+
+func (ms mockSearcher) Search(query string, page int) (*data.SearchResult, error) {
+	if ms.calls != nil {
+		atomic.AddInt32(ms.calls, 1)
+	}
+
+	time.Sleep(ms.delay)
+
+	if ms.fail {
+		return nil, errors.New("Mock failure")
+	}
+
+	posts := make([]*data.Post, 0, len(ms.hashes))
+	for _, i := range ms.hashes {
+		posts = append(posts, &data.Post{InfoHash: i, Title: query})
+	}
+
+	return &data.SearchResult{Posts: posts, Source: ms.source}, nil
+}
+
+type event struct {
+	name string
+	data string
+}
+
+func readEvents(body string) []event {
+	events := make([]event, 0)
+	var current event
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, current)
+			current = event{}
+		}
+	}
+
+	return events
+}
+
+func TestFederatedSearchEvents(t *testing.T) {
+	searchers := []dfi.Searcher{
+		mockSearcher{source: "slow", delay: time.Millisecond * 100, hashes: []string{"a", "d"}},
+		mockSearcher{source: "fast", hashes: []string{"a", "b"}},
+		mockSearcher{source: "middle", delay: time.Millisecond * 50, hashes: []string{"b", "c"}},
+		mockSearcher{source: "broken", fail: true},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dfi.WriteSearchEvents(w, dfi.FederatedSearch(searchers, "query", 0, 10, time.Second))
+	})
+
+	req, _ := http.NewRequest("GET", "/self/fedsearch/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	w := httptest.NewRecorder()
+
+	// streamed responses must not be held back to be compressed
+	dfi.CompressHandler(handler, 0).ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("Event stream was compressed")
+	}
+
+	if w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong content type: ", w.Header().Get("Content-Type"))
+	}
+
+	events := readEvents(w.Body.String())
+
+	expected := []struct {
+		source string
+		hashes []string
+	}{
+		{"fast", []string{"a", "b"}},
+		{"middle", []string{"c"}},
+		{"slow", []string{"d"}},
+	}
+
+	if len(events) != len(expected)+1 {
+		t.Fatalf("Expected %d events, got %d: %v", len(expected)+1, len(events), events)
+	}
+
+	for n, i := range expected {
+		if events[n].name != "result" {
+			t.Fatal("Expected a result event, got ", events[n].name)
+		}
+
+		var res data.SearchResult
+		if err := json.Unmarshal([]byte(events[n].data), &res); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if res.Source != i.source || len(res.Posts) != len(i.hashes) {
+			t.Fatalf("Event %d: expected %s %v, got %s with %d posts", n, i.source,
+				i.hashes, res.Source, len(res.Posts))
+		}
+
+		for m, h := range i.hashes {
+			if res.Posts[m].InfoHash != h {
+				t.Fatalf("Event %d: expected %s, got %s", n, h, res.Posts[m].InfoHash)
+			}
+		}
+	}
+
+	if events[len(events)-1].name != "done" {
+		t.Fatal("Stream not finished with a done event")
+	}
+}
+
+func TestFederatedSearchBounds(t *testing.T) {
+	var calls int32
+
+	searchers := []dfi.Searcher{
+		mockSearcher{source: "quick", hashes: []string{"a"}, calls: &calls},
+		mockSearcher{source: "stuck", delay: time.Second * 5, hashes: []string{"b"}, calls: &calls},
+		mockSearcher{source: "ignored", hashes: []string{"c"}, calls: &calls},
+	}
+
+	start := time.Now()
+	results := make([]*data.SearchResult, 0)
+
+	for res := range dfi.FederatedSearch(searchers, "query", 0, 2, time.Millisecond*100) {
+		results = append(results, res)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("Search did not give up on a stuck peer, took ", elapsed)
+	}
+
+	if len(results) != 1 || results[0].Source != "quick" {
+		t.Fatal("Expected only the quick result, got ", results)
+	}
+
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("Expected 2 peers searched, got %d", calls)
+	}
+}
+
+func TestSearchStreamEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searchstream")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	db := data.NewDatabase(filepath.Join(dir, "posts.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	for n, i := range []string{"ubuntu desktop", "ubuntu server", "debian"} {
+		if _, err = db.InsertPost(data.Post{InfoHash: fmt.Sprintf("%040d", n), Title: i}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err = db.GenerateFts(0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	dfi.WritePostEvents(w, db.SearchStream(context.Background(), "ubuntu", 0, 25))
+
+	if w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong content type: ", w.Header().Get("Content-Type"))
+	}
+
+	events := readEvents(w.Body.String())
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 2 posts and done, got %v", events)
+	}
+
+	for _, i := range events[:2] {
+		var post data.Post
+		if err := json.Unmarshal([]byte(i.data), &post); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !strings.HasPrefix(post.Title, "ubuntu") {
+			t.Fatal("Unexpected post streamed: ", post.Title)
+		}
+	}
+
+	if events[2].name != "done" {
+		t.Fatal("Stream not finished with a done event")
+	}
+}
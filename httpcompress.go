@@ -0,0 +1,167 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this are sent as they are, compressing them isn't
+// worth the effort.
+const CompressThreshold = 1024
+
+// Holds on to the response so we can decide whether to compress it once we
+// know how large it is.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+
+	// Set once the handler flushes, everything after goes straight through
+	streaming bool
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	br.status = status
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	if br.streaming {
+		return br.ResponseWriter.Write(b)
+	}
+
+	return br.body.Write(b)
+}
+
+// A streamed response can't wait around to be compressed, so flushing sends
+// whatever has been written so far as it is and stops buffering.
+func (br *bufferedResponse) Flush() {
+	if !br.streaming {
+		br.streaming = true
+		br.ResponseWriter.WriteHeader(br.status)
+		br.ResponseWriter.Write(br.body.Bytes())
+		br.body.Reset()
+	}
+
+	if f, ok := br.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// A q of 0 means the client won't take it, and gzip itself counts for more
+// than a wildcard.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+
+	for _, i := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(i, ";")
+		enc := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+
+			var err error
+			q, err = strconv.ParseFloat(p[2:], 64)
+
+			// not worth guessing what they meant
+			if err != nil {
+				q = 0
+			}
+		}
+
+		if enc == "gzip" {
+			gzipQ = q
+		} else if enc == "*" {
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+
+	return anyQ > 0
+}
+
+// Things that are already compressed gain nothing from gzip.
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	ct := h.Get("Content-Type")
+
+	for _, i := range []string{"image/", "video/", "audio/", "application/zip",
+		"application/gzip", "application/x-gzip"} {
+		if strings.HasPrefix(ct, i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Gzips responses larger than threshold, if the client says it can handle it.
+func CompressHandler(next http.Handler, threshold int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		br := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(br, r)
+
+		if br.streaming {
+			return
+		}
+
+		if br.body.Len() < threshold || !compressible(w.Header()) {
+			w.WriteHeader(br.status)
+			w.Write(br.body.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(br.status)
+
+		gz := gzip.NewWriter(w)
+		gz.Write(br.body.Bytes())
+		gz.Close()
+	})
+}
@@ -0,0 +1,114 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dfindex/dfi"
+)
+
+func compressed(t *testing.T, body []byte, encoding string) *httptest.ResponseRecorder {
+	handler := dfi.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(body)
+	}), dfi.CompressThreshold)
+
+	req, err := http.NewRequest("GET", "/", nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestCompressLarge(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"title":"ubuntu"},`), 1000)
+	w := compressed(t, body, "gzip, deflate")
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("Large response not gzipped")
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	raw, err := ioutil.ReadAll(gz)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(raw, body) {
+		t.Fatal("Decompressed body does not match")
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	small := compressed(t, []byte(`{"status":"ok"}`), "gzip")
+
+	if small.Header().Get("Content-Encoding") != "" {
+		t.Fatal("Tiny response was compressed")
+	}
+
+	large := compressed(t, bytes.Repeat([]byte("a"), dfi.CompressThreshold*4), "")
+
+	if large.Header().Get("Content-Encoding") != "" {
+		t.Fatal("Compressed for a client that did not ask for it")
+	}
+}
+
+func TestCompressRefused(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), dfi.CompressThreshold*4)
+
+	for _, i := range []string{"gzip;q=0", "gzip; q=0.0, deflate", "*;q=0", "gzip;q=0, *"} {
+		if compressed(t, body, i).Header().Get("Content-Encoding") != "" {
+			t.Fatal("Compressed for a client that refused it: ", i)
+		}
+	}
+
+	for _, i := range []string{"gzip;q=0.5", "deflate, *;q=0.1", "*, gzip;q=1"} {
+		if compressed(t, body, i).Header().Get("Content-Encoding") != "gzip" {
+			t.Fatal("Not compressed for a client that accepts it: ", i)
+		}
+	}
+}
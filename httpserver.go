@@ -28,13 +28,19 @@
 package dfi
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	httppprof "net/http/pprof"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -43,10 +49,95 @@ type HttpServer struct {
 	CommandServer *CommandServer
 }
 
+// The most a request adding a post may send, far more than any post needs.
+const MaxPostBody = 1024 * 1024
+
 func (hs *HttpServer) ListenHttp(addr string) {
+	log.WithField("address", addr).Info("Starting HTTP server")
+
+	err := http.ListenAndServe(addr, CompressHandler(hs.Handler(), CompressThreshold))
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// The router, behind a check for the http.token set in the config. CORS comes
+// first, browsers don't send credentials with a preflight.
+func (hs *HttpServer) Handler() http.Handler {
+	return hs.cors(hs.authenticate(hs.Router()))
+}
+
+// Lets browsers on the origins in http.corsOrigins use the API, "*" allowing
+// any. With none set no CORS headers are sent, so browsers keep to the same
+// origin.
+func (hs *HttpServer) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" || !corsAllowed(viper.GetStringSlice("http.corsOrigins"), origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		// a preflight, answered here as routes only match GET and POST
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func corsAllowed(allowed []string, origin string) bool {
+	for _, i := range allowed {
+		if i == "*" || strings.EqualFold(i, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// If http.token is set, every request other than the index and the liveness
+// check needs to carry it as "Authorization: Bearer <token>". Read on every
+// request so that it can be changed without a restart.
+func (hs *HttpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString("http.token")
+
+		if token == "" || r.URL.Path == "/" || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			write_http_response(w, CommandResult{false, nil,
+				Unauthorized(errors.New("Missing or incorrect API token"))})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// All of the API routes, without actually listening.
+func (hs *HttpServer) Router() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.HandleFunc("/", hs.IndexHandler)
+	router.HandleFunc("/health", hs.Liveness).Methods("GET")
 
 	// This should be the ONLY route where the address is a non-DFI address
 
@@ -56,19 +147,28 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/peer/{address}/search/", hs.PeerSearch).Methods("POST")
 	router.HandleFunc("/peer/{address}/suggest/", hs.PeerSuggest).Methods("POST")
 	router.HandleFunc("/peer/{address}/recent/{page}/", hs.Recent)
+	router.HandleFunc("/peer/{address}/recent/", hs.RecentCursor)
 	router.HandleFunc("/peer/{address}/popular/{page}/", hs.Popular)
 	router.HandleFunc("/peer/{address}/mirror/", hs.Mirror)
 	router.HandleFunc("/peer/{address}/mirrorprogress/", hs.MirrorProgress)
 	router.HandleFunc("/peer/{address}/index/{since}/", hs.PeerFtsIndex)
 
 	router.HandleFunc("/self/addpost/", hs.AddPost).Methods("POST")
+	router.HandleFunc("/self/removepost/", hs.RemovePost).Methods("POST")
 	router.HandleFunc("/self/index/{since}/", hs.FtsIndex)
 	router.HandleFunc("/self/resolve/{address}/", hs.Resolve)
 	router.HandleFunc("/self/bootstrap/{address}/", hs.Bootstrap)
 	router.HandleFunc("/self/search/", hs.SelfSearch).Methods("POST")
+	router.HandleFunc("/self/search/cursor/", hs.SelfSearchCursor).Methods("POST")
+	router.HandleFunc("/self/search/stream/", hs.SelfSearchStream)
+	router.HandleFunc("/self/search/mirrors/", hs.MirrorSearch).Methods("POST")
 	router.HandleFunc("/self/suggest/", hs.SelfSuggest).Methods("POST")
+	router.HandleFunc("/self/fedsearch/", hs.FedSearch)
 	router.HandleFunc("/self/recent/{page}/", hs.SelfRecent)
 	router.HandleFunc("/self/popular/{page}/", hs.SelfPopular)
+	router.HandleFunc("/self/recent/", hs.SelfRecentCursor)
+	router.HandleFunc("/self/since/{timestamp}/", hs.SelfSince)
+	router.HandleFunc("/self/popular/", hs.SelfPopularCursor)
 	router.HandleFunc("/self/addmeta/{pid}/", hs.AddMeta).Methods("POST")
 	router.HandleFunc("/self/savecollection/", hs.SaveCollection)
 	router.HandleFunc("/self/rebuildcollection/", hs.RebuildCollection)
@@ -78,22 +178,46 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/self/get/{key}/", hs.SelfGet)
 
 	router.HandleFunc("/self/explore/", hs.SelfExplore)
+	router.HandleFunc("/self/rejoin/", hs.Rejoin)
+	router.HandleFunc("/self/health/", hs.Health)
+	router.HandleFunc("/self/stats/", hs.Stats)
+	router.HandleFunc("/self/tags/", hs.TagCounts)
+	router.HandleFunc("/self/histogram/", hs.SeederHistogram)
+	router.HandleFunc("/self/dbbench/", hs.DbBenchmark)
+	router.HandleFunc("/self/vacuum/", hs.Vacuum).Methods("POST")
+	router.HandleFunc("/self/export/", hs.Export)
+	router.HandleFunc("/self/import/", hs.Import).Methods("POST")
 	router.HandleFunc("/self/encode/", hs.AddressEncode).Methods("POST")
 	router.HandleFunc("/self/searchentry/", hs.SearchEntry).Methods("POST")
+	router.HandleFunc("/self/seedcount/", hs.EntrySeedCount)
+	router.HandleFunc("/self/seeding/", hs.SeedingList).Methods("GET")
+	router.HandleFunc("/self/seeding/{address}/", hs.StopSeeding).Methods("DELETE")
 
 	router.HandleFunc("/self/profile/cpu/", hs.CpuProfile).Methods("POST")
 	router.HandleFunc("/self/profile/mem/", hs.MemProfile).Methods("POST")
 
+	if viper.GetBool("http.pprof") {
+		debugRoutes(router)
+	}
+
 	router.HandleFunc("/self/seedleech/", hs.SetSeedLeech).Methods("POST")
 	router.HandleFunc("/self/map/", hs.NetMap)
 
-	log.WithField("address", addr).Info("Starting HTTP server")
-
-	err := http.ListenAndServe(addr, router)
+	return router
+}
 
-	if err != nil {
-		panic(err)
+// The standard pprof handlers under /self/debug/pprof/. They expect to be at
+// /debug/pprof/, so see the path without the /self.
+func debugRoutes(router *mux.Router) {
+	debug := func(h http.HandlerFunc) http.Handler {
+		return http.StripPrefix("/self", h)
 	}
+
+	router.Handle("/self/debug/pprof/cmdline", debug(httppprof.Cmdline))
+	router.Handle("/self/debug/pprof/profile", debug(httppprof.Profile))
+	router.Handle("/self/debug/pprof/symbol", debug(httppprof.Symbol))
+	router.Handle("/self/debug/pprof/trace", debug(httppprof.Trace))
+	router.PathPrefix("/self/debug/pprof/").Handler(debug(httppprof.Index))
 }
 
 func write_http_response(w http.ResponseWriter, cr CommandResult) {
@@ -102,7 +226,20 @@ func write_http_response(w http.ResponseWriter, cr CommandResult) {
 	if cr.IsOK {
 		err = http.StatusOK
 	} else {
-		err = http.StatusInternalServerError
+		switch cr.Category() {
+		case CategoryBadRequest:
+			err = http.StatusBadRequest
+		case CategoryNotFound:
+			err = http.StatusNotFound
+		case CategoryUnauthorized:
+			err = http.StatusUnauthorized
+		case CategoryRateLimited:
+			err = http.StatusTooManyRequests
+		case CategoryUnavailable:
+			err = http.StatusServiceUnavailable
+		default:
+			err = http.StatusInternalServerError
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -131,11 +268,11 @@ func (hs *HttpServer) PeerRSearch(w http.ResponseWriter, r *http.Request) {
 
 	pagei, err := strconv.Atoi(page)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.RSearch(
+	write_http_response(w, hs.CommandServer.RSearch(r.Context(),
 		CommandRSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
@@ -148,11 +285,11 @@ func (hs *HttpServer) PeerSearch(w http.ResponseWriter, r *http.Request) {
 
 	pagei, err := strconv.Atoi(page)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerSearch(
+	write_http_response(w, hs.CommandServer.PeerSearch(r.Context(),
 		CommandPeerSearch{CommandPeer{addr}, query, pagei}))
 }
 func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
@@ -163,13 +300,19 @@ func (hs *HttpServer) Recent(w http.ResponseWriter, r *http.Request) {
 
 	pagei, err := strconv.Atoi(page)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerRecent(
+	write_http_response(w, hs.CommandServer.PeerRecent(r.Context(),
 		CommandPeerRecent{CommandPeer{addr}, pagei}))
 }
+func (hs *HttpServer) RecentCursor(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.PeerRecentCursor(CommandPeerRecentCursor{
+		CommandPeer{vars["address"]}, CommandCursor{r.FormValue("cursor")}}))
+}
 func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -178,11 +321,11 @@ func (hs *HttpServer) Popular(w http.ResponseWriter, r *http.Request) {
 
 	pagei, err := strconv.Atoi(page)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.PeerPopular(
+	write_http_response(w, hs.CommandServer.PeerPopular(r.Context(),
 		CommandPeerPopular{CommandPeer{addr}, pagei}))
 }
 func (hs *HttpServer) Mirror(w http.ResponseWriter, r *http.Request) {
@@ -205,7 +348,7 @@ func (hs *HttpServer) PeerFtsIndex(w http.ResponseWriter, r *http.Request) {
 
 	sincei, err := strconv.Atoi(since)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -213,30 +356,46 @@ func (hs *HttpServer) PeerFtsIndex(w http.ResponseWriter, r *http.Request) {
 		CommandPeerIndex{CommandPeer{addr}, sincei}))
 }
 
+// Takes either a JSON body, or a form with the post JSON in "data". For JSON
+// bodies index can be in the post or the query string.
 func (hs *HttpServer) AddPost(w http.ResponseWriter, r *http.Request) {
-	pj := r.FormValue("data")
-	index := r.FormValue("index") == "true"
-
 	var post CommandAddPost
-	err := json.Unmarshal([]byte(pj), &post)
+	var err error
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxPostBody)
+
+	if isJSON(r) {
+		err = json.NewDecoder(r.Body).Decode(&post)
+		post.Index = post.Index || r.URL.Query().Get("index") == "true"
+	} else {
+		err = json.Unmarshal([]byte(r.FormValue("data")), &post)
+		post.Index = r.FormValue("index") == "true"
+	}
 
 	if err != nil {
-		fmt.Println("oh noes")
-		fmt.Println(pj)
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
-	post.Index = index
-
 	write_http_response(w, hs.CommandServer.AddPost(post))
 }
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && mediaType == "application/json"
+}
+func (hs *HttpServer) RemovePost(w http.ResponseWriter, r *http.Request) {
+	infoHash := r.FormValue("infohash")
+
+	write_http_response(w, hs.CommandServer.RemovePost(CommandRemovePost{infoHash}))
+}
 func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	since, err := strconv.Atoi(vars["since"])
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -260,12 +419,82 @@ func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 	page := r.FormValue("page")
 
 	pagei, err := strconv.Atoi(page)
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+		return
+	}
+
+	highlight := r.FormValue("highlight") == "true"
+
+	write_http_response(w, hs.CommandServer.SelfSearch(CommandSelfSearch{CommandSuggest{query}, pagei, highlight}))
+}
+
+func (hs *HttpServer) MirrorSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.MirrorSearch(CommandSelfSearch{CommandSuggest{query}, page, false}))
+}
+
+func (hs *HttpServer) FedSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+
+	page := 0
+	if p := r.FormValue("page"); p != "" {
+		var err error
+
+		if page, err = strconv.Atoi(p); err != nil {
+			write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+			return
+		}
+	}
+
+	peers := make([]string, 0)
+	for _, i := range strings.Split(r.FormValue("peers"), ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			peers = append(peers, i)
+		}
+	}
+
+	results, err := hs.CommandServer.FedSearch(CommandFedSearch{query, page, peers})
+
 	if err != nil {
 		write_http_response(w, CommandResult{false, nil, err})
 		return
 	}
 
-	write_http_response(w, hs.CommandServer.SelfSearch(CommandSelfSearch{CommandSuggest{query}, pagei}))
+	WriteSearchEvents(w, results)
+}
+
+func (hs *HttpServer) SelfSearchStream(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+
+	page := 0
+	if p := r.FormValue("page"); p != "" {
+		var err error
+
+		if page, err = strconv.Atoi(p); err != nil {
+			write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+			return
+		}
+	}
+
+	// the request context ends the search if the client goes away
+	WritePostEvents(w, hs.CommandServer.SelfSearchStream(r.Context(),
+		CommandSelfSearch{CommandSuggest{query}, page, false}))
+}
+
+func (hs *HttpServer) SelfSearchCursor(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	cursor := r.FormValue("cursor")
+
+	write_http_response(w, hs.CommandServer.SelfSearchCursor(
+		CommandSelfSearchCursor{CommandSuggest{query}, CommandCursor{cursor}}))
 }
 
 func (hs *HttpServer) SelfSuggest(w http.ResponseWriter, r *http.Request) {
@@ -292,23 +521,49 @@ func (hs *HttpServer) SelfRecent(w http.ResponseWriter, r *http.Request) {
 
 	page, err := strconv.Atoi(vars["page"])
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
 	write_http_response(w, hs.CommandServer.SelfRecent(CommandSelfRecent{page}))
 }
+func (hs *HttpServer) SelfSince(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	since, err := strconv.ParseInt(vars["timestamp"], 10, 64)
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+		return
+	}
+
+	page := 0
+	if p := r.FormValue("page"); p != "" {
+		page, err = strconv.Atoi(p)
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.SelfSince(CommandSelfSince{since, page}))
+}
 func (hs *HttpServer) SelfPopular(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	page, err := strconv.Atoi(vars["page"])
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
 	write_http_response(w, hs.CommandServer.SelfPopular(CommandSelfPopular{page}))
 }
+func (hs *HttpServer) SelfRecentCursor(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.SelfRecentCursor(CommandCursor{r.FormValue("cursor")}))
+}
+func (hs *HttpServer) SelfPopularCursor(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.SelfPopularCursor(CommandCursor{r.FormValue("cursor")}))
+}
 func (hs *HttpServer) AddMeta(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -316,7 +571,7 @@ func (hs *HttpServer) AddMeta(w http.ResponseWriter, r *http.Request) {
 	meta := r.FormValue("meta")
 
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -362,11 +617,73 @@ func (hs *HttpServer) SelfExplore(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.Explore())
 }
 
+func (hs *HttpServer) Rejoin(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Rejoin())
+}
+
+func (hs *HttpServer) Health(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Health())
+}
+
+func (hs *HttpServer) Liveness(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Liveness())
+}
+
+func (hs *HttpServer) Stats(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Stats())
+}
+
+func (hs *HttpServer) TagCounts(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+
+		if limit, err = strconv.Atoi(l); err != nil {
+			write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.TagCounts(CommandTagCounts{limit}))
+}
+
+func (hs *HttpServer) SeederHistogram(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.SeederHistogram())
+}
+
+func (hs *HttpServer) DbBenchmark(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.DbBenchmark())
+}
+
+func (hs *HttpServer) Vacuum(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Vacuum())
+}
+
+// The status has gone out before the posts, so a failure part way through can
+// only cut the export short.
+func (hs *HttpServer) Export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=posts.ndjson")
+
+	res := hs.CommandServer.Export(w)
+
+	if !res.IsOK {
+		log.Error("Export failed: ", res.Error.Error())
+	}
+}
+
+func (hs *HttpServer) Import(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	write_http_response(w, hs.CommandServer.Import(r.Body))
+}
+
 func (hs *HttpServer) AddressEncode(w http.ResponseWriter, r *http.Request) {
 	decoded, err := base64.StdEncoding.DecodeString(r.FormValue("raw"))
 
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -406,21 +723,21 @@ func (hs *HttpServer) SetSeedLeech(w http.ResponseWriter, r *http.Request) {
 	id_s, err := strconv.Atoi(id)
 
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
 	seed_s, err := strconv.Atoi(seed)
 
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
 	leech_s, err := strconv.Atoi(leech)
 
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -434,9 +751,7 @@ func (hs *HttpServer) SetSeedLeech(w http.ResponseWriter, r *http.Request) {
 }
 
 func (hs *HttpServer) IndexHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("DFI"))
+	write_http_response(w, hs.CommandServer.Info())
 }
 
 func (hs *HttpServer) SearchEntry(w http.ResponseWriter, r *http.Request) {
@@ -446,7 +761,7 @@ func (hs *HttpServer) SearchEntry(w http.ResponseWriter, r *http.Request) {
 
 	pagei, err := strconv.Atoi(page)
 	if err != nil {
-		write_http_response(w, CommandResult{false, nil, err})
+		write_http_response(w, CommandResult{false, nil, BadRequest(err)})
 		return
 	}
 
@@ -454,7 +769,63 @@ func (hs *HttpServer) SearchEntry(w http.ResponseWriter, r *http.Request) {
 		CommandSearchEntry{name, desc, pagei}))
 }
 
+func (hs *HttpServer) EntrySeedCount(w http.ResponseWriter, r *http.Request) {
+	var csc CommandSeedCount
+	var err error
+
+	for _, i := range []struct {
+		name string
+		val  *int
+	}{{"min", &csc.Min}, {"max", &csc.Max}, {"page", &csc.Page}} {
+		*i.val, err = strconv.Atoi(r.FormValue(i.name))
+
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, BadRequest(err)})
+			return
+		}
+	}
+
+	csc.Ascending = r.FormValue("order") != "desc"
+
+	write_http_response(w, hs.CommandServer.EntrySeedCount(csc))
+}
+
+func (hs *HttpServer) SeedingList(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.SeedingList())
+}
+
+func (hs *HttpServer) StopSeeding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	write_http_response(w, hs.CommandServer.StopSeeding(CommandStopSeeding{vars["address"]}))
+}
+
 func (hs *HttpServer) NetMap(w http.ResponseWriter, r *http.Request) {
+	var write func(io.Writer, []MapNode, []MapLink) error
+
+	switch r.FormValue("format") {
+	case "", "json":
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
+		write = WriteNetMapDot
+	case "gexf":
+		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+		write = WriteNetMapGexf
+	default:
+		write_http_response(w, CommandResult{false, nil, BadRequest(errors.New("Unknown map format"))})
+		return
+	}
+
 	res := hs.CommandServer.NetMap(CommandNetMap{hs.CommandServer.LocalPeer.Entry.Address.StringOr("")})
-	write_http_response(w, res)
+
+	if write == nil || !res.IsOK {
+		write_http_response(w, res)
+		return
+	}
+
+	ret := res.Result.(map[string]interface{})
+
+	if err := write(w, ret["nodes"].([]MapNode), ret["links"].([]MapLink)); err != nil {
+		log.Error(err.Error())
+	}
 }
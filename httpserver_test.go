@@ -0,0 +1,763 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+	"github.com/spf13/viper"
+	"github.com/streamrail/concurrent-map"
+)
+
+func request(t *testing.T, url string) *httptest.ResponseRecorder {
+	// no local peer, these should all fail before needing one
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(nil)}
+
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	hs.Router().ServeHTTP(w, req)
+
+	return w
+}
+
+func TestHttpBadAddress(t *testing.T) {
+	w := request(t, "/self/resolve/0OIl/")
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad address, got %d", w.Code)
+	}
+}
+
+func TestHttpNotFound(t *testing.T) {
+	w := request(t, "/peer/nothere/mirrorprogress/")
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing mirror, got %d", w.Code)
+	}
+}
+
+func TestHttpBadPage(t *testing.T) {
+	w := request(t, "/self/recent/notapage/")
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad page, got %d", w.Code)
+	}
+}
+
+func TestHttpAddPostBadJSON(t *testing.T) {
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(nil)}
+
+	req, err := http.NewRequest("POST", "/self/addpost/", strings.NewReader("{\"Title\": "))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	w := httptest.NewRecorder()
+	hs.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a truncated body, got %d", w.Code)
+	}
+}
+
+func TestHttpAddPostJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addpostjson")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(lp)}
+
+	add := func(url, body string) int {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		hs.Router().ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	unindexed := fmt.Sprintf(`{"InfoHash": "%s", "Title": "plain"}`, strings.Repeat("a", 40))
+	if code := add("/self/addpost/", unindexed); code != http.StatusOK {
+		t.Fatalf("Expected 200 adding a post, got %d", code)
+	}
+
+	indexed := fmt.Sprintf(`{"InfoHash": "%s", "Title": "findable"}`, strings.Repeat("b", 40))
+	if code := add("/self/addpost/?index=true", indexed); code != http.StatusOK {
+		t.Fatalf("Expected 200 adding an indexed post, got %d", code)
+	}
+
+	if lp.Database.PostCount() != 2 {
+		t.Fatalf("Expected 2 posts, got %d", lp.Database.PostCount())
+	}
+
+	if found, err := lp.Database.Search("plain", 0, 10); err != nil || len(found) != 0 {
+		t.Fatal("Post indexed without asking: ", err)
+	}
+
+	if found, err := lp.Database.Search("findable", 0, 10); err != nil || len(found) != 1 {
+		t.Fatal("Post not indexed when asked: ", err)
+	}
+
+	huge := fmt.Sprintf(`{"InfoHash": "%s", "Title": "%s"}`, strings.Repeat("c", 40),
+		strings.Repeat("x", dfi.MaxPostBody))
+	if code := add("/self/addpost/", huge); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an oversized body, got %d", code)
+	}
+}
+
+func TestHttpIndex(t *testing.T) {
+	lp := freshPeer(t)
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(lp)}
+	hs.CommandServer.Version = "1.2.3"
+
+	req, err := http.NewRequest("GET", "/", nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	hs.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Status string
+		Value  map[string]interface{}
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if resp.Value["address"] != lp.Address().StringOr("") {
+		t.Fatal("Wrong address: ", resp.Value["address"])
+	}
+
+	if resp.Value["version"] != "1.2.3" {
+		t.Fatal("Wrong version: ", resp.Value["version"])
+	}
+
+	for _, i := range []string{"protocolVersion", "uptime"} {
+		if _, ok := resp.Value[i]; !ok {
+			t.Fatal("Missing field: ", i)
+		}
+	}
+
+	if len(resp.Value) != 4 {
+		t.Fatal("Unexpected fields: ", resp.Value)
+	}
+}
+
+func TestHttpToken(t *testing.T) {
+	viper.Set("http.token", "secret")
+	defer viper.Set("http.token", nil)
+
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(freshPeer(t))}
+
+	for _, i := range []struct {
+		path, auth string
+		code       int
+	}{
+		{"/self/recent/notapage/", "", http.StatusUnauthorized},
+		{"/self/recent/notapage/", "Bearer wrong", http.StatusUnauthorized},
+		{"/self/recent/notapage/", "secret", http.StatusUnauthorized},
+		// through to the handler, which dislikes the page
+		{"/self/recent/notapage/", "Bearer secret", http.StatusBadRequest},
+		{"/", "", http.StatusOK},
+		// no databases or peers, but not turned away either
+		{"/health", "", http.StatusServiceUnavailable},
+	} {
+		req, err := http.NewRequest("GET", i.path, nil)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if i.auth != "" {
+			req.Header.Set("Authorization", i.auth)
+		}
+
+		w := httptest.NewRecorder()
+		hs.Handler().ServeHTTP(w, req)
+
+		if w.Code != i.code {
+			t.Fatalf("%s with %q: expected %d, got %d", i.path, i.auth, i.code, w.Code)
+		}
+	}
+}
+
+func TestHttpCors(t *testing.T) {
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(freshPeer(t))}
+
+	serve := func(method, origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/self/search/", nil)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		w := httptest.NewRecorder()
+		hs.Handler().ServeHTTP(w, req)
+
+		return w
+	}
+
+	// nothing configured, nothing changes
+	if w := serve("OPTIONS", "http://ui.example"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers sent with no origins configured")
+	}
+
+	viper.Set("http.corsOrigins", []string{"http://ui.example"})
+	viper.Set("http.token", "secret")
+	defer viper.Set("http.corsOrigins", nil)
+	defer viper.Set("http.token", nil)
+
+	// preflights don't carry the token
+	w := serve("OPTIONS", "http://ui.example")
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a preflight, got %d", w.Code)
+	}
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://ui.example" ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "POST") ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Fatal("Missing CORS headers: ", w.Header())
+	}
+
+	if w := serve("OPTIONS", "http://other.example"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers sent for an origin not allowed")
+	}
+
+	// still refused, but the browser can read why
+	w = serve("POST", "http://ui.example")
+
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("Expected a 401 with CORS headers, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestHttpPprof(t *testing.T) {
+	if w := request(t, "/self/debug/pprof/"); w.Code != http.StatusNotFound {
+		t.Fatalf("Profiler served without being enabled, got %d", w.Code)
+	}
+
+	viper.Set("http.pprof", true)
+	defer viper.Set("http.pprof", nil)
+
+	if w := request(t, "/self/debug/pprof/"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the profiler index, got %d", w.Code)
+	}
+
+	if w := request(t, "/self/debug/pprof/goroutine?debug=1"); w.Code != http.StatusOK {
+		t.Fatalf("Expected a goroutine profile, got %d", w.Code)
+	}
+}
+
+func TestCpuProfileTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	cs := dfi.NewCommandServer(nil)
+	path := filepath.Join(dir, "cpu.prof")
+
+	if res := cs.StartCpuProfile(dfi.CommandFile{path}); !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	defer cs.StopCpuProfile()
+
+	if res := cs.StartCpuProfile(dfi.CommandFile{path}); res.IsOK || res.Category() != dfi.CategoryBadRequest {
+		t.Fatal("Started profiling twice")
+	}
+
+	if res := cs.StopCpuProfile(); !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	if res := cs.StopCpuProfile(); !res.IsOK {
+		t.Fatal("Stopping with no profile running failed: ", res.Error)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liveness")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+
+	lp.Database = data.NewDatabase(filepath.Join(dir, "posts.db"))
+	if err := lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lp.Database.Close()
+
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	lp.Server = proto.NewServer(nil)
+	go lp.Server.Listen("127.0.0.1:0", lp, lp.Entry)
+	defer lp.Server.Close()
+
+	for lp.Server.Addr() == nil {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// everything but peers is up
+	res := dfi.NewCommandServer(lp).Liveness()
+
+	if res.IsOK || res.Category() != dfi.CategoryUnavailable {
+		t.Fatal("Live with no peers")
+	}
+
+	if msg := res.Error.Error(); msg != "peers: none connected" {
+		t.Fatal("Unexpected failures: ", msg)
+	}
+}
+
+func TestLivenessOK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livenessok")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := listeningPeer(t, "local")
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+	defer lp.Server.Close()
+
+	if _, err = lp.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(lp)}
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	hs.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with everything up, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "stats", 2, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	cs := dfi.NewCommandServer(lp)
+	res := cs.Stats()
+
+	if !res.IsOK {
+		t.Fatal(res.Error.Error())
+	}
+
+	stats := res.Result.(map[string]interface{})
+	entries, err := lp.DHT.Len()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stats["entries"] != entries || stats["posts"] != uint(2) || stats["peers"] != 0 || stats["seeding"] != 0 {
+		t.Fatal("Unexpected counts: ", stats)
+	}
+
+	for _, i := range []string{"uptime", "table", "cache", "rejected"} {
+		if _, ok := stats[i]; !ok {
+			t.Fatal("Stats missing ", i)
+		}
+	}
+
+	// counting is cached, so none of this shows up yet
+	other := servingPeer(t, "other", 0, 10)
+	defer other.DHT.Close()
+	defer other.Database.Close()
+
+	if err = other.PrepareEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = lp.DHT.Insert(*other.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = lp.Database.InsertPost(data.Post{InfoHash: fmt.Sprintf("a%039d", 0), Title: "late"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stats = cs.Stats().Result.(map[string]interface{})
+
+	if stats["entries"] != entries || stats["posts"] != uint(2) {
+		t.Fatal("Counts not cached: ", stats)
+	}
+
+	fresh := dfi.NewCommandServer(lp).Stats().Result.(map[string]interface{})
+
+	if fresh["entries"] != entries+1 || fresh["posts"] != uint(3) {
+		t.Fatal("New entry and post not counted: ", fresh)
+	}
+}
+
+func TestHttpPeerNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peernotfound")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	// knows nobody, so nobody can be found
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(lp)}
+	missing := freshPeer(t).Address().StringOr("")
+
+	req, err := http.NewRequest("GET", "/peer/"+missing+"/ping/", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	hs.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown peer, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHttpPeerRateLimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerratelimited")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if _, err = lp.DHT.Insert(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hs := dfi.HttpServer{CommandServer: dfi.NewCommandServer(lp)}
+
+	announce := func() int {
+		req, err := http.NewRequest("GET", "/peer/"+remote.Address().StringOr("")+"/announce/", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		hs.Router().ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// connecting announces too, and a few more are allowed but not many
+	if code := announce(); code == http.StatusTooManyRequests {
+		t.Fatal("Rate limited straight away")
+	}
+
+	for i := 0; i < 5; i++ {
+		announce()
+	}
+
+	if code := announce(); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once over the announce limit, got %d", code)
+	}
+}
+
+func TestLocalSetAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localset")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	cs := dfi.NewCommandServer(lp)
+
+	if res := cs.LocalSet(dfi.CommandLocalSet{"addresses", "192.0.2.1, [2001:db8::1],abc.onion"}); !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	if res := cs.LocalGet(dfi.CommandLocalGet{"addresses"}); res.Result != "192.0.2.1,[2001:db8::1],abc.onion" {
+		t.Fatal("Addresses not set: ", res.Result)
+	}
+
+	if err = lp.Entry.Verify(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// nothing changes for one that isn't a host
+	res := cs.LocalSet(dfi.CommandLocalSet{"addresses", "192.0.2.1:5050"})
+
+	if res.IsOK || res.Category() != dfi.CategoryBadRequest {
+		t.Fatal("Address with a port was accepted")
+	}
+
+	if len(lp.Entry.PublicAddresses) != 3 {
+		t.Fatal("Addresses changed by a bad request")
+	}
+
+	// back to just the public address
+	if res := cs.LocalSet(dfi.CommandLocalSet{"addresses", ""}); !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	if res := cs.LocalGet(dfi.CommandLocalGet{"addresses"}); res.Result != lp.Entry.PublicAddress {
+		t.Fatal("Addresses not cleared: ", res.Result)
+	}
+}
+
+func TestPeerRecentCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerrecentcursor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.Databases = cmap.New()
+
+	open := func(name, prefix string, count int) *data.Database {
+		db := data.NewDatabase(filepath.Join(dir, name+".db"))
+
+		if err := db.Connect(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for i := 0; i < count; i++ {
+			_, err := db.InsertPost(data.Post{InfoHash: fmt.Sprintf("%s%039d", prefix, i), Title: name})
+
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		return db
+	}
+
+	lp.Database = open("own", "a", 30)
+	defer lp.Database.Close()
+
+	mirrored := freshPeer(t).Address().StringOr("")
+	mirror := open("mir", "b", 3)
+	defer mirror.Close()
+	lp.Databases.Set(mirrored, mirror)
+
+	cs := dfi.NewCommandServer(lp)
+	cursor := func(addr, c string) dfi.CommandPeerRecentCursor {
+		return dfi.CommandPeerRecentCursor{dfi.CommandPeer{addr}, dfi.CommandCursor{c}}
+	}
+
+	// ours, over two pages
+	res := cs.PeerRecentCursor(cursor(lp.Address().StringOr(""), ""))
+	if !res.IsOK {
+		t.Fatal(res.Error)
+	}
+
+	page := res.Result.(*data.CursorPage)
+	if len(page.Posts) != 25 || page.Next == "" {
+		t.Fatalf("Expected a full first page, got %d posts", len(page.Posts))
+	}
+
+	res = cs.PeerRecentCursor(cursor(lp.Address().StringOr(""), page.Next))
+	if page = res.Result.(*data.CursorPage); !res.IsOK || len(page.Posts) != 5 || page.Next != "" {
+		t.Fatal("Expected the last 5 posts on the second page")
+	}
+
+	// read from the mirror, not our own posts
+	res = cs.PeerRecentCursor(cursor(mirrored, ""))
+	if page = res.Result.(*data.CursorPage); !res.IsOK || len(page.Posts) != 3 || page.Posts[0].Title != "mir" {
+		t.Fatal("Mirrored posts not returned")
+	}
+
+	res = cs.PeerRecentCursor(cursor(freshPeer(t).Address().StringOr(""), ""))
+	if res.IsOK || res.Category() != dfi.CategoryNotFound {
+		t.Fatal("Expected NotFound for a peer that isn't mirrored")
+	}
+
+	res = cs.PeerRecentCursor(cursor(mirrored, "not a cursor"))
+	if res.IsOK || res.Category() != dfi.CategoryBadRequest {
+		t.Fatal("Expected BadRequest for a bad cursor")
+	}
+}
+
+func TestMirrorSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorsearch")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.Databases = cmap.New()
+	lp.SearchProvider = data.NewSearchProvider()
+
+	open := func(name, prefix string, seeders int) *data.Database {
+		db := data.NewDatabase(filepath.Join(dir, name+".db"))
+
+		if err := db.Connect(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		_, err := db.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("%s%039d", prefix, 0),
+			Title:    "ubuntu " + name,
+			Seeders:  seeders,
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err = db.GenerateFts(0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		return db
+	}
+
+	lp.Database = open("own", "a", 1)
+	defer lp.Database.Close()
+
+	mirror := open("mirror", "b", 10)
+	defer mirror.Close()
+	lp.Databases.Set(freshPeer(t).Address().StringOr(""), mirror)
+
+	// with nothing to search, so every search of it fails
+	broken := open("broken", "c", 5)
+	defer broken.Close()
+	lp.Databases.Set(freshPeer(t).Address().StringOr(""), broken)
+
+	conn, err := sql.Open("sqlite3", filepath.Join(dir, "broken.db"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = conn.Exec("DROP TABLE fts_post"); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.Close()
+
+	res := dfi.NewCommandServer(lp).MirrorSearch(dfi.CommandSelfSearch{dfi.CommandSuggest{"ubuntu"}, 0, false})
+
+	if !res.IsOK {
+		t.Fatal("Search failed with a broken mirror: ", res.Error)
+	}
+
+	posts := res.Result.([]*data.Post)
+
+	if len(posts) != 2 || posts[0].Title != "ubuntu mirror" || posts[1].Title != "ubuntu own" {
+		t.Fatal("Expected the mirror's better seeded post first, got ", posts)
+	}
+}
@@ -0,0 +1,165 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dfindex/dfi/util"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Identity files starting with this are encrypted, anything else is a bare key
+// from before encryption existed, or one written without a passphrase.
+var keyMagic = []byte("DFIKEY1\n")
+
+// scrypt parameters for new key files, N being the cost. They are stored in the
+// file, so these can go up later without breaking old ones.
+const (
+	KeyScryptN = 1 << 15
+	KeyScryptR = 8
+	KeyScryptP = 1
+
+	// the most a key file can ask for, 128 * N * r bytes of memory is 1GB and
+	// N * r * p is 64 times the work of the defaults
+	keyMaxScryptMemory = 1 << 30
+	keyMaxScryptWork   = KeyScryptN * KeyScryptR * KeyScryptP * 64
+
+	keySaltSize   = 16
+	keyParamsSize = 12
+)
+
+// Returned reading an encrypted identity without a passphrase.
+var ErrKeyEncrypted = errors.New("Identity is encrypted, set identity.passphrase or DFI_PASSPHRASE")
+
+// The key couldn't be decrypted. GCM can't tell a wrong passphrase from a file
+// that has been changed, so this is either.
+var ErrKeyPassphrase = errors.New("Wrong passphrase for identity, or the file is corrupt")
+
+// Whether an identity file was written by EncryptKey, rather than being a bare
+// key.
+func IsEncryptedKey(data []byte) bool {
+	return bytes.HasPrefix(data, keyMagic)
+}
+
+// The AES-256-GCM cipher for a passphrase and salt.
+func keyCipher(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypts a private key with a passphrase. The layout is the magic, salt, the
+// scrypt N, r and p, and GCM nonce, then the sealed key. Everything before the
+// sealed key is authenticated too.
+func EncryptKey(key []byte, passphrase string) ([]byte, error) {
+	salt, err := util.CryptoRandBytes(keySaltSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := keyCipher(passphrase, salt, KeyScryptN, KeyScryptR, KeyScryptP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := util.CryptoRandBytes(aead.NonceSize())
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(keyMagic)+keySaltSize+keyParamsSize+len(nonce))
+	header = append(header, keyMagic...)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, KeyScryptN)
+	header = binary.BigEndian.AppendUint32(header, KeyScryptR)
+	header = binary.BigEndian.AppendUint32(header, KeyScryptP)
+	header = append(header, nonce...)
+
+	return aead.Seal(header, nonce, key, header), nil
+}
+
+// Undoes EncryptKey.
+func DecryptKey(data []byte, passphrase string) ([]byte, error) {
+	if !IsEncryptedKey(data) {
+		return nil, errors.New("Identity is not encrypted")
+	}
+
+	rest := data[len(keyMagic):]
+
+	if len(rest) < keySaltSize+keyParamsSize {
+		return nil, ErrKeyPassphrase
+	}
+
+	salt := rest[:keySaltSize]
+	n := int(binary.BigEndian.Uint32(rest[keySaltSize:]))
+	r := int(binary.BigEndian.Uint32(rest[keySaltSize+4:]))
+	p := int(binary.BigEndian.Uint32(rest[keySaltSize+8:]))
+
+	// a corrupt file shouldn't have us allocating gigabytes
+	if r < 1 || p < 1 || n > keyMaxScryptMemory/128/r || n > keyMaxScryptWork/r/p {
+		return nil, ErrKeyPassphrase
+	}
+
+	aead, err := keyCipher(passphrase, salt, n, r, p)
+
+	// scrypt refuses anything else it can't work with
+	if err != nil {
+		return nil, ErrKeyPassphrase
+	}
+
+	headerSize := len(keyMagic) + keySaltSize + keyParamsSize + aead.NonceSize()
+
+	if len(data) < headerSize {
+		return nil, ErrKeyPassphrase
+	}
+
+	nonce := data[headerSize-aead.NonceSize() : headerSize]
+	key, err := aead.Open(nil, nonce, data[headerSize:], data[:headerSize])
+
+	if err != nil {
+		return nil, ErrKeyPassphrase
+	}
+
+	return key, nil
+}
@@ -0,0 +1,136 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfindex/dfi"
+	"github.com/spf13/viper"
+)
+
+func TestEncryptKey(t *testing.T) {
+	key := []byte("not really an ed25519 private key, but close enough")
+
+	enc, err := dfi.EncryptKey(key, "correct horse")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !dfi.IsEncryptedKey(enc) || bytes.Contains(enc, key) {
+		t.Fatal("Key was not encrypted")
+	}
+
+	dec, err := dfi.DecryptKey(enc, "correct horse")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(dec, key) {
+		t.Fatal("Decrypted key does not match")
+	}
+
+	if _, err := dfi.DecryptKey(enc, "battery staple"); err != dfi.ErrKeyPassphrase {
+		t.Fatal("Expected ErrKeyPassphrase for the wrong passphrase, got ", err)
+	}
+
+	// the header is authenticated as well
+	enc[len(enc)-len(key)-30] ^= 1
+
+	if _, err := dfi.DecryptKey(enc, "correct horse"); err == nil {
+		t.Fatal("Tampered key decrypted")
+	}
+}
+
+func TestDecryptKeyParams(t *testing.T) {
+	enc, err := dfi.EncryptKey([]byte("key"), "correct horse")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// N comes straight after the magic and salt
+	params := len("DFIKEY1\n") + 16
+
+	for _, n := range []uint32{0, 3, 1 << 31} {
+		bad := append([]byte{}, enc...)
+		binary.BigEndian.PutUint32(bad[params:], n)
+
+		if _, err := dfi.DecryptKey(bad, "correct horse"); err != dfi.ErrKeyPassphrase {
+			t.Fatalf("Expected ErrKeyPassphrase for N %d, got %v", n, err)
+		}
+	}
+}
+
+func TestWriteKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writekey")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("identity.passphrase", "correct horse")
+	defer viper.Set("identity.passphrase", nil)
+
+	// left behind by a write that didn't finish
+	if err = ioutil.WriteFile("data/identity.dat.tmp", []byte("partial"), 0400); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp := freshPeer(t)
+
+	// a second write replaces the read only file from the first
+	for i := 0; i < 2; i++ {
+		if err = lp.WriteKey(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	info, err := os.Stat("data/identity.dat")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if info.Mode().Perm() != 0400 {
+		t.Fatalf("Identity written with mode %o", info.Mode().Perm())
+	}
+
+	read := &dfi.LocalPeer{}
+	if err = read.ReadKey(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(read.PublicKey(), lp.PublicKey()) {
+		t.Fatal("Read back a different key")
+	}
+}
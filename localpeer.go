@@ -29,15 +29,19 @@
 package dfi
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/streamrail/concurrent-map"
 	"golang.org/x/crypto/ed25519"
 
@@ -68,6 +72,36 @@ type LocalPeer struct {
 	privateKey  ed25519.PrivateKey
 	peerManager *PeerManager
 	seedManager *SeedManager
+
+	// shared by every piece upload, so the limit is for the whole node
+	uploadLimiter util.ByteLimiter
+
+	// the best proof of work found for our entry, and the version it is for
+	workLock    sync.Mutex
+	work        uint64
+	workVersion uint64
+}
+
+// A copy of our entry with at least difficulty bits of proof of work. Work
+// found is kept, so it's only done again once the entry is signed again or a
+// peer wants more.
+func (lp *LocalPeer) workedEntry(difficulty int) dht.Entry {
+	lp.workLock.Lock()
+	defer lp.workLock.Unlock()
+
+	entry := *lp.Entry
+
+	if entry.Version == lp.workVersion {
+		entry.Work = lp.work
+	}
+
+	if entry.WorkBits() < difficulty {
+		entry.DoWork(difficulty)
+		lp.work = entry.Work
+		lp.workVersion = entry.Version
+	}
+
+	return entry
 }
 
 func (lp *LocalPeer) Setup() {
@@ -83,13 +117,30 @@ func (lp *LocalPeer) Setup() {
 
 	lp.Address().Generate(lp.PublicKey())
 
-	lp.DHT = dht.NewDHT(lp.address, "./data/peers.db")
-	lp.DHT.LoadTable("./data/table.dat")
+	driver := viper.GetString("database.driver")
+	if driver == "" {
+		driver = util.DefaultDriver
+	}
 
-	if err != nil {
+	peers := viper.GetString("database.peers")
+	if peers == "" {
+		peers = "./data/peers.db"
+	}
+
+	lp.DHT = dht.NewDHTDriver(driver, lp.address, peers, "./data/table.dat")
+	lp.DHT.LoadTable()
+	lp.DHT.SetBucketSize(viper.GetInt("net.bucketSize"))
+	dht.SetMaxEntrySeeds(viper.GetInt("net.maxEntrySeeds"))
+	dht.SetMinEntryWork(viper.GetInt("net.announceWork"))
+	lp.DHT.SetQueryCache(viper.GetInt("net.queryCacheSize"), viper.GetDuration("net.queryCacheTTL"))
+
+	if err = lp.DHT.SetRawAddresses(viper.GetBool("net.rawAddresses")); err != nil {
 		panic(err)
 	}
 
+	lp.DHT.SetLivenessCheck(lp.peerManager.IsAlive)
+	lp.DHT.StartFlusher(viper.GetDuration("net.tableFlushInterval"))
+
 	lp.Collection, err = data.LoadCollection("./data/collection.dat")
 
 	if err != nil {
@@ -109,6 +160,7 @@ func (lp *LocalPeer) Setup() {
 			addr := r.FindStringSubmatch(path)
 
 			db := data.NewDatabase(path)
+			db.SetPieceSize(viper.GetInt("database.pieceSize"))
 
 			err = db.Connect()
 
@@ -148,16 +200,49 @@ func (lp *LocalPeer) Setup() {
 
 	lp.capabilities.Compression = append(lp.capabilities.Compression,
 		[]string{"gzip", "none"}...)
+	lp.capabilities.Features = []string{proto.FeatureMirror, proto.FeatureRecentRange,
+		proto.FeatureCompression, proto.FeatureSearchSession}
+	lp.capabilities.AnnounceWork = dht.MinEntryWork()
 
 	lp.Server = proto.NewServer(&lp.capabilities)
+	lp.Server.StreamDeadline = viper.GetDuration("net.streamDeadline")
 }
 
 func (lp *LocalPeer) SignEntry() {
 	lp.Entry.Updated = uint64(time.Now().Unix())
+	lp.Entry.Version++
 	data, _ := lp.Entry.Bytes()
+
+	if len(lp.Entry.Signature) != ed25519.SignatureSize {
+		lp.Entry.Signature = make([]byte, ed25519.SignatureSize)
+	}
+
 	copy(lp.Entry.Signature, ed25519.Sign(lp.privateKey, data))
 }
 
+// Makes sure the entry is complete enough to send to other peers, and signed.
+// A node with no posts yet announces the hash of an empty collection rather
+// than nothing at all.
+func (lp *LocalPeer) PrepareEntry() error {
+	if len(lp.Entry.CollectionHash) == 0 {
+		collection := lp.Collection
+
+		if collection == nil {
+			collection = data.NewCollection()
+		}
+
+		lp.Entry.CollectionHash = collection.Hash()
+	}
+
+	// only signed again if something changed, as a new version needs new
+	// proof of work
+	if lp.Entry.Verify() != nil {
+		lp.SignEntry()
+	}
+
+	return lp.Entry.Verify()
+}
+
 // Sign any bytes.
 func (lp *LocalPeer) Sign(msg []byte) []byte {
 	return ed25519.Sign(lp.privateKey, msg)
@@ -175,7 +260,15 @@ func (lp *LocalPeer) Listen(addr string) {
 	lp.SignEntry()
 	go lp.Server.Listen(addr, lp, lp.Entry)
 	go lp.QuerySelf()
-	go lp.peerManager.LoadSeeds()
+	go func() {
+		// no seed list just means we haven't seeded anything yet
+		if err := lp.peerManager.LoadSeeds(); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed to load seed list: ", err.Error())
+		}
+	}()
+	go lp.peerManager.PruneEntries()
+	go lp.peerManager.RefreshTable()
+	go lp.peerManager.Crawl()
 
 	lp.seedManager.Start()
 }
@@ -193,20 +286,46 @@ func (lp *LocalPeer) GenerateKey() {
 
 // Writes the private key to a file, in this way persisting your identity -
 // all the other addresses can be generated from this, no need to save them.
-// By default this file is "identity.dat"
+// By default this file is "identity.dat". If identity.passphrase is set the key
+// is encrypted with it, see EncryptKey.
 func (lp *LocalPeer) WriteKey() error {
 	if len(lp.privateKey) == 0 {
 		return errors.
 			New("LocalPeer does not have a private key, please generate")
 	}
 
-	err := ioutil.WriteFile("./data/identity.dat", lp.privateKey, 0400)
+	key := []byte(lp.privateKey)
 
-	return err
+	if passphrase := viper.GetString("identity.passphrase"); passphrase != "" {
+		var err error
+		key, err = EncryptKey(key, passphrase)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file is read only, so it can't be written over in place. One left
+	// behind by a crash would be read only too
+	tmp := "./data/identity.dat.tmp"
+	os.Remove(tmp)
+
+	err := ioutil.WriteFile(tmp, key, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp, 0400); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, "./data/identity.dat")
 }
 
 // Read the private key from file. This is the "identity.dat" file. The public
-// key is also then generated from the private key.
+// key is also then generated from the private key. An encrypted key needs
+// identity.passphrase, and a plain one is encrypted once one is set.
 func (lp *LocalPeer) ReadKey() error {
 	pk, err := ioutil.ReadFile("./data/identity.dat")
 
@@ -214,9 +333,31 @@ func (lp *LocalPeer) ReadKey() error {
 		return err
 	}
 
+	passphrase := viper.GetString("identity.passphrase")
+	encrypted := IsEncryptedKey(pk)
+
+	if encrypted {
+		if passphrase == "" {
+			return ErrKeyEncrypted
+		}
+
+		if pk, err = DecryptKey(pk, passphrase); err != nil {
+			return err
+		}
+	}
+
+	if len(pk) != ed25519.PrivateKeySize {
+		return errors.New("Identity is not a private key")
+	}
+
 	lp.privateKey = pk
 	lp.publicKey = lp.privateKey.Public().(ed25519.PublicKey)
 
+	if !encrypted && passphrase != "" {
+		log.Info("Encrypting identity")
+		return lp.WriteKey()
+	}
+
 	return nil
 }
 
@@ -257,7 +398,7 @@ func (lp *LocalPeer) LoadEntry() error {
 
 func (lp *LocalPeer) Close() {
 	lp.CloseStreams()
-	lp.DHT.SaveTable("./data/table.dat")
+	lp.DHT.Close()
 	lp.Server.Close()
 	lp.Database.Close()
 }
@@ -265,17 +406,16 @@ func (lp *LocalPeer) Close() {
 func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 	log.WithField("Title", p.Title).Info("Adding post")
 
-	valid := p.Valid()
+	id, err := lp.Database.InsertPost(p)
 
-	if valid != nil {
-		return -1, valid
+	if err != nil {
+		return -1, err
 	}
 
 	lp.Entry.PostCount += 1
 
-	id, err := lp.Database.InsertPost(p)
-
-	pieceIndex := int(math.Floor(float64(id) / float64(data.PieceSize)))
+	// pieces go by position, the new post is always in the last one
+	pieceIndex := int(math.Floor(float64(lp.Database.PostCount()-1) / float64(lp.Database.PieceSize())))
 	piece, err := lp.Database.QueryPiece(uint(pieceIndex), false)
 
 	lp.Collection.Add(piece)
@@ -297,6 +437,96 @@ func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 	return id, err
 }
 
+// Imports posts written by Database.Export, then rebuilds the collection and
+// re-signs the entry so peers see the new posts.
+func (lp *LocalPeer) ImportPosts(r io.Reader) (int, error) {
+	count, err := lp.Database.Import(r)
+
+	if count == 0 {
+		return count, err
+	}
+
+	if rerr := lp.RebuildCollection(); rerr != nil {
+		return count, rerr
+	}
+
+	return count, err
+}
+
+// Rebuilds the collection from the database, then puts its hash and the post
+// count in the entry and re-signs it. For when the stored collection no longer
+// matches the posts, mirrors of it would all fail verification otherwise.
+func (lp *LocalPeer) RebuildCollection() error {
+	if lp.Collection == nil {
+		lp.Collection = data.NewCollection()
+	}
+
+	if err := lp.Collection.RebuildFrom(lp.Database); err != nil {
+		return err
+	}
+
+	lp.Collection.Save("./data/collection.dat")
+
+	hash := lp.Collection.Hash()
+
+	lp.Entry.PostCount = int(lp.Database.PostCount())
+	lp.Entry.CollectionHash = make([]byte, len(hash))
+	copy(lp.Entry.CollectionHash, hash)
+
+	return lp.SaveEntry()
+}
+
+// Removes a post from the local database, then lets all of our seeds know so
+// that their mirrors stay in sync. Every piece after the post shifts, so the
+// collection is rebuilt and the entry re-signed.
+func (lp *LocalPeer) RemovePost(infoHash string) error {
+	log.WithField("info hash", infoHash).Info("Removing post")
+
+	err := lp.Database.DeleteByInfoHash(infoHash)
+
+	if err != nil {
+		return err
+	}
+
+	err = lp.RebuildCollection()
+
+	if err != nil {
+		return err
+	}
+
+	mpr := proto.MessagePostRemove{
+		Address:   lp.Address().StringOr(""),
+		InfoHash:  infoHash,
+		Timestamp: time.Now().Unix(),
+	}
+	mpr.Sign(lp)
+
+	for _, i := range lp.Entry.Seeds {
+		addr := dht.Address{Raw: i}
+
+		if addr.Equals(lp.Address()) {
+			continue
+		}
+
+		go func(addr dht.Address) {
+			peer, _, err := lp.ConnectPeer(addr)
+
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+
+			err = peer.PostRemove(mpr)
+
+			if err != nil {
+				log.WithField("peer", addr.StringOr("")).Error(err.Error())
+			}
+		}(addr)
+	}
+
+	return nil
+}
+
 func (lp *LocalPeer) StartExploring() error {
 	in := make(chan dht.Entry, jobs.ExploreBufferSize)
 
@@ -450,13 +680,61 @@ func (lp *LocalPeer) seedExplore(in chan dht.Entry, seen *cmap.ConcurrentMap) er
 
 // convenience methods
 func (lp *LocalPeer) PeerCount() int {
+	if lp.peerManager == nil {
+		return 0
+	}
+
 	return lp.peerManager.Count()
 }
 
+func (lp *LocalPeer) SeedCount() int {
+	return lp.peerManager.SeedCount()
+}
+
+func (lp *LocalPeer) SeedingList() []dht.Address {
+	return lp.peerManager.SeedingList()
+}
+
+// Stops seeding addr, and undoes AddSeeding: the feed comes off our entry,
+// which is signed again, and we come off its seeds.
+func (lp *LocalPeer) StopSeeding(addr dht.Address) error {
+	seeding := make([][]byte, 0, len(lp.Entry.Seeding))
+
+	for _, i := range lp.Entry.Seeding {
+		if !bytes.Equal(i, addr.Raw) {
+			seeding = append(seeding, i)
+		}
+	}
+
+	// the seed manager may not have been started yet, the entry still needs
+	// putting right
+	err := lp.peerManager.StopSeeding(addr)
+
+	if err != nil && (err != NotSeeding || len(seeding) == len(lp.Entry.Seeding)) {
+		return err
+	}
+
+	lp.Entry.Seeding = seeding
+
+	if err := lp.DHT.RemoveSeed(addr, *lp.Address()); err != nil {
+		return err
+	}
+
+	return lp.SaveEntry()
+}
+
 func (lp *LocalPeer) Peers() map[string]*Peer {
 	return lp.peerManager.Peers()
 }
 
+func (lp *LocalPeer) LastSeen(addr dht.Address) (time.Time, bool) {
+	return lp.peerManager.LastSeen(addr)
+}
+
+func (lp *LocalPeer) Reputation(addr dht.Address) int {
+	return lp.peerManager.Reputation(addr)
+}
+
 func (lp *LocalPeer) ConnectPeerDirect(addr string) (*Peer, error) {
 	return lp.peerManager.ConnectPeerDirect(addr)
 }
@@ -465,6 +743,14 @@ func (lp *LocalPeer) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error) {
 	return lp.peerManager.ConnectPeer(addr)
 }
 
+func (lp *LocalPeer) CheckReachable(entry *dht.Entry) error {
+	return lp.peerManager.CheckReachable(entry)
+}
+
+func (lp *LocalPeer) BackOff(addr dht.Address, d time.Duration) {
+	lp.peerManager.BackOff(addr, d)
+}
+
 func (lp *LocalPeer) HandleCloseConnection(addr *dht.Address) {
 	lp.peerManager.HandleCloseConnection(addr)
 }
@@ -498,6 +784,12 @@ func (lp *LocalPeer) SetSocksPort(port int) {
 	lp.peerManager.socksPort = port
 }
 
+// Credentials for the SOCKS proxy, an empty user means none.
+func (lp *LocalPeer) SetSocksAuth(user, pass string) {
+	lp.peerManager.socksUser = user
+	lp.peerManager.socksPass = pass
+}
+
 func (lp *LocalPeer) GetSocksPort() int {
 	return lp.peerManager.socksPort
 }
@@ -506,6 +798,10 @@ func (lp *LocalPeer) Resolve(addr dht.Address) (*dht.Entry, error) {
 	return lp.peerManager.Resolve(addr)
 }
 
+func (lp *LocalPeer) Rejoin() RejoinReport {
+	return lp.peerManager.Rejoin()
+}
+
 func (lp *LocalPeer) QueryEntry(addr dht.Address) (*dht.Entry, error) {
 	if addr.Equals(lp.Address()) {
 		return lp.Entry, nil
@@ -577,17 +873,24 @@ func (lp *LocalPeer) AddEntry(entry dht.Entry) error {
 }
 
 func (lp *LocalPeer) AddSeeding(entry dht.Entry) error {
-	// save with the local entry, then the remote
-	lp.Entry.Seeding = append(lp.Entry.Seeding, entry.Address.Raw)
-	entry.Seeds = append(entry.Seeds, lp.Address().Raw)
+	// peers would reject our entry outright with any more
+	if len(lp.Entry.Seeding) >= dht.MaxEntrySeeds() {
+		return errors.New("Cannot seed, already seeding as many peers as an entry can hold")
+	}
 
-	lp.SignEntry()
+	// only the owner can add to a signed seed list, it wouldn't verify
+	if !entry.SignedSeeds {
+		entry.Seeds = append(entry.Seeds, lp.Address().Raw)
+	}
 
+	// the remote entry has to be stored before ours can refer to it
 	err := lp.AddEntry(entry)
 
 	if err != nil {
 		return err
 	}
 
+	lp.Entry.Seeding = append(lp.Entry.Seeding, entry.Address.Raw)
+
 	return lp.SaveEntry()
 }
@@ -0,0 +1,752 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+)
+
+// A local peer with keys and an entry, but nothing else set up.
+func freshPeer(t *testing.T) *dfi.LocalPeer {
+	lp := &dfi.LocalPeer{}
+	lp.GenerateKey()
+
+	if _, err := lp.Address().Generate(lp.PublicKey()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp.Entry = &dht.Entry{
+		Name:          "fresh",
+		Address:       *lp.Address(),
+		PublicKey:     lp.PublicKey(),
+		PublicAddress: "127.0.0.1",
+		Port:          5050,
+	}
+
+	return lp
+}
+
+func TestPrepareEntryNoPosts(t *testing.T) {
+	lp := freshPeer(t)
+	lp.Collection = data.NewCollection()
+
+	if err := lp.PrepareEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(lp.Entry.CollectionHash, data.NewCollection().Hash()) {
+		t.Fatal("Entry does not carry the empty collection hash")
+	}
+
+	if lp.Entry.PostCount != 0 {
+		t.Fatal("Entry claims to have posts")
+	}
+
+	// what a peer would receive should decode and verify
+	enc, err := lp.Entry.EncodeString()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := dht.DecodeEntry([]byte(enc), true); err != nil {
+		t.Fatal("Announced entry does not verify: ", err.Error())
+	}
+
+	// nothing has changed, so the version and its work still stand
+	version := lp.Entry.Version
+
+	if err := lp.PrepareEntry(); err != nil || lp.Entry.Version != version {
+		t.Fatal("Unchanged entry signed again: ", err)
+	}
+
+	lp.Entry.Name = "renamed"
+
+	if err := lp.PrepareEntry(); err != nil || lp.Entry.Version == version {
+		t.Fatal("Changed entry not signed again: ", err)
+	}
+}
+
+func TestPrepareEntryIncomplete(t *testing.T) {
+	lp := freshPeer(t)
+	lp.Entry.PublicAddress = ""
+
+	if err := lp.PrepareEntry(); err == nil {
+		t.Fatal("Entry with no public address was ready to announce")
+	}
+}
+
+func TestHandlePostRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handlepostremove")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	origin := servingPeer(t, "origin", 3, 10)
+	defer origin.DHT.Close()
+	defer origin.Database.Close()
+
+	lp := servingPeer(t, "mirror", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	// we mirror the origin, and know its entry
+	lp.Databases.Set(origin.Address().StringOr(""), origin.Database)
+
+	if _, err = lp.DHT.Insert(*origin.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := connectedTo(t, lp)
+	defer p.Terminate()
+
+	removal := func(id int, age time.Duration, signer *dfi.LocalPeer) proto.MessagePostRemove {
+		mpr := proto.MessagePostRemove{
+			Address:   origin.Address().StringOr(""),
+			InfoHash:  fmt.Sprintf("%040d", id),
+			Timestamp: time.Now().Add(-age).Unix(),
+		}
+		mpr.Sign(signer)
+
+		return mpr
+	}
+
+	if err = p.PostRemove(removal(0, 0, lp)); err == nil {
+		t.Fatal("Removal signed by someone else was accepted")
+	}
+
+	if err = p.PostRemove(removal(1, proto.PostRemoveMaxAge*2, origin)); err == nil {
+		t.Fatal("Stale removal was accepted")
+	}
+
+	if origin.Database.PostCount() != 3 {
+		t.Fatal("Refused removals deleted posts")
+	}
+
+	if err = p.PostRemove(removal(2, 0, origin)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if origin.Database.PostCount() != 2 {
+		t.Fatal("Removal did not delete the post")
+	}
+}
+
+func TestHandlePieceLengthRefused(t *testing.T) {
+	lp := freshPeer(t)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sc, _ := proto.NewClient(server)
+	cc, _ := proto.NewClient(client)
+
+	msg := &proto.Message{Header: proto.ProtoRequestPiece, Client: sc, Stream: server}
+	err := msg.Write(proto.MessageRequestPiece{
+		Address: lp.Address().StringOr(""),
+		Id:      0,
+		Length:  0,
+	})
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	handled := make(chan error, 1)
+	go func() { handled <- lp.HandlePiece(msg) }()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := cc.ReadMessage()
+
+	if err != nil {
+		t.Fatal("No prompt response: ", err.Error())
+	}
+
+	if resp.Header != proto.ProtoNo {
+		t.Fatalf("Expected %q, got %q", proto.ProtoNo, resp.Header)
+	}
+
+	if <-handled == nil {
+		t.Fatal("Empty piece request was accepted")
+	}
+}
+
+// Passes msg to handler over a pipe, returning the response.
+func handle(t *testing.T, msg *proto.Message, handler func(*proto.Message) error) (*proto.Message, error) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sc, _ := proto.NewClient(server)
+	cc, _ := proto.NewClient(client)
+
+	msg.Client = sc
+	msg.Stream = server
+
+	handled := make(chan error, 1)
+	go func() { handled <- handler(msg) }()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := cc.ReadMessage()
+
+	if err != nil {
+		t.Fatal("No prompt response: ", err.Error())
+	}
+
+	return resp, <-handled
+}
+
+func TestHandleRecentRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recent")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.Database = data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lp.Database.Close()
+
+	// two and a bit pages
+	count := proto.MaxPageSize*2 + 5
+	for i := 0; i < count; i++ {
+		_, err := lp.Database.InsertPost(data.Post{
+			InfoHash:   fmt.Sprintf("%040d", i),
+			Title:      fmt.Sprintf("post %d", i),
+			UploadDate: i,
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	expected := make([]*data.Post, 0, count)
+	for page := 0; page < 3; page++ {
+		posts, err := lp.Database.QueryRecent(page)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		expected = append(expected, posts...)
+	}
+
+	msg := &proto.Message{Header: proto.ProtoRecentRange}
+	if err = msg.Write(proto.MessageRecentRange{FromPage: 0, ToPage: 3}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resp, err := handle(t, msg, lp.HandleRecentRange)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var posts []*data.Post
+	if err = resp.Read(&posts); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(posts) != count {
+		t.Fatalf("Expected %d posts, got %d", count, len(posts))
+	}
+
+	for n, i := range posts {
+		if i.InfoHash != expected[n].InfoHash {
+			t.Fatalf("Post %d out of order, expected %s got %s", n, expected[n].InfoHash, i.InfoHash)
+		}
+
+		if n > 0 && i.UploadDate > posts[n-1].UploadDate {
+			t.Fatal("Range not newest first")
+		}
+	}
+}
+
+func TestSeedLimit(t *testing.T) {
+	dht.SetMaxEntrySeeds(2)
+	defer dht.SetMaxEntrySeeds(0)
+
+	lp := freshPeer(t)
+	lp.Entry.Seeds = [][]byte{freshPeer(t).Address().Raw, freshPeer(t).Address().Raw}
+	lp.Entry.Seeding = [][]byte{freshPeer(t).Address().Raw, freshPeer(t).Address().Raw}
+
+	msg := &proto.Message{Header: proto.ProtoRequestAddPeer, From: freshPeer(t).Address()}
+	if err := msg.Write(lp.Address()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resp, err := handle(t, msg, lp.HandleAddPeer)
+
+	if err == nil || resp.Header != proto.ProtoNo {
+		t.Fatal("Seed added past the limit")
+	}
+
+	if len(lp.Entry.Seeds) != 2 {
+		t.Fatal("Seeds changed: ", len(lp.Entry.Seeds))
+	}
+
+	if err = lp.AddSeeding(*freshPeer(t).Entry); err == nil {
+		t.Fatal("Seeding added past the limit")
+	}
+
+	if len(lp.Entry.Seeding) != 2 {
+		t.Fatal("Seeding changed: ", len(lp.Entry.Seeding))
+	}
+}
+
+func TestAddSeedingSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addseeding")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	remote := freshPeer(t)
+	remote.Entry.SignedSeeds = true
+
+	if err = remote.PrepareEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = lp.AddSeeding(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(lp.Entry.Seeding) != 1 || lp.Entry.Verify() != nil {
+		t.Fatal("Seeding not added and signed")
+	}
+
+	saved, err := ioutil.ReadFile("data/entry.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if entry, err := dht.DecodeEntry(saved, true); err != nil || len(entry.Seeding) != 1 {
+		t.Fatal("Seeding not saved: ", err)
+	}
+
+	stored, err := lp.DHT.Query(*remote.Address())
+
+	if err != nil || stored == nil || len(stored.Seeds) != 0 || stored.Verify() != nil {
+		t.Fatal("Signed seed list changed: ", err)
+	}
+}
+
+func TestStopSeedingUndoes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopseeding")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	remote := freshPeer(t)
+
+	if err = remote.PrepareEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = lp.AddSeeding(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stored, err := lp.DHT.Query(*remote.Address()); err != nil || len(stored.Seeds) != 1 {
+		t.Fatal("Not added to the seeds: ", err)
+	}
+
+	if err = lp.StopSeeding(*remote.Address()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(lp.Entry.Seeding) != 0 || lp.Entry.Verify() != nil {
+		t.Fatal("Seeding not removed and signed")
+	}
+
+	for _, addr := range []dht.Address{*remote.Address(), *lp.Address()} {
+		stored, err := lp.DHT.Query(addr)
+
+		if err != nil || len(stored.Seeds) != 0 || len(stored.Seeding) != 0 {
+			t.Fatal("Seed still stored: ", err)
+		}
+	}
+
+	saved, err := ioutil.ReadFile("data/entry.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if entry, err := dht.DecodeEntry(saved, true); err != nil || len(entry.Seeding) != 0 {
+		t.Fatal("Seeding not saved: ", err)
+	}
+
+	if err = lp.StopSeeding(*remote.Address()); err != dfi.NotSeeding {
+		t.Fatal("Expected NotSeeding, got ", err)
+	}
+}
+
+func TestHandleRecentRangeCapped(t *testing.T) {
+	lp := freshPeer(t)
+
+	for _, r := range []proto.MessageRecentRange{
+		{FromPage: 0, ToPage: proto.MaxRecentRangePages},
+		{FromPage: 5, ToPage: 4},
+		{FromPage: -1, ToPage: 2},
+	} {
+		msg := &proto.Message{Header: proto.ProtoRecentRange}
+		if err := msg.Write(r); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		resp, err := handle(t, msg, lp.HandleRecentRange)
+
+		if resp.Header != proto.ProtoNo {
+			t.Fatalf("Range %d-%d: expected %q, got %q", r.FromPage, r.ToPage, proto.ProtoNo, resp.Header)
+		}
+
+		if err == nil {
+			t.Fatalf("Range %d-%d was accepted", r.FromPage, r.ToPage)
+		}
+	}
+}
+
+func TestHandleSearchSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.Database = data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lp.Database.Close()
+
+	// two pages and a bit of matches
+	count := 25*2 + 5
+	for i := 0; i < count; i++ {
+		_, err := lp.Database.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("%040d", i),
+			Title:    fmt.Sprintf("ubuntu %d", i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err = lp.Database.GenerateFts(0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serve := func() (*proto.Client, net.Conn, chan error) {
+		server, client := net.Pipe()
+		sc, _ := proto.NewClient(server)
+		cc, _ := proto.NewClient(client)
+
+		handled := make(chan error, 1)
+		go func() {
+			msg, err := sc.ReadMessage()
+
+			if err != nil {
+				handled <- err
+				return
+			}
+
+			msg.Client = sc
+			handled <- lp.HandleSearch(msg)
+		}()
+
+		return cc, client, handled
+	}
+
+	// a plain search gets its page and nothing more
+	cc, client, handled := serve()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err = cc.Search("ubuntu", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Plain search kept the stream open")
+	}
+
+	cc.Close()
+
+	if _, err = cc.SearchSession("ubuntu", proto.MessageCapabilities{}); err != proto.ErrSearchSessionUnsupported {
+		t.Fatal("Search session started with a peer that doesn't support it")
+	}
+
+	cc, client, handled = serve()
+	caps := proto.MessageCapabilities{Features: []string{proto.FeatureSearchSession}}
+	session, err := cc.SearchSession("ubuntu", caps)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	seen := make(map[string]bool)
+	for _, expected := range []int{25, 25, 5, 0} {
+		client.SetDeadline(time.Now().Add(time.Second))
+		posts, err := session.Next()
+
+		if err != nil {
+			t.Fatalf("Page %d: %s", session.Page(), err.Error())
+		}
+
+		if len(posts) != expected {
+			t.Fatalf("Page %d: expected %d posts, got %d", session.Page()-1, expected, len(posts))
+		}
+
+		for _, i := range posts {
+			seen[i.InfoHash] = true
+		}
+	}
+
+	if len(seen) != count {
+		t.Fatalf("Expected %d distinct posts, got %d", count, len(seen))
+	}
+
+	session.Close()
+
+	if err := <-handled; err != nil {
+		t.Fatal("Session did not end cleanly: ", err.Error())
+	}
+}
+
+// A rebuilt collection has to match what a mirror reconstructs from the
+// pieces it's served, or every mirror fails verification.
+func TestRebuildCollectionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.Database = data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lp.Database.Close()
+
+	lp.Database.SetPieceSize(10)
+
+	for i := 0; i < 35; i++ {
+		_, err := lp.Database.InsertPost(data.Post{
+			InfoHash:   fmt.Sprintf("%040d", i),
+			Title:      fmt.Sprintf("post %d ünïcode", i),
+			Size:       i * 1000,
+			Seeders:    i,
+			UploadDate: i,
+			Tags:       "linux,iso",
+			Meta:       fmt.Sprintf(`{"n":%d}`, i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// gaps in the ids shouldn't matter
+	for _, id := range []uint{3, 17} {
+		if err = lp.Database.DeletePost(id); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	col := data.NewCollection()
+	if err = col.RebuildFrom(lp.Database); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pieceCount := len(col.HashList) / 32
+	if pieceCount != 4 {
+		t.Fatalf("Expected 4 pieces, got %d", pieceCount)
+	}
+
+	received := servedPieces(t, lp, pieceCount)
+
+	if !bytes.Equal(received.HashList, col.HashList) {
+		t.Fatal("Received pieces hash differently to the rebuilt collection")
+	}
+
+	if err = received.Verify(col.Hash()); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// The collection a mirror builds from the pieces lp serves.
+func servedPieces(t *testing.T, lp *dfi.LocalPeer, count int) *data.Collection {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+
+		sc, _ := proto.NewClient(server)
+		msg, err := sc.ReadMessage()
+
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		msg.Client = sc
+		if err = lp.HandlePiece(msg); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+
+	cc, _ := proto.NewClient(client)
+	pieces, errs := cc.Pieces(*lp.Address(), 0, count, lp.Database.PieceSize())
+
+	received := &data.Collection{HashList: make([]byte, 0, count*32)}
+	for piece := range pieces {
+		received.HashList = append(received.HashList, piece.Hash()...)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return received
+}
+
+// Changes to dir with a data directory in it, for anything saved under ./data.
+// Returns a func to change back.
+func inDir(t *testing.T, dir string) func() {
+	wd, _ := os.Getwd()
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Mkdir("data", 0777)
+
+	return func() { os.Chdir(wd) }
+}
+
+// Removing a post shifts every piece after it, mirrors have to be able to
+// verify what they get against the entry afterwards.
+func TestRemovePostMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "removepost")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	defer inDir(t, dir)()
+
+	lp := freshPeer(t)
+	lp.Database = data.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err = lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lp.Database.Close()
+
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	lp.Database.SetPieceSize(10)
+
+	for i := 0; i < 25; i++ {
+		_, err := lp.Database.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("%040d", i),
+			Title:    fmt.Sprintf("post %d", i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err = lp.RebuildCollection(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	before := lp.Entry.CollectionHash
+
+	if err = lp.RemovePost(fmt.Sprintf("%040d", 5)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if bytes.Equal(before, lp.Entry.CollectionHash) {
+		t.Fatal("Collection hash not updated")
+	}
+
+	if lp.Entry.PostCount != 24 {
+		t.Fatal("Expected 24 posts in the entry, got ", lp.Entry.PostCount)
+	}
+
+	if err = lp.Entry.Verify(); err != nil {
+		t.Fatal("Entry not re-signed: ", err.Error())
+	}
+
+	if err = servedPieces(t, lp, 3).Verify(lp.Entry.CollectionHash); err != nil {
+		t.Fatal("Mirror after removal failed: ", err.Error())
+	}
+}
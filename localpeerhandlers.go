@@ -27,17 +27,24 @@ package dfi
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
 	"github.com/dfindex/dfi/proto"
+	"github.com/dfindex/dfi/util"
+	"github.com/hashicorp/yamux"
 )
 
 const MaxSearchLength = 256
@@ -47,11 +54,39 @@ const MaxSearchLength = 256
 // TODO: While I think about it, move all these TODOs to issues or a separate
 // file/issue tracker or something.
 
+// Refuses the message with ProtoNo if the peer it came from is over its limit,
+// saying why so the peer sees proto.ErrRateLimited.
+// Peers we aren't connected to have no limiter, so are let through.
+func (lp *LocalPeer) rateLimit(msg *proto.Message, allow func(*util.PeerLimiter) bool) error {
+	if msg.From == nil {
+		return nil
+	}
+
+	peer := lp.GetPeer(*msg.From)
+
+	if peer == nil || peer.Limiter() == nil || allow(peer.Limiter()) {
+		return nil
+	}
+
+	log.WithField("peer", msg.From.StringOr("")).Info("Rate limited")
+
+	no := &proto.Message{Header: proto.ProtoNo}
+	no.Write(proto.RefusedRateLimited)
+	msg.Client.WriteMessage(no)
+
+	return PeerRateLimited
+}
+
 // Querying peer sends a DFI address
 // This peer will respond with a list of the k closest peers, ordered by distance.
 // The top peer may well be the one that is being queried for :)
 func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 	log.Info("Handling query")
+
+	if err := lp.rateLimit(msg, (*util.PeerLimiter).AllowQuery); err != nil {
+		return err
+	}
+
 	cl := msg.Client
 
 	address := dht.Address{}
@@ -84,7 +119,7 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 		}
 
 		if kv == nil {
-			cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+			return cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 		}
 
 		msg := &proto.Message{Header: proto.ProtoDhtQuery}
@@ -102,6 +137,9 @@ func (lp *LocalPeer) HandleQuery(msg *proto.Message) error {
 }
 
 func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
+	if err := lp.rateLimit(msg, (*util.PeerLimiter).AllowQuery); err != nil {
+		return err
+	}
 
 	cl := msg.Client
 
@@ -127,6 +165,11 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 
 	log.WithField("count", len(pairs)).Debug("Found entries")
 
+	// a bigger bucket size is only for us, peers won't read past this
+	if len(pairs) > proto.MaxClosestEntries {
+		pairs = pairs[:proto.MaxClosestEntries]
+	}
+
 	results.Write(pairs)
 
 	err = cl.WriteMessage(results)
@@ -139,6 +182,10 @@ func (lp *LocalPeer) HandleFindClosest(msg *proto.Message) error {
 }
 
 func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
+	if err := lp.rateLimit(msg, (*util.PeerLimiter).AllowAnnounce); err != nil {
+		return err
+	}
+
 	cl, err := proto.NewClient(msg.Stream)
 
 	if err != nil {
@@ -158,6 +205,12 @@ func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 
 	affected, err := lp.DHT.Insert(entry)
 
+	// let them know how much is wanted, older peers don't send capabilities
+	if err == dht.ErrTooLittleWork {
+		cl.WriteErr(fmt.Errorf("Announce needs %d bits of proof of work", dht.MinEntryWork()))
+		return err
+	}
+
 	if err == nil && affected > 0 {
 		cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
 		log.WithField("peer", entry.Address.StringOr("")).Info("Saved new peer")
@@ -172,6 +225,9 @@ func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 }
 
 func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
+	if err := lp.rateLimit(msg, (*util.PeerLimiter).AllowQuery); err != nil {
+		return err
+	}
 
 	sq := proto.MessageSearchQuery{}
 	err := msg.Read(&sq)
@@ -180,26 +236,75 @@ func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 		return err
 	}
 
-	log.WithField("query", sq.Query).Info("Search recieved")
+	deadline := proto.DefaultStreamDeadline
+	if lp.Server != nil && lp.Server.StreamDeadline > 0 {
+		deadline = lp.Server.StreamDeadline
+	}
 
-	posts, err := lp.Database.Search(sq.Query, sq.Page, 25)
+	// a search session keeps asking for pages on the same stream, answer them
+	// until it's closed
+	for {
+		log.WithField("query", sq.Query).Info("Search recieved")
 
-	if err != nil {
-		return err
-	}
-	log.Info("Posts loaded")
+		posts, err := lp.Database.Search(sq.Query, sq.Page, 25)
 
-	post_msg := &proto.Message{
-		Header: proto.ProtoPosts,
-	}
+		if err != nil {
+			return err
+		}
+		log.Info("Posts loaded")
 
-	err = post_msg.Write(posts)
+		post_msg := &proto.Message{
+			Header: proto.ProtoPosts,
+		}
 
-	if err != nil {
-		return err
-	}
+		err = post_msg.Write(posts)
+
+		if err != nil {
+			return err
+		}
 
-	return msg.Client.WriteMessage(post_msg)
+		err = msg.Client.WriteMessage(post_msg)
+
+		if err != nil {
+			return err
+		}
+
+		// a plain search is done with, the stream is closed on return
+		if !sq.Session {
+			return nil
+		}
+
+		msg.Client.SetDeadline(time.Now().Add(deadline))
+		next, err := msg.Client.ReadMessage()
+
+		// the client is done with it
+		if err == io.EOF {
+			return nil
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if next.Header != proto.ProtoSearch {
+			msg.Client.WriteErr(errors.New("Expected a search page"))
+			return errors.New("Search session sent " + next.Header)
+		}
+
+		next.Client = msg.Client
+		next.From = msg.From
+
+		if err := lp.rateLimit(next, (*util.PeerLimiter).AllowQuery); err != nil {
+			return err
+		}
+
+		sq = proto.MessageSearchQuery{}
+		err = next.Read(&sq)
+
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
@@ -231,6 +336,57 @@ func (lp *LocalPeer) HandleRecent(msg *proto.Message) error {
 	return msg.Client.WriteMessage(resp)
 }
 
+func (lp *LocalPeer) HandleRecentRange(msg *proto.Message) error {
+	mrr := proto.MessageRecentRange{}
+	err := msg.Read(&mrr)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"from": mrr.FromPage,
+		"to":   mrr.ToPage,
+	}).Info("Recieved query for a range of recent posts")
+
+	pages := mrr.ToPage - mrr.FromPage + 1
+
+	if mrr.FromPage < 0 || pages < 1 || pages > proto.MaxRecentRangePages {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return errors.New(fmt.Sprintf("Recent range %d-%d out of range (max %d pages)",
+			mrr.FromPage, mrr.ToPage, proto.MaxRecentRangePages))
+	}
+
+	recent := make([]*data.Post, 0)
+
+	for page := mrr.FromPage; page <= mrr.ToPage; page++ {
+		posts, err := lp.Database.QueryRecent(page)
+
+		if err != nil {
+			return err
+		}
+
+		recent = append(recent, posts...)
+
+		// nothing further back
+		if len(posts) < proto.MaxPageSize {
+			break
+		}
+	}
+
+	resp := &proto.Message{
+		Header: proto.ProtoPosts,
+	}
+
+	err = resp.Write(recent)
+
+	if err != nil {
+		return err
+	}
+
+	return msg.Client.WriteMessage(resp)
+}
+
 func (lp *LocalPeer) HandlePopular(msg *proto.Message) error {
 	log.Info("Recieved query for popular posts")
 
@@ -271,6 +427,7 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	log.WithField("address", address.StringOr("")).Info("Collection request recieved")
 
 	var hashList []byte
+	pieceSize := lp.Database.PieceSize()
 
 	entry, err := lp.DHT.Query(address)
 
@@ -300,13 +457,18 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 		hashList = make([]byte, len(hl))
 		copy(hashList, hl)
 
+		if db, ok := lp.Databases.Get(address.StringOr("")); ok {
+			pieceSize = db.(*data.Database).PieceSize()
+		}
+
 	} else {
 		return errors.New("Cannot return collection hash list")
 	}
 
 	mhl := proto.MessageCollection{
-		HashList: hashList,
-		Size:     len(hashList) / 32,
+		HashList:  hashList,
+		Size:      len(hashList) / 32,
+		PieceSize: pieceSize,
 	}
 
 	resp := &proto.Message{
@@ -338,6 +500,22 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 		return err
 	}
 
+	if mrp.Length < 1 {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return errors.New(fmt.Sprintf("Piece request length %d out of range", mrp.Length))
+	}
+
+	// otherwise a peer can have us serving pieces more or less forever. The
+	// peer asks again for whatever it didn't get
+	max := viper.GetInt("net.maxPiecesPerRequest")
+	if max < 1 {
+		max = proto.MaxPiecesPerRequest
+	}
+
+	if mrp.Length > max {
+		mrp.Length = max
+	}
+
 	var posts chan *data.Post
 
 	if mrp.Address == lp.Address().StringOr("") {
@@ -357,7 +535,10 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	// I'm guessing the latter allows for gzip to maybe run a little faster?
 	// The former may allow for database reads to occur a little faster though.
 	// buffer both?
-	bw := bufio.NewWriter(msg.Stream)
+	// rate limited underneath both, so it's compressed bytes that are counted
+	lp.uploadLimiter.SetRate(viper.GetInt("net.uploadLimit"))
+
+	bw := bufio.NewWriter(lp.uploadLimiter.Writer(msg.Stream))
 	gzw := gzip.NewWriter(bw)
 
 	for i := range posts {
@@ -399,11 +580,18 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 			}
 		}
 
+		// peers would reject the entry outright with any more
+		if add && len(lp.Entry.Seeds) >= dht.MaxEntrySeeds() {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+			return errors.New("Cannot add peer, entry has too many seeds")
+		}
+
 		if add {
 			b, _ := msg.From.Bytes()
 			lp.Entry.Seeds = append(lp.Entry.Seeds, b)
 		}
 
+		// re-signs, the new seed may be part of the signature
 		err := lp.SaveEntry()
 		if err != nil {
 			return err
@@ -423,6 +611,17 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 			return errors.New("Cannot add peer, do not have entry")
 		}
 
+		// only the owner can add seeds to these
+		if entry.SignedSeeds {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+			return errors.New("Cannot add peer, entry seeds are signed")
+		}
+
+		if len(entry.Seeds) >= dht.MaxEntrySeeds() {
+			msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+			return errors.New("Cannot add peer, entry has too many seeds")
+		}
+
 		// read the address of the peer as raw bytes, and add it to the seed list
 		b, _ := msg.From.Bytes()
 		entry.Seeds = append(entry.Seeds, b)
@@ -440,9 +639,91 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 	return nil
 }
 
+func (lp *LocalPeer) HandlePostRemove(msg *proto.Message) error {
+	mpr := proto.MessagePostRemove{}
+	err := msg.Read(&mpr)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"for":       mpr.Address,
+		"info hash": mpr.InfoHash,
+	}).Info("Recieved post removal")
+
+	db, ok := lp.Databases.Get(mpr.Address)
+
+	if !ok {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return errors.New("Not mirroring peer, cannot remove post")
+	}
+
+	address, err := dht.DecodeAddress(mpr.Address)
+
+	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
+
+	entry, err := lp.DHT.Query(address)
+
+	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
+
+	// only the origin of the collection may remove posts from it
+	err = mpr.Verify(entry)
+
+	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
+
+	err = db.(*data.Database).DeleteByInfoHash(mpr.InfoHash)
+
+	if err != nil && err != sql.ErrNoRows {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
+
+	return msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+}
+
 func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer, error) {
+	banned := lp.peerManager.IsBanned(header.Entry.Address)
+
+	if remote := header.Client.RemoteAddr(); remote != nil && !banned {
+		host, _, err := net.SplitHostPort(remote.String())
+		banned = err == nil && lp.peerManager.IsHostBanned(host)
+	}
+
+	if banned {
+		header.Client.Close()
+		return nil, PeerBanned
+	}
+
+	// a peer that's already connected dialling again wants another session
+	if existing := lp.peerManager.GetPeer(header.Entry.Address); existing != nil {
+		if session := existing.Session(); session != nil && !session.IsClosed() {
+			// the handshake proved they hold this key, it has to be the one
+			// the peer is already connected with
+			if !bytes.Equal(existing.PublicKey(), header.Entry.PublicKey) {
+				header.Client.Close()
+				return nil, errors.New("Peer dialled again with a different key")
+			}
+
+			return nil, lp.addSession(existing, header)
+		}
+	}
+
 	peer := &Peer{}
+	configurePeer(peer)
 	peer.SetTCP(header)
+	// before SetPeer, which announces to it straight away
+	peer.SetCapabilities(header.Capabilities)
+	peer.compression = proto.NegotiateCompression(header.Capabilities, lp.capabilities)
 	_, err := peer.ConnectServer()
 
 	if err != nil {
@@ -462,6 +743,24 @@ func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer
 	return peer, nil
 }
 
+func (lp *LocalPeer) addSession(peer *Peer, header proto.ConnHeader) error {
+	session, err := yamux.Server(peer.streams.CountConn(header.Client.Conn()), peer.streams.SessionConfig)
+
+	if err != nil {
+		header.Client.Close()
+		return err
+	}
+
+	if !peer.streams.AddSession(session) {
+		session.Close()
+		return errors.New("Peer has too many sessions open")
+	}
+
+	go lp.Server.ListenSession(peer, lp, session)
+
+	return nil
+}
+
 func (lp *LocalPeer) ListenStream(peer *Peer) {
 	lp.Server.ListenStream(peer, lp)
 }
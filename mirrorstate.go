@@ -0,0 +1,115 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// Where a mirror got up to, saved next to the mirrored database so that an
+// interrupted mirror can carry on rather than start again. Removed once the
+// mirror completes.
+type MirrorState struct {
+	// The collection being mirrored, if this changes the progress is no use.
+	CollectionHash []byte `json:"collectionHash"`
+
+	// How many pieces have been received and verified.
+	Pieces int `json:"pieces"`
+}
+
+// A missing file is not an error, it just means there is nothing to resume.
+func LoadMirrorState(path string) (MirrorState, error) {
+	var ret MirrorState
+
+	raw, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+
+	if err != nil {
+		return ret, err
+	}
+
+	err = json.Unmarshal(raw, &ret)
+
+	return ret, err
+}
+
+// Written to a temporary file first, so a crash never leaves half a state.
+func (ms MirrorState) Save(path string) error {
+	raw, err := json.Marshal(ms)
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", raw, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// The piece to start mirroring a collection of size pieces from, given its
+// hash, how many posts are already stored and how many go in a piece. Without
+// any saved state this re-fetches the last piece stored, which may not have
+// been complete. If the collection has changed since, it starts again from the
+// beginning.
+func (ms MirrorState) ResumeFrom(hash []byte, postCount, size, pieceSize int) int {
+	if len(ms.CollectionHash) == 0 {
+		stored := int(math.Ceil(float64(postCount) / float64(pieceSize)))
+
+		if stored == 0 {
+			return 0
+		}
+
+		return stored - 1
+	}
+
+	if !bytes.Equal(ms.CollectionHash, hash) {
+		return 0
+	}
+
+	// pieces are stored as they arrive, so a crash can leave the saved state
+	// ahead of the database
+	resume := ms.Pieces
+	if stored := postCount / pieceSize; stored < resume {
+		resume = stored
+	}
+
+	if resume > size {
+		resume = size
+	}
+
+	return resume
+}
@@ -26,8 +26,12 @@
 package dfi
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
+
 	"github.com/dfindex/dfi/dht"
 	log "github.com/sirupsen/logrus"
 )
@@ -47,12 +51,12 @@ type MapLink struct {
 
 // This takes a node to start with, and recurses through all seeds/seeding
 func CreateNetMap(entry dht.Entry, db *dht.DHT, currentNodes map[string]bool, currentLinks map[string]bool) ([]MapNode, []MapLink) {
-	// BUG: Fix the duplicate nodes, luckily there are no duplicate links afaik.
 	// Ensure that all links have associated nodes, and no duplicates.
 	nodes := make([]MapNode, 0)
 	links := make([]MapLink, 0)
 
 	if _, ok := currentNodes[string(entry.Address.Raw)]; !ok {
+		currentNodes[string(entry.Address.Raw)] = true
 		nodes = append(nodes, MapNode{Address: entry.Address.StringOr(""), Name: entry.Name})
 	}
 
@@ -74,7 +78,6 @@ func CreateNetMap(entry dht.Entry, db *dht.DHT, currentNodes map[string]bool, cu
 		}
 
 		if _, ok := currentNodes[string(e.Address.Raw)]; !ok {
-			fmt.Println(e.Address.StringOr(""))
 			currentNodes[string(e.Address.Raw)] = true
 			nodes = append(nodes, MapNode{Address: e.Address.StringOr(""), Name: e.Name})
 		} else {
@@ -99,3 +102,84 @@ func CreateNetMap(entry dht.Entry, db *dht.DHT, currentNodes map[string]bool, cu
 
 	return nodes, links
 }
+
+// A readable label for a node, the name if we know it.
+func (mn MapNode) Label() string {
+	if mn.Name != "" {
+		return mn.Name
+	}
+
+	return mn.Address
+}
+
+// Writes the map as a Graphviz digraph, seeds point at what they seed.
+func WriteNetMapDot(w io.Writer, nodes []MapNode, links []MapLink) error {
+	if _, err := io.WriteString(w, "digraph dfi {\n"); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		_, err := fmt.Fprintf(w, "\t%s [label=%s];\n", strconv.Quote(n.Address), strconv.Quote(n.Label()))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range links {
+		_, err := fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(l.Source), strconv.Quote(l.Target))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "}\n")
+
+	return err
+}
+
+type gexfNode struct {
+	Id    string `xml:"id,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type gexfEdge struct {
+	Id     int    `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type gexfDocument struct {
+	XMLName xml.Name `xml:"gexf"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Graph   struct {
+		DefaultEdgeType string     `xml:"defaultedgetype,attr"`
+		Nodes           []gexfNode `xml:"nodes>node"`
+		Edges           []gexfEdge `xml:"edges>edge"`
+	} `xml:"graph"`
+}
+
+// Writes the map as GEXF, which is what Gephi likes best.
+func WriteNetMapGexf(w io.Writer, nodes []MapNode, links []MapLink) error {
+	doc := gexfDocument{Xmlns: "http://www.gexf.net/1.2draft", Version: "1.2"}
+	doc.Graph.DefaultEdgeType = "directed"
+
+	for _, n := range nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gexfNode{n.Address, n.Label()})
+	}
+
+	for i, l := range links {
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{i, l.Source, l.Target})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	return enc.Encode(doc)
+}
@@ -0,0 +1,91 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dfindex/dfi"
+)
+
+var (
+	mapNodes = []dfi.MapNode{{Address: "Qaaa", Name: "alpha"}, {Address: "Qbbb"}}
+	mapLinks = []dfi.MapLink{{Source: "Qbbb", Target: "Qaaa"}}
+)
+
+func TestNetMapDot(t *testing.T) {
+	var buf bytes.Buffer
+
+	if err := dfi.WriteNetMapDot(&buf, mapNodes, mapLinks); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	out := buf.String()
+
+	for _, i := range []string{"digraph", `"Qaaa" [label="alpha"]`, `"Qbbb" [label="Qbbb"]`, `"Qbbb" -> "Qaaa"`} {
+		if !strings.Contains(out, i) {
+			t.Fatalf("Missing %s in:\n%s", i, out)
+		}
+	}
+}
+
+func TestNetMapGexf(t *testing.T) {
+	var buf bytes.Buffer
+
+	if err := dfi.WriteNetMapGexf(&buf, mapNodes, mapLinks); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var doc struct {
+		Nodes []struct {
+			Id    string `xml:"id,attr"`
+			Label string `xml:"label,attr"`
+		} `xml:"graph>nodes>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+		} `xml:"graph>edges>edge"`
+	}
+
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(doc.Nodes) != 2 || doc.Nodes[0].Label != "alpha" || len(doc.Edges) != 1 || doc.Edges[0].Source != "Qbbb" {
+		t.Fatalf("Bad GEXF:\n%s", buf.String())
+	}
+}
+
+func TestHttpBadMapFormat(t *testing.T) {
+	w := request(t, "/self/map/?format=png")
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown format, got %d", w.Code)
+	}
+}
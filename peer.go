@@ -32,10 +32,12 @@ package dfi
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"math"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -50,7 +52,49 @@ import (
 	"github.com/dfindex/dfi/common"
 )
 
+var ErrMirrorUnsupported = errors.New("Peer does not support mirroring")
+
+// A successful ping, heartbeats included, is trusted for this long before a
+// request pings again.
+const AliveWindow = time.Second * 15
+
+// When pieces can't be had from the peer being mirrored, its seeds are tried
+// instead. This many times at most over the whole mirror, waiting a little
+// longer before each.
+const (
+	MirrorFallbackAttempts   = 5
+	MirrorFallbackBackoff    = time.Second
+	MirrorFallbackMaxBackoff = time.Second * 30
+)
+
+// A mirror's progress is saved after this many pieces or this long, whichever
+// comes first, and when it stops. Falling behind only means a few pieces are
+// fetched twice on resuming.
+const (
+	MirrorStatePieces   = 100
+	MirrorStateInterval = time.Second * 10
+)
+
+// How long to wait before the given fallback attempt, counting from zero.
+func MirrorBackoff(attempt int) time.Duration {
+	if attempt > 16 {
+		return MirrorFallbackMaxBackoff
+	}
+
+	wait := MirrorFallbackBackoff << uint(attempt)
+	if wait > MirrorFallbackMaxBackoff {
+		wait = MirrorFallbackMaxBackoff
+	}
+
+	return wait
+}
+
 type Peer struct {
+	// UnixNano of the last successful ping, first for 64 bit atomic alignment
+	lastAlive int64
+	// round trip time of that ping, in nanoseconds
+	lastLatency int64
+
 	address dht.Address
 
 	publicKey ed25519.PublicKey
@@ -71,6 +115,16 @@ type Peer struct {
 	addSeeding     func(dht.Entry) error
 	addEntry       func(dht.Entry) error
 	updateSeen     func()
+	// used to reach seeds when mirroring falls back to them, the func returned
+	// disconnects the seed again unless it was already connected
+	connectPeer func(dht.Address) (*Peer, func(), error)
+	// rewards the peer for a nil error, penalises it otherwise
+	rate func(error)
+}
+
+// How long to wait on a ping before giving up on the peer.
+func (p *Peer) PingTimeout() time.Duration {
+	return p.streams.GetPingTimeout()
 }
 
 func (p *Peer) UpdateSeen() {
@@ -79,6 +133,12 @@ func (p *Peer) UpdateSeen() {
 	}
 }
 
+func (p *Peer) rateOutcome(err error) {
+	if p.rate != nil {
+		p.rate(err)
+	}
+}
+
 func (p *Peer) EAddress() common.Encoder {
 	return &p.address
 }
@@ -91,11 +151,53 @@ func (p *Peer) PublicKey() []byte {
 	return p.publicKey
 }
 
+func (p *Peer) Limiter() *util.PeerLimiter {
+	return p.limiter
+}
+
 func (p *Peer) Streams() *proto.StreamManager {
 	return &p.streams
 }
 
 func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeOut)
+	defer cancel()
+
+	t, err := p.PingContext(ctx)
+
+	if err == context.DeadlineExceeded {
+		return -1, errors.New("Timeout")
+	}
+
+	return t, err
+}
+
+// How much a connection to a peer has carried, see Peer.Stats.
+type PeerConnStats struct {
+	BytesIn       uint64 `json:"bytesIn"`
+	BytesOut      uint64 `json:"bytesOut"`
+	StreamsOpened uint64 `json:"streamsOpened"`
+	OpenStreams   int    `json:"openStreams"`
+}
+
+// Traffic over every session with the peer, safe to call mid transfer.
+func (p *Peer) Stats() PeerConnStats {
+	return PeerConnStats{
+		BytesIn:       p.streams.BytesRead(),
+		BytesOut:      p.streams.BytesWritten(),
+		StreamsOpened: p.streams.StreamsOpened(),
+		OpenStreams:   p.streams.OpenStreams(),
+	}
+}
+
+// The round trip time of the last successful ping, heartbeats included. 0 if
+// the peer hasn't been pinged yet.
+func (p *Peer) LastLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.lastLatency))
+}
+
+// Pings the peer, giving up with ctx.Err() if the context is done first.
+func (p *Peer) PingContext(ctx context.Context) (time.Duration, error) {
 	type timeErr struct {
 		t   time.Duration
 		err error
@@ -111,9 +213,8 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 		return -1, errors.New("Session closed")
 	}
 
-	timer := time.NewTimer(timeOut)
-
-	ret := make(chan timeErr)
+	// buffered, nobody may be listening by the time the ping returns
+	ret := make(chan timeErr, 1)
 
 	go func() {
 		t, err := session.Ping()
@@ -122,19 +223,45 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 
 	select {
 	case ping := <-ret:
+		if ping.err == nil {
+			atomic.StoreInt64(&p.lastAlive, time.Now().UnixNano())
+			atomic.StoreInt64(&p.lastLatency, int64(ping.t))
+		}
+
 		return ping.t, ping.err
 
-	case _ = <-timer.C:
-		return -1, errors.New("Timeout")
+	case <-ctx.Done():
+		return -1, ctx.Err()
 	}
 }
 
-func (p *Peer) Announce(lp *LocalPeer) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
+// Checks the peer is still there before a request, only pinging if there
+// hasn't been a successful ping in the last AliveWindow.
+func (p *Peer) checkAlive(ctx context.Context) error {
+	session := p.streams.GetSession()
+	last := time.Unix(0, atomic.LoadInt64(&p.lastAlive))
+
+	if session != nil && !session.IsClosed() && time.Since(last) < AliveWindow {
+		return nil
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, p.PingTimeout())
+	defer cancel()
+
+	_, err := p.PingContext(pingCtx)
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
 
+	if err == context.DeadlineExceeded {
+		return errors.New("Timeout")
+	}
+
+	return err
+}
+
+func (p *Peer) Announce(lp *LocalPeer) error {
 	log.WithField("peer", p.Address().StringOr("")).Debug("Sending announce")
 
 	if lp.Entry.PublicAddress == "" {
@@ -143,7 +270,13 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 		log.Debug("External IP is ", ip)
 		lp.Entry.PublicAddress = ip
 	}
-	lp.SignEntry()
+
+	// don't let peers cache a half finished entry
+	err := lp.PrepareEntry()
+
+	if err != nil {
+		return err
+	}
 
 	stream, err := p.OpenStream()
 
@@ -153,7 +286,7 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 
 	defer stream.Close()
 
-	err = stream.Announce(lp.Entry)
+	err = stream.Announce(lp.workedEntry(p.capabilities.AnnounceWork))
 
 	return err
 }
@@ -168,6 +301,7 @@ func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	}
 
 	p.SetCapabilities(pair.Capabilities)
+	p.compression = proto.NegotiateCompression(*lp.GetCapabilities(), pair.Capabilities)
 	p.publicKey = pair.Entry.PublicKey
 	p.address = pair.Entry.Address
 
@@ -202,6 +336,10 @@ func (p *Peer) ConnectClient(lp *LocalPeer) (*yamux.Session, error) {
 
 	go lp.ListenStream(p)
 
+	p.streams.OnSession = func(session *yamux.Session) {
+		go lp.Server.ListenSession(p, lp, session)
+	}
+
 	return client, err
 }
 
@@ -214,7 +352,7 @@ func (p *Peer) Terminate() {
 }
 
 func (p *Peer) OpenStream() (*proto.Client, error) {
-	_, err := p.Ping(time.Second * 10)
+	err := p.checkAlive(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -222,7 +360,14 @@ func (p *Peer) OpenStream() (*proto.Client, error) {
 	p.UpdateSeen()
 
 	s, err := p.streams.OpenStream()
-	return s, err
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.SetCompression(p.compression)
+
+	return s, nil
 }
 
 func (p *Peer) AddStream(conn net.Conn) {
@@ -233,6 +378,11 @@ func (p *Peer) RemoveStream(conn net.Conn) {
 	p.streams.RemoveStream(conn)
 }
 
+// The number of streams opened by this peer that we are still handling.
+func (p *Peer) OpenStreamCount() int {
+	return p.streams.StreamCount()
+}
+
 func (p *Peer) GetStream(conn net.Conn) *proto.Client {
 	return p.streams.GetStream(conn)
 }
@@ -250,11 +400,6 @@ func (p *Peer) Entry() (*dht.Entry, error) {
 }
 
 func (p *Peer) GetEntry() (*dht.Entry, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
 	e, err := p.Query(*p.Address())
 
 	if err != nil {
@@ -275,11 +420,20 @@ func (p *Peer) GetEntry() (*dht.Entry, error) {
 }
 
 func (p *Peer) Bootstrap(d *dht.DHT) error {
-	_, err := p.Ping(time.Second * 10)
+	stream, err := p.OpenStream()
+
 	if err != nil {
 		return err
 	}
 
+	defer stream.Close()
+
+	return stream.Bootstrap(d, d.Address())
+}
+
+// Bootstrap, inserting only the entries check passes. See
+// proto.Client.BootstrapValidate.
+func (p *Peer) BootstrapValidate(d *dht.DHT, check func(*dht.Entry) error) error {
 	stream, err := p.OpenStream()
 
 	if err != nil {
@@ -288,49 +442,94 @@ func (p *Peer) Bootstrap(d *dht.DHT) error {
 
 	defer stream.Close()
 
-	return stream.Bootstrap(d, d.Address())
+	return stream.BootstrapValidate(d, d.Address(), check)
 }
 
-func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
+// Opens a stream that is closed as soon as ctx is done, so anything blocked
+// reading from it returns. The returned function must be called once finished
+// with the stream, it closes it and swaps err for ctx.Err() if the context was
+// the reason things failed.
+func (p *Peer) openStreamContext(ctx context.Context) (*proto.Client, func(error) error, error) {
+	err := p.checkAlive(ctx)
+
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	p.UpdateSeen()
+
+	stream, err := p.streams.OpenStream()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream.SetCompression(p.compression)
+
+	// the stream already has a deadline, only ever shorten it
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < p.streams.GetStreamDeadline() {
+		stream.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	finish := func(err error) error {
+		close(done)
+		stream.Close()
+
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	return stream, finish, nil
+}
+
+func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
+	return p.QueryContext(context.Background(), address)
+}
+
+func (p *Peer) QueryContext(ctx context.Context, address dht.Address) (common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Querying")
 
-	stream, err := p.OpenStream()
+	stream, finish, err := p.openStreamContext(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer stream.Close()
-
 	entry, err := stream.Query(address)
 
-	return entry, err
+	return entry, finish(err)
 }
 
 func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
+	return p.FindClosestContext(context.Background(), address)
+}
 
+func (p *Peer) FindClosestContext(ctx context.Context, address dht.Address) ([]common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Finding closest")
 
-	stream, err := p.OpenStream()
+	stream, finish, err := p.openStreamContext(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer stream.Close()
-
 	res, err := stream.FindClosest(address)
+	err = finish(err)
 
 	ret := make([]common.Verifier, 0, len(res))
 
@@ -343,87 +542,174 @@ func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
 
 // asks a peer to query its database and return the results
 func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
-	_, err := p.Ping(time.Second * 10)
+	return p.SearchContext(context.Background(), search, page)
+}
+
+func (p *Peer) SearchContext(ctx context.Context, search string, page int) (*data.SearchResult, error) {
+	log.WithField("peer", p.Address().StringOr("")).Info("Searching")
+
+	stream, finish, err := p.openStreamContext(ctx)
+
 	if err != nil {
 		return nil, err
 	}
 
-	log.WithField("peer", p.Address().StringOr("")).Info("Searching")
-	stream, err := p.OpenStream()
+	posts, err := stream.Search(search, page)
+	err = finish(err)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer stream.Close()
-
-	posts, err := stream.Search(search, page)
 	res := &data.SearchResult{
 		Posts:  posts,
 		Source: p.Address().StringOr(""),
 	}
 
-	if err != nil {
-		return nil, err
-	}
-
 	return res, nil
 }
 
 func (p *Peer) Recent(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
+	return p.RecentContext(context.Background(), page)
+}
+
+func (p *Peer) RecentContext(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, finish, err := p.openStreamContext(ctx)
+
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := p.OpenStream()
+	posts, err := stream.Recent(page)
 
-	if err != nil {
-		return nil, err
+	return posts, finish(err)
+}
+
+// Pages fromPage to toPage of the peer's recent posts, in one request if it
+// supports it and a page at a time if not.
+func (p *Peer) RecentRange(fromPage, toPage int) ([]*data.Post, error) {
+	return p.RecentRangeContext(context.Background(), fromPage, toPage)
+}
+
+func (p *Peer) RecentRangeContext(ctx context.Context, fromPage, toPage int) ([]*data.Post, error) {
+	if !p.Supports(proto.FeatureRecentRange) {
+		ret := make([]*data.Post, 0)
+
+		for page := fromPage; page <= toPage; page++ {
+			posts, err := p.RecentContext(ctx, page)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, posts...)
+		}
+
+		return ret, nil
 	}
 
-	defer stream.Close()
+	ret := make([]*data.Post, 0)
 
-	posts, err := stream.Recent(page)
+	// the peer caps how many pages it will send at once
+	for start := fromPage; start <= toPage; start += proto.MaxRecentRangePages {
+		end := start + proto.MaxRecentRangePages - 1
+		if end > toPage {
+			end = toPage
+		}
+
+		stream, finish, err := p.openStreamContext(ctx)
 
-	return posts, err
+		if err != nil {
+			return nil, err
+		}
+
+		posts, err := stream.RecentRange(start, end)
+
+		if err = finish(err); err != nil {
+			return nil, err
+		}
 
+		ret = append(ret, posts...)
+	}
+
+	return ret, nil
 }
 
 func (p *Peer) Popular(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
+	return p.PopularContext(context.Background(), page)
+}
 
-	stream, err := p.OpenStream()
+func (p *Peer) PopularContext(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, finish, err := p.openStreamContext(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer stream.Close()
-
 	posts, err := stream.Popular(page)
 
-	return posts, err
-
+	return posts, finish(err)
 }
 
+// Sends the index of each piece on onPiece as it arrives, the first being
+// where an interrupted mirror resumed from.
 func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error {
-	_, err := p.Ping(time.Second * 10)
+	return p.MirrorContext(context.Background(), db, lp, onPiece)
+}
+
+// Mirror, but stops downloading once ctx is done. Pieces already received are
+// kept, so a later mirror carries on from where this one stopped.
+func (p *Peer) MirrorContext(ctx context.Context, db *data.Database, lp dht.Address, onPiece chan int) (err error) {
+	defer close(onPiece)
+
+	// no point connecting if it can't serve the collection or pieces
+	if !p.Supports(proto.FeatureMirror) {
+		return ErrMirrorUnsupported
+	}
+
+	err = p.checkAlive(ctx)
+
 	if err != nil {
 		return err
 	}
 
-	pieces := make(chan *data.Piece, data.PieceSize)
-	defer close(onPiece)
+	pieces := make(chan *data.Piece, db.PieceSize())
+	inserted := make(chan error, 1)
+
+	go func() {
+		inserted <- db.InsertPieces(pieces, true)
+	}()
+
+	// however this ends, let the database commit what it was given, unless
+	// the peer has been sending pieces that can't be trusted. Only done once
+	// it's all stored
+	insertDone := false
+	finishInsert := func(abort bool) error {
+		if insertDone {
+			return nil
+		}
+		insertDone = true
+
+		if abort {
+			pieces <- data.AbortPieces
+		} else {
+			pieces <- nil
+		}
+
+		return <-inserted
+	}
 
-	go db.InsertPieces(pieces, true)
+	defer func() {
+		ierr := finishInsert(err == proto.ErrShortPiece || err == data.ErrCollectionMismatch)
+
+		if err == nil {
+			err = ierr
+		}
+	}()
 
 	var entry *dht.Entry
 	if p.seed {
-		e, err := p.Query(p.seedFor.Address)
+		e, err := p.QueryContext(ctx, p.seedFor.Address)
 
 		if err != nil {
 			return err
@@ -444,83 +730,177 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 		}
 	}
 
-	p.addEntry(*entry)
+	if p.addEntry != nil {
+		p.addEntry(*entry)
+	}
 
 	log.WithField("peer", entry.Address.StringOr("")).Info("Mirroring")
 
 	if err != nil {
 		return err
 	}
-	stream, err := p.OpenStream()
+	stream, finish, err := p.openStreamContext(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	defer stream.Close()
-
-	mcol, err := stream.Collection(entry.Address, *entry)
+	mcol, err := stream.Collection(entry.Address, *entry, db.PieceSize())
+	err = finish(err)
 
 	if err != nil {
 		return err
 	}
 
 	collection := data.Collection{HashList: mcol.HashList}
+	collection.Rehash()
 
-	err = collection.Save(fmt.Sprintf("./data/%s/collection.dat", entry.Address.StringOr("err")))
+	dir := fmt.Sprintf("./data/%s", entry.Address.StringOr("err"))
+
+	err = collection.Save(dir + "/collection.dat")
 
 	if err != nil {
 		return err
 	}
 
+	// the pieces were all checked on the way in, but what the database ends
+	// up holding is what gets served on, so that has to match the entry too
+	verifyStored := func() error {
+		err := finishInsert(false)
+
+		if err != nil {
+			return err
+		}
+
+		stored := data.Collection{}
+		err = stored.RebuildFrom(db)
+
+		if err != nil {
+			return err
+		}
+
+		return stored.Verify(entry.CollectionHash)
+	}
+
 	if int(db.PostCount()) == entry.PostCount {
-		return nil
+		return verifyStored()
 	}
 
-	currentStore := int(math.Ceil(float64(db.PostCount()) / float64(data.PieceSize)))
+	statePath := dir + "/mirror.json"
+	state, err := LoadMirrorState(statePath)
 
-	since := 0
-	if currentStore != 0 {
-		since = currentStore - 1
+	if err != nil {
+		log.WithField("path", statePath).Warn("Ignoring unreadable mirror state: ", err.Error())
+		state = MirrorState{}
 	}
 
-	log.WithField("size", mcol.Size).Info("Downloading collection")
+	hash := collection.Hash()
+	since := state.ResumeFrom(hash, int(db.PostCount()), mcol.Size, db.PieceSize())
 
-	pieceStream, err := p.OpenStream()
+	if len(state.CollectionHash) > 0 && !bytes.Equal(state.CollectionHash, hash) {
+		log.Info("Collection changed since the last mirror, starting again")
+	} else if since > 0 {
+		log.WithField("piece", since).Info("Resuming mirror")
+	}
 
-	if err != nil {
-		return err
+	state = MirrorState{CollectionHash: hash, Pieces: since}
+	savedAt := time.Now()
+
+	saveState := func() {
+		if err := state.Save(statePath); err != nil {
+			log.Error("Failed to save mirror state: ", err.Error())
+		}
+
+		savedAt = time.Now()
 	}
 
-	defer pieceStream.Close()
+	saveState()
 
-	piece_chan := pieceStream.Pieces(entry.Address, since, mcol.Size)
+	log.WithField("size", mcol.Size).Info("Downloading collection")
 
-	i := 0
-	for piece := range piece_chan {
-		log.Info(len(mcol.HashList))
-		hash := piece.Hash()
+	// seeds have the same collection, so if this peer lets us down one of
+	// them can carry on from the piece it stopped at
+	source := p
+	release := func() {}
+	defer func() { release() }()
+
+	seeds := make([][]byte, len(entry.Seeds))
+	copy(seeds, entry.Seeds)
+	util.ShuffleBytes(seeds)
+	fallbacks := 0
+
+	// peers won't serve a whole collection in one go, so ask for it in chunks
+	i := since
+	for i < mcol.Size {
+		length := mcol.Size - i
+		if length > proto.MaxPiecesPerRequest {
+			length = proto.MaxPiecesPerRequest
+		}
 
-		if !bytes.Equal(mcol.HashList[32*i:32*i+32], hash) {
-			return errors.New("Piece hash mismatch")
+		err = source.downloadPieces(ctx, entry.Address, i, length, db.PieceSize(), mcol, func(piece *data.Piece) {
+			onPiece <- i
+
+			if len(pieces) == 100 {
+				log.Info("Piece buffer full, io is blocking")
+			}
+			pieces <- piece
+			i++
+
+			if i-state.Pieces >= MirrorStatePieces || time.Since(savedAt) >= MirrorStateInterval {
+				state.Pieces = i
+				saveState()
+			}
+		})
+
+		if err == nil {
+			continue
+		}
+
+		state.Pieces = i
+		saveState()
+
+		if ctx.Err() != nil {
+			return err
+		}
+
+		// whether it timed out or sent pieces that don't match
+		source.rateOutcome(err)
+
+		if fallbacks >= MirrorFallbackAttempts {
+			return err
 		}
 
-		onPiece <- i
+		log.WithFields(log.Fields{
+			"peer":  source.Address().StringOr(""),
+			"piece": i,
+		}).Warn("Piece download failed, trying a seed: ", err.Error())
+
+		fallback, drop, ferr := p.fallbackSeed(ctx, seeds, fallbacks)
+		fallbacks++
 
-		if len(pieces) == 100 {
-			log.Info("Piece buffer full, io is blocking")
+		if ferr != nil {
+			log.Error(ferr.Error())
+			return err
 		}
-		pieces <- piece
 
-		i++
+		release()
+		source, release = fallback, drop
 	}
 
-	log.Info("Mirror complete, generating index")
+	err = verifyStored()
 
 	if err != nil {
+		log.WithField("peer", entry.Address.StringOr("")).Error("Mirrored database does not match the collection: ", err.Error())
 		return err
 	}
 
+	// nothing left to resume
+	os.Remove(statePath)
+
+	source.rateOutcome(nil)
+
+	log.Info("Mirror complete, generating index")
+
 	err = p.RequestAddPeer(*entry)
 
 	// we're done mirroring, so now we need to switch OFF the fact that this is
@@ -529,17 +909,97 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 	p.seed = false
 	p.seedFor = nil
 
-	pieces <- nil
-
 	return err
 }
 
-func (p *Peer) RequestAddPeer(entry dht.Entry) error {
-	_, err := p.Ping(time.Second * 10)
+// Waits out the backoff for the given attempt, then connects to the first of
+// the seeds that will have us, starting from a different one each attempt.
+// Calling the func returned lets go of the seed once it's no longer needed.
+func (p *Peer) fallbackSeed(ctx context.Context, seeds [][]byte, attempt int) (*Peer, func(), error) {
+	if p.connectPeer == nil || len(seeds) == 0 {
+		return nil, nil, errors.New("No seeds to fall back to")
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-time.After(MirrorBackoff(attempt)):
+	}
+
+	for n := range seeds {
+		addr := dht.Address{Raw: seeds[(attempt+n)%len(seeds)]}
+
+		if addr.Equals(p.Address()) {
+			continue
+		}
+
+		seed, release, err := p.connectPeer(addr)
+
+		if err != nil {
+			log.WithField("seed", addr.StringOr("")).Info("Seed unreachable: ", err.Error())
+			continue
+		}
+
+		if !seed.Supports(proto.FeatureMirror) {
+			release()
+			continue
+		}
+
+		return seed, release, nil
+	}
+
+	return nil, nil, errors.New("None of the seeds could be reached")
+}
+
+// Fetches a single chunk of pieces over its own stream, checking each against
+// the collection hash list.
+func (p *Peer) downloadPieces(ctx context.Context, address dht.Address, start, length, pieceSize int, mcol *proto.MessageCollection, onPiece func(*data.Piece)) (err error) {
+	stream, finish, err := p.openStreamContext(ctx)
+
 	if err != nil {
 		return err
 	}
 
+	pieces, errs := stream.Pieces(address, start, length, pieceSize)
+
+	// with the stream closed the reader gives up quickly, drain it so it
+	// isn't left blocked on a send
+	defer func() {
+		err = finish(err)
+
+		for _ = range pieces {
+		}
+	}()
+
+	received := 0
+	for piece := range pieces {
+		index := start + received
+
+		if len(mcol.HashList) < 32*index+32 {
+			return errors.New("Peer sent more pieces than it has")
+		}
+
+		if !bytes.Equal(mcol.HashList[32*index:32*index+32], piece.Hash()) {
+			return errors.New("Piece hash mismatch")
+		}
+
+		onPiece(piece)
+		received++
+	}
+
+	if err = <-errs; err != nil {
+		return err
+	}
+
+	// peers may send fewer than asked for, the rest is asked for again
+	if received == 0 {
+		return errors.New(fmt.Sprintf("Expected %d pieces, received none", length))
+	}
+
+	return nil
+}
+
+func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 	stream, err := p.OpenStream()
 
 	if err != nil {
@@ -553,6 +1013,11 @@ func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 		return err
 	}
 
+	// only peers from a peer manager have somewhere to keep track of seeding
+	if p.addSeedManager == nil || p.addSeeding == nil {
+		return nil
+	}
+
 	err = p.addSeedManager(entry.Address)
 
 	if err != nil {
@@ -571,6 +1036,19 @@ func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 	return p.addSeeding(entry)
 }
 
+// Tell a peer mirroring us that a post has been removed.
+func (p *Peer) PostRemove(mpr proto.MessagePostRemove) error {
+	stream, err := p.OpenStream()
+
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	return stream.PostRemove(mpr)
+}
+
 func (p *Peer) GetCapabilities() *proto.MessageCapabilities {
 	return &p.capabilities
 }
@@ -579,11 +1057,19 @@ func (p *Peer) SetCapabilities(caps proto.MessageCapabilities) {
 	p.capabilities = caps
 }
 
+func (p *Peer) Supports(feature string) bool {
+	return p.capabilities.Supports(feature)
+}
+
 func (p *Peer) NewMessage(header string) *proto.Message {
 	ret := &proto.Message{
-		Header:      header,
-		Compression: p.compression,
+		Header: header,
 	}
 
 	return ret
 }
+
+// What messages to and from this peer are compressed with, "" for nothing.
+func (p *Peer) Compression() string {
+	return p.compression
+}
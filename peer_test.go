@@ -0,0 +1,765 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+	"github.com/hashicorp/yamux"
+	"github.com/spf13/viper"
+)
+
+// A local peer set up as dfid would, in the current directory, with count
+// posts in pieces of pieceSize. Its databases are named after it, so more than
+// one can share a directory.
+func servingPeer(t *testing.T, name string, count, pieceSize int) *dfi.LocalPeer {
+	viper.Set("database.peers", "data/"+name+"-peers.db")
+	defer viper.Set("database.peers", nil)
+
+	lp := &dfi.LocalPeer{}
+	lp.GenerateKey()
+	lp.Setup()
+
+	lp.Entry.Name = name
+	lp.Entry.Address = *lp.Address()
+	lp.Entry.PublicKey = lp.PublicKey()
+	lp.Entry.PublicAddress = "127.0.0.1"
+	lp.Entry.Port = 5050
+
+	lp.Database = data.NewDatabase("data/" + name + "-posts.db")
+	if err := lp.Database.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	lp.Database.SetPieceSize(pieceSize)
+
+	for i := 0; i < count; i++ {
+		_, err := lp.Database.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("%040d", i),
+			Title:    fmt.Sprintf("served %d", i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := lp.RebuildCollection(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return lp
+}
+
+// A servingPeer with no posts, listening on a free port that its entry has.
+func listeningPeer(t *testing.T, name string) *dfi.LocalPeer {
+	return listen(t, servingPeer(t, name, 0, 10))
+}
+
+// Has lp listen on a free port, and puts it in its entry.
+func listen(t *testing.T, lp *dfi.LocalPeer) *dfi.LocalPeer {
+	go lp.Server.Listen("127.0.0.1:0", lp, lp.Entry)
+
+	for lp.Server.Addr() == nil {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	lp.Entry.Port = lp.Server.Addr().(*net.TCPAddr).Port
+
+	if err := lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return lp
+}
+
+// A peer connected to lp over a pipe, lp answering whatever it asks.
+func connectedTo(t *testing.T, lp *dfi.LocalPeer) *dfi.Peer {
+	a, b := net.Pipe()
+
+	remote, err := yamux.Client(b, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c, err := proto.NewClient(a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := &dfi.Peer{}
+	p.Streams().Setup()
+	p.SetTCP(proto.ConnHeader{Client: *c, Entry: *lp.Entry})
+	p.SetCapabilities(*lp.GetCapabilities())
+
+	if _, err = p.ConnectServer(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// how lp sees us, never registered so never rate limited
+	us := &dfi.Peer{}
+	us.Streams().Setup()
+
+	go lp.Server.ListenSession(us, lp, remote)
+
+	return p
+}
+
+func TestMirrorUnsupported(t *testing.T) {
+	// never connected, so anything touching the network would fail or panic
+	p := &dfi.Peer{}
+	p.SetCapabilities(proto.MessageCapabilities{Compression: []string{"gzip"}})
+
+	progress := make(chan int)
+
+	err := p.Mirror(nil, dht.Address{}, progress)
+
+	if err != dfi.ErrMirrorUnsupported {
+		t.Fatal("Peer without mirror support was not rejected: ", err)
+	}
+
+	if _, ok := <-progress; ok {
+		t.Fatal("Progress channel left open")
+	}
+}
+
+func TestMirrorStateSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mirror.json")
+
+	state, err := dfi.LoadMirrorState(path)
+	if err != nil {
+		t.Fatal("Missing state should not be an error: ", err)
+	}
+
+	if len(state.CollectionHash) != 0 || state.Pieces != 0 {
+		t.Fatal("Missing state loaded as something")
+	}
+
+	saved := dfi.MirrorState{CollectionHash: []byte{1, 2, 3}, Pieces: 42}
+	if err = saved.Save(path); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	state, err = dfi.LoadMirrorState(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(state.CollectionHash, saved.CollectionHash) || state.Pieces != 42 {
+		t.Fatal("State changed on the way to disk and back: ", state)
+	}
+}
+
+func TestMirrorResume(t *testing.T) {
+	hash := []byte{1, 2, 3}
+	state := dfi.MirrorState{CollectionHash: hash, Pieces: 5}
+
+	tests := []struct {
+		name      string
+		state     dfi.MirrorState
+		hash      []byte
+		postCount int
+		expected  int
+	}{
+		{"fresh", dfi.MirrorState{}, hash, 0, 0},
+		// no state, fetch the possibly partial last piece again
+		{"no state", dfi.MirrorState{}, hash, data.PieceSize*3 + 1, 3},
+		{"resumed", state, hash, data.PieceSize * 5, 5},
+		{"database behind", state, hash, data.PieceSize*2 + 10, 2},
+		{"collection changed", state, []byte{4, 5, 6}, data.PieceSize * 5, 0},
+	}
+
+	for _, i := range tests {
+		if got := i.state.ResumeFrom(i.hash, i.postCount, 10, data.PieceSize); got != i.expected {
+			t.Fatalf("%s: expected to resume from %d, got %d", i.name, i.expected, got)
+		}
+	}
+
+	// never past the end of the collection
+	if got := state.ResumeFrom(hash, data.PieceSize*5, 3, data.PieceSize); got != 3 {
+		t.Fatal("Resumed past the end of the collection: ", got)
+	}
+}
+
+func TestOpenStreamCount(t *testing.T) {
+	a, b := net.Pipe()
+
+	client, err := yamux.Client(a, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	server, err := yamux.Server(b, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+
+	p := &dfi.Peer{}
+	p.Streams().Setup()
+
+	accepted := make([]net.Conn, 0, 3)
+
+	for i := 0; i < 3; i++ {
+		out, err := client.Open()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer out.Close()
+
+		// yamux only tells the other side about a stream once it is written to
+		out.Write([]byte{0})
+
+		in, err := server.Accept()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		p.AddStream(in)
+		accepted = append(accepted, in)
+	}
+
+	if p.OpenStreamCount() != 3 {
+		t.Fatalf("Expected 3 open streams, got %d", p.OpenStreamCount())
+	}
+
+	p.RemoveStream(accepted[1])
+
+	if p.OpenStreamCount() != 2 {
+		t.Fatalf("Expected 2 open streams, got %d", p.OpenStreamCount())
+	}
+
+	removed := accepted[1].(*yamux.Stream).StreamID()
+	for _, id := range p.Streams().StreamIDs() {
+		if id == removed {
+			t.Fatal("Removed stream still listed")
+		}
+	}
+
+	p.RemoveStream(accepted[0])
+	p.RemoveStream(accepted[2])
+
+	if p.OpenStreamCount() != 0 {
+		t.Fatalf("Expected no open streams, got %d", p.OpenStreamCount())
+	}
+}
+
+func TestQueryContextCancel(t *testing.T) {
+	a, b := net.Pipe()
+
+	// the other side of the session takes our streams but never answers
+	remote, err := yamux.Client(b, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer remote.Close()
+
+	c, err := proto.NewClient(a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := &dfi.Peer{}
+	p.Streams().Setup()
+	p.SetTCP(proto.ConnHeader{Client: *c})
+
+	_, err = p.ConnectServer()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer p.Terminate()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+
+	start := time.Now()
+
+	_, err = p.QueryContext(ctx, dht.Address{Raw: make([]byte, 20)})
+
+	if err != context.Canceled {
+		t.Fatal("Expected the query to be cancelled, got: ", err)
+	}
+
+	// without the context this would sit on the 10 second stream deadline
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Query took %s to notice it was cancelled", elapsed)
+	}
+
+	_, err = p.SearchContext(ctx, "query", 0)
+
+	if err != context.Canceled {
+		t.Fatal("Search with a cancelled context went ahead: ", err)
+	}
+}
+
+func TestMirrorCorruptHashList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorcorrupt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "corrupt", 25, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	// still signed for the real one
+	lp.Collection.HashList[5] ^= 1
+
+	p := connectedTo(t, lp)
+	defer p.Terminate()
+
+	db := data.NewDatabase(filepath.Join(dir, "mirror.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.SetPieceSize(10)
+
+	progress := make(chan int, 10)
+	err = p.Mirror(db, *freshPeer(t).Address(), progress)
+
+	if err != data.ErrCollectionMismatch {
+		t.Fatal("Expected a collection mismatch, got ", err)
+	}
+
+	if db.PostCount() != 0 {
+		t.Fatal("Posts stored from a corrupt collection")
+	}
+}
+
+func TestMirrorStoredMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorstored")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "stored", 25, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	p := connectedTo(t, lp)
+	defer p.Terminate()
+
+	if err = os.MkdirAll(filepath.Join("data", lp.Address().StringOr("")), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db := data.NewDatabase(filepath.Join(dir, "mirror.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.SetPieceSize(10)
+
+	// as many posts as the entry says, just not the same ones
+	for i := 0; i < 25; i++ {
+		_, err = db.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("a%039d", i),
+			Title:    fmt.Sprintf("other %d", i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	progress := make(chan int, 10)
+	err = p.Mirror(db, *freshPeer(t).Address(), progress)
+
+	if err != data.ErrCollectionMismatch {
+		t.Fatal("Expected a collection mismatch, got ", err)
+	}
+}
+
+func TestMirrorClamped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorclamped")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "clamped", 50, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	// far fewer than we ask for at once
+	viper.Set("net.maxPiecesPerRequest", 2)
+	defer viper.Set("net.maxPiecesPerRequest", nil)
+
+	p := connectedTo(t, lp)
+	defer p.Terminate()
+
+	if err = os.MkdirAll(filepath.Join("data", lp.Address().StringOr("")), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db := data.NewDatabase(filepath.Join(dir, "mirror.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.SetPieceSize(10)
+
+	progress := make(chan int, 100)
+
+	if err = p.Mirror(db, *lp.Address(), progress); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if db.PostCount() != 50 {
+		t.Fatalf("Expected 50 posts mirrored, got %d", db.PostCount())
+	}
+}
+
+func TestMirrorInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorresume")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp := servingPeer(t, "resume", 100, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	// a piece at a time, so there's plenty left when it's interrupted
+	viper.Set("net.maxPiecesPerRequest", 1)
+	defer viper.Set("net.maxPiecesPerRequest", nil)
+
+	statePath := filepath.Join("data", lp.Address().StringOr(""), "mirror.json")
+
+	if err = os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db := data.NewDatabase(filepath.Join(dir, "mirror.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.SetPieceSize(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := make(chan int)
+
+	go func() {
+		for i := range progress {
+			if i == 2 {
+				cancel()
+			}
+		}
+	}()
+
+	p := connectedTo(t, lp)
+
+	if err = p.MirrorContext(ctx, db, *lp.Address(), progress); err == nil {
+		t.Fatal("Interrupted mirror finished")
+	}
+	p.Terminate()
+
+	state, err := dfi.LoadMirrorState(statePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if state.Pieces < 3 || state.Pieces >= 10 {
+		t.Fatal("Progress not saved when interrupted: ", state.Pieces)
+	}
+
+	p = connectedTo(t, lp)
+	defer p.Terminate()
+
+	progress = make(chan int, 100)
+
+	if err = p.Mirror(db, *lp.Address(), progress); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if first := <-progress; first == 0 {
+		t.Fatal("Mirror started again rather than resuming")
+	}
+
+	if db.PostCount() != 100 {
+		t.Fatalf("Expected 100 posts mirrored, got %d", db.PostCount())
+	}
+
+	if _, err = os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatal("Mirror state left behind once complete")
+	}
+}
+
+func TestMirrorFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorfallback")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	origin := listen(t, servingPeer(t, "origin", 100, 10))
+	defer origin.DHT.Close()
+	defer origin.Database.Close()
+	defer origin.Server.Close()
+
+	seed := listeningPeer(t, "seed")
+	defer seed.DHT.Close()
+	defer seed.Database.Close()
+	defer seed.Server.Close()
+
+	// the seed has a full copy of the origin's posts
+	mirrored := data.NewDatabase(filepath.Join(dir, "seed-mirror.db"))
+	if err = mirrored.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer mirrored.Close()
+	mirrored.SetPieceSize(10)
+
+	for i := 0; i < 100; i++ {
+		_, err := mirrored.InsertPost(data.Post{
+			InfoHash: fmt.Sprintf("%040d", i),
+			Title:    fmt.Sprintf("served %d", i),
+		})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	seed.Databases.Set(origin.Address().StringOr(""), mirrored)
+
+	origin.Entry.Seeds = [][]byte{seed.Address().Raw}
+	if err = origin.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the origin's last piece no longer matches its collection
+	if err = origin.Database.DeleteByInfoHash(fmt.Sprintf("%040d", 95)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp := servingPeer(t, "mirror", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	// the seed first, so the origin's entry can refer to it
+	for _, i := range []*dfi.LocalPeer{seed, origin} {
+		if _, err = lp.DHT.Insert(*i.Entry); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	p, _, err := lp.ConnectPeer(*origin.Address())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer p.Terminate()
+
+	if err = os.MkdirAll(filepath.Join("data", origin.Address().StringOr("")), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	db := data.NewDatabase(filepath.Join(dir, "mirror.db"))
+	if err = db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.SetPieceSize(10)
+
+	if err = p.Mirror(db, *origin.Address(), make(chan int, 100)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if db.PostCount() != 100 {
+		t.Fatalf("Expected 100 posts mirrored, got %d", db.PostCount())
+	}
+
+	if lp.GetPeer(*seed.Address()) != nil {
+		t.Fatal("Seed still connected once the mirror was done with it")
+	}
+}
+
+func TestMirrorBackoff(t *testing.T) {
+	if dfi.MirrorBackoff(0) != dfi.MirrorFallbackBackoff {
+		t.Fatal("First fallback should wait the base backoff")
+	}
+
+	if dfi.MirrorBackoff(2) != dfi.MirrorFallbackBackoff*4 {
+		t.Fatal("Backoff should double each attempt")
+	}
+
+	for _, i := range []int{10, 64, 1000} {
+		if dfi.MirrorBackoff(i) != dfi.MirrorFallbackMaxBackoff {
+			t.Fatalf("Backoff for attempt %d not capped", i)
+		}
+	}
+}
+
+// A peer whose connection can be cut, after which whatever it sends is lost
+// without the session noticing.
+func cuttablePeer(t *testing.T) (*dfi.Peer, *int32) {
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+
+	remote, err := yamux.Client(d, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cut := new(int32)
+
+	go io.Copy(b, c)
+	go func() {
+		buf := make([]byte, 4096)
+
+		for {
+			n, err := b.Read(buf)
+			if err != nil {
+				remote.Close()
+				return
+			}
+
+			if atomic.LoadInt32(cut) == 0 {
+				c.Write(buf[:n])
+			}
+		}
+	}()
+
+	client, err := proto.NewClient(a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := &dfi.Peer{}
+	p.Streams().Setup()
+	p.Streams().PingTimeout = time.Millisecond * 200
+	p.SetTCP(proto.ConnHeader{Client: *client})
+
+	if _, err = p.ConnectServer(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return p, cut
+}
+
+func TestCheckAlive(t *testing.T) {
+	p, cut := cuttablePeer(t)
+	defer p.Terminate()
+
+	if _, err := p.Ping(time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	atomic.StoreInt32(cut, 1)
+
+	// it answered a moment ago, so no need to ask again
+	s, err := p.OpenStream()
+	if err != nil {
+		t.Fatal("Pinged a peer seen within the alive window: ", err.Error())
+	}
+	s.Close()
+
+	// never heard from, so it is pinged and doesn't answer
+	silent, cut := cuttablePeer(t)
+	defer silent.Terminate()
+
+	atomic.StoreInt32(cut, 1)
+
+	if _, err = silent.OpenStream(); err == nil {
+		t.Fatal("Opened a stream to a peer that doesn't answer pings")
+	}
+}
+
+func TestLastLatency(t *testing.T) {
+	a, b := net.Pipe()
+
+	// yamux answers pings itself
+	remote, err := yamux.Client(b, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer remote.Close()
+
+	c, err := proto.NewClient(a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := &dfi.Peer{}
+	p.Streams().Setup()
+	p.SetTCP(proto.ConnHeader{Client: *c})
+
+	if p.LastLatency() != 0 {
+		t.Fatal("Latency before any ping")
+	}
+
+	_, err = p.ConnectServer()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer p.Terminate()
+
+	rtt, err := p.Ping(time.Second * 5)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if p.LastLatency() != rtt || rtt <= 0 {
+		t.Fatalf("Expected a latency of %s, got %s", rtt, p.LastLatency())
+	}
+}
@@ -0,0 +1,111 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+// How many events a subscriber can fall behind by before they are dropped.
+const PeerEventBuffer = 64
+
+type PeerEventKind int
+
+const (
+	EventConnected PeerEventKind = iota
+	EventDisconnected
+	EventAnnounced
+	// a peer we had never heard of, found crawling
+	EventDiscovered
+)
+
+func (k PeerEventKind) String() string {
+	switch k {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventAnnounced:
+		return "announced"
+	case EventDiscovered:
+		return "discovered"
+	}
+
+	return "unknown"
+}
+
+// Something that happened to a peer connection.
+type PeerEvent struct {
+	Address dht.Address
+	Kind    PeerEventKind
+	Time    time.Time
+}
+
+// Hands out events to everyone listening, never waiting on a slow listener.
+type peerEvents struct {
+	lock        sync.RWMutex
+	subscribers []chan PeerEvent
+}
+
+func (pe *peerEvents) subscribe() <-chan PeerEvent {
+	ch := make(chan PeerEvent, PeerEventBuffer)
+
+	pe.lock.Lock()
+	pe.subscribers = append(pe.subscribers, ch)
+	pe.lock.Unlock()
+
+	return ch
+}
+
+func (pe *peerEvents) unsubscribe(ch <-chan PeerEvent) {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+
+	for n, i := range pe.subscribers {
+		if i == ch {
+			pe.subscribers = append(pe.subscribers[:n], pe.subscribers[n+1:]...)
+			close(i)
+			return
+		}
+	}
+}
+
+func (pe *peerEvents) publish(addr dht.Address, kind PeerEventKind) {
+	event := PeerEvent{addr, kind, time.Now()}
+
+	pe.lock.RLock()
+	defer pe.lock.RUnlock()
+
+	for _, i := range pe.subscribers {
+		select {
+		case i <- event:
+		default:
+			// full, they'll have to miss this one
+		}
+	}
+}
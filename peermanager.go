@@ -25,15 +25,24 @@
 package dfi
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+	"github.com/dfindex/dfi/util"
+	"github.com/hashicorp/yamux"
 	"github.com/spf13/viper"
 	"github.com/streamrail/concurrent-map"
 
@@ -43,12 +52,46 @@ import (
 const HeartbeatFrequency = time.Second * 30
 const AnnounceFrequency = time.Minute * 30
 
+// Reconnect attempts start this far apart, doubling each time up to
+// ReconnectMaxDelay.
+const ReconnectBaseDelay = time.Second * 2
+const ReconnectMaxDelay = time.Minute * 4
+
+// How long we stop dialling a peer that never came back, unless configured
+// otherwise. It can still connect to us.
+const DefaultReconnectBackoff = time.Minute * 30
+
+// How many of the closest entries are resolved through at once, unless
+// configured otherwise.
+const DefaultResolveParallelism = 3
+
+// How many hops each branch of a resolve may take.
+const ResolveDepth = 6
+
+// Below this routing table coverage score, buckets are refreshed. See
+// dht.NetDB.CoverageScore.
+const DefaultMinCoverage = 0.5
+
+// How many of the buckets that aren't full RefreshBuckets asks about each time.
+const RefreshBucketSample = 8
+
+// Where the addresses being seeded are kept between runs, unless set with
+// SetSeedListPath.
+const SeedListPath = "./data/seeding.dat"
+
 // errors
 
 var (
 	PeerUnreachable  = errors.New("Peer could not be reached")
 	PeerDisconnected = errors.New("Peer has disconnected")
 	RecursionLimit   = errors.New("Recursion limit reached, peer cannot be resolved")
+	AddressNotFound  = errors.New("Address could not be resolved")
+	NoCandidates     = errors.New("No peers to ask, bootstrap first")
+	CorruptSeedList  = errors.New("Seed list is corrupt, not a single whole address")
+	NotSeeding       = errors.New("Not seeding that address")
+	PeerRateLimited  = errors.New("Peer has made too many requests")
+	PeerBanned       = errors.New("Peer is banned")
+	PeerBackingOff   = errors.New("Peer did not come back after dropping, not dialling it for now")
 )
 
 // handles peer connections
@@ -61,10 +104,25 @@ type PeerManager struct {
 	// A map of public address to DFI address
 	publicToDFI  cmap.ConcurrentMap
 	seedManagers cmap.ConcurrentMap
+	seedListPath string
+	// peers that dropped and are being reconnected to, to the attempt they
+	// are on
+	reconnecting cmap.ConcurrentMap
+	// peers we gave up reconnecting to, to when we'll dial them again
+	backoff cmap.ConcurrentMap
 
 	socks     bool
 	socksPort int
+	socksUser string
+	socksPass string
 	localPeer *LocalPeer
+
+	// peers we won't connect to, or accept connections from
+	blacklist *Blacklist
+
+	events peerEvents
+
+	reputations reputations
 }
 
 func NewPeerManager(lp *LocalPeer) *PeerManager {
@@ -74,15 +132,134 @@ func NewPeerManager(lp *LocalPeer) *PeerManager {
 	ret.publicToDFI = cmap.New()
 	ret.seedManagers = cmap.New()
 	ret.peerSeen = cmap.New()
+	ret.reconnecting = cmap.New()
+	ret.backoff = cmap.New()
 	ret.localPeer = lp
+	ret.seedListPath = SeedListPath
+
+	bl, err := LoadBlacklist("./data/blacklist.dat")
+
+	if err != nil {
+		log.Error("Failed to load blacklist: ", err.Error())
+	}
+
+	ret.blacklist = bl
 
 	return ret
 }
 
+// Refuses all connections to and from the peer, for good.
+func (pm *PeerManager) Ban(addr dht.Address, reason string) error {
+	return pm.BanFor(addr, reason, 0)
+}
+
+// Bans the peer for d, 0 being forever. It is disconnected if connected.
+func (pm *PeerManager) BanFor(addr dht.Address, reason string, d time.Duration) error {
+	log.WithFields(log.Fields{
+		"peer":   addr.StringOr(""),
+		"reason": reason,
+	}).Info("Banning peer")
+
+	err := pm.blacklist.Ban(addr.StringOr(""), reason, d)
+
+	if peer := pm.GetPeer(addr); peer != nil {
+		peer.Terminate()
+		pm.HandleCloseConnection(&addr)
+	}
+
+	return err
+}
+
+func (pm *PeerManager) Unban(addr dht.Address) error {
+	return pm.blacklist.Unban(addr.StringOr(""))
+}
+
+func (pm *PeerManager) IsBanned(addr dht.Address) bool {
+	return pm.blacklist.IsBanned(addr.StringOr(""))
+}
+
+// Bans a public address, without the port, rather than a DFI address.
+func (pm *PeerManager) BanHost(host, reason string, d time.Duration) error {
+	log.WithFields(log.Fields{
+		"host":   host,
+		"reason": reason,
+	}).Info("Banning host")
+
+	return pm.blacklist.Ban(host, reason, d)
+}
+
+func (pm *PeerManager) UnbanHost(host string) error {
+	return pm.blacklist.Unban(host)
+}
+
+func (pm *PeerManager) IsHostBanned(host string) bool {
+	return pm.blacklist.IsBanned(host)
+}
+
 func (pm *PeerManager) Count() int {
 	return pm.peers.Count()
 }
 
+// The number of seed managers running, one per feed we're seeding.
+func (pm *PeerManager) SeedCount() int {
+	return pm.seedManagers.Count()
+}
+
+// The addresses of the feeds we're seeding, in no particular order.
+func (pm *PeerManager) SeedingList() []dht.Address {
+	ret := make([]dht.Address, 0, pm.seedManagers.Count())
+
+	for i := range pm.seedManagers.IterBuffered() {
+		if sm, ok := i.Val.(*SeedManager); ok {
+			ret = append(ret, sm.track)
+		}
+	}
+
+	return ret
+}
+
+// Stops the seed manager for addr and takes it off the seed list, so it isn't
+// started again next time.
+func (pm *PeerManager) StopSeeding(addr dht.Address) error {
+	sm, ok := pm.seedManagers.Pop(string(addr.Raw))
+
+	if !ok {
+		return NotSeeding
+	}
+
+	// it may be busy looking for seeds, or already stopped if the peer
+	// disconnected, so don't wait on it forever
+	go func() {
+		select {
+		case sm.(*SeedManager).Close <- true:
+		case <-time.After(SeedSearchFrequency):
+		}
+	}()
+
+	addresses, err := ReadSeedList(pm.seedListPath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	kept := make([]dht.Address, 0, len(addresses))
+	for _, i := range addresses {
+		if !i.Equals(&addr) {
+			kept = append(kept, i)
+		}
+	}
+
+	return WriteSeedList(pm.seedListPath, kept)
+}
+
+func (pm *PeerManager) SetSeedListPath(path string) {
+	pm.seedListPath = path
+}
+
 func (pm *PeerManager) Peers() map[string]*Peer {
 	ret := make(map[string]*Peer)
 
@@ -100,18 +277,29 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 	var peer *Peer
 	var err error
 
+	if host, _, err := net.SplitHostPort(addr); err == nil && pm.IsHostBanned(host) {
+		return nil, PeerBanned
+	}
+
 	dfiAddr, ok := pm.publicToDFI.Get(addr)
 	if ok {
+		if pm.IsBanned(*dfiAddr.(*dht.Address)) {
+			return nil, PeerBanned
+		}
+
 		if peer = pm.GetPeer(*dfiAddr.(*dht.Address)); peer != nil {
 			return peer, nil
 		}
 	}
 
 	peer = &Peer{}
+	configurePeer(peer)
 
 	if pm.socks {
 		peer.streams.Socks = true
 		peer.streams.SocksPort = pm.socksPort
+		peer.streams.SocksUser = pm.socksUser
+		peer.streams.SocksPass = pm.socksPass
 	}
 
 	err = peer.Connect(addr, pm.localPeer)
@@ -120,6 +308,12 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 		return nil, PeerUnreachable
 	}
 
+	// only now do we know who is really there
+	if pm.IsBanned(*peer.Address()) {
+		peer.Terminate()
+		return nil, PeerBanned
+	}
+
 	peer.ConnectClient(pm.localPeer)
 
 	pm.SetPeer(peer)
@@ -127,23 +321,158 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 	return peer, nil
 }
 
-// Resolved a DFI address into an entry, connects to the peer at the
-// PublicAddress in the Entry, then return it. The peer is also stored in a map.
+// Sets up connection limits and timeouts from the config.
+func configurePeer(p *Peer) {
+	p.streams.DialTimeout = viper.GetDuration("net.dialTimeout")
+	p.streams.StreamDeadline = viper.GetDuration("net.streamDeadline")
+	p.streams.PingTimeout = viper.GetDuration("net.pingTimeout")
+	p.streams.MaxSessions = viper.GetInt("net.maxSessions")
+	p.streams.SessionStreams = viper.GetInt("net.sessionStreams")
+	p.streams.SessionConfig = sessionConfig()
+}
+
+// Session settings from the config, anything not set is left as yamux has it.
+// Returns nil, so the yamux defaults, if the result wouldn't be valid.
+func sessionConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+
+	if viper.IsSet("net.keepAlive") {
+		config.EnableKeepAlive = viper.GetBool("net.keepAlive")
+	}
+
+	if d := viper.GetDuration("net.keepAliveInterval"); d > 0 {
+		config.KeepAliveInterval = d
+	}
+
+	if d := viper.GetDuration("net.writeTimeout"); d > 0 {
+		config.ConnectionWriteTimeout = d
+	}
+
+	if size := viper.GetInt("net.maxStreamWindow"); size > 0 {
+		config.MaxStreamWindowSize = uint32(size)
+	}
+
+	if err := yamux.VerifyConfig(config); err != nil {
+		log.Warn("Ignoring session settings: ", err.Error())
+		return nil
+	}
+
+	return config
+}
+
+// Joins a host and port, bracketing IPv6 literals. The host may already be
+// bracketed.
+func HostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// Every host:port an entry can be reached at, in the order they should be
+// tried. Onion addresses come first when going through SOCKS, as that is most
+// likely Tor, and last otherwise as they are unlikely to connect.
+func DialAddresses(entry *dht.Entry, preferOnion bool) []string {
+	onion := make([]string, 0)
+	other := make([]string, 0)
+
+	for _, i := range entry.Addresses() {
+		addr := HostPort(i, entry.Port)
+
+		if strings.HasSuffix(strings.ToLower(strings.Trim(i, "[]")), ".onion") {
+			onion = append(onion, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+
+	if preferOnion {
+		return append(onion, other...)
+	}
+
+	return append(other, onion...)
+}
+
+// Tries each of the entry's addresses in turn, returning the first peer that
+// connects.
+func (pm *PeerManager) connectEntry(entry *dht.Entry) (*Peer, error) {
+	if pm.backingOff(entry.Address) {
+		return nil, PeerBackingOff
+	}
+
+	err := PeerUnreachable
+
+	for _, i := range DialAddresses(entry, pm.socks) {
+		var peer *Peer
+		peer, err = pm.ConnectPeerDirect(i)
+
+		if err == nil {
+			return peer, nil
+		}
+
+		log.WithField("address", i).Debug("Failed to connect, trying next address")
+	}
+
+	return nil, err
+}
+
+// Connects to the peer at an entry's addresses and pings it, making sure the
+// entry is for a peer that's actually there before it's trusted. Unless we were
+// already connected, the connection is dropped again afterwards.
+func (pm *PeerManager) CheckReachable(entry *dht.Entry) error {
+	if pm.IsBanned(entry.Address) {
+		return PeerBanned
+	}
+
+	before := pm.Peers()
+
+	peer, err := pm.connectEntry(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if before[string(peer.Address().Raw)] != peer {
+		defer pm.dropProbe(peer)
+	}
+
+	if !peer.Address().Equals(&entry.Address) {
+		return errors.New("A different peer answered at the entry's address")
+	}
+
+	_, err = peer.Ping(peer.PingTimeout())
+
+	return err
+}
+
+// Disconnects a peer that was only connected to for a check, or to fall back on
+// for a while. Another connection to the same peer is left alone.
+func (pm *PeerManager) dropProbe(peer *Peer) {
+	peer.Terminate()
+
+	if pm.GetPeer(*peer.Address()) == peer {
+		pm.HandleCloseConnection(peer.Address())
+	}
+}
+
+// Resolved a DFI address into an entry, connects to the peer at one of the
+// addresses in the Entry, then return it. The peer is also stored in a map.
 func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error) {
 	var peer *Peer
 
+	if pm.IsBanned(addr) {
+		return nil, nil, PeerBanned
+	}
+
 	entry, err := pm.Resolve(addr)
 
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if entry.Address.Equals(pm.localPeer.Address()) {
-		return nil, nil, errors.New("Cannot connect to self")
+	if entry == nil {
+		return nil, nil, &ResolveError{addr, 0, AddressNotFound}
 	}
 
-	if entry == nil {
-		return nil, nil, data.AddressResolutionError{Address: entry.Address.StringOr("")}
+	if entry.Address.Equals(pm.localPeer.Address()) {
+		return nil, nil, errors.New("Cannot connect to self")
 	}
 
 	if peer = pm.GetPeer(entry.Address); peer != nil {
@@ -158,7 +487,7 @@ func (pm *PeerManager) ConnectPeer(addr dht.Address) (*Peer, *dht.Entry, error)
 	// now should have an entry for the peer, connect to it!
 	log.WithField("address", entry.Address.StringOr("")).Debug("Connecting")
 
-	peer, err = pm.ConnectPeerDirect(entry.PublicAddress + ":" + strconv.Itoa(entry.Port))
+	peer, err = pm.connectEntry(entry)
 
 	// Caller can go on to choose a seed to connect to, not quite the end of the
 	// world :P
@@ -194,36 +523,63 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 		return
 	}
 
-	pm.publicToDFI.Set(e.PublicAddress, p.Address())
+	for _, i := range DialAddresses(e, false) {
+		pm.publicToDFI.Set(i, p.Address())
+	}
 
 	p.addSeedManager = pm.AddSeedManager
 	p.addEntry = pm.localPeer.AddEntry
 	p.addSeeding = pm.localPeer.AddSeeding
+	p.connectPeer = func(addr dht.Address) (*Peer, func(), error) {
+		existing := pm.GetPeer(addr)
+		peer, _, err := pm.ConnectPeer(addr)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if peer == existing {
+			return peer, func() {}, nil
+		}
+
+		return peer, func() { pm.dropProbe(peer) }, nil
+	}
 
 	p.updateSeen = func() {
 		pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
 	}
+	p.rate = func(err error) {
+		pm.rate(*p.Address(), err)
+	}
 
 	pm.peers.Set(string(p.Address().Raw), p)
+	pm.backoff.Remove(string(p.Address().Raw))
 	pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
+	pm.saveSeen(*p.Address())
+	pm.events.publish(*p.Address(), EventConnected)
 
 	// if we need to clear space for another, remove the least recently used one
 	for pm.peers.Count() > viper.GetInt("net.maxPeers") {
+		seen := make(map[string]int64)
+		reputation := make(map[string]int)
 
-		oldestKey := ""
-		oldestValue := int64(time.Now().UnixNano())
-
-		// find the least recently seen peer
 		for i := range pm.peerSeen.IterBuffered() {
-			if i.Val == nil {
+			t, ok := i.Val.(int64)
+
+			if !ok || !pm.peers.Has(i.Key) {
 				continue
 			}
 
-			time := i.Val.(int64)
+			seen[i.Key] = t
+			reputation[i.Key] = pm.Reputation(dht.Address{Raw: []byte(i.Key)})
+		}
 
-			if time < oldestValue {
-				oldestKey = i.Key
-			}
+		// never the one we've just added
+		oldestKey, ok := LeastReputable(seen, reputation, string(p.Address().Raw))
+
+		if !ok {
+			log.Error("No peer to remove")
+			break
 		}
 
 		// then remove it, after disconnecting it from the network
@@ -249,8 +605,50 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 	go pm.announcePeer(p)
 }
 
+// The key with the earliest time in seen, other than except. False if there
+// isn't one.
+func LeastRecentlySeen(seen map[string]int64, except string) (string, bool) {
+	oldestKey := ""
+	found := false
+
+	var oldestValue int64
+
+	for k, t := range seen {
+		if k == except {
+			continue
+		}
+
+		if !found || t < oldestValue {
+			oldestKey = k
+			oldestValue = t
+			found = true
+		}
+	}
+
+	return oldestKey, found
+}
+
+// Events for peers connecting, disconnecting and being announced to. The
+// channel is buffered, and events are dropped rather than waiting for a
+// subscriber that has fallen behind.
+func (pm *PeerManager) Subscribe() <-chan PeerEvent {
+	return pm.events.subscribe()
+}
+
+// Stops events being sent to a channel from Subscribe, and closes it.
+func (pm *PeerManager) Unsubscribe(ch <-chan PeerEvent) {
+	pm.events.unsubscribe(ch)
+}
+
 func (pm *PeerManager) HandleCloseConnection(addr *dht.Address) {
-	pm.peers.Remove(string(addr.Raw))
+	// this can be called more than once for the same peer, only tell people
+	// the first time
+	if _, ok := pm.peers.Pop(string(addr.Raw)); ok {
+		pm.events.publish(*addr, EventDisconnected)
+	}
+
+	// the last we heard of it, anything since the last heartbeat would be lost
+	pm.saveSeen(*addr)
 	pm.peerSeen.Remove(string(addr.Raw))
 
 	sm, ok := pm.seedManagers.Get(string(addr.Raw))
@@ -279,17 +677,111 @@ func (pm *PeerManager) heartbeatPeer(p *Peer) {
 		log.WithField("peer", p.Address().StringOr("")).Debug("Sending heartbeat")
 		// allows for a suddenly slower connection, most requests have a lower timeout
 		_, err := p.Ping(HeartbeatFrequency)
+		pm.rate(*p.Address(), err)
 
 		if err != nil {
 			log.WithField("peer", p.Address().StringOr("")).Info("Peer has no heartbeat, terminating")
 
 			pm.HandleCloseConnection(p.Address())
 
+			// only try and get it back if we know where it is
+			if p.entry != nil {
+				go pm.reconnect(*p.entry)
+			}
+
 			return
 		}
+
+		pm.saveSeen(*p.Address())
 	}
 }
 
+// How long to wait before reconnect attempt n, counting from 0. Doubles each
+// time up to a cap, with up to half as much again added at random so peers
+// that dropped together don't all come back at once.
+func ReconnectDelay(attempt int) time.Duration {
+	delay := ReconnectMaxDelay
+
+	if attempt < 32 {
+		if d := ReconnectBaseDelay << uint(attempt); d > 0 && d < ReconnectMaxDelay {
+			delay = d
+		}
+	}
+
+	return delay + time.Duration(util.CryptoRandInt(0, int64(delay/2)))
+}
+
+// Tries to get back a peer that dropped, waiting longer after each failure.
+// After net.reconnectAttempts we back off from dialling it for a while, though
+// it is welcome to connect to us.
+func (pm *PeerManager) reconnect(entry dht.Entry) {
+	attempts := viper.GetInt("net.reconnectAttempts")
+
+	if attempts <= 0 {
+		return
+	}
+
+	key := string(entry.Address.Raw)
+
+	// someone is already on it
+	if !pm.reconnecting.SetIfAbsent(key, 0) {
+		return
+	}
+
+	// whatever happens, the next drop starts from scratch
+	defer pm.reconnecting.Remove(key)
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		pm.reconnecting.Set(key, attempt)
+		time.Sleep(ReconnectDelay(attempt))
+
+		// it may well have come back on its own
+		if pm.GetPeer(entry.Address) != nil || pm.IsBanned(entry.Address) {
+			return
+		}
+
+		if _, err := pm.connectEntry(&entry); err == nil {
+			log.WithField("peer", entry.Address.StringOr("")).Info("Reconnected")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"peer":    entry.Address.StringOr(""),
+			"attempt": attempt + 1,
+		}).Debug("Reconnect failed")
+	}
+
+	backoff := viper.GetDuration("net.reconnectBackoff")
+	if backoff <= 0 {
+		backoff = DefaultReconnectBackoff
+	}
+
+	log.WithField("peer", entry.Address.StringOr("")).Info("Peer did not come back, backing off")
+	pm.BackOff(entry.Address, backoff)
+}
+
+// Stops dialling addr for d. This is only kept in memory, and is lifted as
+// soon as the peer connects to us.
+func (pm *PeerManager) BackOff(addr dht.Address, d time.Duration) {
+	pm.backoff.Set(string(addr.Raw), time.Now().Add(d))
+}
+
+func (pm *PeerManager) backingOff(addr dht.Address) bool {
+	until, ok := pm.backoff.Get(string(addr.Raw))
+
+	if !ok {
+		return false
+	}
+
+	if time.Now().Before(until.(time.Time)) {
+		return true
+	}
+
+	pm.backoff.Remove(string(addr.Raw))
+
+	return false
+}
+
 func (pm *PeerManager) announcePeer(p *Peer) {
 	ticker := time.NewTicker(AnnounceFrequency)
 
@@ -311,6 +803,8 @@ func (pm *PeerManager) announcePeer(p *Peer) {
 			return err
 		}
 
+		pm.events.publish(*p.Address(), EventAnnounced)
+
 		return nil
 	}
 
@@ -329,6 +823,106 @@ func (pm *PeerManager) announcePeer(p *Peer) {
 	}
 }
 
+// When we last heard from a peer, false if we never have. Connected peers are
+// tracked in memory, which wins as it's written through to the entry table
+// every heartbeat and on disconnect, so is never older. Anyone else falls back
+// to the seen time stored with their entry, which survives restarts.
+func (pm *PeerManager) LastSeen(addr dht.Address) (time.Time, bool) {
+	if seen, ok := pm.peerSeen.Get(string(addr.Raw)); ok {
+		return time.Unix(0, seen.(int64)), true
+	}
+
+	if pm.localPeer == nil || pm.localPeer.DHT == nil {
+		return time.Time{}, false
+	}
+
+	entry, err := pm.localPeer.DHT.Query(addr)
+
+	if err != nil || entry == nil || entry.Seen <= 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(entry.Seen), 0), true
+}
+
+// Writes when we last heard from addr through to its entry, so it outlives a
+// restart. The table only ever moves seen forward, so the newest time wins.
+func (pm *PeerManager) saveSeen(addr dht.Address) {
+	if pm.localPeer == nil || pm.localPeer.DHT == nil {
+		return
+	}
+
+	seen, ok := pm.peerSeen.Get(string(addr.Raw))
+
+	if !ok {
+		return
+	}
+
+	err := pm.localPeer.DHT.UpdateSeen(addr, seen.(int64)/int64(time.Second))
+
+	if err != nil {
+		log.WithField("peer", addr.StringOr("")).Debug("Failed to save seen time: ", err.Error())
+	}
+}
+
+// Used by the DHT before evicting a peer from a full bucket. Anyone heard from
+// recently is alive, otherwise we ping them if connected. Peers we aren't
+// connected to aren't dialled, that would be far too slow for a table insert.
+func (pm *PeerManager) IsAlive(addr dht.Address) bool {
+	if seen, ok := pm.peerSeen.Get(string(addr.Raw)); ok {
+		if time.Since(time.Unix(0, seen.(int64))) < HeartbeatFrequency*2 {
+			return true
+		}
+	}
+
+	peer := pm.GetPeer(addr)
+
+	if peer == nil {
+		return false
+	}
+
+	_, err := peer.Ping(time.Second * 5)
+
+	return err == nil
+}
+
+// Periodically removes entries for peers that haven't been seen in a while, so
+// the DHT doesn't fill up with nodes that are never coming back. Blocks.
+func (pm *PeerManager) PruneEntries() {
+	interval := viper.GetDuration("net.pruneInterval")
+	ttl := viper.GetDuration("net.entryTTL")
+
+	if interval <= 0 || ttl <= 0 {
+		log.Info("Entry pruning disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+
+	for _ = range ticker.C {
+		// anyone we are connected to is very much alive
+		for i := range pm.peerSeen.IterBuffered() {
+			seen, ok := i.Val.(int64)
+
+			if !ok {
+				continue
+			}
+
+			addr := dht.Address{Raw: []byte(i.Key)}
+			pm.localPeer.DHT.UpdateSeen(addr, seen/int64(time.Second))
+		}
+
+		removed, err := pm.localPeer.DHT.PruneOlderThan(ttl)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		log.WithField("removed", removed).Info("Pruned stale entries")
+	}
+}
+
 func (pm *PeerManager) AddSeedManager(addr dht.Address) error {
 	if pm.seedManagers.Has(string(addr.Raw)) {
 		return nil
@@ -348,19 +942,66 @@ func (pm *PeerManager) AddSeedManager(addr dht.Address) error {
 	return nil
 }
 
+// Reads a list of raw addresses, one after the other. A trailing partial
+// address or blank records are logged and skipped, but a file with no whole
+// address in it at all is treated as corrupt.
+func ReadSeedList(path string) ([]dht.Address, error) {
+	file, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := dht.AddressBinarySize
+
+	if len(file) > 0 && len(file) < size {
+		return nil, CorruptSeedList
+	}
+
+	if extra := len(file) % size; extra != 0 {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"bytes": extra,
+		}).Warn("Seed list has a partial address at the end, skipping it")
+	}
+
+	ret := make([]dht.Address, 0, len(file)/size)
+	blank := make([]byte, size)
+
+	for i := 0; i+size <= len(file); i += size {
+		raw := file[i : i+size]
+
+		if bytes.Equal(raw, blank) {
+			log.WithField("offset", i).Warn("Skipping blank seed list record")
+			continue
+		}
+
+		ret = append(ret, dht.Address{Raw: raw})
+	}
+
+	return ret, nil
+}
+
+// Writes addresses as a seed list that ReadSeedList can read back.
+func WriteSeedList(path string, addresses []dht.Address) error {
+	buf := make([]byte, 0, len(addresses)*dht.AddressBinarySize)
+
+	for _, i := range addresses {
+		buf = append(buf, i.Raw...)
+	}
+
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
 func (pm *PeerManager) LoadSeeds() error {
 	log.Info("Loading seed list")
-	file, err := ioutil.ReadFile("./data/seeding.dat")
+	addresses, err := ReadSeedList(pm.seedListPath)
 
 	if err != nil {
 		return err
 	}
 
-	seedCount := len(file) / 20
-
-	for i := 0; i < seedCount; i++ {
-		addr := dht.Address{Raw: file[i*20 : 20+i*20]}
-
+	for _, addr := range addresses {
 		err := pm.AddSeedManager(addr)
 
 		if err != nil {
@@ -369,12 +1010,285 @@ func (pm *PeerManager) LoadSeeds() error {
 	}
 	log.Info("Finished loading seed list")
 
-	return err
+	return nil
+}
+
+// Asks about a random address in a sample of the buckets that aren't full, up
+// to the closest one with anything in it, adding whatever is found along the
+// way to the routing table. At most RefreshBucketSample buckets are asked
+// about, the rest wait for the next refresh. Returns how many new entries were
+// inserted.
+func (pm *PeerManager) RefreshBuckets() int {
+	self := pm.localPeer.Address()
+	coverage := pm.localPeer.DHT.Coverage()
+
+	deepest := -1
+	for n, i := range coverage {
+		if i > 0 {
+			deepest = n
+		}
+	}
+
+	lacking := make([]int, 0, deepest+1)
+	for n := 0; n <= deepest; n++ {
+		if coverage[n] < 1 {
+			lacking = append(lacking, n)
+		}
+	}
+
+	rand.Shuffle(len(lacking), func(i, j int) {
+		lacking[i], lacking[j] = lacking[j], lacking[i]
+	})
+
+	if len(lacking) > RefreshBucketSample {
+		lacking = lacking[:RefreshBucketSample]
+	}
+
+	inserted := 0
+	for _, n := range lacking {
+		target, err := dht.RandomAddressInBucket(self, n)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		closest, err := pm.localPeer.DHT.FindClosest(*target)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		for _, i := range closest {
+			if i.Address.Equals(self) {
+				continue
+			}
+
+			peer := pm.GetPeer(i.Address)
+
+			if peer == nil {
+				peer, err = pm.connectEntry(i)
+
+				if err != nil {
+					continue
+				}
+			}
+
+			found, err := peer.FindClosest(*target)
+
+			if err != nil {
+				continue
+			}
+
+			entries := make([]dht.Entry, 0, len(found))
+			for _, f := range found {
+				entries = append(entries, *f.(*dht.Entry))
+			}
+
+			// InsertMany verifies them all first
+			affected, err := pm.localPeer.DHT.InsertMany(entries)
+
+			if err != nil {
+				log.Error(err.Error())
+				continue
+			}
+
+			inserted += int(affected)
+
+			// one peer answering is enough for each bucket
+			break
+		}
+	}
+
+	return inserted
+}
+
+// What happened when rejoining the network.
+type RejoinReport struct {
+	// Stale entries removed.
+	Pruned int `json:"pruned"`
+	// New entries found refreshing buckets.
+	Refreshed int `json:"refreshed"`
+	// Peers we tried to announce to, and those that took it.
+	Tried     int `json:"tried"`
+	Announced int `json:"announced"`
+	// Entries we seed that we registered as a seed for again.
+	Reregistered int `json:"reregistered"`
+}
+
+// Catches up after being offline for a while. Prunes stale entries, refreshes
+// the routing table, announces to connected peers and those closest to us,
+// then lets the origins of everything we seed know we are still about.
+func (pm *PeerManager) Rejoin() RejoinReport {
+	var report RejoinReport
+	var err error
+
+	log.Info("Rejoining the network")
+
+	if ttl := viper.GetDuration("net.entryTTL"); ttl > 0 {
+		report.Pruned, err = pm.localPeer.DHT.PruneOlderThan(ttl)
+
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	report.Refreshed = pm.RefreshBuckets()
+
+	self := pm.localPeer.Address()
+	targets := make(map[string]*dht.Entry)
+
+	for _, p := range pm.Peers() {
+		e, err := p.Entry()
+
+		if err != nil {
+			continue
+		}
+
+		targets[string(e.Address.Raw)] = e
+	}
+
+	closest, err := pm.localPeer.DHT.FindClosest(*self)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	for _, i := range closest {
+		targets[string(i.Address.Raw)] = i
+	}
+
+	for _, i := range targets {
+		if i.Address.Equals(self) {
+			continue
+		}
+
+		report.Tried++
+
+		peer := pm.GetPeer(i.Address)
+
+		if peer == nil {
+			peer, err = pm.connectEntry(i)
+
+			if err != nil {
+				continue
+			}
+		}
+
+		if err = peer.Announce(pm.localPeer); err != nil {
+			log.WithField("peer", i.Address.StringOr("")).Info("Announce failed: ", err.Error())
+			continue
+		}
+
+		report.Announced++
+	}
+
+	for i := range pm.seedManagers.IterBuffered() {
+		sm, ok := i.Val.(*SeedManager)
+
+		if !ok || sm.track.Equals(self) {
+			continue
+		}
+
+		peer, _, err := pm.ConnectPeer(sm.track)
+
+		if err != nil {
+			continue
+		}
+
+		// already seeding it, so only the origin needs telling
+		stream, err := peer.OpenStream()
+
+		if err != nil {
+			continue
+		}
+
+		err = stream.RequestAddPeer(sm.track)
+		stream.Close()
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		report.Reregistered++
+	}
+
+	log.WithFields(log.Fields{
+		"pruned":    report.Pruned,
+		"refreshed": report.Refreshed,
+		"announced": report.Announced,
+	}).Info("Rejoined the network")
+
+	return report
+}
+
+// Periodically checks how well the routing table covers the keyspace, and
+// refreshes its buckets if it is lacking. Blocks.
+func (pm *PeerManager) RefreshTable() {
+	interval := viper.GetDuration("net.refreshInterval")
+
+	if interval <= 0 {
+		log.Info("Bucket refreshing disabled")
+		return
+	}
+
+	minCoverage := viper.GetFloat64("net.minCoverage")
+	if minCoverage <= 0 {
+		minCoverage = DefaultMinCoverage
+	}
+
+	ticker := time.NewTicker(interval)
+
+	for _ = range ticker.C {
+		score := pm.localPeer.DHT.CoverageScore()
+
+		if score >= minCoverage {
+			continue
+		}
+
+		log.WithField("coverage", score).Info("Refreshing buckets")
+
+		inserted := pm.RefreshBuckets()
+
+		log.WithFields(log.Fields{
+			"inserted": inserted,
+			"coverage": pm.localPeer.DHT.CoverageScore(),
+		}).Info("Refreshed buckets")
+	}
+}
+
+// Why resolving an address failed.
+type ResolveError struct {
+	Address dht.Address
+	// How many peers were asked before giving up.
+	Queried int
+	// RecursionLimit, AddressNotFound or NoCandidates when the search finished
+	// without finding it, otherwise whatever stopped it, eg. a peer that could
+	// not be reached.
+	Err error
+}
+
+func (re *ResolveError) Error() string {
+	return fmt.Sprintf("Resolving %s: %s (%d peers queried)", re.Address.StringOr(""),
+		re.Err.Error(), re.Queried)
+}
+
+func (re *ResolveError) Unwrap() error {
+	return re.Err
+}
+
+// Whether the search was carried out and the address just isn't out there, as
+// opposed to the network getting in the way.
+func (re *ResolveError) NotFound() bool {
+	return re.Err == RecursionLimit || re.Err == AddressNotFound || re.Err == NoCandidates
 }
 
 // Resolves a DFI address into an entry. Hopefully we already have the entry,
 // in which case it's just loaded from disk. Otherwise, recursive network
-// queries are made to try and find it.
+// queries are made to try and find it. Failing that the error is a
+// *ResolveError, unless reading our own database failed.
 func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 	log.WithField("address", addr.StringOr("")).Debug("Resolving")
 
@@ -397,64 +1311,154 @@ func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 	}
 
 	// gets an initial set to work with
-	closest, err := pm.localPeer.DHT.FindClosest(addr)
+	found, err := pm.localPeer.DHT.FindClosest(addr)
 
 	if err != nil {
 		return nil, err
 	}
 
-	depth := 6
+	// our own entry is in there too
+	closest := make([]*dht.Entry, 0, len(found))
+	for _, i := range found {
+		if !i.Address.Equals(pm.localPeer.Address()) {
+			closest = append(closest, i)
+		}
+	}
+
+	// shared by every branch
+	var queried int32
+
+	if len(closest) == 0 {
+		return nil, &ResolveError{addr, 0, NoCandidates}
+	}
+
+	parallelism := viper.GetInt("net.resolveParallelism")
+	if parallelism < 1 {
+		parallelism = DefaultResolveParallelism
+	}
+
+	// cancelled as soon as one branch finds it, stopping the others
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type branchResult struct {
+		entry *dht.Entry
+		err   error
+	}
+
+	// those that have answered well before get asked first
+	pm.sortByReputation(closest)
+
+	candidates := make(chan *dht.Entry, len(closest))
 	for _, i := range closest {
-		// TODO: Goroutine this.
-		entry, err := pm.resolveStep(i, addr, &depth)
+		candidates <- i
+	}
+	close(candidates)
 
-		if err != nil {
-			if err == RecursionLimit {
-				return nil, err
-			}
+	// buffered, so branches still running once we've returned don't block
+	results := make(chan branchResult, len(closest))
 
-			log.Error(err.Error())
-			continue
-		}
+	for w := 0; w < parallelism && w < len(closest); w++ {
+		go func() {
+			for i := range candidates {
+				if ctx.Err() != nil {
+					results <- branchResult{nil, ctx.Err()}
+					continue
+				}
 
-		if entry == nil {
-			continue
-		}
+				// every branch gets the full depth
+				depth := ResolveDepth
+				entry, err := pm.resolveStep(ctx, i, addr, &depth, &queried)
 
-		if entry.Address.Equals(&addr) {
-			pm.localPeer.DHT.Insert(*entry)
+				// stop the others before picking up another candidate
+				if entry != nil && entry.Address.Equals(&addr) {
+					cancel()
+				}
+
+				results <- branchResult{entry, err}
+			}
+		}()
+	}
 
-			return entry, nil
+	// a branch that searched all the way without finding it outweighs the
+	// ones that failed along the way
+	exhausted, searched := 0, 0
+	var failure error
+
+	for _ = range closest {
+		res := <-results
+
+		switch {
+		case res.err == RecursionLimit:
+			exhausted++
+		case res.err == AddressNotFound:
+			searched++
+		case res.err != nil:
+			log.Error(res.err.Error())
+			failure = res.err
+		case res.entry != nil && res.entry.Address.Equals(&addr):
+			pm.localPeer.DHT.Insert(*res.entry)
+
+			return res.entry, nil
+		default:
+			searched++
 		}
 	}
 
-	return nil, errors.New("Address could not be resolved")
+	ret := &ResolveError{addr, int(atomic.LoadInt32(&queried)), AddressNotFound}
+
+	if exhausted == len(closest) {
+		ret.Err = RecursionLimit
+	} else if exhausted == 0 && searched == 0 && failure != nil {
+		ret.Err = failure
+	}
+
+	return nil, ret
 }
 
-// Will return the entry itself, or an error.
-func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (*dht.Entry, error) {
+// Will return the entry itself, or an error: RecursionLimit once depth runs
+// out, AddressNotFound if nobody along the way had it, or the last thing that
+// went wrong asking. Each peer tried adds one to queried.
+// Gives up with ctx.Err() once ctx is done.
+func (pm *PeerManager) resolveStep(ctx context.Context, e *dht.Entry, addr dht.Address, depth *int, queried *int32) (*dht.Entry, error) {
 	// connect to the peer
 	var peer *Peer
 	var err error
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if *depth == 0 {
 		return nil, RecursionLimit
 	}
 	*depth -= 1
 
 	log.WithField("peer", e.Address.StringOr("")).Info("Querying for resolve")
+	atomic.AddInt32(queried, 1)
 
 	peer = pm.GetPeer(e.Address)
 
 	if peer == nil {
-		peer, err = pm.ConnectPeerDirect(fmt.Sprintf("%s:%d", e.PublicAddress, e.Port))
+		peer, err = pm.connectEntry(e)
 
 		if err != nil {
+			pm.Penalise(e.Address)
 			return nil, err
 		}
 	}
 
-	kv, err := peer.Query(addr)
+	kv, err := peer.QueryContext(ctx, addr)
+
+	// it doesn't have it, but can still say who's closer
+	if err == proto.ErrRefused {
+		kv, err = nil, nil
+	}
+
+	// being cancelled isn't the peer's fault
+	if ctx.Err() == nil {
+		pm.rate(e.Address, err)
+	}
 
 	if err != nil {
 		return nil, err
@@ -465,25 +1469,46 @@ func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (
 		return entry.(*dht.Entry), err
 	}
 
-	closest, err := peer.FindClosest(addr)
+	found, err := peer.FindClosestContext(ctx, addr)
 
 	if err != nil {
+		if ctx.Err() == nil {
+			pm.Penalise(e.Address)
+		}
+
 		return nil, err
 	}
 
-	for _, i := range closest {
-		entry := i.(*dht.Entry)
+	closest := make([]*dht.Entry, 0, len(found))
+	for _, i := range found {
+		closest = append(closest, i.(*dht.Entry))
+	}
 
-		result, err := pm.resolveStep(entry, addr, depth)
+	pm.sortByReputation(closest)
 
-		if err != nil {
-			return nil, err
+	// one peer failing doesn't stop us asking the others
+	ret := AddressNotFound
+
+	for _, entry := range closest {
+		// no use asking ourselves
+		if entry.Address.Equals(pm.localPeer.Address()) {
+			continue
+		}
+
+		result, err := pm.resolveStep(ctx, entry, addr, depth, queried)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
 
 		if result != nil {
 			return result, nil
 		}
+
+		if err != nil && ret != RecursionLimit {
+			ret = err
+		}
 	}
 
-	return nil, errors.New("No entries could be found")
+	return nil, ret
 }
@@ -0,0 +1,1232 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi"
+	"github.com/dfindex/dfi/dht"
+	"github.com/spf13/viper"
+)
+
+func TestDialAddresses(t *testing.T) {
+	entry := &dht.Entry{
+		PublicAddresses: []string{"192.0.2.1", "2001:db8::1", "abc.onion", "[2001:db8::2]"},
+		Port:            5050,
+	}
+
+	clearnet := []string{
+		"192.0.2.1:5050", "[2001:db8::1]:5050", "[2001:db8::2]:5050", "abc.onion:5050",
+	}
+
+	if got := dfi.DialAddresses(entry, false); !reflect.DeepEqual(got, clearnet) {
+		t.Fatal("Unexpected order without SOCKS: ", got)
+	}
+
+	tor := []string{
+		"abc.onion:5050", "192.0.2.1:5050", "[2001:db8::1]:5050", "[2001:db8::2]:5050",
+	}
+
+	if got := dfi.DialAddresses(entry, true); !reflect.DeepEqual(got, tor) {
+		t.Fatal("Unexpected order with SOCKS: ", got)
+	}
+
+	// older entries only have the one address
+	old := &dht.Entry{PublicAddress: "example.com", Port: 5050}
+
+	if got := dfi.DialAddresses(old, true); !reflect.DeepEqual(got, []string{"example.com:5050"}) {
+		t.Fatal("Unexpected addresses for an old entry: ", got)
+	}
+}
+
+func TestLeastRecentlySeen(t *testing.T) {
+	// iteration order is random, so run it a few times
+	for n := 0; n < 20; n++ {
+		seen := map[string]int64{
+			"middle": 200,
+			"oldest": 100,
+			"newest": 300,
+		}
+
+		if key, ok := dfi.LeastRecentlySeen(seen, "newest"); !ok || key != "oldest" {
+			t.Fatal("Expected the oldest peer to be evicted, got: ", key)
+		}
+
+		// the peer just added is never evicted, even if its time is oldest
+		if key, ok := dfi.LeastRecentlySeen(seen, "oldest"); !ok || key != "middle" {
+			t.Fatal("Expected the next oldest peer to be evicted, got: ", key)
+		}
+	}
+
+	if _, ok := dfi.LeastRecentlySeen(map[string]int64{"only": 1}, "only"); ok {
+		t.Fatal("Found a peer to evict when there are no others")
+	}
+}
+
+// A signed entry last updated at the given time, reachable at port.
+func entryUpdated(t *testing.T, updated uint64, port int) dht.Entry {
+	lp := freshPeer(t)
+	lp.Entry.Port = port
+	lp.Entry.Updated = updated
+
+	raw, err := lp.Entry.Bytes()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp.Entry.Signature = lp.Sign(raw)
+
+	return *lp.Entry
+}
+
+func TestRejoin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rejoin")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	viper.Set("net.entryTTL", time.Hour)
+	defer viper.Set("net.entryTTL", nil)
+
+	// somewhere nothing is listening, so connections are refused right away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	now := uint64(time.Now().Unix())
+
+	stale := []dht.Entry{entryUpdated(t, 1, port), entryUpdated(t, 1, port)}
+	fresh := []dht.Entry{entryUpdated(t, now, port), entryUpdated(t, now, port),
+		entryUpdated(t, now, port)}
+
+	for _, i := range append(append([]dht.Entry{}, stale...), fresh...) {
+		if _, err := lp.DHT.Insert(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	report := dfi.NewPeerManager(lp).Rejoin()
+
+	if report.Pruned != len(stale) {
+		t.Fatalf("Expected %d stale entries pruned, got %d", len(stale), report.Pruned)
+	}
+
+	for _, i := range stale {
+		if e, _ := lp.DHT.Query(i.Address); e != nil {
+			t.Fatal("Stale entry survived the rejoin")
+		}
+	}
+
+	// everyone left in the table was tried, none answered
+	if report.Tried != len(fresh) {
+		t.Fatalf("Expected to try %d peers, tried %d", len(fresh), report.Tried)
+	}
+
+	if report.Announced != 0 || report.Refreshed != 0 {
+		t.Fatal("Reached peers that aren't there: ", report)
+	}
+
+	if lp.DHT.TableLen() != len(fresh) {
+		t.Fatalf("Expected %d entries left in the table, got %d", len(fresh), lp.DHT.TableLen())
+	}
+}
+
+func TestRejoinAnnounced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rejoinannounced")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if err = lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = lp.DHT.Insert(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report := lp.Rejoin()
+
+	if report.Tried != 1 || report.Announced != 1 {
+		t.Fatal("Expected to announce to the remote peer: ", report)
+	}
+
+	if e, _ := remote.DHT.Query(*lp.Address()); e == nil {
+		t.Fatal("Remote peer did not store the announced entry")
+	}
+}
+
+func TestAnnounceWork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "announcework")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	// the remote advertises what it wants, we have to do at least that
+	viper.Set("net.announceWork", 8)
+	defer viper.Set("net.announceWork", nil)
+	defer dht.SetMinEntryWork(0)
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if err = lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	worked := *remote.Entry
+	worked.DoWork(8)
+
+	if _, err = lp.DHT.Insert(worked); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if report := lp.Rejoin(); report.Announced != 1 {
+		t.Fatal("Expected to announce to the remote peer: ", report)
+	}
+
+	e, _ := remote.DHT.Query(*lp.Address())
+
+	if e == nil || e.WorkBits() < 8 {
+		t.Fatal("Remote peer did not store the announced entry with its work")
+	}
+}
+
+// The same when the remote dials us, our first announce goes out as soon as
+// it has connected.
+func TestAnnounceWorkInbound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "announceworkinbound")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	lp := listeningPeer(t, "local")
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+	defer lp.Server.Close()
+
+	viper.Set("net.announceWork", 8)
+	defer viper.Set("net.announceWork", nil)
+	defer dht.SetMinEntryWork(0)
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	p, err := remote.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", lp.Entry.Port))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer p.Terminate()
+
+	for i := 0; i < 100; i++ {
+		if e, _ := remote.DHT.Query(*lp.Address()); e != nil && e.WorkBits() >= 8 {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("Remote peer did not store our announce with its work")
+}
+
+// Waits for lp to notice from has gone.
+func waitDisconnected(t *testing.T, lp, from *dfi.LocalPeer) {
+	for start := time.Now(); lp.GetPeer(*from.Address()) != nil; {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("Connection was not closed")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestCheckReachable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkreachable")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if err = lp.CheckReachable(remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if lp.GetPeer(*remote.Address()) != nil {
+		t.Fatal("Still connected after the check")
+	}
+	waitDisconnected(t, remote, lp)
+
+	// someone else's entry, but the remote answers
+	forged := freshPeer(t)
+	forged.Entry.Port = remote.Entry.Port
+
+	if err = forged.PrepareEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = lp.CheckReachable(forged.Entry); err == nil {
+		t.Fatal("Entry passed with a different peer answering")
+	}
+
+	if lp.GetPeer(*remote.Address()) != nil {
+		t.Fatal("Still connected to the wrong peer after the check")
+	}
+	waitDisconnected(t, remote, lp)
+
+	// a connection we already had is kept
+	peer, err := lp.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = lp.CheckReachable(remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if lp.GetPeer(*remote.Address()) != peer {
+		t.Fatal("Existing connection dropped by the check")
+	}
+}
+
+func seedList(t *testing.T, contents []byte) ([]dht.Address, error) {
+	dir, err := ioutil.TempDir("", "seeds")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seeding.dat")
+
+	if err = ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return dfi.ReadSeedList(path)
+}
+
+func TestReadSeedList(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, dht.AddressBinarySize)
+	second := bytes.Repeat([]byte{2}, dht.AddressBinarySize)
+
+	addrs, err := seedList(t, append(append([]byte{}, first...), second...))
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(addrs) != 2 || !bytes.Equal(addrs[0].Raw, first) || !bytes.Equal(addrs[1].Raw, second) {
+		t.Fatal("Clean seed list read incorrectly: ", addrs)
+	}
+}
+
+func TestReadSeedListTruncated(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, dht.AddressBinarySize)
+	blank := make([]byte, dht.AddressBinarySize)
+
+	contents := append(append([]byte{}, first...), blank...)
+	contents = append(contents, 3, 3, 3)
+
+	addrs, err := seedList(t, contents)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the blank record and partial address are both skipped
+	if len(addrs) != 1 || !bytes.Equal(addrs[0].Raw, first) {
+		t.Fatal("Truncated seed list read incorrectly: ", addrs)
+	}
+
+	_, err = seedList(t, []byte{1, 2, 3})
+
+	if err != dfi.CorruptSeedList {
+		t.Fatal("Expected a corrupt seed list, got: ", err)
+	}
+}
+
+func TestReadSeedListEmpty(t *testing.T) {
+	addrs, err := seedList(t, []byte{})
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(addrs) != 0 {
+		t.Fatal("Addresses read from an empty seed list")
+	}
+}
+
+func TestBackOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backoff")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := listeningPeer(t, "local")
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+	defer lp.Server.Close()
+
+	lp.BackOff(*remote.Address(), time.Hour)
+
+	if err = lp.CheckReachable(remote.Entry); err != dfi.PeerBackingOff {
+		t.Fatal("Expected PeerBackingOff, got ", err)
+	}
+
+	// it can still reach us, which lifts the backoff
+	if err = remote.CheckReachable(lp.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitDisconnected(t, lp, remote)
+
+	if err = lp.CheckReachable(remote.Entry); err != nil {
+		t.Fatal("Still backing off after the peer came back: ", err)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	last := time.Duration(0)
+
+	for i := 0; i < 6; i++ {
+		base := dfi.ReconnectBaseDelay << uint(i)
+		delay := dfi.ReconnectDelay(i)
+
+		if delay < base || delay > base+base/2 {
+			t.Fatalf("Attempt %d waits %s, expected %s plus jitter", i, delay, base)
+		}
+
+		if delay < last {
+			t.Fatalf("Attempt %d waits less than attempt %d", i, i-1)
+		}
+
+		last = base
+	}
+
+	for _, i := range []int{7, 20, 100} {
+		if delay := dfi.ReconnectDelay(i); delay > dfi.ReconnectMaxDelay+dfi.ReconnectMaxDelay/2 {
+			t.Fatalf("Attempt %d waits %s, above the cap", i, delay)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	pm := dfi.NewPeerManager(freshPeer(t))
+	events := pm.Subscribe()
+
+	// never connected, so nothing to tell anyone
+	pm.HandleCloseConnection(freshPeer(t).Address())
+
+	select {
+	case e := <-events:
+		t.Fatal("Event for a peer that was never connected: ", e.Kind)
+	default:
+	}
+
+	pm.Unsubscribe(events)
+
+	if _, ok := <-events; ok {
+		t.Fatal("Channel still open after unsubscribing")
+	}
+}
+
+func TestSubscribeDelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subscribe")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	pm := dfi.NewPeerManager(lp)
+	events := pm.Subscribe()
+	defer pm.Unsubscribe(events)
+
+	// we announce ourselves to it in the background, that can come whenever
+	expect := func(kind dfi.PeerEventKind) {
+		for {
+			select {
+			case e := <-events:
+				if e.Kind == dfi.EventAnnounced {
+					continue
+				}
+
+				if e.Kind != kind || !e.Address.Equals(remote.Address()) {
+					t.Fatalf("Expected event %d for the remote peer, got %d", kind, e.Kind)
+				}
+
+				return
+			case <-time.After(time.Second * 5):
+				t.Fatalf("No event %d", kind)
+			}
+		}
+	}
+
+	p, err := pm.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer p.Terminate()
+
+	expect(dfi.EventConnected)
+
+	pm.HandleCloseConnection(p.Address())
+
+	expect(dfi.EventDisconnected)
+}
+
+func TestCrawlOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawl")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// nothing listening, every peer fails straight away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	now := uint64(time.Now().Unix())
+
+	for i := 0; i < 3; i++ {
+		if _, err := lp.DHT.Insert(entryUpdated(t, now, port)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	pm := dfi.NewPeerManager(lp)
+	events := pm.Subscribe()
+
+	queries := 0
+	discovered := pm.CrawlOnce(func() { queries++ })
+
+	// every target is closest to the same three, each is only asked once
+	if queries != 3 {
+		t.Fatalf("Expected 3 queries, made %d", queries)
+	}
+
+	if discovered != 0 {
+		t.Fatalf("Discovered %d peers from nobody", discovered)
+	}
+
+	select {
+	case e := <-events:
+		if e.Kind == dfi.EventDiscovered {
+			t.Fatal("Discovered event with nothing found")
+		}
+	default:
+	}
+}
+
+func TestCrawlDiscovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawldiscovers")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	remote := listeningPeer(t, "remote")
+	defer remote.DHT.Close()
+	defer remote.Database.Close()
+	defer remote.Server.Close()
+
+	// someone only the remote peer knows of
+	other := entryUpdated(t, uint64(time.Now().Unix()), port)
+
+	if _, err = remote.DHT.Insert(other); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	if err = lp.SaveEntry(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = lp.DHT.Insert(*remote.Entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pm := dfi.NewPeerManager(lp)
+	events := pm.Subscribe()
+
+	if discovered := pm.CrawlOnce(func() {}); discovered != 1 {
+		t.Fatalf("Expected 1 peer discovered, got %d", discovered)
+	}
+
+	if e, _ := lp.DHT.Query(other.Address); e == nil {
+		t.Fatal("Discovered entry not stored")
+	}
+
+	found := false
+	for len(events) > 0 {
+		e := <-events
+		found = found || (e.Kind == dfi.EventDiscovered && e.Address.Equals(&other.Address))
+	}
+
+	if !found {
+		t.Fatal("No discovered event for the new peer")
+	}
+
+	if pm.GetPeer(*remote.Address()) != nil {
+		t.Fatal("Crawled peer left connected")
+	}
+
+	// all the remote peer knows of now we know too, so that's as far as it goes
+	queries := 0
+	if discovered := pm.CrawlOnce(func() { queries++ }); discovered != 0 {
+		t.Fatalf("Discovered %d peers we already had", discovered)
+	}
+
+	if queries != 2 {
+		t.Fatalf("Expected 2 queries, made %d", queries)
+	}
+
+	// and a banned peer isn't asked at all
+	if err = pm.Ban(*remote.Address(), "test"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	queries = 0
+	pm.CrawlOnce(func() { queries++ })
+
+	if queries != 1 {
+		t.Fatalf("Expected only the unbanned peer queried, made %d queries", queries)
+	}
+}
+
+func TestResolveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolve")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	pm := dfi.NewPeerManager(lp)
+	target := freshPeer(t).Address()
+
+	_, err = pm.Resolve(*target)
+	re, ok := err.(*dfi.ResolveError)
+
+	if !ok || re.Err != dfi.NoCandidates || re.Queried != 0 || !re.NotFound() {
+		t.Fatalf("Expected no candidates, got %v", err)
+	}
+
+	now := uint64(time.Now().Unix())
+
+	for i := 0; i < 3; i++ {
+		if _, err := lp.DHT.Insert(entryUpdated(t, now, port)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// every peer is unreachable, which isn't the same as it not existing
+	_, err = pm.Resolve(*target)
+	re, ok = err.(*dfi.ResolveError)
+
+	if !ok || re.NotFound() || re.Queried != 3 {
+		t.Fatalf("Expected a transport failure after 3 peers, got %v", err)
+	}
+
+	if !re.Address.Equals(target) {
+		t.Fatal("Error is for the wrong address")
+	}
+}
+
+// Remotes that are up, only the holder knowing about target.
+func resolveNetwork(t *testing.T, target dht.Entry, others int) (*dfi.LocalPeer, *dfi.LocalPeer, func()) {
+	// nobody gets evicted while we're asking around
+	viper.Set("net.maxPeers", 10)
+
+	lp := servingPeer(t, "local", 0, 10)
+	holder := listeningPeer(t, "holder")
+
+	if _, err := holder.DHT.Insert(target); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	remotes := []*dfi.LocalPeer{holder}
+	for i := 0; i < others; i++ {
+		remotes = append(remotes, listeningPeer(t, fmt.Sprintf("other%d", i)))
+	}
+
+	for _, i := range remotes {
+		if _, err := lp.DHT.Insert(*i.Entry); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	return lp, holder, func() {
+		for _, i := range remotes {
+			i.Server.Close()
+			i.DHT.Close()
+			i.Database.Close()
+		}
+
+		lp.DHT.Close()
+		lp.Database.Close()
+		viper.Set("net.maxPeers", nil)
+	}
+}
+
+func TestResolveParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolveparallel")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	target := entryUpdated(t, uint64(time.Now().Unix()), 5050)
+
+	lp, _, closeAll := resolveNetwork(t, target, 2)
+	defer closeAll()
+
+	pm := dfi.NewPeerManager(lp)
+
+	entry, err := pm.Resolve(target.Address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !entry.Address.Equals(&target.Address) {
+		t.Fatal("Resolved the wrong entry")
+	}
+
+	// kept, so next time nobody needs asking
+	if kv, err := lp.DHT.Query(target.Address); err != nil || kv == nil {
+		t.Fatal("Resolved entry was not stored")
+	}
+}
+
+func TestResolveAllFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolveallfail")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	lp, _, closeAll := resolveNetwork(t, entryUpdated(t, uint64(time.Now().Unix()), 5050), 2)
+	defer closeAll()
+
+	pm := dfi.NewPeerManager(lp)
+	target := freshPeer(t).Address()
+
+	// everyone answers, nobody has it
+	_, err = pm.Resolve(*target)
+	re, ok := err.(*dfi.ResolveError)
+
+	if !ok || !re.NotFound() {
+		t.Fatalf("Expected the address not to be found, got %v", err)
+	}
+
+	if re.Queried < 3 {
+		t.Fatalf("Only %d of 3 peers were asked", re.Queried)
+	}
+}
+
+func TestResolveStops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolvestops")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.resolveParallelism", 1)
+	defer viper.Set("net.resolveParallelism", nil)
+
+	target := entryUpdated(t, uint64(time.Now().Unix()), 5050)
+
+	lp, holder, closeAll := resolveNetwork(t, target, 0)
+	defer closeAll()
+
+	// anyone asked after the holder would connect here
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&accepted, 1)
+			c.Close()
+		}
+	}()
+
+	now := uint64(time.Now().Unix())
+	port := l.Addr().(*net.TCPAddr).Port
+
+	for i := 0; i < 3; i++ {
+		if _, err := lp.DHT.Insert(entryUpdated(t, now, port)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	pm := dfi.NewPeerManager(lp)
+
+	// so the holder is asked first
+	pm.Reward(*holder.Address())
+
+	if _, err = pm.Resolve(target.Address); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Fatalf("%d more peers asked after it was found", n)
+	}
+}
+
+func TestStopSeeding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopseeding")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	seeded := entryUpdated(t, uint64(time.Now().Unix()), 5050)
+	if _, err := lp.DHT.Insert(seeded); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// not loaded, but still on the list
+	other := dht.Address{Raw: bytes.Repeat([]byte{1}, dht.AddressBinarySize)}
+
+	path := filepath.Join(dir, "seeding.dat")
+	if err := dfi.WriteSeedList(path, []dht.Address{seeded.Address, other}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pm := dfi.NewPeerManager(lp)
+	pm.SetSeedListPath(path)
+
+	if err := pm.AddSeedManager(seeded.Address); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if list := pm.SeedingList(); len(list) != 1 || !list[0].Equals(&seeded.Address) {
+		t.Fatal("Unexpected seeding list: ", list)
+	}
+
+	if err := pm.StopSeeding(seeded.Address); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(pm.SeedingList()) != 0 {
+		t.Fatal("Still seeding after being stopped")
+	}
+
+	addrs, err := dfi.ReadSeedList(path)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(addrs) != 1 || !addrs[0].Equals(&other) {
+		t.Fatal("Seed list not updated: ", addrs)
+	}
+
+	if err := pm.StopSeeding(seeded.Address); err != dfi.NotSeeding {
+		t.Fatal("Expected NotSeeding, got ", err)
+	}
+}
+
+func TestLastSeenStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastseen")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	entry := entryUpdated(t, uint64(time.Now().Unix()), 5050)
+	if _, err := lp.DHT.Insert(entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	seen := time.Now().Add(-time.Hour).Unix()
+	if err := lp.DHT.UpdateSeen(entry.Address, seen); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// as it would be after a restart, nothing in memory
+	pm := dfi.NewPeerManager(lp)
+
+	last, ok := pm.LastSeen(entry.Address)
+
+	if !ok || last.Unix() != seen {
+		t.Fatalf("Expected the stored seen time %d, got %d", seen, last.Unix())
+	}
+
+	if _, ok := pm.LastSeen(*freshPeer(t).Address()); ok {
+		t.Fatal("Seen a peer we know nothing about")
+	}
+}
+
+func TestLeastReputable(t *testing.T) {
+	second := int64(time.Second)
+	seen := map[string]int64{
+		"oldest":  100 * second,
+		"tied":    110 * second,
+		"newest":  1000 * second,
+		"another": 105 * second,
+	}
+
+	reputation := map[string]int{"oldest": 10, "tied": -5, "newest": -50}
+
+	for n := 0; n < 20; n++ {
+		// newest is the least reputable, but far too recent to count
+		if key, ok := dfi.LeastReputable(seen, reputation, "newest"); !ok || key != "tied" {
+			t.Fatal("Expected the least reputable tied peer, got: ", key)
+		}
+
+		// all the same, so down to recency
+		if key, _ := dfi.LeastReputable(seen, nil, "newest"); key != "oldest" {
+			t.Fatal("Expected the oldest peer when reputations are equal, got: ", key)
+		}
+	}
+
+	if _, ok := dfi.LeastReputable(map[string]int64{"only": 1}, nil, "only"); ok {
+		t.Fatal("Found a peer to evict when there are no others")
+	}
+}
+
+func TestEvictLeastReputable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evict")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 2)
+	defer viper.Set("net.maxPeers", nil)
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	pm := dfi.NewPeerManager(lp)
+	connected := make([]*dfi.Peer, 0, 3)
+
+	for _, name := range []string{"first", "second", "third"} {
+		remote := listeningPeer(t, name)
+		defer remote.DHT.Close()
+		defer remote.Database.Close()
+		defer remote.Server.Close()
+
+		// the second is newer than the first, but has misbehaved
+		if name == "third" {
+			pm.Penalise(*connected[1].Address())
+		}
+
+		p, err := pm.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer p.Terminate()
+
+		connected = append(connected, p)
+	}
+
+	if pm.GetPeer(*connected[1].Address()) != nil {
+		t.Fatal("Least reputable peer was not evicted")
+	}
+
+	for _, i := range []*dfi.Peer{connected[0], connected[2]} {
+		if pm.GetPeer(*i.Address()) == nil {
+			t.Fatal("Evicted a peer in good standing")
+		}
+	}
+}
+
+func TestReputation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reputation")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lp := freshPeer(t)
+	lp.DHT = dht.NewDHT(*lp.Address(), filepath.Join(dir, "peers.db"),
+		filepath.Join(dir, "table.dat"))
+	defer lp.DHT.Close()
+
+	entry := entryUpdated(t, uint64(time.Now().Unix()), 5050)
+	if _, err := lp.DHT.Insert(entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pm := dfi.NewPeerManager(lp)
+
+	// only the first of a burst counts
+	for i := 0; i < 10; i++ {
+		pm.Reward(entry.Address)
+	}
+
+	if score := pm.Reputation(entry.Address); score != dfi.ReputationGain {
+		t.Fatalf("Expected %d after a burst of rewards, got %d", dfi.ReputationGain, score)
+	}
+
+	for i := 0; i < 100; i++ {
+		pm.Penalise(entry.Address)
+	}
+
+	if score := pm.Reputation(entry.Address); score != dfi.MinReputation {
+		t.Fatalf("Expected the score to stop at %d, got %d", dfi.MinReputation, score)
+	}
+
+	// as it would be after a restart
+	if score := dfi.NewPeerManager(lp).Reputation(entry.Address); score != dfi.MinReputation {
+		t.Fatalf("Expected %d to be stored, got %d", dfi.MinReputation, score)
+	}
+}
+
+func TestSessionConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer inDir(t, dir)()
+
+	viper.Set("net.maxPeers", 10)
+	defer viper.Set("net.maxPeers", nil)
+
+	settings := map[string]interface{}{
+		"net.keepAlive":         false,
+		"net.keepAliveInterval": "5s",
+		"net.writeTimeout":      "2m",
+		"net.maxStreamWindow":   1024 * 1024,
+	}
+
+	for k, v := range settings {
+		viper.Set(k, v)
+		defer viper.Set(k, nil)
+	}
+
+	lp := servingPeer(t, "local", 0, 10)
+	defer lp.DHT.Close()
+	defer lp.Database.Close()
+
+	pm := dfi.NewPeerManager(lp)
+
+	connect := func(name string) *dfi.Peer {
+		remote := listeningPeer(t, name)
+		defer remote.DHT.Close()
+		defer remote.Database.Close()
+		defer remote.Server.Close()
+
+		p, err := pm.ConnectPeerDirect(fmt.Sprintf("127.0.0.1:%d", remote.Entry.Port))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer p.Terminate()
+
+		return p
+	}
+
+	config := connect("configured").Streams().SessionConfig
+
+	if config == nil {
+		t.Fatal("Session config not set")
+	}
+
+	if config.EnableKeepAlive {
+		t.Fatal("Keepalives not disabled")
+	}
+
+	if config.KeepAliveInterval != 5*time.Second {
+		t.Fatal("Wrong keepalive interval ", config.KeepAliveInterval)
+	}
+
+	if config.ConnectionWriteTimeout != 2*time.Minute {
+		t.Fatal("Wrong write timeout ", config.ConnectionWriteTimeout)
+	}
+
+	if config.MaxStreamWindowSize != 1024*1024 {
+		t.Fatal("Wrong stream window ", config.MaxStreamWindowSize)
+	}
+
+	// yamux won't take a window smaller than its initial one, so the
+	// defaults are used instead
+	viper.Set("net.maxStreamWindow", 1024)
+
+	if connect("invalid").Streams().SessionConfig != nil {
+		t.Fatal("Invalid session config used")
+	}
+}
+
+func TestReputationsBounded(t *testing.T) {
+	// nowhere to save them, so a dropped score is gone
+	pm := dfi.NewPeerManager(freshPeer(t))
+
+	first := dht.Address{Raw: []byte("first")}
+	pm.Penalise(first)
+
+	for i := 0; i < dfi.MaxCachedReputations-1; i++ {
+		pm.Reputation(dht.Address{Raw: []byte(fmt.Sprint(i))})
+	}
+
+	if pm.Reputation(first) != -dfi.ReputationLoss {
+		t.Fatal("Score dropped before the limit was reached")
+	}
+
+	for i := 0; i < dfi.MaxCachedReputations; i++ {
+		pm.Reputation(dht.Address{Raw: []byte(fmt.Sprint("other", i))})
+	}
+
+	if pm.Reputation(first) != 0 {
+		t.Fatal("Least recently used score was not dropped")
+	}
+}
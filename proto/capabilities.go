@@ -1,5 +1,31 @@
 package proto
 
+const (
+	// Serves collections and pieces, so can be mirrored.
+	FeatureMirror = "mirror"
+
+	// Answers ProtoRecentRange.
+	FeatureRecentRange = "recent.range"
+
+	// Reads messages with compressed content. Older peers listed compression
+	// they didn't actually do, so it's only trusted alongside this.
+	FeatureCompression = "compression"
+
+	// Keeps answering search pages on the same stream, see SearchSession.
+	FeatureSearchSession = "search.session"
+)
+
+// Whether the peer advertised the given feature.
+func (mc *MessageCapabilities) Supports(feature string) bool {
+	for _, i := range mc.Features {
+		if i == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
 func ChooseCompression(client MessageCapabilities, server MessageCapabilities) string {
 	// check if the peer has our caps, in order of preference
 	// the server has preference
@@ -18,3 +44,20 @@ func ChooseCompression(client MessageCapabilities, server MessageCapabilities) s
 
 	return compression
 }
+
+// The compression for messages between a client (the peer that connected) and
+// a server, "" for none. Both ends work it out from the same capabilities, so
+// they agree without another round trip.
+func NegotiateCompression(client MessageCapabilities, server MessageCapabilities) string {
+	if !client.Supports(FeatureCompression) || !server.Supports(FeatureCompression) {
+		return ""
+	}
+
+	compression := ChooseCompression(client, server)
+
+	if compression == "none" {
+		return ""
+	}
+
+	return compression
+}
@@ -1,11 +1,14 @@
 package proto
 
 import (
+	"bufio"
 	"compress/gzip"
 	"errors"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 
@@ -18,27 +21,128 @@ import (
 const (
 	EntryLengthMax = 1024
 	MaxPageSize    = 25
+
+	// The most pieces a peer will serve from a single request, unless
+	// configured otherwise. Larger downloads must be split into several
+	// requests of at most this many pieces.
+	MaxPiecesPerRequest = 100
+
+	// The most pages of recent posts a peer will serve from a single range
+	// request.
+	MaxRecentRangePages = 10
+
+	// The most entries a find closest reply carries. This is part of the
+	// protocol, so it stays the default bucket size whatever ours is set to.
+	MaxClosestEntries = dht.BucketSize
 )
 
+// Only the last piece of a download can have fewer than a full piece of posts,
+// anywhere else the piece boundaries after it would be wrong.
+var ErrShortPiece = errors.New("Peer sent a piece with too few posts")
+
+// The peer replied to a request with ProtoNo.
+var ErrRefused = errors.New("Peer refused the request")
+
+// The peer refused a request as we've been making too many, it sent a ProtoNo
+// with RefusedRateLimited as the content.
+var ErrRateLimited = errors.New("Peer is rate limiting us")
+
+const RefusedRateLimited = "rate limited"
+
 type Client struct {
 	conn net.Conn
 
-	limiter *io.LimitedReader
+	// applied to everything written, see NegotiateCompression
+	compression string
+
+	reader  *bufio.Reader
+	limiter *limitReader
 	decoder *msgpack.Decoder
 	encoder *msgpack.Encoder
 }
 
+// Caps how much a single message can read. It is a buffered reader itself so
+// msgpack does not wrap it in another buffer, which would read past the end of
+// a message and lose whatever came after it, like the first frames of a yamux
+// session after a handshake.
+type limitReader struct {
+	*bufio.Reader
+	N int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.N <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.N {
+		p = p[0:l.N]
+	}
+
+	n, err := l.Reader.Read(p)
+	l.N -= int64(n)
+
+	return n, err
+}
+
+func (l *limitReader) ReadByte() (byte, error) {
+	if l.N <= 0 {
+		return 0, io.EOF
+	}
+
+	b, err := l.Reader.ReadByte()
+
+	if err == nil {
+		l.N--
+	}
+
+	return b, err
+}
+
+func (l *limitReader) UnreadByte() error {
+	err := l.Reader.UnreadByte()
+
+	if err == nil {
+		l.N++
+	}
+
+	return err
+}
+
+// A connection that reads through a client's buffer first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
 // Creates a new client, automatically setting up the json encoder/decoder.
 func NewClient(conn net.Conn) (*Client, error) {
 	c := &Client{conn: conn}
 
-	c.limiter = &io.LimitedReader{R: c.conn, N: common.MaxMessageSize}
-	c.decoder = msgpack.NewDecoder(c.limiter)
+	c.setupDecoder()
 	c.encoder = msgpack.NewEncoder(c.conn)
 
 	return c, nil
 }
 
+func (c *Client) setupDecoder() {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.conn)
+	}
+
+	if c.limiter == nil {
+		c.limiter = &limitReader{c.reader, common.MaxMessageSize}
+	}
+
+	if c.decoder == nil {
+		c.decoder = msgpack.NewDecoder(c.limiter)
+	}
+}
+
 func (c *Client) Terminate() {
 	//c.conn.Write(proto_terminate)
 }
@@ -51,7 +155,40 @@ func (c *Client) Close() (err error) {
 	return
 }
 
-// Encodes v as json and writes it to c.conn.
+// The underlying connection. Reads from it start with anything the client
+// has buffered but not yet decoded.
+func (c *Client) Conn() net.Conn {
+	if c.reader == nil {
+		return c.conn
+	}
+
+	return bufferedConn{c.conn, c.reader}
+}
+
+// Where the other end of the connection is, nil if there is no connection.
+func (c *Client) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.RemoteAddr()
+}
+
+// Changes when the underlying connection gives up on reads and writes.
+func (c *Client) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errors.New("No connection")
+	}
+
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Client) SetCompression(alg string) {
+	c.compression = alg
+}
+
+// Encodes v as json and writes it to c.conn. Messages have their content
+// compressed first, if the client has a compression set.
 func (c *Client) WriteMessage(v interface{}) error {
 	if c == nil {
 		return errors.New("Client nil")
@@ -61,6 +198,21 @@ func (c *Client) WriteMessage(v interface{}) error {
 		c.encoder = msgpack.NewEncoder(c.conn)
 	}
 
+	// copies, so the caller's message is left as it was
+	switch msg := v.(type) {
+	case *Message:
+		compressed := *msg
+		if err := compressed.Compress(c.compression); err != nil {
+			return err
+		}
+		v = &compressed
+	case Message:
+		if err := msg.Compress(c.compression); err != nil {
+			return err
+		}
+		v = msg
+	}
+
 	err := c.encoder.Encode(v)
 
 	return err
@@ -82,22 +234,21 @@ func (c *Client) WriteErr(toSend error) error {
 func (c *Client) ReadMessage() (*Message, error) {
 	var msg Message
 
-	if c.limiter == nil {
-		c.limiter = &io.LimitedReader{R: c.conn, N: common.MaxMessageSize}
-	}
-
-	if c.decoder == nil {
-		c.decoder = msgpack.NewDecoder(c.limiter)
-	}
+	c.setupDecoder()
 
 	if err := c.decoder.Decode(&msg); err != nil {
 		c.limiter.N = common.MaxMessageSize
 		return nil, err
 	}
 
-	msg.Stream = c.conn
+	msg.Stream = c.Conn()
 
 	c.limiter.N = common.MaxMessageSize
+
+	if err := msg.Decompress(); err != nil {
+		return nil, err
+	}
+
 	return &msg, nil
 }
 
@@ -105,127 +256,128 @@ func (c *Client) Decode(i interface{}) error {
 	return c.decoder.Decode(i)
 }
 
-// Sends a DHT entry to a peer.
-func (c *Client) SendStruct(e common.Encoder) error {
-	msg := Message{Header: ProtoDhtEntry}
-	err := msg.Write(e)
+// Sends payload under header and reads the reply into out. With a nil out the
+// peer is expected to just reply ok. A ProtoNo reply is ErrRefused, or
+// ErrRateLimited if that's why.
+func (c *Client) request(header string, payload interface{}, out interface{}) error {
+	reply, err := c.exchange(header, payload)
 
 	if err != nil {
-		c.conn.Close()
 		return err
 	}
 
-	c.WriteMessage(msg)
-
-	return nil
-}
+	if out == nil {
+		if !reply.Ok() {
+			return errors.New("Peer did not respond with ok")
+		}
 
-// Announce the given DHT entry to a peer, passes on this peers details,
-// meaning that it can be reached by other peers on the network.
-func (c *Client) Announce(e common.Encoder) error {
-	msg := &Message{
-		Header: ProtoDhtAnnounce,
+		return nil
 	}
 
-	err := msg.Write(e)
+	return reply.Read(out)
+}
+
+// Sends a request and reads the reply, whatever it is unless it's a refusal.
+func (c *Client) exchange(header string, payload interface{}) (*Message, error) {
+	msg := &Message{Header: header}
+	err := msg.Write(payload)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = c.WriteMessage(msg)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ok, err := c.ReadMessage()
+	reply, err := c.ReadMessage()
 
 	if err != nil {
-		return err
-	}
-
-	if !ok.Ok() {
-		return errors.New("Peer did not respond with ok")
+		return nil, err
 	}
 
-	return nil
-}
+	if reply.Header == ProtoNo {
+		var reason string
 
-func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
-	// TODO: LimitReader
+		if reply.Read(&reason) == nil && reason == RefusedRateLimited {
+			return nil, ErrRateLimited
+		}
 
-	msg := &Message{
-		Header: ProtoDhtFindClosest,
+		return nil, ErrRefused
 	}
 
-	err := msg.Write(address)
+	return reply, nil
+}
+
+// Sends a DHT entry to a peer.
+func (c *Client) SendStruct(e common.Encoder) error {
+	msg := Message{Header: ProtoDhtEntry}
+	err := msg.Write(e)
 
 	if err != nil {
-		return nil, err
+		c.conn.Close()
+		return err
 	}
 
-	// Tell the peer the address we are looking for
-	err = c.WriteMessage(msg)
+	c.WriteMessage(msg)
 
-	if err != nil {
-		return nil, err
-	}
+	return nil
+}
 
-	log.Debug("Send FindClosest request")
+// Announce the given DHT entry to a peer, passes on this peers details,
+// meaning that it can be reached by other peers on the network. The entry
+// needs as much proof of work as the peer's capabilities ask for.
+func (c *Client) Announce(e dht.Entry) error {
+	return c.request(ProtoDhtAnnounce, &e, nil)
+}
 
-	closest, err := c.ReadMessage()
+// Asks for the entries closest to address. At most MaxClosestEntries are read,
+// anything past that isn't even decoded, and entries that don't verify are
+// left out.
+func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
+	reply, err := c.exchange(ProtoDhtFindClosest, address)
 
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]*dht.Entry, 0, 1)
-	err = closest.Read(&ret)
+	entries, sent, err := reply.ReadEntries(MaxClosestEntries)
 
 	if err != nil {
 		return nil, err
 	}
 
-	log.WithField("entries", len(ret)).Info("Find closest complete")
-
-	return ret, err
-}
-
-func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
-	// TODO: LimitReader
-
-	msg := &Message{
-		Header: ProtoDhtQuery,
+	if sent > len(entries) {
+		log.WithField("sent", sent).Warn("Peer sent too many closest entries, ignoring the rest")
 	}
 
-	err := msg.Write(address)
+	ret := make([]*dht.Entry, 0, len(entries))
+	errs := dht.VerifyEntries(entries, 0)
 
-	if err != nil {
-		return nil, err
-	}
+	for n, i := range entries {
+		if errs[n] == dht.ErrNilEntry {
+			log.Info("Skipping nil entry")
+			continue
+		}
 
-	// Tell the peer the address we are looking for
-	err = c.WriteMessage(msg)
+		if errs[n] != nil {
+			log.WithField("address", i.Address.StringOr("")).Info("Skipping invalid entry: ", errs[n].Error())
+			continue
+		}
 
-	if err != nil {
-		return nil, err
+		ret = append(ret, i)
 	}
-	log.Debug("Written address")
-
-	var entry dht.Entry
-	er, err := c.ReadMessage()
 
-	if err != nil {
-		return nil, err
-	}
+	log.WithField("entries", len(ret)).Info("Find closest complete")
 
-	if er.Header == ProtoNo {
-		return nil, errors.New("Peer returned no")
-	}
-	log.Debug("Recieved entry")
+	return ret, nil
+}
 
-	err = er.Read(&entry)
+func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
+	var entry dht.Entry
+	err := c.request(ProtoDhtQuery, address, &entry)
 
 	if err != nil {
 		return nil, err
@@ -248,6 +400,14 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 // both it's own and the peers address, storing the result. This means that after
 // a bootstrap, it should be possible to connect to *any* peer!
 func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
+	return c.BootstrapValidate(d, address, nil)
+}
+
+// Bootstrap, but only trusting entries that check passes, typically by
+// connecting to and pinging the peer. The bootstrap node picks what goes in our
+// routing table, this stops it filling it with peers that don't exist. Entries
+// failing are logged and skipped, a nil check is the same as Bootstrap.
+func (c *Client) BootstrapValidate(d *dht.DHT, address dht.Address, check func(*dht.Entry) error) error {
 	defer c.Close()
 	peers, err := c.FindClosest(address)
 
@@ -255,66 +415,76 @@ func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
 		return err
 	}
 
-	// add them all to our routing table! :D
+	// FindClosest has verified them
+	candidates := make([]*dht.Entry, 0, len(peers))
 	for _, i := range peers {
-		if i.Address.Equals(&address) {
-			continue
+		if !i.Address.Equals(&address) {
+			candidates = append(candidates, i)
 		}
+	}
 
-		if i == nil {
-			continue
+	passed := make([]bool, len(candidates))
+
+	if check == nil {
+		for n := range passed {
+			passed[n] = true
 		}
+	} else {
+		// checks can mean dialling each peer, so don't wait on them in turn
+		var wg sync.WaitGroup
 
-		err := i.Verify()
+		for n, i := range candidates {
+			wg.Add(1)
 
-		if err != nil {
-			log.WithField("address", i.Address.StringOr("")).Error("Bad peer, entry not valid: ", err.Error())
-			continue
+			go func(n int, entry *dht.Entry) {
+				defer wg.Done()
+
+				err := entry.Verify()
+
+				if err == nil {
+					err = check(entry)
+				}
+
+				if err != nil {
+					log.WithField("peer", entry.Address.StringOr("")).Warn("Skipping bootstrap peer: ", err.Error())
+					return
+				}
+
+				passed[n] = true
+			}(n, i)
 		}
 
-		_, err = d.Insert(*i)
+		wg.Wait()
+	}
 
-		if err != nil {
-			return err
+	valid := make([]dht.Entry, 0, len(candidates))
+	for n, i := range candidates {
+		if passed[n] {
+			valid = append(valid, *i)
 		}
 	}
 
-	if len(peers) > 1 {
-		log.Info("Bootstrapped with ", len(peers), " new peers")
-	} else if len(peers) == 1 {
+	// add them all to our routing table! :D
+	_, err = d.InsertMany(valid)
+
+	if err != nil {
+		return err
+	}
+
+	if len(valid) > 1 {
+		log.Info("Bootstrapped with ", len(valid), " new peers")
+	} else if len(valid) == 1 {
 		log.Info("Bootstrapped with 1 new peer")
 	}
 
 	return nil
 }
 
-// TODO: Paginate searches
 func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 	log.WithField("Query", search).Info("Querying")
 
-	sq := MessageSearchQuery{search, page}
-
-	msg := &Message{
-		Header: ProtoSearch,
-	}
-
-	err := msg.Write(sq)
-
-	if err != nil {
-		return nil, err
-	}
-
-	c.WriteMessage(msg)
-
 	var posts []*data.Post
-
-	recv, err := c.ReadMessage()
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = recv.Read(&posts)
+	err := c.request(ProtoSearch, MessageSearchQuery{search, page, false}, &posts)
 
 	if err != nil {
 		return nil, err
@@ -326,30 +496,28 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 func (c *Client) Recent(page int) ([]*data.Post, error) {
 	log.Info("Fetching recent posts from peer")
 
-	msg := &Message{
-		Header: ProtoRecent,
-	}
-
-	err := msg.Write(page)
+	var posts []*data.Post
+	err := c.request(ProtoRecent, page, &posts)
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
+	log.Info("Recieved ", len(posts), " recent posts")
 
-	posts_msg, err := c.ReadMessage()
+	return posts, nil
+}
 
-	if err != nil {
-		return nil, err
-	}
+// Fetches pages fromPage to toPage of recent posts in one go, newest first.
+// The peer must support FeatureRecentRange.
+func (c *Client) RecentRange(fromPage, toPage int) ([]*data.Post, error) {
+	log.WithFields(log.Fields{
+		"from": fromPage,
+		"to":   toPage,
+	}).Info("Fetching a range of recent posts from peer")
 
 	var posts []*data.Post
-	err = posts_msg.Read(&posts)
+	err := c.request(ProtoRecentRange, MessageRecentRange{fromPage, toPage}, &posts)
 
 	if err != nil {
 		return nil, err
@@ -363,30 +531,8 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 func (c *Client) Popular(page int) ([]*data.Post, error) {
 	log.Info("Fetching popular posts from peer")
 
-	msg := &Message{
-		Header: ProtoPopular,
-	}
-
-	err := msg.Write(page)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	posts_msg, err := c.ReadMessage()
-
-	if err != nil {
-		return nil, err
-	}
-
 	var posts []*data.Post
-	err = posts_msg.Read(&posts)
+	err := c.request(ProtoPopular, page, &posts)
 
 	if err != nil {
 		return nil, err
@@ -398,38 +544,12 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 }
 
 // Download a hash list for a peer. Expects said hash list to be valid and
-// signed.
-func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageCollection, error) {
+// signed, and made of pieces pieceSize posts long.
+func (c *Client) Collection(address dht.Address, entry dht.Entry, pieceSize int) (*MessageCollection, error) {
 	log.WithField("for", address.StringOr("")).Info("Sending request for a collection")
 
-	msg := &Message{
-		Header: ProtoRequestHashList,
-	}
-
-	err := msg.Write(address)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	log.Debug("Sent hash list request")
-
-	hl, err := c.ReadMessage()
-
-	if err != nil {
-		return nil, err
-	}
-
-	log.Debug("Recieved response")
-
 	mhl := MessageCollection{}
-	err = hl.Read(&mhl)
+	err := c.request(ProtoRequestHashList, address, &mhl)
 
 	if err != nil {
 		return nil, err
@@ -437,7 +557,7 @@ func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageColle
 
 	log.Debug("Read hash list ok")
 
-	err = mhl.Verify(entry.CollectionHash)
+	err = mhl.Verify(entry.CollectionHash, pieceSize)
 
 	if err != nil {
 		return nil, err
@@ -448,8 +568,14 @@ func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageColle
 	return &mhl, nil
 }
 
-// Download a piece from a peer, given the address and id of the piece we want.
-func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
+// Download pieces from a peer, given the address, the id of the first piece we
+// want, how many, and how many posts are in each. Peers send at most
+// MaxPiecesPerRequest at a time unless configured otherwise, so fewer pieces
+// than asked for may arrive.
+//
+// Once the piece channel is closed the error channel gets why, nil if every
+// piece arrived.
+func (c *Client) Pieces(address dht.Address, id, length, pieceSize int) (chan *data.Piece, chan error) {
 	log.WithFields(log.Fields{
 		"address": address.StringOr(""),
 		"id":      id,
@@ -457,6 +583,15 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	}).Info("Sending request for piece")
 
 	ret := make(chan *data.Piece, 100)
+	errs := make(chan error, 1)
+
+	fail := func(err error) (chan *data.Piece, chan error) {
+		log.Error(err.Error())
+		close(ret)
+		errs <- err
+
+		return ret, errs
+	}
 
 	mrp := MessageRequestPiece{address.StringOr(""), id, length}
 
@@ -467,15 +602,13 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	err := msg.Write(mrp)
 
 	if err != nil {
-		log.Error(err.Error())
-		return nil
+		return fail(err)
 	}
 
 	err = c.WriteMessage(msg)
 
 	if err != nil {
-		log.Error(err.Error())
-		return nil
+		return fail(err)
 	}
 
 	// Convert a string to an int, prevents endless error checks below.
@@ -491,10 +624,16 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 	}
 
 	go func() {
-		defer close(ret)
+		var err error
+
+		defer func() {
+			close(ret)
+			errs <- err
+		}()
+
 		log.Info("Recieving pieces")
 
-		gzr, err := gzip.NewReader(c.conn)
+		gzr, err := gzip.NewReader(c.Conn())
 
 		if err != nil {
 			log.Error(err.Error())
@@ -504,12 +643,12 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 		errReader := data.NewErrorReader(gzr)
 
 		for i := 0; i < length; i++ {
-			piece := data.Piece{}
+			piece := data.Piece{Size: pieceSize}
 			piece.Setup()
 
 			count := 0
 			for {
-				if count >= data.PieceSize {
+				if count >= pieceSize {
 					break
 				}
 
@@ -532,7 +671,8 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 
 				if errReader.Err != nil {
 					log.Error("Failed to read post: ", errReader.Err.Error())
-					break
+					err = errReader.Err
+					return
 				}
 
 				if err != nil {
@@ -555,43 +695,40 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 				piece.Add(post, true)
 				count++
 			}
+
+			// the peer stopped between pieces, sending fewer than asked for
+			if count == 0 && i > 0 {
+				return
+			}
+
+			if count == 0 || (count < pieceSize && i < length-1) {
+				err = ErrShortPiece
+				return
+			}
+
 			ret <- &piece
 		}
 	}()
 
-	return ret
+	return ret, errs
 }
 
 func (c *Client) RequestAddPeer(addr dht.Address) error {
 	log.WithField("for", addr.StringOr("")).Info("Registering as seed")
 
-	msg := &Message{
-		Header: ProtoRequestAddPeer,
-	}
-
-	err := msg.Write(addr)
+	err := c.request(ProtoRequestAddPeer, addr, nil)
 
 	if err != nil {
 		return err
 	}
 
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return err
-	}
-
-	rep, err := c.ReadMessage()
-
-	if err != nil {
-		return err
-	}
-
-	if !rep.Ok() {
-		return errors.New("Peer add request failed")
-	}
-
 	log.Info("Registered as seed peer")
 
 	return nil
 }
+
+func (c *Client) PostRemove(mpr MessagePostRemove) error {
+	log.WithField("info hash", mpr.InfoHash).Info("Sending post removal")
+
+	return c.request(ProtoPostRemove, mpr, nil)
+}
@@ -0,0 +1,324 @@
+package proto_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+)
+
+// Serves count posts for any piece request, however many pieces were asked for.
+func servePosts(t *testing.T, conn net.Conn, count int) {
+	defer conn.Close()
+
+	server, _ := proto.NewClient(conn)
+
+	if _, err := server.ReadMessage(); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	gzw := gzip.NewWriter(conn)
+
+	for i := 1; i <= count; i++ {
+		post := data.Post{Id: i, InfoHash: "ih", Title: "post"}
+		post.Write("|", "", true, gzw)
+	}
+
+	(&data.Post{Id: -1}).Write("|", "", true, gzw)
+	gzw.Close()
+}
+
+func TestPiecesShortMiddle(t *testing.T) {
+	local, remote := net.Pipe()
+	go servePosts(t, remote, data.PieceSize+10)
+
+	client, _ := proto.NewClient(local)
+	defer client.Close()
+
+	pieces, errs := client.Pieces(dht.Address{}, 0, 3, data.PieceSize)
+
+	received := 0
+	for _ = range pieces {
+		received++
+	}
+
+	if received != 1 {
+		t.Fatalf("Expected only the first piece, got %d", received)
+	}
+
+	if err := <-errs; err != proto.ErrShortPiece {
+		t.Fatal("Expected ErrShortPiece, got ", err)
+	}
+}
+
+func TestPiecesShortLast(t *testing.T) {
+	local, remote := net.Pipe()
+	go servePosts(t, remote, data.PieceSize+10)
+
+	client, _ := proto.NewClient(local)
+	defer client.Close()
+
+	pieces, errs := client.Pieces(dht.Address{}, 0, 2, data.PieceSize)
+
+	received := 0
+	for _ = range pieces {
+		received++
+	}
+
+	if received != 2 {
+		t.Fatalf("Expected 2 pieces, got %d", received)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRequestRefused(t *testing.T) {
+	local, remote := net.Pipe()
+
+	go func() {
+		defer remote.Close()
+
+		server, _ := proto.NewClient(remote)
+
+		if _, err := server.ReadMessage(); err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		server.WriteErr(errors.New("Not today"))
+	}()
+
+	client, _ := proto.NewClient(local)
+	defer client.Close()
+
+	if _, err := client.Popular(0); err != proto.ErrRefused {
+		t.Fatal("Expected ErrRefused, got ", err)
+	}
+}
+
+// Reads and writes go to a buffer instead of the connection.
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (b bufferConn) Read(p []byte) (int, error) {
+	return b.buf.Read(p)
+}
+
+func (b bufferConn) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func TestConnAfterMessage(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// a message and whatever follows it arrive in the same read
+	buf := &bytes.Buffer{}
+	writer, _ := proto.NewClient(bufferConn{remote, buf})
+
+	if err := writer.WriteMessage(proto.Message{Header: proto.ProtoOk}); err != nil {
+		t.Fatal(err.Error())
+	}
+	buf.WriteString("after")
+
+	reader, _ := proto.NewClient(bufferConn{local, buf})
+
+	msg, err := reader.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if msg.Header != proto.ProtoOk {
+		t.Fatal("Wrong header read")
+	}
+
+	rest, err := ioutil.ReadAll(reader.Conn())
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if string(rest) != "after" {
+		t.Fatalf("Expected what followed the message, got %q", rest)
+	}
+}
+
+func TestFindClosestTooMany(t *testing.T) {
+	local, remote := net.Pipe()
+
+	go func() {
+		defer remote.Close()
+
+		server, _ := proto.NewClient(remote)
+
+		if _, err := server.ReadMessage(); err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		// an invalid one first, then more valid ones than a reply can hold
+		entries := []*dht.Entry{&dht.Entry{Name: "forged"}}
+
+		for i := 0; i < proto.MaxClosestEntries+5; i++ {
+			entry := signedEntry(t, nil)
+			entries = append(entries, &entry)
+		}
+
+		msg := &proto.Message{Header: proto.ProtoDhtEntries}
+		msg.Write(entries)
+		server.WriteMessage(msg)
+	}()
+
+	client, _ := proto.NewClient(local)
+	defer client.Close()
+
+	entries, err := client.FindClosest(dht.Address{})
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the forged entry takes up one of the slots
+	if len(entries) != proto.MaxClosestEntries-1 {
+		t.Fatalf("Expected %d entries, got %d", proto.MaxClosestEntries-1, len(entries))
+	}
+
+	for _, i := range entries {
+		if err := i.Verify(); err != nil {
+			t.Fatal("Invalid entry returned: ", err)
+		}
+	}
+}
+
+func TestBootstrapValidate(t *testing.T) {
+	entries := make([]*dht.Entry, 0, 4)
+
+	for i := 0; i < 4; i++ {
+		entry := signedEntry(t, func(e *dht.Entry) { e.Port = 5050 + i })
+		entries = append(entries, &entry)
+	}
+
+	local, remote := net.Pipe()
+
+	go func() {
+		defer remote.Close()
+
+		server, _ := proto.NewClient(remote)
+
+		if _, err := server.ReadMessage(); err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		msg := &proto.Message{Header: proto.ProtoDhtEntries}
+		msg.Write(entries)
+		server.WriteMessage(msg)
+	}()
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	var self dht.Address
+	self.Generate(pub)
+
+	d := dht.NewDHT(self, ".testing/bootstrap.db", ".testing/bootstrap.dat")
+	defer d.Close()
+
+	// only the odd ports answer
+	check := func(e *dht.Entry) error {
+		if e.Port%2 == 0 {
+			return errors.New("Unreachable")
+		}
+
+		return nil
+	}
+
+	client, _ := proto.NewClient(local)
+
+	if err := client.BootstrapValidate(d, self, check); err != nil {
+		t.Fatal("A failed check aborted the bootstrap: ", err)
+	}
+
+	for _, i := range entries {
+		found, err := d.Query(i.Address)
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if stored := found != nil; stored != (i.Port%2 == 1) {
+			t.Fatalf("Peer on port %d stored: %t", i.Port, stored)
+		}
+	}
+}
+
+func TestCompressedMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	sender, _ := proto.NewClient(local)
+	sender.SetCompression("gzip")
+
+	receiver, _ := proto.NewClient(remote)
+
+	msg := &proto.Message{Header: proto.ProtoSearch}
+	msg.Write(strings.Repeat("ubuntu ", 1000))
+	content := msg.Content
+
+	go func() {
+		if err := sender.WriteMessage(msg); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+
+	recv, err := receiver.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(recv.Content, content) {
+		t.Fatal("Content changed on the way")
+	}
+
+	if msg.Compression != "" || !bytes.Equal(msg.Content, content) {
+		t.Fatal("Sent message was modified")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	old := proto.MessageCapabilities{Compression: []string{"gzip", "none"}}
+	current := proto.MessageCapabilities{
+		Compression: []string{"gzip", "none"},
+		Features:    []string{proto.FeatureCompression},
+	}
+
+	if c := proto.NegotiateCompression(old, current); c != "" {
+		t.Fatal("Compressing for a peer that can't read it: ", c)
+	}
+
+	if c := proto.NegotiateCompression(current, current); c != "gzip" {
+		t.Fatal("Expected gzip, got ", c)
+	}
+
+	current.Compression = []string{"none"}
+
+	if c := proto.NegotiateCompression(current, current); c != "" {
+		t.Fatal("Expected no compression, got ", c)
+	}
+}
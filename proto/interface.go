@@ -29,6 +29,7 @@ import (
 
 	"github.com/dfindex/dfi/common"
 	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/util"
 	"github.com/hashicorp/yamux"
 )
 
@@ -41,11 +42,16 @@ type ProtocolHandler interface {
 	HandleFindClosest(*Message) error
 	HandleSearch(*Message) error
 	HandleRecent(*Message) error
+	HandleRecentRange(*Message) error
 	HandlePopular(*Message) error
 	HandleHashList(*Message) error
 	HandlePiece(*Message) error
 	HandleAddPeer(*Message) error
+	HandlePostRemove(*Message) error
 
+	// A nil peer means the connection was added to one already connected.
+	// The peer returned already has the capabilities from the header, it may
+	// be in use by then.
 	HandleHandshake(ConnHeader) (NetworkPeer, error)
 	HandleCloseConnection(*dht.Address)
 
@@ -59,10 +65,13 @@ type ProtocolHandler interface {
 type NetworkPeer interface {
 	Session() *yamux.Session
 	AddStream(net.Conn)
+	RemoveStream(net.Conn)
 
 	Address() *dht.Address
 	Query(dht.Address) (common.Verifier, error)
 	FindClosest(dht.Address) ([]common.Verifier, error)
 	SetCapabilities(MessageCapabilities)
+	Compression() string
 	UpdateSeen()
+	Limiter() *util.PeerLimiter
 }
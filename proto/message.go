@@ -2,8 +2,10 @@ package proto
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
@@ -12,6 +14,11 @@ import (
 	"github.com/dfindex/dfi/dht"
 )
 
+// Content smaller than this isn't worth compressing.
+const MinCompressSize = 512
+
+var ErrUnknownCompression = errors.New("Unknown compression")
+
 type Message struct {
 	Header      string
 	Stream      net.Conn
@@ -52,6 +59,114 @@ func (m *Message) Read(iface interface{}) error {
 	return err
 }
 
+// Compresses the content with alg, setting Compression so the other end knows
+// to undo it. "" or "none" leaves it alone, as does a small content.
+func (m *Message) Compress(alg string) error {
+	switch alg {
+	case "", "none":
+		return nil
+	case "gzip":
+	default:
+		return ErrUnknownCompression
+	}
+
+	if m.Compression != "" || len(m.Content) < MinCompressSize {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+
+	if _, err := gzw.Write(m.Content); err != nil {
+		return err
+	}
+
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	m.Content = buf.Bytes()
+	m.Compression = alg
+
+	return nil
+}
+
+// Undoes Compress. Content is capped at the maximum message size once
+// decompressed, so a tiny message can't inflate into something huge.
+func (m *Message) Decompress() error {
+	switch m.Compression {
+	case "", "none":
+		return nil
+	case "gzip":
+	default:
+		return ErrUnknownCompression
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(m.Content))
+
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(gzr, common.MaxMessageSize+1))
+
+	if err != nil {
+		return err
+	}
+
+	if len(content) > common.MaxMessageSize {
+		return errors.New("Decompressed message too large")
+	}
+
+	m.Content = content
+	m.Compression = ""
+
+	return nil
+}
+
+// Reads a list of entries, decoding at most max of them. Also returns how many
+// were sent, the rest are left undecoded.
+func (m *Message) ReadEntries(max int) ([]*dht.Entry, int, error) {
+	if m.Content == nil {
+		return nil, 0, errors.New("Message has no content")
+	}
+
+	reader := bytes.NewReader(m.Content)
+	limiter := &io.LimitedReader{R: reader, N: common.MaxMessageContentSize}
+
+	decoder := msgpack.NewDecoder(limiter)
+
+	sent, err := decoder.DecodeArrayLen()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// a nil list
+	if sent < 0 {
+		sent = 0
+	}
+
+	count := sent
+	if count > max {
+		count = max
+	}
+
+	ret := make([]*dht.Entry, 0, count)
+
+	for i := 0; i < count; i++ {
+		var entry dht.Entry
+
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, sent, err
+		}
+
+		ret = append(ret, &entry)
+	}
+
+	return ret, sent, nil
+}
+
 func (m *Message) ReadInt() (int, error) {
 	var ret int
 
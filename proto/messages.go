@@ -4,9 +4,17 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/sha3"
+
+	"github.com/dfindex/dfi/common"
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
 )
 
 // This contains the more "complex" structures that will be sent in message
@@ -17,11 +25,32 @@ type MessageCollection struct {
 	HashList  []byte
 	Size      int
 	Signature []byte
+	// posts in each piece, older peers leave it out and use data.PieceSize
+	PieceSize int
+}
+
+// A collection built with a different piece size than ours. The root hash can
+// still match, but none of the pieces would.
+type PieceSizeError struct {
+	Theirs int
+	Ours   int
+}
+
+func (pe PieceSizeError) Error() string {
+	return fmt.Sprintf("Peer uses %d posts per piece, we use %d", pe.Theirs, pe.Ours)
 }
 
 type MessageSearchQuery struct {
 	Query string
 	Page  int
+	// Part of a SearchSession, so the stream is kept open for the next page.
+	Session bool
+}
+
+// Pages fromPage to toPage of recent posts, inclusive.
+type MessageRecentRange struct {
+	FromPage int
+	ToPage   int
 }
 
 type MessageRequestPiece struct {
@@ -30,6 +59,22 @@ type MessageRequestPiece struct {
 	Length  int
 }
 
+// Sent by the origin of a collection to its mirrors when a post has been
+// removed. It must be signed by the origin, otherwise anyone could remove
+// posts from a mirror.
+type MessagePostRemove struct {
+	Address  string
+	InfoHash string
+	// unix time the removal was signed at, so old ones can't be replayed
+	Timestamp int64
+	Signature []byte
+}
+
+// How far a removal's timestamp may be from our clock before it is refused.
+const PostRemoveMaxAge = 10 * time.Minute
+
+var ErrStaleRemoval = errors.New("Removal is too old or from the future")
+
 // Allows us to decode a pieces without also decoding all of the posts within it.
 type MessagePiece struct {
 	Posts interface{}
@@ -40,6 +85,13 @@ type MessageCapabilities struct {
 	// Index 0 is the preferred method. The method used is the shared method
 	// with the lowest index.
 	Compression []string
+
+	// Optional parts of the protocol this peer can serve, eg. "mirror".
+	Features []string
+
+	// Bits of proof of work entries need for this peer to store them, see
+	// dht.Entry.WorkBits. Older peers don't send it, they need none.
+	AnnounceWork int
 }
 
 func (mp *MessagePiece) Hash() ([]byte, error) {
@@ -55,7 +107,22 @@ func (mp *MessagePiece) Hash() ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
-func (mhl *MessageCollection) Verify(root []byte) error {
+// Checks the hash list against the root hash from the entry, and that the
+// pieces it describes are the size we expect.
+func (mhl *MessageCollection) Verify(root []byte, pieceSize int) error {
+	theirs := mhl.PieceSize
+	if theirs < 1 {
+		theirs = data.PieceSize
+	}
+
+	if theirs != pieceSize {
+		return PieceSizeError{theirs, pieceSize}
+	}
+
+	if mhl.Size < 0 || len(mhl.HashList) != 32*mhl.Size {
+		return data.ErrCollectionMismatch
+	}
+
 	hash := sha3.New256()
 
 	for i := 0; i < mhl.Size; i++ {
@@ -63,7 +130,7 @@ func (mhl *MessageCollection) Verify(root []byte) error {
 	}
 
 	if !bytes.Equal(hash.Sum(nil), root) {
-		return errors.New("Invalid hash list")
+		return data.ErrCollectionMismatch
 	}
 
 	return nil
@@ -83,3 +150,62 @@ func (mrp *MessageRequestPiece) Encode() ([]byte, error) {
 	data, err := json.Marshal(mrp)
 	return data, err
 }
+
+func (mpr *MessagePostRemove) Bytes() []byte {
+	return []byte(mpr.Address + mpr.InfoHash + strconv.FormatInt(mpr.Timestamp, 10))
+}
+
+func (mpr *MessagePostRemove) Sign(s common.Signer) {
+	mpr.Signature = s.Sign(mpr.Bytes())
+}
+
+// Checks that the removal was signed by the owner of entry, and that entry is
+// the origin of the collection the removal is for. Removals signed more than
+// PostRemoveMaxAge away from now are refused.
+func (mpr *MessagePostRemove) Verify(entry *dht.Entry) error {
+	if entry == nil {
+		return errors.New("No entry for removal")
+	}
+
+	age := time.Since(time.Unix(mpr.Timestamp, 0))
+
+	if age > PostRemoveMaxAge || age < -PostRemoveMaxAge {
+		return ErrStaleRemoval
+	}
+
+	address, err := dht.DecodeAddress(mpr.Address)
+
+	if err != nil {
+		return err
+	}
+
+	if !address.Equals(&entry.Address) {
+		return errors.New("Removal is not for this entry")
+	}
+
+	// the address must be derived from the key that signed the removal
+	owner, err := dht.NewAddress(entry.PublicKey)
+
+	if err != nil {
+		return err
+	}
+
+	if !owner.Equals(&address) {
+		return errors.New("Entry public key does not match address")
+	}
+
+	if len(mpr.Signature) < ed25519.SignatureSize {
+		return errors.New("Signature too small")
+	}
+
+	if !ed25519.Verify(entry.PublicKey, mpr.Bytes(), mpr.Signature) {
+		return errors.New("Failed to verify removal signature")
+	}
+
+	return nil
+}
+
+func (mpr *MessagePostRemove) Encode() ([]byte, error) {
+	data, err := json.Marshal(mpr)
+	return data, err
+}
@@ -0,0 +1,171 @@
+package proto_test
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+)
+
+type keySigner struct {
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+func (ks keySigner) Sign(msg []byte) []byte {
+	return ed25519.Sign(ks.priv, msg)
+}
+
+func (ks keySigner) PublicKey() []byte {
+	return ks.pub
+}
+
+func newSigner(t testing.TB) (keySigner, dht.Entry) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	addr, err := dht.NewAddress(pub)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return keySigner{pub, priv}, dht.Entry{Address: addr, PublicKey: pub}
+}
+
+// An entry for a new key, changed by edit if it isn't nil and then signed.
+func signedEntry(t testing.TB, edit func(*dht.Entry)) dht.Entry {
+	signer, entry := newSigner(t)
+	entry.Name = "peer"
+	entry.PublicAddress = "localhost"
+	entry.Port = 5050
+
+	if edit != nil {
+		edit(&entry)
+	}
+
+	dat, err := entry.Bytes()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	entry.Signature = signer.Sign(dat)
+
+	return entry
+}
+
+func TestMain(m *testing.M) {
+	os.Mkdir(".testing", 0777)
+	ret := m.Run()
+	os.RemoveAll(".testing")
+	os.Exit(ret)
+}
+
+func TestPostRemove(t *testing.T) {
+	origin, entry := newSigner(t)
+	mallory, _ := newSigner(t)
+
+	db := data.NewDatabase(".testing/remove.db")
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	aaaa, bbbb := strings.Repeat("a", 40), strings.Repeat("b", 40)
+
+	for _, ih := range []string{aaaa, bbbb} {
+		_, err := db.InsertPost(data.Post{InfoHash: ih, Title: ih})
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// signed by someone other than the origin, must be rejected
+	now := time.Now().Unix()
+
+	bad := proto.MessagePostRemove{Address: entry.Address.StringOr(""), InfoHash: bbbb, Timestamp: now}
+	bad.Sign(mallory)
+
+	if err := bad.Verify(&entry); err == nil {
+		t.Fatal("Unauthorized removal verified")
+	}
+
+	// a genuine removal, but captured long ago and replayed
+	stale := proto.MessagePostRemove{Address: entry.Address.StringOr(""), InfoHash: bbbb,
+		Timestamp: now - int64(proto.PostRemoveMaxAge.Seconds()) - 60}
+	stale.Sign(origin)
+
+	if err := stale.Verify(&entry); err != proto.ErrStaleRemoval {
+		t.Fatal("Stale removal verified")
+	}
+
+	good := proto.MessagePostRemove{Address: entry.Address.StringOr(""), InfoHash: aaaa, Timestamp: now}
+	good.Sign(origin)
+
+	if err := good.Verify(&entry); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := db.DeleteByInfoHash(good.InfoHash); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := db.DeleteByInfoHash(good.InfoHash); err != sql.ErrNoRows {
+		t.Fatal("Post was not removed")
+	}
+
+	recent, err := db.QueryRecent(0)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(recent) != 1 || recent[0].InfoHash != bbbb {
+		t.Fatal("Wrong posts remaining after removal")
+	}
+}
+
+func TestCollectionPieceSize(t *testing.T) {
+	hashList := make([]byte, 64)
+	for i := range hashList {
+		hashList[i] = byte(i)
+	}
+
+	root := sha3.Sum256(hashList)
+
+	// older peers don't say, they use the default
+	old := proto.MessageCollection{HashList: hashList, Size: 2}
+
+	if err := old.Verify(root[:], data.PieceSize); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, ok := old.Verify(root[:], 500).(proto.PieceSizeError); !ok {
+		t.Fatal("Default piece size accepted as 500")
+	}
+
+	small := proto.MessageCollection{HashList: hashList, Size: 2, PieceSize: 500}
+
+	if err := small.Verify(root[:], 500); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := small.Verify(root[:], data.PieceSize)
+	if pe, ok := err.(proto.PieceSizeError); !ok || pe.Theirs != 500 || pe.Ours != data.PieceSize {
+		t.Fatal("Expected a piece size mismatch, got ", err)
+	}
+}
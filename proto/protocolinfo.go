@@ -23,6 +23,10 @@ var (
 	ProtoRecent  = "recent"  // Request recent posts
 	ProtoPopular = "popular" // Request popular posts
 
+	// Request several pages of recent posts at once, the content is a
+	// MessageRecentRange. Only sent to peers with FeatureRecentRange.
+	ProtoRecentRange = "recent.range"
+
 	// Request a signed hash list
 	// The content field should contain the bytes for a DFI address.
 	// This is the peer we are requesting a hash list for.
@@ -33,6 +37,9 @@ var (
 	// stays registered as a seed, otherwise it is culled.
 	// TODO: Look into how Bittorrent trackers keep peer lists up to date properly.
 	ProtoRequestAddPeer = "req.addpeer"
+	// Sent by the origin of a collection to the peers mirroring it, the content
+	// is a signed MessagePostRemove.
+	ProtoPostRemove = "post.remove"
 
 	ProtoPosts    = "posts" // A list of posts in Content
 	ProtoHashList = "hashlist"
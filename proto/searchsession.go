@@ -0,0 +1,55 @@
+package proto
+
+import (
+	"errors"
+
+	"github.com/dfindex/dfi/data"
+)
+
+var ErrSearchSessionUnsupported = errors.New("Peer does not support search sessions")
+
+// A search kept open on one stream, each call to Next asks for the following
+// page. The peer must support FeatureSearchSession.
+type SearchSession struct {
+	client *Client
+	query  string
+	page   int
+}
+
+// Starts a search session on the client's stream, caps being those of the
+// peer at the other end. Nothing is sent until the first call to Next.
+func (c *Client) SearchSession(query string, caps MessageCapabilities) (*SearchSession, error) {
+	if c == nil || c.conn == nil {
+		return nil, errors.New("No connection")
+	}
+
+	if !caps.Supports(FeatureSearchSession) {
+		return nil, ErrSearchSessionUnsupported
+	}
+
+	return &SearchSession{client: c, query: query}, nil
+}
+
+// Fetches the next page of results, an empty page once they've run out.
+func (ss *SearchSession) Next() ([]*data.Post, error) {
+	var posts []*data.Post
+	err := ss.client.request(ProtoSearch, MessageSearchQuery{ss.query, ss.page, true}, &posts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ss.page++
+
+	return posts, nil
+}
+
+// The page the next call to Next will fetch.
+func (ss *SearchSession) Page() int {
+	return ss.page
+}
+
+// Ends the session, closing the stream.
+func (ss *SearchSession) Close() error {
+	return ss.client.Close()
+}
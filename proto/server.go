@@ -6,16 +6,23 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/dfindex/dfi/common"
 	"github.com/dfindex/dfi/util"
+	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
 )
 
 type Server struct {
 	listener     net.Listener
+	listenerLock sync.RWMutex
 	capabilities *MessageCapabilities
+
+	// How long a peer's stream has to send its request, DefaultStreamDeadline
+	// if not set.
+	StreamDeadline time.Duration
 }
 
 func NewServer(cap *MessageCapabilities) *Server {
@@ -27,20 +34,28 @@ func NewServer(cap *MessageCapabilities) *Server {
 }
 
 func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encoder) {
-	var err error
-
-	s.listener, err = net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", addr)
 
 	if err != nil {
 		panic(err)
 	}
 
+	s.listenerLock.Lock()
+	s.listener = listener
+	s.listenerLock.Unlock()
+
 	log.WithField("address", addr).Info("Listening")
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 
 		if err != nil {
+			// closed, rather than something worth trying again
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				log.Info("Stopped listening: ", err.Error())
+				return
+			}
+
 			log.Error(err.Error())
 			continue
 		}
@@ -73,16 +88,25 @@ func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encode
 }
 
 func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
-	// Allowed to open 4 streams per second, bursting to three.
-	limiter := util.NewLimiter(time.Second/4, 3, true)
-	defer limiter.Stop()
 	defer handler.HandleCloseConnection(peer.Address())
 
-	session := peer.Session()
+	s.ListenSession(peer, handler, peer.Session())
+}
+
+// Handles streams from one of a peer's sessions until it closes. Unlike
+// ListenStream the peer isn't dropped afterwards, as it may have others.
+func (s *Server) ListenSession(peer NetworkPeer, handler ProtocolHandler, session *yamux.Session) {
+	// shared between all of the peer's sessions
+	limiter := peer.Limiter()
+
+	if limiter == nil {
+		limiter = &util.PeerLimiter{}
+		limiter.Setup()
+	}
 
 	for {
 		stream, err := session.Accept()
-		limiter.Wait()
+		limiter.WaitStream()
 
 		if err != nil {
 			if err == io.EOF {
@@ -95,7 +119,12 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 			return
 		}
 
-		err = stream.SetDeadline(time.Now().Add(time.Second * 10))
+		deadline := s.StreamDeadline
+		if deadline <= 0 {
+			deadline = DefaultStreamDeadline
+		}
+
+		err = stream.SetDeadline(time.Now().Add(deadline))
 
 		if err != nil {
 			log.Error(err.Error())
@@ -113,6 +142,7 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 
 func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream net.Conn) {
 	log.Debug("Handling stream")
+	defer peer.RemoveStream(stream)
 
 	cl, err := NewClient(stream)
 
@@ -121,6 +151,8 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 		return
 	}
 
+	cl.SetCompression(peer.Compression())
+
 	for {
 		msg, err := cl.ReadMessage()
 
@@ -154,6 +186,8 @@ func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
 		err = handler.HandleSearch(msg)
 	case ProtoRecent:
 		err = handler.HandleRecent(msg)
+	case ProtoRecentRange:
+		err = handler.HandleRecentRange(msg)
 	case ProtoPopular:
 		err = handler.HandlePopular(msg)
 	case ProtoRequestHashList:
@@ -162,6 +196,8 @@ func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
 		err = handler.HandlePiece(msg)
 	case ProtoRequestAddPeer:
 		err = handler.HandleAddPeer(msg)
+	case ProtoPostRemove:
+		err = handler.HandlePostRemove(msg)
 
 	default:
 		log.Error("Unknown message type")
@@ -196,13 +232,32 @@ func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encode
 		return
 	}
 
-	lp.SetCapabilities(*caps)
+	// taken on as another session for a peer that's already connected
+	if peer == nil {
+		return
+	}
+
 	lp.SetNetworkPeer(peer)
 
 	go s.ListenStream(peer, lp)
 }
 
+// The address being listened on, nil until Listen has bound it.
+func (s *Server) Addr() net.Addr {
+	s.listenerLock.RLock()
+	defer s.listenerLock.RUnlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
 func (s *Server) Close() {
+	s.listenerLock.RLock()
+	defer s.listenerLock.RUnlock()
+
 	if s.listener != nil {
 		s.listener.Close()
 	}
@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -17,6 +19,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// How long to wait for a TCP connection if no timeout is set.
+const DefaultDialTimeout = time.Second * 10
+
+// How long a stream has to do its work, and how long to wait on a ping, if
+// they aren't set.
+const (
+	DefaultStreamDeadline = time.Second * 10
+	DefaultPingTimeout    = time.Second * 10
+)
+
+// Open streams that make a session busy enough to want another, if no
+// SessionStreams is set.
+const DefaultSessionStreams = 32
+
 type StreamManager struct {
 	connection ConnHeader
 
@@ -27,11 +43,148 @@ type StreamManager struct {
 	client *yamux.Session
 
 	// Open yamux streams
-	clients []Client
+	clients     []Client
+	clientsLock sync.Mutex
 
 	Socks     bool
 	SocksPort int
 	torDialer proxy.Dialer
+
+	// Credentials for proxies that want them, no auth is used if SocksUser is
+	// empty.
+	SocksUser string
+	SocksPass string
+
+	// Without one, dialling a dead address blocks for the OS default
+	DialTimeout time.Duration
+
+	// Over Tor the defaults can be too tight for perfectly good peers
+	StreamDeadline time.Duration
+	PingTimeout    time.Duration
+
+	// Keepalives, write timeout and window size for every session, nil for
+	// yamux's defaults.
+	SessionConfig *yamux.Config
+
+	// Sessions over their own connections, on top of the first. Streams are
+	// spread across all of them, and the side that dialled adds more while
+	// every session has SessionStreams open, up to MaxSessions in total.
+	extra          []*yamux.Session
+	extraLock      sync.Mutex
+	next           int
+	dialing        bool
+	MaxSessions    int
+	SessionStreams int
+
+	// Given every session added after the first, so its streams are handled.
+	OnSession func(*yamux.Session)
+
+	// how the first connection was made, for dialling more
+	addr    string
+	handler ProtocolHandler
+	data    common.Encoder
+
+	counters     *connCounters
+	countersOnce sync.Once
+}
+
+// Totals across every session with the peer. Kept apart from StreamManager so
+// the counters are 64 bit aligned for atomics.
+type connCounters struct {
+	read    uint64
+	written uint64
+	streams uint64
+}
+
+// Counts the bytes going through a connection a session runs over.
+type countingConn struct {
+	net.Conn
+	counters *connCounters
+}
+
+func (cc countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	atomic.AddUint64(&cc.counters.read, uint64(n))
+
+	return n, err
+}
+
+func (cc countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddUint64(&cc.counters.written, uint64(n))
+
+	return n, err
+}
+
+func (sm *StreamManager) getCounters() *connCounters {
+	sm.countersOnce.Do(func() {
+		sm.counters = &connCounters{}
+	})
+
+	return sm.counters
+}
+
+// Wraps a connection so what goes over it counts towards BytesRead and
+// BytesWritten. Every session with the peer should run over one.
+func (sm *StreamManager) CountConn(conn net.Conn) net.Conn {
+	return countingConn{conn, sm.getCounters()}
+}
+
+// Bytes received over all sessions with the peer, yamux framing included.
+func (sm *StreamManager) BytesRead() uint64 {
+	return atomic.LoadUint64(&sm.getCounters().read)
+}
+
+// Bytes sent over all sessions with the peer, yamux framing included.
+func (sm *StreamManager) BytesWritten() uint64 {
+	return atomic.LoadUint64(&sm.getCounters().written)
+}
+
+// How many streams have been opened with the peer, by either side.
+func (sm *StreamManager) StreamsOpened() uint64 {
+	return atomic.LoadUint64(&sm.getCounters().streams)
+}
+
+// How many streams are open right now, across all sessions.
+func (sm *StreamManager) OpenStreams() int {
+	sm.extraLock.Lock()
+	defer sm.extraLock.Unlock()
+
+	count := 0
+
+	if session := sm.GetSession(); session != nil && !session.IsClosed() {
+		count += session.NumStreams()
+	}
+
+	for _, i := range sm.liveExtra() {
+		count += i.NumStreams()
+	}
+
+	return count
+}
+
+func (sm *StreamManager) dialTimeout() time.Duration {
+	if sm.DialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+
+	return sm.DialTimeout
+}
+
+func (sm *StreamManager) GetStreamDeadline() time.Duration {
+	if sm.StreamDeadline <= 0 {
+		return DefaultStreamDeadline
+	}
+
+	return sm.StreamDeadline
+}
+
+func (sm *StreamManager) GetPingTimeout() time.Duration {
+	if sm.PingTimeout <= 0 {
+		return DefaultPingTimeout
+	}
+
+	return sm.PingTimeout
 }
 
 func (sm *StreamManager) SetConnection(conn ConnHeader) {
@@ -45,8 +198,42 @@ func (sm *StreamManager) Setup() {
 }
 
 func (sm *StreamManager) OpenSocks(addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+	conn, err := sm.dialSocks(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sm.handleConnection(conn, addr, lp, data)
+}
+
+// Dials the proxy with a deadline on the connection, so a proxy that never
+// answers the handshake or CONNECT can't hold the dial up either.
+type deadlineDialer struct {
+	timeout time.Duration
+}
+
+func (d deadlineDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, d.timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(d.timeout))
+
+	return conn, nil
+}
+
+func (sm *StreamManager) dialSocks(addr string) (net.Conn, error) {
 	if sm.torDialer == nil {
-		dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", sm.SocksPort), nil, proxy.Direct)
+		var auth *proxy.Auth
+		if sm.SocksUser != "" {
+			auth = &proxy.Auth{User: sm.SocksUser, Password: sm.SocksPass}
+		}
+
+		forward := deadlineDialer{timeout: sm.dialTimeout()}
+		dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", sm.SocksPort), auth, forward)
 
 		if err != nil {
 			return nil, err
@@ -61,7 +248,10 @@ func (sm *StreamManager) OpenSocks(addr string, lp ProtocolHandler, data common.
 		return nil, err
 	}
 
-	return sm.handleConnection(conn, lp, data)
+	// connected, the streams set their own deadlines from here
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
 }
 
 func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
@@ -73,16 +263,31 @@ func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.En
 		return &sm.connection, nil
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, sm.dialTimeout())
 
 	if err != nil {
 		return nil, err
 	}
 
-	return sm.handleConnection(conn, lp, data)
+	return sm.handleConnection(conn, addr, lp, data)
 }
 
-func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+func (sm *StreamManager) handleConnection(conn net.Conn, addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+	pair, err := sm.handshakeConn(conn, lp, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sm.connection = *pair
+	sm.addr = addr
+	sm.handler = lp
+	sm.data = data
+
+	return pair, nil
+}
+
+func (sm *StreamManager) handshakeConn(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
 	log.WithField("dfi", ProtoDFI).Info("Sending")
 	err := binary.Write(conn, binary.LittleEndian, ProtoDFI)
 
@@ -114,7 +319,6 @@ func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, dat
 	}
 
 	pair := ConnHeader{*c, *header, *caps}
-	sm.connection = pair
 
 	return &pair, nil
 }
@@ -164,7 +368,7 @@ func (sm *StreamManager) ConnectClient() (*yamux.Session, error) {
 		return nil, errors.New("There is already a server connected to that socket")
 	}
 
-	client, err := yamux.Client(sm.connection.Client.conn, nil)
+	client, err := yamux.Client(sm.CountConn(sm.connection.Client.Conn()), sm.SessionConfig)
 
 	if err != nil {
 		return nil, err
@@ -185,7 +389,7 @@ func (sm *StreamManager) ConnectServer() (*yamux.Session, error) {
 		return nil, errors.New("There is already a client connected to that socket")
 	}
 
-	server, err := yamux.Server(sm.connection.Client.conn, nil)
+	server, err := yamux.Server(sm.CountConn(sm.connection.Client.Conn()), sm.SessionConfig)
 
 	if err != nil {
 		return nil, err
@@ -203,6 +407,13 @@ func (sm *StreamManager) Close() {
 		session.Close()
 	}
 
+	sm.extraLock.Lock()
+	for _, i := range sm.extra {
+		i.Close()
+	}
+	sm.extra = nil
+	sm.extraLock.Unlock()
+
 	if sm.connection.Client.conn != nil {
 		sm.connection.Client.Close()
 	}
@@ -220,10 +431,143 @@ func (sm *StreamManager) GetSession() *yamux.Session {
 	return nil
 }
 
+// Adds a session over another connection to the same peer. Returns false, and
+// leaves the session alone, if there are already MaxSessions.
+func (sm *StreamManager) AddSession(session *yamux.Session) bool {
+	sm.extraLock.Lock()
+	defer sm.extraLock.Unlock()
+
+	if sm.GetSession() == nil || len(sm.liveExtra())+1 >= sm.MaxSessions {
+		return false
+	}
+
+	sm.extra = append(sm.extra, session)
+
+	return true
+}
+
+// How many sessions are open, counting the first.
+func (sm *StreamManager) SessionCount() int {
+	sm.extraLock.Lock()
+	defer sm.extraLock.Unlock()
+
+	count := len(sm.liveExtra())
+
+	if session := sm.GetSession(); session != nil && !session.IsClosed() {
+		count++
+	}
+
+	return count
+}
+
+// Drops closed sessions from sm.extra, the lock must be held.
+func (sm *StreamManager) liveExtra() []*yamux.Session {
+	live := sm.extra[:0]
+
+	for _, i := range sm.extra {
+		if !i.IsClosed() {
+			live = append(live, i)
+		}
+	}
+
+	sm.extra = live
+
+	return live
+}
+
+func (sm *StreamManager) sessionStreams() int {
+	if sm.SessionStreams < 1 {
+		return DefaultSessionStreams
+	}
+
+	return sm.SessionStreams
+}
+
+// The next session to open a stream on, round robin. Starts dialling another
+// if they're all busy.
+func (sm *StreamManager) pickSession() *yamux.Session {
+	sm.extraLock.Lock()
+	defer sm.extraLock.Unlock()
+
+	first := sm.GetSession()
+
+	if first == nil {
+		return nil
+	}
+
+	sessions := append([]*yamux.Session{first}, sm.liveExtra()...)
+	busy := true
+
+	for _, i := range sessions {
+		if i.NumStreams() < sm.sessionStreams() {
+			busy = false
+			break
+		}
+	}
+
+	// only the side that dialled knows where to dial again
+	if busy && !sm.dialing && sm.client != nil && sm.addr != "" && len(sessions) < sm.MaxSessions {
+		sm.dialing = true
+		go sm.dialSession()
+	}
+
+	sm.next = (sm.next + 1) % len(sessions)
+
+	return sessions[sm.next]
+}
+
+func (sm *StreamManager) dialSession() {
+	defer func() {
+		sm.extraLock.Lock()
+		sm.dialing = false
+		sm.extraLock.Unlock()
+	}()
+
+	var conn net.Conn
+	var err error
+
+	if sm.Socks {
+		conn, err = sm.dialSocks(sm.addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", sm.addr, sm.dialTimeout())
+	}
+
+	if err != nil {
+		log.WithField("address", sm.addr).Debug("Failed to dial another session: ", err.Error())
+		return
+	}
+
+	_, err = sm.handshakeConn(conn, sm.handler, sm.data)
+
+	if err != nil {
+		log.WithField("address", sm.addr).Debug("Failed to handshake another session: ", err.Error())
+		conn.Close()
+		return
+	}
+
+	session, err := yamux.Client(sm.CountConn(conn), sm.SessionConfig)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if !sm.AddSession(session) {
+		session.Close()
+		return
+	}
+
+	log.WithField("address", sm.addr).Debug("Opened another session")
+
+	if sm.OnSession != nil {
+		sm.OnSession(session)
+	}
+}
+
 func (sm *StreamManager) OpenStream() (*Client, error) {
 	var ret Client
 	var err error
-	session := sm.GetSession()
+	session := sm.pickSession()
 
 	if session == nil {
 		return nil, errors.New("Cannot open stream, no session")
@@ -235,12 +579,14 @@ func (sm *StreamManager) OpenStream() (*Client, error) {
 		return nil, err
 	}
 
-	err = ret.conn.SetDeadline(time.Now().Add(time.Second * 10))
+	err = ret.conn.SetDeadline(time.Now().Add(sm.GetStreamDeadline()))
 
 	if err != nil {
 		return nil, err
 	}
 
+	atomic.AddUint64(&sm.getCounters().streams, 1)
+
 	log.WithField("total", session.NumStreams()).Debug("Opened stream")
 	return &ret, nil
 }
@@ -250,14 +596,23 @@ func (sm *StreamManager) OpenStream() (*Client, error) {
 func (sm *StreamManager) AddStream(conn net.Conn) {
 	var ret Client
 	ret.conn = conn
+
+	atomic.AddUint64(&sm.getCounters().streams, 1)
+
+	sm.clientsLock.Lock()
+	defer sm.clientsLock.Unlock()
+
 	sm.clients = append(sm.clients, ret)
 }
 
+// Stream ids are only unique within a session, so streams are matched on the
+// stream itself.
 func (sm *StreamManager) GetStream(conn net.Conn) *Client {
-	id := conn.(*yamux.Stream).StreamID()
+	sm.clientsLock.Lock()
+	defer sm.clientsLock.Unlock()
 
 	for _, c := range sm.clients {
-		if c.conn.(*yamux.Stream).StreamID() == id {
+		if c.conn == conn {
 			return &c
 		}
 	}
@@ -266,11 +621,40 @@ func (sm *StreamManager) GetStream(conn net.Conn) *Client {
 }
 
 func (sm *StreamManager) RemoveStream(conn net.Conn) {
-	id := conn.(*yamux.Stream).StreamID()
+	sm.clientsLock.Lock()
+	defer sm.clientsLock.Unlock()
 
 	for i, c := range sm.clients {
-		if c.conn.(*yamux.Stream).StreamID() == id {
+		if c.conn == conn {
 			sm.clients = append(sm.clients[:i], sm.clients[i+1:]...)
+			break
 		}
 	}
 }
+
+// The ids of the streams the peer has opened with us that are still being
+// handled. If this keeps growing, something isn't closing its streams.
+// Connections that aren't yamux streams have no id, so are left out.
+func (sm *StreamManager) StreamIDs() []uint32 {
+	sm.clientsLock.Lock()
+	defer sm.clientsLock.Unlock()
+
+	ids := make([]uint32, 0, len(sm.clients))
+
+	for _, c := range sm.clients {
+		if stream, ok := c.conn.(interface{ StreamID() uint32 }); ok {
+			ids = append(ids, stream.StreamID())
+		}
+	}
+
+	return ids
+}
+
+// The number of streams the peer has opened with us that are still being
+// handled, including any without an id.
+func (sm *StreamManager) StreamCount() int {
+	sm.clientsLock.Lock()
+	defer sm.clientsLock.Unlock()
+
+	return len(sm.clients)
+}
@@ -0,0 +1,293 @@
+package proto_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/proto"
+	"github.com/hashicorp/yamux"
+)
+
+func TestDialTimeout(t *testing.T) {
+	sm := proto.StreamManager{DialTimeout: time.Millisecond * 200}
+	sm.Setup()
+
+	start := time.Now()
+
+	// reserved, nothing will ever answer here
+	_, err := sm.OpenTCP("10.255.255.1:5050", nil, nil)
+
+	if err == nil {
+		t.Fatal("Connected to an unroutable address")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Dial took %s, timeout is %s", elapsed, sm.DialTimeout)
+	}
+}
+
+// A session over a pipe, and the other end of it.
+func pipeSessions(t *testing.T) (*yamux.Session, *yamux.Session) {
+	local, remote := net.Pipe()
+
+	client, err := yamux.Client(local, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server, err := yamux.Server(remote, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return client, server
+}
+
+func TestStreamManagerSessions(t *testing.T) {
+	local, remote := net.Pipe()
+	conn, _ := proto.NewClient(local)
+
+	sm := proto.StreamManager{MaxSessions: 2}
+	sm.Setup()
+	sm.SetConnection(proto.ConnHeader{Client: *conn})
+	defer sm.Close()
+
+	if _, err := sm.ConnectClient(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	first, err := yamux.Server(remote, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	extra, second := pipeSessions(t)
+
+	if !sm.AddSession(extra) {
+		t.Fatal("Second session refused")
+	}
+
+	over, _ := pipeSessions(t)
+	defer over.Close()
+
+	if sm.AddSession(over) {
+		t.Fatal("Added more than MaxSessions")
+	}
+
+	if count := sm.SessionCount(); count != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", count)
+	}
+
+	// one stream on each, in turn
+	for i := 0; i < 2; i++ {
+		stream, err := sm.OpenStream()
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		defer stream.Close()
+
+		// yamux only tells the other end once something is written
+		stream.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+	}
+
+	for _, i := range []*yamux.Session{first, second} {
+		if _, err := i.Accept(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if sm.GetSession() == extra {
+		t.Fatal("GetSession should stay on the first session")
+	}
+}
+
+func TestStreamManagerCounters(t *testing.T) {
+	local, remote := net.Pipe()
+	conn, _ := proto.NewClient(local)
+
+	var sm proto.StreamManager
+	sm.Setup()
+	sm.SetConnection(proto.ConnHeader{Client: *conn})
+	defer sm.Close()
+
+	if _, err := sm.ConnectClient(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server, err := yamux.Server(remote, nil)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+
+	payload := make([]byte, 4096)
+
+	go func() {
+		stream, err := server.Accept()
+
+		if err != nil {
+			return
+		}
+
+		io.ReadFull(stream, payload)
+		stream.Write(payload[:1024])
+	}()
+
+	stream, err := sm.OpenStream()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer stream.Close()
+
+	stream.Conn().Write(payload)
+	io.ReadFull(stream.Conn(), make([]byte, 1024))
+
+	if sm.BytesWritten() < 4096 || sm.BytesRead() < 1024 {
+		t.Fatalf("Counted %d bytes out and %d in", sm.BytesWritten(), sm.BytesRead())
+	}
+
+	if sm.StreamsOpened() != 1 || sm.OpenStreams() != 1 {
+		t.Fatalf("Expected 1 stream opened and open, got %d and %d", sm.StreamsOpened(), sm.OpenStreams())
+	}
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	var sm proto.StreamManager
+
+	if sm.GetStreamDeadline() != proto.DefaultStreamDeadline || sm.GetPingTimeout() != proto.DefaultPingTimeout {
+		t.Fatal("Unset timeouts should use the defaults")
+	}
+
+	sm.StreamDeadline = time.Minute
+	sm.PingTimeout = time.Second * 30
+
+	if sm.GetStreamDeadline() != time.Minute || sm.GetPingTimeout() != time.Second*30 {
+		t.Fatal("Configured timeouts ignored")
+	}
+}
+
+func TestStreamIDsPlainConn(t *testing.T) {
+	var sm proto.StreamManager
+	sm.Setup()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// not a yamux stream, so there's no id to give
+	sm.AddStream(a)
+
+	if ids := sm.StreamIDs(); len(ids) != 0 {
+		t.Fatal("Got ids for a plain connection: ", ids)
+	}
+
+	if sm.StreamCount() != 1 {
+		t.Fatal("Plain connection not counted")
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer l.Close()
+
+	creds := make(chan string, 1)
+
+	// just enough of a SOCKS5 proxy to see the credentials
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			creds <- err.Error()
+			return
+		}
+
+		defer conn.Close()
+
+		greeting := make([]byte, 2)
+		io.ReadFull(conn, greeting)
+		io.ReadFull(conn, make([]byte, greeting[1]))
+
+		// username/password
+		conn.Write([]byte{5, 2})
+
+		header := make([]byte, 2)
+		io.ReadFull(conn, header)
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+
+		io.ReadFull(conn, header[:1])
+		pass := make([]byte, header[0])
+		io.ReadFull(conn, pass)
+
+		creds <- string(user) + ":" + string(pass)
+	}()
+
+	sm := proto.StreamManager{
+		Socks:     true,
+		SocksPort: l.Addr().(*net.TCPAddr).Port,
+		SocksUser: "dfi",
+		SocksPass: "hunter2",
+	}
+	sm.Setup()
+
+	// the proxy never finishes, only the credentials matter
+	sm.OpenTCP("peer.onion:5050", nil, nil)
+
+	if got := <-creds; got != "dfi:hunter2" {
+		t.Fatal("Proxy got the wrong credentials: ", got)
+	}
+}
+
+func TestSocksDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer l.Close()
+
+	// accepts, then never says a word
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	sm := proto.StreamManager{
+		Socks:       true,
+		SocksPort:   l.Addr().(*net.TCPAddr).Port,
+		DialTimeout: time.Millisecond * 200,
+	}
+	sm.Setup()
+
+	start := time.Now()
+
+	if _, err := sm.OpenTCP("peer.onion:5050", nil, nil); err == nil {
+		t.Fatal("Connected through a proxy that never answered")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Dial took %s, timeout is %s", elapsed, sm.DialTimeout)
+	}
+}
@@ -0,0 +1,209 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Scores stay between these.
+	MaxReputation = 100
+	MinReputation = -100
+
+	// Something going wrong costs a lot more than something going right earns,
+	// and a peer can only earn once every ReputationGainInterval. Answering
+	// a flood of requests gets it no further than answering one.
+	ReputationGain         = 1
+	ReputationLoss         = 5
+	ReputationGainInterval = HeartbeatFrequency
+
+	// Peers last seen within this long of the least recently seen one are
+	// tied for eviction, the least reputable of them goes first.
+	ReputationTieWindow = HeartbeatFrequency
+
+	// How many scores are kept in memory. Every change is already saved, so
+	// the least recently used are just dropped and loaded again if needed.
+	MaxCachedReputations = 4096
+)
+
+// How much we trust each peer, by raw address. Loaded from the entry table
+// the first time a peer is asked about, and written back on every change.
+type reputations struct {
+	lock sync.Mutex
+
+	// most recently used at the front
+	order  *list.List
+	scores map[string]*list.Element
+}
+
+type reputation struct {
+	key   string
+	score int
+	// when it last went up, unix nanoseconds
+	gained int64
+}
+
+// A peer's score, 0 for one we've never dealt with.
+func (pm *PeerManager) Reputation(addr dht.Address) int {
+	pm.reputations.lock.Lock()
+	defer pm.reputations.lock.Unlock()
+
+	return pm.reputation(addr).score
+}
+
+// For a peer that answered properly.
+func (pm *PeerManager) Reward(addr dht.Address) {
+	pm.adjustReputation(addr, ReputationGain)
+}
+
+// For a peer that timed out, or sent something that can't be trusted.
+func (pm *PeerManager) Penalise(addr dht.Address) {
+	pm.adjustReputation(addr, -ReputationLoss)
+}
+
+// Rewards the peer if err is nil, otherwise penalises it.
+func (pm *PeerManager) rate(addr dht.Address, err error) {
+	if err == nil {
+		pm.Reward(addr)
+	} else {
+		pm.Penalise(addr)
+	}
+}
+
+func (pm *PeerManager) adjustReputation(addr dht.Address, delta int) {
+	pm.reputations.lock.Lock()
+
+	rep := pm.reputation(addr)
+	now := time.Now().UnixNano()
+
+	if delta > 0 {
+		if now-rep.gained < int64(ReputationGainInterval) {
+			pm.reputations.lock.Unlock()
+			return
+		}
+
+		rep.gained = now
+	}
+
+	score := rep.score + delta
+
+	if score > MaxReputation {
+		score = MaxReputation
+	} else if score < MinReputation {
+		score = MinReputation
+	}
+
+	changed := score != rep.score
+	rep.score = score
+
+	pm.reputations.lock.Unlock()
+
+	if !changed || pm.localPeer == nil || pm.localPeer.DHT == nil {
+		return
+	}
+
+	if err := pm.localPeer.DHT.UpdateReputation(addr, score); err != nil {
+		log.WithField("peer", addr.StringOr("")).Debug("Failed to save reputation: ", err.Error())
+	}
+}
+
+// Expects the lock to be held.
+func (pm *PeerManager) reputation(addr dht.Address) *reputation {
+	reps := &pm.reputations
+
+	if reps.scores == nil {
+		reps.order = list.New()
+		reps.scores = make(map[string]*list.Element)
+	}
+
+	key := string(addr.Raw)
+
+	if el, ok := reps.scores[key]; ok {
+		reps.order.MoveToFront(el)
+		return el.Value.(*reputation)
+	}
+
+	rep := &reputation{key: key}
+
+	if pm.localPeer != nil && pm.localPeer.DHT != nil {
+		rep.score, _ = pm.localPeer.DHT.Reputation(addr)
+	}
+
+	reps.scores[key] = reps.order.PushFront(rep)
+
+	for reps.order.Len() > MaxCachedReputations {
+		oldest := reps.order.Back()
+		reps.order.Remove(oldest)
+		delete(reps.scores, oldest.Value.(*reputation).key)
+	}
+
+	return rep
+}
+
+// Puts the most reputable entries first, otherwise leaving them in order.
+func (pm *PeerManager) sortByReputation(entries []*dht.Entry) {
+	scores := make(map[string]int, len(entries))
+
+	for _, i := range entries {
+		scores[string(i.Address.Raw)] = pm.Reputation(i.Address)
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return scores[string(entries[a].Address.Raw)] > scores[string(entries[b].Address.Raw)]
+	})
+}
+
+// Like LeastRecentlySeen, but everyone seen within ReputationTieWindow of the
+// least recently seen peer counts as tied with it, and the least reputable of
+// those is picked. Among equals the least recently seen still goes first.
+func LeastReputable(seen map[string]int64, reputation map[string]int, except string) (string, bool) {
+	ret, ok := LeastRecentlySeen(seen, except)
+
+	if !ok {
+		return "", false
+	}
+
+	cutoff := seen[ret] + int64(ReputationTieWindow)
+
+	for k, t := range seen {
+		if k == except || t > cutoff {
+			continue
+		}
+
+		if reputation[k] < reputation[ret] || (reputation[k] == reputation[ret] && t < seen[ret]) {
+			ret = k
+		}
+	}
+
+	return ret, true
+}
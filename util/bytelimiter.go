@@ -0,0 +1,106 @@
+// This is free and unencumbered software released into the public domain.
+// 
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+// 
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+// 
+// For more information, please refer to <http://unlicense.org/>
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A token bucket counted in bytes, shared by every writer made from it. It
+// holds at most a second's worth of tokens, and a rate of 0 (the zero value)
+// means unlimited.
+type ByteLimiter struct {
+	mutex  sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+func NewByteLimiter(rate int) *ByteLimiter {
+	return &ByteLimiter{rate: rate}
+}
+
+// Change the rate in bytes per second, 0 or less turns limiting off.
+func (bl *ByteLimiter) SetRate(rate int) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if rate != bl.rate {
+		bl.rate = rate
+		bl.last = time.Time{}
+	}
+}
+
+// Block until n bytes can be sent. Writes bigger than the bucket go through
+// anyway, and put it into debt that later writes have to wait out.
+func (bl *ByteLimiter) WaitN(n int) {
+	bl.mutex.Lock()
+
+	if bl.rate <= 0 {
+		bl.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	rate := float64(bl.rate)
+
+	if bl.last.IsZero() {
+		bl.tokens = rate
+	} else {
+		bl.tokens += now.Sub(bl.last).Seconds() * rate
+	}
+
+	if bl.tokens > rate {
+		bl.tokens = rate
+	}
+
+	bl.last = now
+	bl.tokens -= float64(n)
+	wait := time.Duration(-bl.tokens / rate * float64(time.Second))
+
+	bl.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Wraps w so that everything written to it is taken from the bucket first.
+func (bl *ByteLimiter) Writer(w io.Writer) io.Writer {
+	return &limitedWriter{w, bl}
+}
+
+type limitedWriter struct {
+	w  io.Writer
+	bl *ByteLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	lw.bl.WaitN(len(p))
+
+	return lw.w.Write(p)
+}
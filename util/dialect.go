@@ -0,0 +1,83 @@
+// This is free and unencumbered software released into the public domain.
+// 
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+// 
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+// 
+// For more information, please refer to <http://unlicense.org/>
+package util
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// The driver used when none is given.
+const DefaultDriver = "sqlite3"
+
+// The parts of setting up a database that differ between SQL servers. Only
+// sqlite3 is built in, another server needs its driver imported and a Dialect
+// registered under the same name, with data.RegisterDialect for posts and
+// dht.RegisterDialect for peers.
+//
+// Queries are still written for sqlite, with ? placeholders and FTS4 tables. A
+// dialect for a server without FTS4 has to provide the search some other way,
+// eg. a view over a tsvector column in postgres.
+type Dialect interface {
+	// Run once straight after connecting.
+	Setup(conn *sql.DB) error
+
+	// Creates the tables and indexes if they don't exist already, and brings
+	// ones made by older versions up to date.
+	CreateSchema(conn *sql.DB) error
+}
+
+// Dialects by driver name. Each kind of database has its own, as the schema is
+// different for each.
+type Dialects struct {
+	dialects map[string]Dialect
+	lock     sync.RWMutex
+}
+
+// Starts off knowing sqlite3.
+func NewDialects(sqlite Dialect) *Dialects {
+	return &Dialects{dialects: map[string]Dialect{DefaultDriver: sqlite}}
+}
+
+func (d *Dialects) Register(driver string, dialect Dialect) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.dialects[driver] = dialect
+}
+
+func (d *Dialects) Get(driver string) (Dialect, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	dialect, ok := d.dialects[driver]
+
+	if !ok {
+		return nil, fmt.Errorf("No dialect for database driver %s", driver)
+	}
+
+	return dialect, nil
+}
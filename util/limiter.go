@@ -50,12 +50,16 @@ func NewLimiter(rate time.Duration, burst int, fill bool) *Limiter {
 	}
 
 	go func() {
-		for t := range tick.C {
+		for {
 			select {
 			case _ = <-quit:
+				close(throttle)
 				return
-			case throttle <- t:
-			default:
+			case t := <-tick.C:
+				select {
+				case throttle <- t:
+				default:
+				}
 			}
 		}
 	}()
@@ -68,17 +72,41 @@ func (l *Limiter) Wait() {
 	_, _ = <-l.Throttle
 }
 
+// Like Wait, but gives up after d. Returns whether a token was taken, with a d
+// of 0 only taking one if there is one waiting.
+func (l *Limiter) WaitFor(d time.Duration) bool {
+	select {
+	case _, ok := <-l.Throttle:
+		return ok
+	default:
+	}
+
+	if d <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case _, ok := <-l.Throttle:
+		return ok
+	case _ = <-timer.C:
+		return false
+	}
+}
+
 // Finish running.
 func (l *Limiter) Stop() {
 	l.Ticker.Stop()
-	l.quit <- true
-	close(l.Throttle)
+	close(l.quit)
 }
 
 // Limits requests from peers
 type PeerLimiter struct {
 	queryLimiter    *Limiter
 	announceLimiter *Limiter
+	streamLimiter   *Limiter
 }
 
 func (pl *PeerLimiter) Setup() {
@@ -87,4 +115,23 @@ func (pl *PeerLimiter) Setup() {
 	pl.announceLimiter = NewLimiter(time.Minute*10, 3, true)
 
 	pl.queryLimiter = NewLimiter(time.Second/3, 3, true)
+
+	// Allowed to open 4 streams per second, bursting to three. This is across
+	// all of the peer's sessions, so opening more doesn't get around it.
+	pl.streamLimiter = NewLimiter(time.Second/4, 3, true)
+}
+
+// Whether a query can go ahead, waiting a moment for the bucket to refill.
+func (pl *PeerLimiter) AllowQuery() bool {
+	return pl.queryLimiter.WaitFor(time.Second)
+}
+
+// Announces refill far too slowly to be worth waiting on.
+func (pl *PeerLimiter) AllowAnnounce() bool {
+	return pl.announceLimiter.WaitFor(0)
+}
+
+// Blocks until the peer may open another stream.
+func (pl *PeerLimiter) WaitStream() {
+	pl.streamLimiter.Wait()
 }
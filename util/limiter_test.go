@@ -0,0 +1,139 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/util"
+)
+
+func TestLimiterWaitFor(t *testing.T) {
+	// refills far slower than the test runs
+	l := util.NewLimiter(time.Hour, 2, true)
+
+	for i := 0; i < 2; i++ {
+		if !l.WaitFor(0) {
+			t.Fatal("Burst token refused")
+		}
+	}
+
+	if l.WaitFor(0) {
+		t.Fatal("Token taken from an empty bucket")
+	}
+
+	start := time.Now()
+
+	if l.WaitFor(time.Millisecond * 50) {
+		t.Fatal("Token taken from an empty bucket")
+	}
+
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatal("Gave up before the wait was over")
+	}
+}
+
+func TestPeerLimiterAnnounce(t *testing.T) {
+	var pl util.PeerLimiter
+	pl.Setup()
+
+	// a burst of three, then nothing for ten minutes
+	for i := 0; i < 3; i++ {
+		if !pl.AllowAnnounce() {
+			t.Fatalf("Announce %d refused", i)
+		}
+	}
+
+	if pl.AllowAnnounce() {
+		t.Fatal("Announce flood allowed through")
+	}
+}
+
+func TestPeerLimiterStreams(t *testing.T) {
+	var pl util.PeerLimiter
+	pl.Setup()
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		pl.WaitStream()
+	}
+
+	if time.Since(start) > time.Millisecond*50 {
+		t.Fatal("Waited with streams left in the burst")
+	}
+
+	pl.WaitStream()
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Fatalf("Fourth stream only waited %s", elapsed)
+	}
+}
+
+func TestByteLimiter(t *testing.T) {
+	var bl util.ByteLimiter
+
+	start := time.Now()
+
+	// unlimited
+	bl.WaitN(1 << 30)
+
+	bl.SetRate(10000)
+
+	// a second's worth is there from the start
+	bl.WaitN(10000)
+
+	if time.Since(start) > time.Millisecond*50 {
+		t.Fatal("Waited with tokens in the bucket")
+	}
+
+	start = time.Now()
+	bl.WaitN(2000)
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Fatalf("Only waited %s for 2000 bytes at 10000/s", elapsed)
+	}
+}
+
+func TestLimiterStop(t *testing.T) {
+	l := util.NewLimiter(time.Millisecond, 1, false)
+
+	done := make(chan bool)
+	go func() {
+		l.Stop()
+		// waiting on a stopped limiter returns at once
+		for l.WaitFor(time.Second) {
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Stop blocked")
+	}
+}
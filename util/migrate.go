@@ -0,0 +1,173 @@
+// This is free and unencumbered software released into the public domain.
+// 
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+// 
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+// 
+// For more information, please refer to <http://unlicense.org/>
+
+package util
+
+import (
+	"database/sql"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sqlCreateSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL)`
+	sqlQuerySchemaVersion  = `SELECT version FROM schema_version`
+	sqlInsertSchemaVersion = `INSERT INTO schema_version(version) VALUES(0)`
+	sqlUpdateSchemaVersion = `UPDATE schema_version SET version=?`
+)
+
+// One step in bringing a schema up to date, run inside Migrate's transaction.
+type Migration func(tx *sql.Tx) error
+
+// A migration that is just a statement to run.
+func Statement(query string) Migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// A migration adding a column to a table, unless it's already there. Databases
+// made before migrations were tracked have none of them run, but may already
+// have any of the columns added since. Those made later get whatever the
+// CREATE TABLE gave them.
+func AddColumn(table, column, definition string) Migration {
+	return func(tx *sql.Tx) error {
+		columns, err := tableColumns(tx, table)
+
+		if err != nil {
+			return err
+		}
+
+		if columns[column] {
+			return nil
+		}
+
+		log.WithField("column", column).Info("Adding column to ", table)
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+
+		return err
+	}
+}
+
+// The names of a table's columns, empty if there is no such table.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[string]bool)
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var def interface{}
+
+		if err = rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err != nil {
+			return nil, err
+		}
+
+		ret[name] = true
+	}
+
+	return ret, rows.Err()
+}
+
+// Brings a database schema up to date, after the tables have been created.
+// The version stored in the schema_version table is how many migrations have
+// been run, so only those after it are applied, in order. A database newer than
+// the migrations given is an error, this build doesn't know what changed.
+//
+// Everything runs in a single transaction, if one migration fails none of them
+// are kept and the version is left alone.
+//
+// Migrations can only ever be appended to, never changed or reordered, as
+// databases out there have already run them.
+func Migrate(conn *sql.DB, migrations []Migration) (err error) {
+	tx, err := conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.Exec(sqlCreateSchemaVersion); err != nil {
+		return err
+	}
+
+	version, err := SchemaVersion(tx)
+
+	if err == sql.ErrNoRows {
+		version = 0
+		_, err = tx.Exec(sqlInsertSchemaVersion)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema is version %d, newer than this build knows (%d)",
+			version, len(migrations))
+	}
+
+	for n := version; n < len(migrations); n++ {
+		log.WithField("version", n+1).Info("Migrating database schema")
+
+		if err = migrations[n](tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(sqlUpdateSchemaVersion, len(migrations))
+
+	return err
+}
+
+// The version a database schema is at, which is how many migrations Migrate
+// has run on it. sql.ErrNoRows if it has never been migrated, a database error
+// if it predates the schema_version table. q is either the database or a
+// transaction on it.
+func SchemaVersion(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}) (int, error) {
+	var version int
+
+	err := q.QueryRow(sqlQuerySchemaVersion).Scan(&version)
+
+	return version, err
+}
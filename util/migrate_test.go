@@ -0,0 +1,122 @@
+// This is free and unencumbered software released into the public domain.
+// 
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+// 
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+// 
+// For more information, please refer to <http://unlicense.org/>
+
+package util_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/dfindex/dfi/util"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrate(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer conn.Close()
+
+	// every query has to see the same in memory database
+	conn.SetMaxOpenConns(1)
+
+	migrations := []util.Migration{
+		util.Statement(`CREATE TABLE thing(id INTEGER PRIMARY KEY)`),
+		util.Statement(`ALTER TABLE thing ADD COLUMN name STRING`),
+	}
+
+	// a second run must not add the column again
+	for i := 0; i < 2; i++ {
+		if err := util.Migrate(conn, migrations); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if v, _ := util.SchemaVersion(conn); v != 2 {
+		t.Fatalf("Expected version 2, got %d", v)
+	}
+
+	// a broken step leaves the database as it was
+	broken := append(migrations, util.Statement(`ALTER TABLE thing ADD COLUMN size INT`),
+		util.Statement(`NOT SQL`))
+
+	if util.Migrate(conn, broken) == nil {
+		t.Fatal("Broken migration succeeded")
+	}
+
+	if v, _ := util.SchemaVersion(conn); v != 2 {
+		t.Fatalf("Failed migration changed the version to %d", v)
+	}
+
+	if _, err := conn.Exec(`INSERT INTO thing(name, size) VALUES('a', 1)`); err == nil {
+		t.Fatal("Column from a failed migration was kept")
+	}
+
+	if util.Migrate(conn, migrations[:1]) == nil {
+		t.Fatal("Migrated a database newer than the migrations")
+	}
+}
+
+func TestAddColumn(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+
+	// as if made before migrations, with one of the columns already added
+	if _, err = conn.Exec(`CREATE TABLE thing(id INTEGER PRIMARY KEY, name STRING)`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	migrations := []util.Migration{
+		util.AddColumn("thing", "name", "STRING"),
+		util.AddColumn("thing", "size", "INTEGER DEFAULT 0"),
+	}
+
+	if err = util.Migrate(conn, migrations); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var size int
+
+	if _, err = conn.Exec(`INSERT INTO thing(name) VALUES('a')`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = conn.QueryRow(`SELECT size FROM thing`).Scan(&size); err != nil || size != 0 {
+		t.Fatal("Column not added with its default: ", err)
+	}
+
+	if v, _ := util.SchemaVersion(conn); v != 2 {
+		t.Fatalf("Expected version 2, got %d", v)
+	}
+}